@@ -0,0 +1,286 @@
+/*
+Package grpcsign provides gRPC interceptors that sign and authenticate calls
+between services with httpsign. See README.md for more details.
+*/
+package grpcsign
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mailgun/lemma/httpsign"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// MethodAttribute is the name the full gRPC method name is signed under. It
+// takes the place of the HTTP verb and URI.
+const MethodAttribute = "grpc-method"
+
+// SignatureField is the protobuf field number the signature of a stream
+// message is sent in, as an unknown field appended to the message. It is the
+// largest field number protobuf allows, so it won't be used by the message.
+const SignatureField protowire.Number = protowire.MaxValidNumber
+
+// UnaryClientInterceptor signs every unary call with the method name and the
+// marshalled request message.
+func UnaryClientInterceptor(s *httpsign.Service) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+
+		body, err := marshal(req)
+		if err != nil {
+			return err
+		}
+
+		e, err := s.SignMessage(body, map[string]string{MethodAttribute: method})
+		if err != nil {
+			return status.Errorf(codes.Internal, "unable to sign call: %v", err)
+		}
+
+		return invoker(withEnvelope(ctx, s, e), method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor signs every stream with the method name when it is
+// opened, then every message sent on it, and authenticates every message
+// received on it.
+func StreamClientInterceptor(s *httpsign.Service) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+
+		e, session, err := s.SignMessageSession(nil, map[string]string{MethodAttribute: method})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "unable to sign call: %v", err)
+		}
+
+		cs, err := streamer(withEnvelope(ctx, s, e), desc, cc, method, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		return &clientStream{ClientStream: cs, session: session}, nil
+	}
+}
+
+// UnaryServerInterceptor authenticates every unary call before it is handled.
+// Calls that fail are rejected with codes.Unauthenticated.
+func UnaryServerInterceptor(s *httpsign.Service) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+
+		body, err := marshal(req)
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.AuthenticateMessage(body, map[string]string{MethodAttribute: info.FullMethod}, envelope(ctx, s))
+		if err != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "unable to authenticate call: %v", err)
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor authenticates every stream when it is opened, then
+// every message received on it, and signs every message sent on it. Streams
+// and messages that fail are rejected with codes.Unauthenticated.
+func StreamServerInterceptor(s *httpsign.Service) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+
+		session, err := s.AuthenticateMessageSession(nil, map[string]string{MethodAttribute: info.FullMethod},
+			envelope(ss.Context(), s))
+		if err != nil {
+			return status.Errorf(codes.Unauthenticated, "unable to authenticate call: %v", err)
+		}
+
+		return handler(srv, &serverStream{ServerStream: ss, session: session})
+	}
+}
+
+// clientStream signs the messages sent on a stream and authenticates the
+// messages received on it.
+type clientStream struct {
+	grpc.ClientStream
+	session *httpsign.Session
+}
+
+func (c *clientStream) SendMsg(m interface{}) error {
+	signed, err := signMessage(c.session, m)
+	if err != nil {
+		return err
+	}
+	return c.ClientStream.SendMsg(signed)
+}
+
+func (c *clientStream) RecvMsg(m interface{}) error {
+	if err := c.ClientStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return authenticateMessage(c.session, m)
+}
+
+// serverStream authenticates the messages received on a stream and signs the
+// messages sent on it.
+type serverStream struct {
+	grpc.ServerStream
+	session *httpsign.Session
+}
+
+func (s *serverStream) SendMsg(m interface{}) error {
+	signed, err := signMessage(s.session, m)
+	if err != nil {
+		return err
+	}
+	return s.ServerStream.SendMsg(signed)
+}
+
+func (s *serverStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return authenticateMessage(s.session, m)
+}
+
+// signMessage returns a copy of the stream message m with its signature
+// appended in SignatureField. m itself is left alone.
+func signMessage(session *httpsign.Session, m interface{}) (proto.Message, error) {
+	body, err := marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := session.SignDetached(body)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to sign message: %v", err)
+	}
+
+	signed := proto.Clone(m.(proto.Message))
+	unknown := signed.ProtoReflect().GetUnknown()
+	unknown = protowire.AppendTag(unknown, SignatureField, protowire.BytesType)
+	unknown = protowire.AppendBytes(unknown, signature)
+	signed.ProtoReflect().SetUnknown(unknown)
+
+	return signed, nil
+}
+
+// authenticateMessage removes the signature from the stream message m and
+// checks it against the rest of the message.
+func authenticateMessage(session *httpsign.Session, m interface{}) error {
+	pm, ok := m.(proto.Message)
+	if !ok {
+		return status.Errorf(codes.Internal, "unable to authenticate message: %T is not a proto.Message", m)
+	}
+
+	signature, unknown, err := removeSignature(pm.ProtoReflect().GetUnknown())
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "unable to authenticate message: %v", err)
+	}
+	pm.ProtoReflect().SetUnknown(unknown)
+
+	body, err := marshal(pm)
+	if err != nil {
+		return err
+	}
+	if err := session.AuthenticateDetached(body, signature); err != nil {
+		return status.Errorf(codes.Unauthenticated, "unable to authenticate message: %v", err)
+	}
+
+	return nil
+}
+
+// removeSignature returns the signature in the unknown fields of a message,
+// and the unknown fields without it.
+func removeSignature(unknown []byte) ([]byte, []byte, error) {
+	var signature []byte
+	var rest []byte
+	found := false
+
+	for len(unknown) > 0 {
+		num, typ, n := protowire.ConsumeField(unknown)
+		if n < 0 {
+			return nil, nil, protowire.ParseError(n)
+		}
+		field := unknown[:n]
+		unknown = unknown[n:]
+
+		if num != SignatureField {
+			rest = append(rest, field...)
+			continue
+		}
+		if found || typ != protowire.BytesType {
+			return nil, nil, fmt.Errorf("invalid message signature")
+		}
+		_, _, tagLen := protowire.ConsumeTag(field)
+		signature, _ = protowire.ConsumeBytes(field[tagLen:])
+		found = true
+	}
+
+	if !found {
+		return nil, nil, fmt.Errorf("message signature not found")
+	}
+	return signature, rest, nil
+}
+
+// metadataKeys returns the metadata keys the signature is carried in: the
+// lower case versions of the header names the service is configured with.
+func metadataKeys(s *httpsign.Service) (nonce string, timestamp string, signature string, version string) {
+	nonce, timestamp, signature, version = s.HeaderNames()
+	return strings.ToLower(nonce), strings.ToLower(timestamp), strings.ToLower(signature), strings.ToLower(version)
+}
+
+// withEnvelope returns a context that sends the envelope in the outgoing
+// metadata.
+func withEnvelope(ctx context.Context, s *httpsign.Service, e *httpsign.Envelope) context.Context {
+	nonceKey, timestampKey, signatureKey, versionKey := metadataKeys(s)
+
+	return metadata.AppendToOutgoingContext(ctx,
+		nonceKey, e.Nonce,
+		timestampKey, e.Timestamp,
+		signatureKey, e.Signature,
+		versionKey, e.Version,
+	)
+}
+
+// envelope returns the envelope sent in the incoming metadata.
+func envelope(ctx context.Context, s *httpsign.Service) *httpsign.Envelope {
+	md, _ := metadata.FromIncomingContext(ctx)
+	nonceKey, timestampKey, signatureKey, versionKey := metadataKeys(s)
+
+	return &httpsign.Envelope{
+		Nonce:     first(md, nonceKey),
+		Timestamp: first(md, timestampKey),
+		Signature: first(md, signatureKey),
+		Version:   first(md, versionKey),
+	}
+}
+
+// marshal returns the wire encoding of a message. Deterministic marshalling
+// makes sure both sides sign the same bytes for the same message.
+func marshal(req interface{}) ([]byte, error) {
+	m, ok := req.(proto.Message)
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "unable to sign call: %T is not a proto.Message", req)
+	}
+
+	body, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to marshal request: %v", err)
+	}
+
+	return body, nil
+}
+
+func first(md metadata.MD, key string) string {
+	values := md.Get(key)
+	if len(values) < 1 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,281 @@
+package grpcsign
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mailgun/lemma/httpsign"
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/timetools"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+var _ = fmt.Printf // for testing
+
+var testKey = []byte("042DAD12E0BE4625AC0B2C3F7172DBA8")
+
+func newService(t *testing.T, key []byte) *httpsign.Service {
+	return newServiceWithConfig(t, &httpsign.Config{KeyBytes: key})
+}
+
+func newServiceWithConfig(t *testing.T, config *httpsign.Config) *httpsign.Service {
+	s, err := httpsign.NewWithProviders(
+		config,
+		&timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)},
+		&random.CSPRNG{},
+	)
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewWithProviders: %v", err)
+	}
+	return s
+}
+
+// newServer starts an in-process health server that authenticates calls with
+// serverKey and returns a client connection to it.
+func newServer(t *testing.T, serverKey []byte, opts ...grpc.DialOption) (*grpc.ClientConn, func()) {
+	s := newService(t, serverKey)
+	return newServerWithOptions(t, []grpc.ServerOption{
+		grpc.UnaryInterceptor(UnaryServerInterceptor(s)),
+		grpc.StreamInterceptor(StreamServerInterceptor(s)),
+	}, opts...)
+}
+
+// newServerWithOptions starts an in-process health server with serverOpts and
+// returns a client connection to it.
+func newServerWithOptions(t *testing.T, serverOpts []grpc.ServerOption, opts ...grpc.DialOption) (*grpc.ClientConn, func()) {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer(serverOpts...)
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(lis)
+
+	opts = append(opts,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	conn, err := grpc.NewClient("passthrough:///bufnet", opts...)
+	if err != nil {
+		t.Fatalf("Got unexpected error from grpc.NewClient: %v", err)
+	}
+
+	return conn, func() {
+		conn.Close()
+		srv.Stop()
+	}
+}
+
+func TestUnary(t *testing.T) {
+	s := newService(t, testKey)
+	conn, stop := newServer(t, testKey, grpc.WithUnaryInterceptor(UnaryClientInterceptor(s)))
+	defer stop()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Got unexpected error from Check: %v", err)
+	}
+	if g, w := resp.Status, healthpb.HealthCheckResponse_SERVING; g != w {
+		t.Errorf("Status: Got %v, Want %v", g, w)
+	}
+}
+
+func TestUnaryWrongKey(t *testing.T) {
+	s := newService(t, []byte("abc"))
+	conn, stop := newServer(t, testKey, grpc.WithUnaryInterceptor(UnaryClientInterceptor(s)))
+	defer stop()
+
+	_, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if g, w := status.Code(err), codes.Unauthenticated; g != w {
+		t.Errorf("Code: Got %v, Want %v (%v)", g, w, err)
+	}
+}
+
+func TestUnaryUnsigned(t *testing.T) {
+	conn, stop := newServer(t, testKey)
+	defer stop()
+
+	_, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if g, w := status.Code(err), codes.Unauthenticated; g != w {
+		t.Errorf("Code: Got %v, Want %v (%v)", g, w, err)
+	}
+}
+
+func TestUnaryTamperedRequest(t *testing.T) {
+	s := newService(t, testKey)
+
+	// sign one request message but send another
+	tamper := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(ctx, method, &healthpb.HealthCheckRequest{Service: "other"}, reply, cc, opts...)
+	}
+
+	conn, stop := newServer(t, testKey, grpc.WithChainUnaryInterceptor(UnaryClientInterceptor(s), tamper))
+	defer stop()
+
+	_, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if g, w := status.Code(err), codes.Unauthenticated; g != w {
+		t.Errorf("Code: Got %v, Want %v (%v)", g, w, err)
+	}
+}
+
+func TestUnaryReplay(t *testing.T) {
+	s := newService(t, testKey)
+
+	// send the same signed call twice
+	replay := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if err := invoker(ctx, method, req, reply, cc, opts...); err != nil {
+			return err
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	conn, stop := newServer(t, testKey, grpc.WithChainUnaryInterceptor(UnaryClientInterceptor(s), replay))
+	defer stop()
+
+	_, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if g, w := status.Code(err), codes.Unauthenticated; g != w {
+		t.Errorf("Code: Got %v, Want %v (%v)", g, w, err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	s := newService(t, testKey)
+	conn, stop := newServer(t, testKey, grpc.WithStreamInterceptor(StreamClientInterceptor(s)))
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Got unexpected error from Watch: %v", err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Got unexpected error from Recv: %v", err)
+	}
+	if g, w := resp.Status, healthpb.HealthCheckResponse_SERVING; g != w {
+		t.Errorf("Status: Got %v, Want %v", g, w)
+	}
+}
+
+func TestStreamUnsigned(t *testing.T) {
+	conn, stop := newServer(t, testKey)
+	defer stop()
+
+	stream, err := healthpb.NewHealthClient(conn).Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Got unexpected error from Watch: %v", err)
+	}
+	_, err = stream.Recv()
+	if g, w := status.Code(err), codes.Unauthenticated; g != w {
+		t.Errorf("Code: Got %v, Want %v (%v)", g, w, err)
+	}
+}
+
+// tamperStream changes the messages sent on a stream after they were signed.
+type tamperStream struct {
+	grpc.ClientStream
+	tamper func(m *healthpb.HealthCheckRequest)
+}
+
+func (t *tamperStream) SendMsg(m interface{}) error {
+	t.tamper(m.(*healthpb.HealthCheckRequest))
+	return t.ClientStream.SendMsg(m)
+}
+
+func TestStreamTamperedMessage(t *testing.T) {
+	var tests = []struct {
+		inTamper func(m *healthpb.HealthCheckRequest)
+	}{
+		// a signed field changed
+		{func(m *healthpb.HealthCheckRequest) { m.Service = "other" }},
+		// the signature removed
+		{func(m *healthpb.HealthCheckRequest) { m.ProtoReflect().SetUnknown(nil) }},
+		// a second signature
+		{func(m *healthpb.HealthCheckRequest) {
+			unknown := m.ProtoReflect().GetUnknown()
+			m.ProtoReflect().SetUnknown(append(unknown, unknown...))
+		}},
+	}
+
+	for i, tt := range tests {
+		s := newService(t, testKey)
+		tamper := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+			streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			cs, err := streamer(ctx, desc, cc, method, opts...)
+			return &tamperStream{ClientStream: cs, tamper: tt.inTamper}, err
+		}
+
+		conn, stop := newServer(t, testKey, grpc.WithChainStreamInterceptor(StreamClientInterceptor(s), tamper))
+
+		stream, err := healthpb.NewHealthClient(conn).Watch(context.Background(), &healthpb.HealthCheckRequest{})
+		if err != nil {
+			t.Fatalf("[%v] Got unexpected error from Watch: %v", i, err)
+		}
+		_, err = stream.Recv()
+		if g, w := status.Code(err), codes.Unauthenticated; g != w {
+			t.Errorf("[%v] Code: Got %v, Want %v (%v)", i, g, w, err)
+		}
+		stop()
+	}
+}
+
+func TestStreamUnsignedResponses(t *testing.T) {
+	// the server doesn't sign the messages it sends
+	s := newService(t, testKey)
+	conn, stop := newServerWithOptions(t, nil, grpc.WithStreamInterceptor(StreamClientInterceptor(s)))
+	defer stop()
+
+	stream, err := healthpb.NewHealthClient(conn).Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Got unexpected error from Watch: %v", err)
+	}
+	_, err = stream.Recv()
+	if g, w := status.Code(err), codes.Unauthenticated; g != w {
+		t.Errorf("Code: Got %v, Want %v (%v)", g, w, err)
+	}
+}
+
+func TestHeaderNames(t *testing.T) {
+	config := func() *httpsign.Config {
+		return &httpsign.Config{
+			KeyBytes:                   testKey,
+			NonceHeaderName:            "X-Acme-Nonce",
+			TimestampHeaderName:        "X-Acme-Timestamp",
+			SignatureHeaderName:        "X-Acme-Signature",
+			SignatureVersionHeaderName: "X-Acme-Signature-Version",
+		}
+	}
+
+	var tests = []struct {
+		inClient *httpsign.Service
+		outCode  codes.Code
+	}{
+		{newServiceWithConfig(t, config()), codes.OK},
+		{newService(t, testKey), codes.Unauthenticated},
+	}
+
+	for i, tt := range tests {
+		server := newServiceWithConfig(t, config())
+		conn, stop := newServerWithOptions(t,
+			[]grpc.ServerOption{grpc.UnaryInterceptor(UnaryServerInterceptor(server))},
+			grpc.WithUnaryInterceptor(UnaryClientInterceptor(tt.inClient)))
+
+		_, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+		if g, w := status.Code(err), tt.outCode; g != w {
+			t.Errorf("[%v] Code: Got %v, Want %v (%v)", i, g, w, err)
+		}
+		stop()
+	}
+}
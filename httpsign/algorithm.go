@@ -0,0 +1,72 @@
+package httpsign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Algorithm is the keyed hash used to compute signatures.
+type Algorithm string
+
+const (
+	HMACSHA256 Algorithm = "hmac-sha256" // default, signature version "2"
+	HMACSHA512 Algorithm = "hmac-sha512" // signature version "2-hmac-sha512"
+	BLAKE2b256 Algorithm = "blake2b-256" // keyed blake2b, signature version "2-blake2b-256"
+)
+
+// SignatureVersion returns the value of the signature version header for
+// signatures computed with this algorithm. HMAC-SHA256 keeps the original
+// version so existing verifiers continue to work.
+func (a Algorithm) SignatureVersion() string {
+	if a == HMACSHA256 {
+		return SignatureVersion
+	}
+	return SignatureVersion + "-" + string(a)
+}
+
+// Valid reports if the algorithm is one httpsign knows how to compute.
+func (a Algorithm) Valid() bool {
+	switch a {
+	case HMACSHA256, HMACSHA512, BLAKE2b256:
+		return true
+	}
+	return false
+}
+
+// algorithmFromVersion parses the signature version header back into the
+// algorithm it names.
+func algorithmFromVersion(version string) (Algorithm, error) {
+	if version == SignatureVersion {
+		return HMACSHA256, nil
+	}
+
+	name := strings.TrimPrefix(version, SignatureVersion+"-")
+	if name == version || !Algorithm(name).Valid() || Algorithm(name) == HMACSHA256 {
+		return "", fmt.Errorf("unsupported signature version: %q", version)
+	}
+
+	return Algorithm(name), nil
+}
+
+// newMAC returns a keyed hash for the algorithm.
+func newMAC(algorithm Algorithm, secretKey []byte) (hash.Hash, error) {
+	switch algorithm {
+	case HMACSHA256:
+		return hmac.New(sha256.New, secretKey), nil
+	case HMACSHA512:
+		return hmac.New(sha512.New, secretKey), nil
+	case BLAKE2b256:
+		// an empty key would silently turn blake2b into an unkeyed hash
+		if len(secretKey) < 1 || len(secretKey) > blake2b.Size {
+			return nil, fmt.Errorf("%v requires a key of 1 to %v bytes, got %v", algorithm, blake2b.Size, len(secretKey))
+		}
+		return blake2b.New256(secretKey)
+	}
+	return nil, fmt.Errorf("unsupported algorithm: %q", algorithm)
+}
@@ -0,0 +1,177 @@
+package httpsign
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/timetools"
+)
+
+var _ = fmt.Printf // for testing
+
+func TestAlgorithmSignatureVersion(t *testing.T) {
+	var versiontests = []struct {
+		inAlgorithm Algorithm
+		outVersion  string
+	}{
+		{HMACSHA256, "2"},
+		{HMACSHA512, "2-hmac-sha512"},
+		{BLAKE2b256, "2-blake2b-256"},
+	}
+
+	for i, tt := range versiontests {
+		if g, w := tt.inAlgorithm.SignatureVersion(), tt.outVersion; g != w {
+			t.Errorf("[%v] SignatureVersion: Got %s, Want %s", i, g, w)
+		}
+
+		algorithm, err := algorithmFromVersion(tt.outVersion)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from algorithmFromVersion: %v", i, err)
+		}
+		if g, w := algorithm, tt.inAlgorithm; g != w {
+			t.Errorf("[%v] algorithmFromVersion: Got %s, Want %s", i, g, w)
+		}
+	}
+
+	// unknown versions must be rejected
+	for _, version := range []string{"1", "3", "2-", "2-hmac-md5", "2-hmac-sha256", "hmac-sha512"} {
+		if _, err := algorithmFromVersion(version); err == nil {
+			t.Errorf("algorithmFromVersion accepted an unknown version: %q", version)
+		}
+	}
+}
+
+func TestSignRequestAlgorithms(t *testing.T) {
+	var signtests = []struct {
+		inAlgorithm         Algorithm
+		outSignature        string
+		outSignatureVersion string
+	}{
+		{HMACSHA256, "5a42c21371e8b3a2b50ca1ad72869dc7882aa83a6a2fb13db1bf108d92c6f05f", "2"},
+		{HMACSHA512, "6bf904b9940c1f4ad8f4912d18b88b01bae36acfbb7c154a46b7419f72376ce7" +
+			"a8a2b93f6f8428f988b0e4f5bd608bb7c41cbd349c8bb57944da9257dd347610", "2-hmac-sha512"},
+		{BLAKE2b256, "37a25be6770497bc8a2d3fdd8077d0bfd4e0f93caf8bf62d9563b59b0fc744dc", "2-blake2b-256"},
+	}
+
+	for i, tt := range signtests {
+		s, err := NewWithProviders(
+			&Config{
+				KeyBytes:  testKey,
+				Algorithm: tt.inAlgorithm,
+			},
+			&timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)},
+			&random.FakeRNG{},
+		)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from NewWithProviders: %v", i, err)
+		}
+
+		request, err := http.NewRequest("POST", "", strings.NewReader(`{"hello": "world"}`))
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from http.NewRequest: %v", i, err)
+		}
+
+		err = s.SignRequest(request)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from SignRequest: %v", i, err)
+		}
+
+		if g, w := request.Header.Get(XMailgunSignatureVersion), tt.outSignatureVersion; g != w {
+			t.Errorf("[%v] SignatureVersion from SignRequest: Got %s, Want %s", i, g, w)
+		}
+		if g, w := request.Header.Get(XMailgunSignature), tt.outSignature; g != w {
+			t.Errorf("[%v] Signature from SignRequest: Got %s, Want %s", i, g, w)
+		}
+
+		// and the same service must accept it
+		err = s.AuthenticateRequest(request)
+		if err != nil {
+			t.Errorf("[%v] AuthenticateRequest failed to authenticate a correctly signed request: %v", i, err)
+		}
+	}
+}
+
+func TestAuthenticateRequestAllowedAlgorithms(t *testing.T) {
+	ftime := &timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)}
+
+	// signer uses hmac-sha256
+	signer, err := NewWithProviders(&Config{KeyBytes: testKey}, ftime, &random.CSPRNG{})
+	if err != nil {
+		t.Errorf("Got unexpected error from NewWithProviders: %v", err)
+	}
+
+	// verifier only accepts hmac-sha512
+	verifier, err := NewWithProviders(&Config{KeyBytes: testKey, Algorithm: HMACSHA512}, ftime, &random.CSPRNG{})
+	if err != nil {
+		t.Errorf("Got unexpected error from NewWithProviders: %v", err)
+	}
+
+	request, err := http.NewRequest("POST", "", strings.NewReader(`{"hello": "world"}`))
+	if err != nil {
+		t.Errorf("Got unexpected error from http.NewRequest: %v", err)
+	}
+	err = signer.SignRequest(request)
+	if err != nil {
+		t.Errorf("Got unexpected error from SignRequest: %v", err)
+	}
+
+	// a validly signed request with a disallowed algorithm must fail
+	err = verifier.AuthenticateRequest(request)
+	if err == nil {
+		t.Error("AuthenticateRequest authenticated a request signed with a disallowed algorithm.")
+	}
+
+	// claiming a different algorithm than the one used must fail too
+	request.Header.Set(XMailgunSignatureVersion, HMACSHA512.SignatureVersion())
+	err = verifier.AuthenticateRequest(request)
+	if err == nil {
+		t.Error("AuthenticateRequest authenticated a request with a mismatched algorithm.")
+	}
+
+	// a verifier migrating between algorithms accepts both
+	migrating, err := NewWithProviders(
+		&Config{
+			KeyBytes:          testKey,
+			Algorithm:         HMACSHA512,
+			AllowedAlgorithms: []Algorithm{HMACSHA256, HMACSHA512},
+		},
+		ftime,
+		&random.CSPRNG{},
+	)
+	if err != nil {
+		t.Errorf("Got unexpected error from NewWithProviders: %v", err)
+	}
+	request.Header.Set(XMailgunSignatureVersion, HMACSHA256.SignatureVersion())
+	err = migrating.AuthenticateRequest(request)
+	if err != nil {
+		t.Errorf("AuthenticateRequest failed to authenticate an allowed algorithm: %v", err)
+	}
+}
+
+func TestNewUnsupportedAlgorithm(t *testing.T) {
+	_, err := New(&Config{KeyBytes: testKey, Algorithm: "hmac-md5"})
+	if err == nil {
+		t.Error("New accepted an unsupported algorithm.")
+	}
+
+	_, err = New(&Config{KeyBytes: testKey, AllowedAlgorithms: []Algorithm{HMACSHA256, "hmac-md5"}})
+	if err == nil {
+		t.Error("New accepted an unsupported allowed algorithm.")
+	}
+}
+
+func TestBLAKE2bKeyLength(t *testing.T) {
+	if _, err := newMAC(BLAKE2b256, nil); err == nil {
+		t.Error("newMAC accepted an empty blake2b key.")
+	}
+	if _, err := newMAC(BLAKE2b256, make([]byte, 65)); err == nil {
+		t.Error("newMAC accepted a blake2b key longer than 64 bytes.")
+	}
+	if _, err := newMAC(BLAKE2b256, testKey); err != nil {
+		t.Errorf("Got unexpected error from newMAC: %v", err)
+	}
+}
@@ -7,7 +7,6 @@ package httpsign
 import (
 	"bytes"
 	"crypto/hmac"
-	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -16,7 +15,10 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/mailgun/lemma/keysource"
 	"github.com/mailgun/lemma/random"
 	"github.com/mailgun/metrics"
 	"github.com/mailgun/timetools"
@@ -30,36 +32,110 @@ import (
 type Config struct {
 	// KeyPath is a path to a file that contains the key to sign requests. If
 	// it is an empty string then the key should be provided in `KeyBytes`.
-	KeyPath string
+	KeyPath string `json:"key_path" yaml:"key_path"`
 
-	// KeyBytes is a key that is used by lemma to sign requests. Ignored if
-	// `KeyPath` is not an empty string.
-	KeyBytes []byte
-
-	HeadersToSign  []string // list of headers to sign
-	SignVerbAndURI bool     // include the http verb and uri in request
-
-	NonceCacheCapacity int // capacity of the nonce cache
-	NonceCacheTimeout  int // nonce cache timeout
-
-	EmitStats    bool   // toggle emitting metrics or not
-	StatsdHost   string // hostname of statsd server
-	StatsdPort   int    // port of statsd server
-	StatsdPrefix string // prefix to prepend to metrics
+	// KeySource provides the key, for example from an environment variable or
+	// a secret manager (see the keysource package). Ignored if `KeyPath` is
+	// not an empty string.
+	KeySource keysource.Source `json:"-" yaml:"-"`
 
-	NonceHeaderName            string // default: X-Mailgun-Nonce
-	TimestampHeaderName        string // default: X-Mailgun-Timestamp
-	SignatureHeaderName        string // default: X-Mailgun-Signature
-	SignatureVersionHeaderName string // default: X-Mailgun-Signature-Version
+	// KeyBytes is a key that is used by lemma to sign requests. Ignored if
+	// `KeyPath` or `KeySource` is set.
+	KeyBytes []byte `json:"-" yaml:"-"`
+
+	// KeyGracePeriod is how many seconds the previous key is still accepted
+	// when authenticating after the key is reloaded, see ReloadKey and
+	// WatchKey. 0 switches to the new key immediately.
+	KeyGracePeriod int `json:"key_grace_period" yaml:"key_grace_period"`
+
+	HeadersToSign  []string `json:"headers_to_sign" yaml:"headers_to_sign"`     // list of headers to sign
+	SignVerbAndURI bool     `json:"sign_verb_and_uri" yaml:"sign_verb_and_uri"` // include the http verb and uri in request
+
+	// Purpose names the audience signatures are for, like "billing-api". When
+	// set, requests are signed with a subkey derived from the key for this
+	// purpose (see DeriveKey) and the purpose is part of the signed data, so
+	// a signature made for one purpose is rejected by services configured for
+	// any other. Both sides must use the same purpose.
+	Purpose string `json:"purpose" yaml:"purpose"`
+
+	// Algorithm is used to sign requests, default: hmac-sha256. It is recorded
+	// in the signature version header.
+	Algorithm Algorithm `json:"algorithm" yaml:"algorithm"`
+
+	// AllowedAlgorithms are accepted when authenticating requests, requests
+	// signed with any other algorithm are rejected. default: Algorithm only
+	AllowedAlgorithms []Algorithm `json:"allowed_algorithms" yaml:"allowed_algorithms"`
+
+	NonceCacheCapacity int `json:"nonce_cache_capacity" yaml:"nonce_cache_capacity"` // capacity of the nonce cache
+	NonceCacheTimeout  int `json:"nonce_cache_timeout" yaml:"nonce_cache_timeout"`   // nonce cache timeout
+
+	// NonceCacheOverflow decides what happens when the nonce cache is full,
+	// see OverflowPolicy. default: OverflowEvict
+	NonceCacheOverflow OverflowPolicy `json:"nonce_cache_overflow" yaml:"nonce_cache_overflow"`
+
+	// ClientID, when set, makes the service sign requests with a strictly
+	// increasing sequence number instead of a random nonce, sent as
+	// "<ClientID>:<sequence>" in the nonce header. Services verifying them
+	// only remember the highest sequence number seen per client (see
+	// SequenceCache) instead of every nonce. Both kinds of nonce are accepted
+	// when authenticating. Every signing process needs its own ClientID.
+	ClientID string `json:"client_id" yaml:"client_id"`
+
+	// SequenceCacheCapacity is the number of clients whose sequence numbers
+	// are tracked, default: SequenceCapacity. When it is full the client that
+	// was seen least recently is forgotten, and its requests could be replayed
+	// until their timestamps expire.
+	SequenceCacheCapacity int `json:"sequence_cache_capacity" yaml:"sequence_cache_capacity"`
+
+	// ReplayStore creates the storage for the nonce and sequence caches.
+	// default: NewMemoryStore
+	ReplayStore StoreFactory `json:"-" yaml:"-"`
+
+	// FailureLimit is the number of authentication failures in a row a client
+	// is allowed before it is refused without checking its signature. Clients
+	// regain FailureLimitRate failures per second. 0 disables the limiter.
+	FailureLimit           int     `json:"failure_limit" yaml:"failure_limit"`
+	FailureLimitRate       float64 `json:"failure_limit_rate" yaml:"failure_limit_rate"`             // default: 1
+	FailureLimiterCapacity int     `json:"failure_limiter_capacity" yaml:"failure_limiter_capacity"` // number of clients tracked, default: LimiterCapacity
+
+	// FailureLimitHeaderName identifies clients by the value of this header
+	// (for example a key ID set by a trusted proxy) instead of their remote
+	// address. Clients control their own headers, so only use this if they
+	// can't freely change it.
+	FailureLimitHeaderName string `json:"failure_limit_header_name" yaml:"failure_limit_header_name"`
+
+	// MaxSkewCorrection is how many seconds the signing clock may be corrected
+	// by to match the clock of the services being called, as learned through
+	// ObserveServerTime or Transport. 0 disables skew compensation.
+	MaxSkewCorrection int `json:"max_skew_correction" yaml:"max_skew_correction"`
+
+	EmitStats    bool   `json:"emit_stats" yaml:"emit_stats"`       // toggle emitting metrics or not
+	StatsdHost   string `json:"statsd_host" yaml:"statsd_host"`     // hostname of statsd server
+	StatsdPort   int    `json:"statsd_port" yaml:"statsd_port"`     // port of statsd server
+	StatsdPrefix string `json:"statsd_prefix" yaml:"statsd_prefix"` // prefix to prepend to metrics
+
+	NonceHeaderName             string `json:"nonce_header_name" yaml:"nonce_header_name"`                           // default: X-Mailgun-Nonce
+	TimestampHeaderName         string `json:"timestamp_header_name" yaml:"timestamp_header_name"`                   // default: X-Mailgun-Timestamp
+	SignatureHeaderName         string `json:"signature_header_name" yaml:"signature_header_name"`                   // default: X-Mailgun-Signature
+	SignatureVersionHeaderName  string `json:"signature_version_header_name" yaml:"signature_version_header_name"`   // default: X-Mailgun-Signature-Version
+	MultipartManifestHeaderName string `json:"multipart_manifest_header_name" yaml:"multipart_manifest_header_name"` // default: X-Mailgun-Multipart-Manifest
 }
 
 // Represents a service that can be used to sign and authenticate requests.
 type Service struct {
 	config         *Config
 	nonceCache     *NonceCache
+	sequenceCache  *SequenceCache
+	limiter        *FailureLimiter
+	skew           *SkewEstimator
 	randomProvider random.RandomProvider
 	timeProvider   timetools.TimeProvider
+	keyLock        sync.RWMutex
 	secretKey      []byte
+	previousKey    []byte // still accepted until previousExpiry after a reload
+	previousExpiry time.Time
+	sequenceLock   sync.Mutex
+	sequence       uint64 // last sequence number signed with, see ClientID
 	metricsClient  metrics.Client
 }
 
@@ -101,6 +177,40 @@ func NewWithProviders(config *Config, timeProvider timetools.TimeProvider,
 	if config.SignatureVersionHeaderName == "" {
 		config.SignatureVersionHeaderName = XMailgunSignatureVersion
 	}
+	if config.MultipartManifestHeaderName == "" {
+		config.MultipartManifestHeaderName = XMailgunMultipartManifest
+	}
+	if config.Algorithm == "" {
+		config.Algorithm = HMACSHA256
+	}
+	if len(config.AllowedAlgorithms) == 0 {
+		config.AllowedAlgorithms = []Algorithm{config.Algorithm}
+	}
+	if config.NonceCacheOverflow == "" {
+		config.NonceCacheOverflow = OverflowEvict
+	}
+	if config.SequenceCacheCapacity < 1 {
+		config.SequenceCacheCapacity = SequenceCapacity
+	}
+	if config.ReplayStore == nil {
+		config.ReplayStore = NewMemoryStore
+	}
+	if config.FailureLimitRate <= 0 {
+		config.FailureLimitRate = 1
+	}
+	if config.FailureLimiterCapacity < 1 {
+		config.FailureLimiterCapacity = LimiterCapacity
+	}
+
+	// check algorithms
+	if !config.Algorithm.Valid() {
+		return nil, fmt.Errorf("unsupported algorithm: %q", config.Algorithm)
+	}
+	for _, algorithm := range config.AllowedAlgorithms {
+		if !algorithm.Valid() {
+			return nil, fmt.Errorf("unsupported algorithm: %q", algorithm)
+		}
+	}
 
 	// setup metrics service
 	metricsClient := metrics.NewNop()
@@ -125,11 +235,12 @@ func NewWithProviders(config *Config, timeProvider timetools.TimeProvider,
 		}
 	}
 
-	// Read in key from KeyPath or if not given, try getting them from KeyBytes.
+	// Read in key from KeyPath or KeySource, or if not given, try getting them
+	// from KeyBytes.
 	var keyBytes []byte
 	var err error
-	if config.KeyPath != "" {
-		if keyBytes, err = readKeyFromDisk(config.KeyPath); err != nil {
+	if config.KeyPath != "" || config.KeySource != nil {
+		if keyBytes, err = loadKey(config); err != nil {
 			return nil, err
 		}
 	} else {
@@ -140,15 +251,43 @@ func NewWithProviders(config *Config, timeProvider timetools.TimeProvider,
 	}
 
 	// setup nonce cache
-	ncache, err := NewNonceCache(config.NonceCacheCapacity, config.NonceCacheTimeout, timeProvider)
+	ncache, err := NewNonceCacheWithStore(config.NonceCacheCapacity, config.NonceCacheTimeout,
+		config.NonceCacheOverflow, config.ReplayStore, timeProvider)
+	if err != nil {
+		return nil, err
+	}
+	ncache.metricsClient = metricsClient
+
+	// setup sequence cache
+	scache, err := NewSequenceCache(config.SequenceCacheCapacity, config.NonceCacheTimeout,
+		config.ReplayStore, timeProvider)
 	if err != nil {
 		return nil, err
 	}
 
+	// setup failure limiter if requested
+	var limiter *FailureLimiter
+	if config.FailureLimit > 0 {
+		limiter, err = NewFailureLimiter(config.FailureLimit, config.FailureLimitRate,
+			config.FailureLimiterCapacity, timeProvider)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// setup skew estimator if requested
+	var skew *SkewEstimator
+	if config.MaxSkewCorrection > 0 {
+		skew = NewSkewEstimator(time.Duration(config.MaxSkewCorrection) * time.Second)
+	}
+
 	// return service
 	return &Service{
 		config:         config,
 		nonceCache:     ncache,
+		sequenceCache:  scache,
+		limiter:        limiter,
+		skew:           skew,
 		secretKey:      keyBytes,
 		timeProvider:   timeProvider,
 		randomProvider: randomProvider,
@@ -158,10 +297,11 @@ func NewWithProviders(config *Config, timeProvider timetools.TimeProvider,
 
 // Signs a given HTTP request with signature, nonce, and timestamp.
 func (s *Service) SignRequest(r *http.Request) error {
-	if s.secretKey == nil {
+	secretKey := s.currentKey()
+	if secretKey == nil {
 		return fmt.Errorf("service not loaded with key.")
 	}
-	return s.SignRequestWithKey(r, s.secretKey)
+	return s.SignRequestWithKey(r, secretKey)
 }
 
 // Signs a given HTTP request with signature, nonce, and timestamp. Signs the
@@ -173,118 +313,273 @@ func (s *Service) SignRequestWithKey(r *http.Request, secretKey []byte) error {
 		return err
 	}
 
+	return s.signRequest(r, secretKey, bodyBytes)
+}
+
+// signRequest signs the request with bodyBytes standing in for the body and
+// sets the resulting headers.
+func (s *Service) signRequest(r *http.Request, secretKey []byte, bodyBytes []byte) error {
 	// extract any headers if requested
 	headerValues, err := extractHeaderValues(r, s.config.HeadersToSign)
 	if err != nil {
 		return err
 	}
 
-	// get 128-bit random number from /dev/urandom and base16 encode it
-	nonce, err := s.randomProvider.HexDigest(16)
+	// compute the signature
+	timestamp, nonce, signature, err := s.sign(secretKey, s.config.SignVerbAndURI, r.Method, r.URL.RequestURI(),
+		bodyBytes, headerValues)
 	if err != nil {
-		return fmt.Errorf("unable to get random : %v", err)
+		return err
 	}
 
-	// get current timestamp
-	timestamp := strconv.FormatInt(s.timeProvider.UtcNow().Unix(), 10)
-
-	// compute the hmac and base16 encode it
-	computedMAC := computeMAC(secretKey, s.config.SignVerbAndURI, r.Method, r.URL.RequestURI(),
-		timestamp, nonce, bodyBytes, headerValues)
-	signature := hex.EncodeToString(computedMAC)
-
 	// set headers
 	r.Header.Set(s.config.NonceHeaderName, nonce)
 	r.Header.Set(s.config.TimestampHeaderName, timestamp)
 	r.Header.Set(s.config.SignatureHeaderName, signature)
-	r.Header.Set(s.config.SignatureVersionHeaderName, "2")
-
-	// set the body bytes we read in to nil to hint to the gc to pick it up
-	bodyBytes = nil
+	r.Header.Set(s.config.SignatureVersionHeaderName, s.config.Algorithm.SignatureVersion())
 
 	return nil
 }
 
 // Authenticates HTTP request to ensure it was sent by an authorized sender.
 func (s *Service) AuthenticateRequest(r *http.Request) error {
-	if s.secretKey == nil {
+	secretKeys := s.verificationKeys()
+	if len(secretKeys) == 0 {
 		return fmt.Errorf("service not loaded with key.")
 	}
-	return s.AuthenticateRequestWithKey(r, s.secretKey)
+	_, err := s.authenticateRequest(r, secretKeys, readBody)
+	return err
 }
 
 // Authenticates HTTP request to ensure it was sent by an authorized sender.
 // Checks message signature with the passed in key, not the one initialized with.
-func (s *Service) AuthenticateRequestWithKey(r *http.Request, secretKey []byte) (err error) {
-	// Emit a success or failure metric on return.
+func (s *Service) AuthenticateRequestWithKey(r *http.Request, secretKey []byte) error {
+	_, err := s.authenticateRequest(r, [][]byte{secretKey}, readBody)
+	return err
+}
+
+// authenticateRequest authenticates the request with any of secretKeys and
+// the bytes returned by signedBody standing in for the body. It returns the
+// key the request was signed with.
+func (s *Service) authenticateRequest(r *http.Request, secretKeys [][]byte,
+	signedBody func(*http.Request) ([]byte, error)) (secretKey []byte, err error) {
+	// Emit a success, failure, or throttled metric on return and count
+	// failures against the client.
+	var limiterKey string
 	defer func() {
-		if err == nil {
+		switch {
+		case err == nil:
 			s.metricsClient.Inc("success", 1, 1)
-		} else {
+		case err == ErrTooManyFailures:
+			s.metricsClient.Inc("throttled", 1, 1)
+		default:
 			s.metricsClient.Inc("failure", 1, 1)
+			if s.limiter != nil {
+				s.limiter.Fail(limiterKey)
+			}
 		}
 	}()
 
+	// refuse clients that have failed too often before doing any work
+	if s.limiter != nil {
+		limiterKey = s.limiterKey(r)
+		if !s.limiter.Allow(limiterKey) {
+			return nil, ErrTooManyFailures
+		}
+	}
+
 	// extract parameters
 	signature := r.Header.Get(s.config.SignatureHeaderName)
 	if signature == "" {
-		return fmt.Errorf("header not found: %v", s.config.SignatureHeaderName)
+		return nil, fmt.Errorf("header not found: %v", s.config.SignatureHeaderName)
 	}
 	nonce := r.Header.Get(s.config.NonceHeaderName)
 	if nonce == "" {
-		return fmt.Errorf("header not found: %v", s.config.NonceHeaderName)
+		return nil, fmt.Errorf("header not found: %v", s.config.NonceHeaderName)
 	}
 	timestamp := r.Header.Get(s.config.TimestampHeaderName)
 	if timestamp == "" {
-		return fmt.Errorf("header not found: %v", s.config.TimestampHeaderName)
+		return nil, fmt.Errorf("header not found: %v", s.config.TimestampHeaderName)
+	}
+	// requests signed before the version header existed are version 2
+	version := r.Header.Get(s.config.SignatureVersionHeaderName)
+	if version == "" {
+		version = SignatureVersion
+	}
+
+	// check the algorithm is allowed before doing any work
+	algorithm, err := s.allowedAlgorithm(version)
+	if err != nil {
+		return nil, err
 	}
 
 	// extract request body bytes
-	bodyBytes, err := readBody(r)
+	bodyBytes, err := signedBody(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// extract any headers if requested
 	headerValues, err := extractHeaderValues(r, s.config.HeadersToSign)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// check the hmac
-	isValid, err := checkMAC(secretKey, s.config.SignVerbAndURI, r.Method, r.URL.RequestURI(),
+	// check the signature, timestamp, and nonce
+	secretKey, err = s.authenticate(algorithm, secretKeys, s.config.SignVerbAndURI, r.Method, r.URL.RequestURI(),
 		timestamp, nonce, bodyBytes, headerValues, signature)
-	if !isValid {
-		return err
+	if err != nil {
+		return nil, err
+	}
+
+	// set the body bytes we read in to nil to hint to the gc to pick it up
+	bodyBytes = nil
+
+	return secretKey, nil
+}
+
+// sign generates a nonce and timestamp and computes the signature over them
+// and the rest of the signature input.
+func (s *Service) sign(secretKey []byte, signVerbAndUri bool, httpVerb string, httpResourceUri string,
+	body []byte, headerValues []string) (timestamp string, nonce string, signature string, err error) {
+
+	// use the purpose subkey if configured
+	secretKey, headerValues, err = s.bindPurpose(secretKey, headerValues)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	nonce, err = s.newNonce()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	// get current timestamp, corrected for skew
+	timestamp = strconv.FormatInt(s.signingTime().Unix(), 10)
+
+	// compute the hmac and base16 encode it
+	computedMAC, err := computeMAC(s.config.Algorithm, secretKey, signVerbAndUri, httpVerb, httpResourceUri,
+		timestamp, nonce, body, headerValues)
+	if err != nil {
+		return "", "", "", err
+	}
+	signature = hex.EncodeToString(computedMAC)
+
+	return timestamp, nonce, signature, nil
+}
+
+// authenticate checks the signature was made with one of secretKeys, then
+// the timestamp, and finally that the nonce has not been seen before. It
+// returns the key the signature was made with.
+func (s *Service) authenticate(algorithm Algorithm, secretKeys [][]byte, signVerbAndUri bool, httpVerb string,
+	httpResourceUri string, timestamp string, nonce string, body []byte, headerValues []string,
+	signature string) ([]byte, error) {
+
+	// check the hmac against each key
+	var secretKey []byte
+	var err error
+	for _, key := range secretKeys {
+		// use the purpose subkey if configured
+		var purposeKey []byte
+		var purposeHeaderValues []string
+		purposeKey, purposeHeaderValues, err = s.bindPurpose(key, headerValues)
+		if err != nil {
+			return nil, err
+		}
+
+		var isValid bool
+		isValid, err = checkMAC(algorithm, purposeKey, signVerbAndUri, httpVerb, httpResourceUri,
+			timestamp, nonce, body, purposeHeaderValues, signature)
+		if isValid {
+			secretKey = key
+			break
+		}
+	}
+	if secretKey == nil {
+		if err == nil {
+			err = fmt.Errorf("no key to check signature with")
+		}
+		return nil, err
 	}
 
 	// check timestamp
-	isValid, err = s.checkTimestamp(timestamp)
+	isValid, err := s.checkTimestamp(timestamp)
 	if !isValid {
-		return err
+		return nil, err
 	}
 
 	// check to see if we have seen nonce before
-	inCache := s.nonceCache.InCache(nonce)
-	if inCache {
-		return fmt.Errorf("nonce already in cache: %v", nonce)
+	if err := s.checkNonce(nonce); err != nil {
+		return nil, err
 	}
 
-	// set the body bytes we read in to nil to hint to the gc to pick it up
-	bodyBytes = nil
+	return secretKey, nil
+}
 
-	return nil
+// NonceCache returns the cache of nonces seen by the service, for example to
+// report its occupancy.
+func (s *Service) NonceCache() *NonceCache {
+	return s.nonceCache
+}
+
+// HeaderNames returns the names of the nonce, timestamp, signature, and
+// signature version headers the service signs and authenticates requests
+// with, so other transports can carry the same values under the same names.
+func (s *Service) HeaderNames() (nonce string, timestamp string, signature string, version string) {
+	return s.config.NonceHeaderName, s.config.TimestampHeaderName,
+		s.config.SignatureHeaderName, s.config.SignatureVersionHeaderName
+}
+
+// ObserveServerTime lets the service learn the clock skew between itself and
+// a service it sends signed requests to, for example from the Date header of
+// a response. Ignored unless MaxSkewCorrection is set.
+func (s *Service) ObserveServerTime(serverTime time.Time) {
+	if s.skew == nil {
+		return
+	}
+	s.skew.Observe(s.timeProvider.UtcNow(), serverTime)
+}
+
+// signingTime returns the time to sign with: the current time corrected by
+// the estimated skew, if any.
+func (s *Service) signingTime() time.Time {
+	now := s.timeProvider.UtcNow()
+	if s.skew != nil {
+		now = now.Add(s.skew.Offset())
+	}
+	return now
+}
+
+// allowedAlgorithm returns the algorithm named by the signature version if
+// the service is configured to accept it.
+func (s *Service) allowedAlgorithm(version string) (Algorithm, error) {
+	algorithm, err := algorithmFromVersion(version)
+	if err != nil {
+		return "", err
+	}
+
+	for _, allowed := range s.config.AllowedAlgorithms {
+		if algorithm == allowed {
+			return algorithm, nil
+		}
+	}
+
+	return "", fmt.Errorf("algorithm not allowed: %v", algorithm)
 }
 
 func (s *Service) checkTimestamp(timestampHeader string) (bool, error) {
+	return s.checkTimestampAt(timestampHeader, s.timeProvider.UtcNow().Unix())
+}
+
+// checkTimestampAt checks the timestamp against the given current time, which
+// may come from another clock than our own.
+func (s *Service) checkTimestampAt(timestampHeader string, now int64) (bool, error) {
 	// convert unix timestamp string into time struct
 	timestamp, err := strconv.ParseInt(timestampHeader, 10, 0)
 	if err != nil {
 		return false, fmt.Errorf("unable to parse %v: %v", s.config.TimestampHeaderName, timestampHeader)
 	}
 
-	now := s.timeProvider.UtcNow().Unix()
-
 	// if timestamp is from the future, it's invalid
 	if timestamp >= now+MaxSkewSec {
 		return false, fmt.Errorf("timestamp header from the future; now: %v; %v: %v; difference: %v",
@@ -300,11 +595,14 @@ func (s *Service) checkTimestamp(timestampHeader string) (bool, error) {
 	return true, nil
 }
 
-func computeMAC(secretKey []byte, signVerbAndUri bool, httpVerb string, httpResourceUri string,
-	timestamp string, nonce string, body []byte, headerValues []string) []byte {
+func computeMAC(algorithm Algorithm, secretKey []byte, signVerbAndUri bool, httpVerb string, httpResourceUri string,
+	timestamp string, nonce string, body []byte, headerValues []string) ([]byte, error) {
 
-	// use hmac-sha256
-	mac := hmac.New(sha256.New, secretKey)
+	// use the keyed hash for the algorithm, hmac-sha256 by default
+	mac, err := newMAC(algorithm, secretKey)
+	if err != nil {
+		return nil, err
+	}
 
 	// required parameters (timestamp, nonce, body)
 	mac.Write([]byte(fmt.Sprintf("%v|", len(timestamp))))
@@ -328,10 +626,10 @@ func computeMAC(secretKey []byte, signVerbAndUri bool, httpVerb string, httpReso
 		mac.Write([]byte(headerValue))
 	}
 
-	return mac.Sum(nil)
+	return mac.Sum(nil), nil
 }
 
-func checkMAC(secretKey []byte, signVerbAndUri bool, httpVerb string, httpResourceUri string,
+func checkMAC(algorithm Algorithm, secretKey []byte, signVerbAndUri bool, httpVerb string, httpResourceUri string,
 	timestamp string, nonce string, body []byte, headerValues []string, signature string) (bool, error) {
 
 	// the hmac we get is a hexdigest (string representation of hex values)
@@ -342,7 +640,10 @@ func checkMAC(secretKey []byte, signVerbAndUri bool, httpVerb string, httpResour
 	}
 
 	// compute the hmac
-	computedMAC := computeMAC(secretKey, signVerbAndUri, httpVerb, httpResourceUri, timestamp, nonce, body, headerValues)
+	computedMAC, err := computeMAC(algorithm, secretKey, signVerbAndUri, httpVerb, httpResourceUri, timestamp, nonce, body, headerValues)
+	if err != nil {
+		return false, err
+	}
 
 	// constant time compare
 	isEqual := hmac.Equal(expectedMAC, computedMAC)
@@ -411,6 +712,14 @@ func extractHeaderValues(r *http.Request, headerNames []string) ([]string, error
 	return headerValues, nil
 }
 
+// loadKey reads the key from KeyPath, or KeySource if there is no KeyPath.
+func loadKey(config *Config) ([]byte, error) {
+	if config.KeyPath != "" {
+		return readKeyFromDisk(config.KeyPath)
+	}
+	return config.KeySource.Key()
+}
+
 func readKeyFromDisk(keypath string) ([]byte, error) {
 	// load key from disk
 	keyBytes, err := ioutil.ReadFile(keypath)
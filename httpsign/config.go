@@ -0,0 +1,166 @@
+package httpsign
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mailgun/lemma/internal/configfile"
+)
+
+// EnvPrefix prefixes the names of the environment variables read by
+// LoadConfigEnv, for example LEMMA_HTTPSIGN_KEY_PATH.
+const EnvPrefix = "LEMMA_HTTPSIGN_"
+
+// ConfigErrors lists every problem found with a config.
+type ConfigErrors = configfile.Errors
+
+// LoadConfigFile reads a config from a JSON (.json) or YAML (.yaml, .yml)
+// file and validates it. Field names are the snake case of the Config
+// fields, like key_path and headers_to_sign. Unknown fields are an error.
+func LoadConfigFile(path string) (*Config, error) {
+	config := &Config{}
+	if err := configfile.LoadFile(path, config); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// LoadConfigEnv reads a config from environment variables named after the
+// snake case of the Config fields with the EnvPrefix, like
+// LEMMA_HTTPSIGN_KEY_PATH. Lists are comma separated. Every variable that
+// can't be parsed is reported along with any validation errors.
+func LoadConfigEnv() (*Config, error) {
+	config := &Config{}
+	env := &configfile.EnvReader{Prefix: EnvPrefix}
+
+	env.String("KEY_PATH", &config.KeyPath)
+	env.Int("KEY_GRACE_PERIOD", &config.KeyGracePeriod)
+	env.Strings("HEADERS_TO_SIGN", &config.HeadersToSign)
+	env.Bool("SIGN_VERB_AND_URI", &config.SignVerbAndURI)
+	env.String("PURPOSE", &config.Purpose)
+
+	var algorithm string
+	var allowedAlgorithms []string
+	env.String("ALGORITHM", &algorithm)
+	env.Strings("ALLOWED_ALGORITHMS", &allowedAlgorithms)
+	config.Algorithm = Algorithm(algorithm)
+	for _, a := range allowedAlgorithms {
+		config.AllowedAlgorithms = append(config.AllowedAlgorithms, Algorithm(a))
+	}
+
+	var overflow string
+	env.Int("NONCE_CACHE_CAPACITY", &config.NonceCacheCapacity)
+	env.Int("NONCE_CACHE_TIMEOUT", &config.NonceCacheTimeout)
+	env.String("NONCE_CACHE_OVERFLOW", &overflow)
+	config.NonceCacheOverflow = OverflowPolicy(overflow)
+	env.String("CLIENT_ID", &config.ClientID)
+	env.Int("SEQUENCE_CACHE_CAPACITY", &config.SequenceCacheCapacity)
+
+	env.Int("FAILURE_LIMIT", &config.FailureLimit)
+	env.Float("FAILURE_LIMIT_RATE", &config.FailureLimitRate)
+	env.Int("FAILURE_LIMITER_CAPACITY", &config.FailureLimiterCapacity)
+	env.String("FAILURE_LIMIT_HEADER_NAME", &config.FailureLimitHeaderName)
+	env.Int("MAX_SKEW_CORRECTION", &config.MaxSkewCorrection)
+
+	env.Bool("EMIT_STATS", &config.EmitStats)
+	env.String("STATSD_HOST", &config.StatsdHost)
+	env.Int("STATSD_PORT", &config.StatsdPort)
+	env.String("STATSD_PREFIX", &config.StatsdPrefix)
+
+	env.String("NONCE_HEADER_NAME", &config.NonceHeaderName)
+	env.String("TIMESTAMP_HEADER_NAME", &config.TimestampHeaderName)
+	env.String("SIGNATURE_HEADER_NAME", &config.SignatureHeaderName)
+	env.String("SIGNATURE_VERSION_HEADER_NAME", &config.SignatureVersionHeaderName)
+	env.String("MULTIPART_MANIFEST_HEADER_NAME", &config.MultipartManifestHeaderName)
+
+	errs := append(env.Errs, config.validate()...)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return config, nil
+}
+
+// Validate checks the config for every problem New would run into, and some
+// it wouldn't, and returns them all as ConfigErrors.
+func (c *Config) Validate() error {
+	if errs := c.validate(); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c *Config) validate() ConfigErrors {
+	var errs ConfigErrors
+
+	// key
+	if c.KeyPath == "" && c.KeySource == nil && c.KeyBytes == nil {
+		errs = append(errs, fmt.Errorf("a key is required: key_path, KeySource, or KeyBytes"))
+	}
+	if c.KeyPath != "" {
+		if _, err := os.Stat(c.KeyPath); err != nil {
+			errs = append(errs, fmt.Errorf("key_path: %v", err))
+		}
+	}
+	if c.KeyGracePeriod < 0 {
+		errs = append(errs, fmt.Errorf("key_grace_period must not be negative"))
+	}
+	for i, header := range c.HeadersToSign {
+		if header == "" {
+			errs = append(errs, fmt.Errorf("headers_to_sign[%v] is empty", i))
+		}
+	}
+
+	// algorithms
+	if c.Algorithm != "" && !c.Algorithm.Valid() {
+		errs = append(errs, fmt.Errorf("algorithm: unsupported algorithm: %q", c.Algorithm))
+	}
+	for i, algorithm := range c.AllowedAlgorithms {
+		if !algorithm.Valid() {
+			errs = append(errs, fmt.Errorf("allowed_algorithms[%v]: unsupported algorithm: %q", i, algorithm))
+		}
+	}
+
+	// nonce cache
+	if c.NonceCacheCapacity < 0 {
+		errs = append(errs, fmt.Errorf("nonce_cache_capacity must not be negative"))
+	}
+	if c.NonceCacheTimeout < 0 {
+		errs = append(errs, fmt.Errorf("nonce_cache_timeout must not be negative"))
+	}
+	if c.NonceCacheOverflow != "" && !c.NonceCacheOverflow.Valid() {
+		errs = append(errs, fmt.Errorf("nonce_cache_overflow: unsupported overflow policy: %q", c.NonceCacheOverflow))
+	}
+	if c.SequenceCacheCapacity < 0 {
+		errs = append(errs, fmt.Errorf("sequence_cache_capacity must not be negative"))
+	}
+
+	// failure limiter and skew
+	if c.FailureLimit < 0 {
+		errs = append(errs, fmt.Errorf("failure_limit must not be negative"))
+	}
+	if c.FailureLimitRate < 0 {
+		errs = append(errs, fmt.Errorf("failure_limit_rate must not be negative"))
+	}
+	if c.FailureLimiterCapacity < 0 {
+		errs = append(errs, fmt.Errorf("failure_limiter_capacity must not be negative"))
+	}
+	if c.MaxSkewCorrection < 0 {
+		errs = append(errs, fmt.Errorf("max_skew_correction must not be negative"))
+	}
+
+	// metrics
+	if c.EmitStats {
+		if c.StatsdHost == "" {
+			errs = append(errs, fmt.Errorf("statsd_host is required to emit stats"))
+		}
+		if c.StatsdPort < 1 || c.StatsdPort > 65535 {
+			errs = append(errs, fmt.Errorf("statsd_port must be between 1 and 65535 to emit stats"))
+		}
+	}
+
+	return errs
+}
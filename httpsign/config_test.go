@@ -0,0 +1,168 @@
+package httpsign
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var _ = fmt.Printf // for testing
+
+// writeTestFiles writes a key and the named files to a temporary directory.
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "lemma")
+	if err != nil {
+		t.Fatalf("Got unexpected error from ioutil.TempDir: %v", err)
+	}
+	files["test.key"] = string(testKey)
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("Got unexpected error from ioutil.WriteFile: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"config.json": `{
+			"key_path": "KEYPATH",
+			"headers_to_sign": ["X-Mailgun-Foo"],
+			"sign_verb_and_uri": true,
+			"allowed_algorithms": ["hmac-sha256", "hmac-sha512"],
+			"nonce_cache_capacity": 1000,
+			"nonce_cache_overflow": "reject",
+			"failure_limit_rate": 0.5
+		}`,
+		"config.yaml": `
+key_path: KEYPATH
+headers_to_sign:
+  - X-Mailgun-Foo
+sign_verb_and_uri: true
+allowed_algorithms: [hmac-sha256, hmac-sha512]
+nonce_cache_capacity: 1000
+nonce_cache_overflow: reject
+failure_limit_rate: 0.5
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	want := &Config{
+		KeyPath:            filepath.Join(dir, "test.key"),
+		HeadersToSign:      []string{"X-Mailgun-Foo"},
+		SignVerbAndURI:     true,
+		AllowedAlgorithms:  []Algorithm{HMACSHA256, HMACSHA512},
+		NonceCacheCapacity: 1000,
+		NonceCacheOverflow: OverflowReject,
+		FailureLimitRate:   0.5,
+	}
+
+	for _, name := range []string{"config.json", "config.yaml"} {
+		// point the config at the key
+		path := filepath.Join(dir, name)
+		b, _ := ioutil.ReadFile(path)
+		b = []byte(strings.Replace(string(b), "KEYPATH", want.KeyPath, -1))
+		ioutil.WriteFile(path, b, 0600)
+
+		config, err := LoadConfigFile(path)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from LoadConfigFile: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(config, want) {
+			t.Errorf("[%v] Config: Got %+v, Want %+v", name, config, want)
+		}
+	}
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"unknown.json": `{"key_path": "x", "keypath": "x"}`,
+		"invalid.yaml": `
+key_path: /does/not/exist
+algorithm: md5
+nonce_cache_capacity: -1
+emit_stats: true
+`,
+		"config.toml": `key_path = "x"`,
+	})
+	defer os.RemoveAll(dir)
+
+	// unknown fields and file types
+	for _, name := range []string{"unknown.json", "config.toml", "missing.json"} {
+		if _, err := LoadConfigFile(filepath.Join(dir, name)); err == nil {
+			t.Errorf("[%v] LoadConfigFile should fail", name)
+		}
+	}
+
+	// every problem is reported
+	_, err := LoadConfigFile(filepath.Join(dir, "invalid.yaml"))
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("Expected ConfigErrors, got: %v", err)
+	}
+	if g, w := len(errs), 5; g != w {
+		t.Errorf("Errors: Got %v, Want %v (%v)", g, w, errs)
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	env := map[string]string{
+		"LEMMA_HTTPSIGN_KEY_PATH":            filepath.Join(dir, "test.key"),
+		"LEMMA_HTTPSIGN_HEADERS_TO_SIGN":     "X-Mailgun-Foo, X-Mailgun-Bar",
+		"LEMMA_HTTPSIGN_SIGN_VERB_AND_URI":   "true",
+		"LEMMA_HTTPSIGN_ALGORITHM":           "hmac-sha512",
+		"LEMMA_HTTPSIGN_NONCE_CACHE_TIMEOUT": "60",
+		"LEMMA_HTTPSIGN_FAILURE_LIMIT_RATE":  "0.5",
+		"LEMMA_HTTPSIGN_EMIT_STATS":          "true",
+		"LEMMA_HTTPSIGN_STATSD_HOST":         "localhost",
+		"LEMMA_HTTPSIGN_STATSD_PORT":         "8125",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	config, err := LoadConfigEnv()
+	if err != nil {
+		t.Fatalf("Got unexpected error from LoadConfigEnv: %v", err)
+	}
+	want := &Config{
+		KeyPath:           filepath.Join(dir, "test.key"),
+		HeadersToSign:     []string{"X-Mailgun-Foo", "X-Mailgun-Bar"},
+		SignVerbAndURI:    true,
+		Algorithm:         HMACSHA512,
+		NonceCacheTimeout: 60,
+		FailureLimitRate:  0.5,
+		EmitStats:         true,
+		StatsdHost:        "localhost",
+		StatsdPort:        8125,
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("Config: Got %+v, Want %+v", config, want)
+	}
+
+	// parse and validation errors are reported together
+	os.Setenv("LEMMA_HTTPSIGN_SIGN_VERB_AND_URI", "maybe")
+	os.Setenv("LEMMA_HTTPSIGN_STATSD_PORT", "statsd")
+	os.Setenv("LEMMA_HTTPSIGN_NONCE_CACHE_OVERFLOW", "drop")
+	defer os.Unsetenv("LEMMA_HTTPSIGN_NONCE_CACHE_OVERFLOW")
+
+	_, err = LoadConfigEnv()
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("Expected ConfigErrors, got: %v", err)
+	}
+	// sign_verb_and_uri, statsd_port twice (unparsable, then missing), nonce_cache_overflow
+	if g, w := len(errs), 4; g != w {
+		t.Errorf("Errors: Got %v, Want %v (%v)", g, w, errs)
+	}
+}
@@ -0,0 +1,110 @@
+package httpsign
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+)
+
+// ErrTooManyFailures is returned when a client is refused because it failed
+// authentication too many times recently.
+var ErrTooManyFailures = errors.New("too many authentication failures")
+
+// FailureLimiter keeps a token bucket of authentication failures per client.
+// Every failure takes a token, tokens come back at a fixed rate, and a client
+// with an empty bucket is refused until it regains one.
+type FailureLimiter struct {
+	sync.Mutex
+	buckets      *ttlmap.TtlMap
+	burst        float64
+	rate         float64
+	bucketTTL    int
+	timeProvider timetools.TimeProvider
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Return a new FailureLimiter. A client may fail burst times in a row, then one
+// more time for every 1/rate seconds. At most capacity clients are tracked.
+func NewFailureLimiter(burst int, rate float64, capacity int, timeProvider timetools.TimeProvider) (*FailureLimiter, error) {
+	if burst < 1 {
+		return nil, errors.New("burst must be at least 1")
+	}
+	if rate <= 0 {
+		return nil, errors.New("rate must be greater than 0")
+	}
+
+	c, err := ttlmap.NewMapWithProvider(capacity, timeProvider)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FailureLimiter{
+		buckets: c,
+		burst:   float64(burst),
+		rate:    rate,
+		// once a bucket has refilled it is no different from a missing one
+		bucketTTL:    int(math.Ceil(float64(burst)/rate)) + 1,
+		timeProvider: timeProvider,
+	}, nil
+}
+
+// Allow returns true if the client has failures to spare.
+func (l *FailureLimiter) Allow(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.refill(key).tokens >= 1
+}
+
+// Fail records an authentication failure for the client.
+func (l *FailureLimiter) Fail(key string) {
+	l.Lock()
+	defer l.Unlock()
+
+	b := l.refill(key)
+	b.tokens = math.Max(b.tokens-1, 0)
+	l.buckets.Set(key, b, l.bucketTTL)
+}
+
+// refill returns the bucket for the client topped up with the tokens it
+// earned back since it was last updated.
+func (l *FailureLimiter) refill(key string) *bucket {
+	now := l.timeProvider.UtcNow()
+
+	v, ok := l.buckets.Get(key)
+	if !ok {
+		return &bucket{tokens: l.burst, updated: now}
+	}
+
+	b := v.(*bucket)
+	b.tokens = math.Min(b.tokens+now.Sub(b.updated).Seconds()*l.rate, l.burst)
+	b.updated = now
+
+	return b
+}
+
+// limiterKey identifies the client that sent a request, either by the value
+// of the configured header or by its remote address.
+func (s *Service) limiterKey(r *http.Request) string {
+	if s.config.FailureLimitHeaderName != "" {
+		if key := r.Header.Get(s.config.FailureLimitHeaderName); key != "" {
+			return key
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,200 @@
+package httpsign
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/metrics"
+	"github.com/mailgun/timetools"
+)
+
+var _ = fmt.Printf // for testing
+
+func TestFailureLimiter(t *testing.T) {
+	ftime := &timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)}
+
+	// 3 failures in a row, then one more every 2 seconds
+	l, err := NewFailureLimiter(3, 0.5, 100, ftime)
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewFailureLimiter: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow("10.0.0.1") {
+			t.Errorf("[%v] Allow refused a client with failures to spare.", i)
+		}
+		l.Fail("10.0.0.1")
+	}
+	if l.Allow("10.0.0.1") {
+		t.Error("Allow allowed a client that used up its failures.")
+	}
+
+	// other clients are not affected
+	if !l.Allow("10.0.0.2") {
+		t.Error("Allow refused an unrelated client.")
+	}
+
+	// one second is not enough to earn a failure back
+	ftime.CurrentTime = ftime.CurrentTime.Add(1 * time.Second)
+	if l.Allow("10.0.0.1") {
+		t.Error("Allow allowed a client before it earned a failure back.")
+	}
+
+	// two seconds is
+	ftime.CurrentTime = ftime.CurrentTime.Add(1 * time.Second)
+	if !l.Allow("10.0.0.1") {
+		t.Error("Allow refused a client that earned a failure back.")
+	}
+	l.Fail("10.0.0.1")
+	if l.Allow("10.0.0.1") {
+		t.Error("Allow allowed a client that used up its failures.")
+	}
+
+	// after a long time the bucket is full again, but no fuller
+	ftime.CurrentTime = ftime.CurrentTime.Add(1 * time.Hour)
+	for i := 0; i < 3; i++ {
+		if !l.Allow("10.0.0.1") {
+			t.Errorf("[%v] Allow refused a client with failures to spare.", i)
+		}
+		l.Fail("10.0.0.1")
+	}
+	if l.Allow("10.0.0.1") {
+		t.Error("Allow allowed a client that used up its failures.")
+	}
+}
+
+func TestNewFailureLimiterInvalid(t *testing.T) {
+	ftime := &timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)}
+
+	if _, err := NewFailureLimiter(0, 1, 100, ftime); err == nil {
+		t.Error("NewFailureLimiter accepted a burst of 0.")
+	}
+	if _, err := NewFailureLimiter(1, 0, 100, ftime); err == nil {
+		t.Error("NewFailureLimiter accepted a rate of 0.")
+	}
+}
+
+type countingMetrics struct {
+	metrics.Client
+	counts map[string]int64
+}
+
+func (c *countingMetrics) Inc(stat interface{}, value int64, rate float32) error {
+	c.counts[stat.(string)] += value
+	return nil
+}
+
+func TestAuthenticateRequestFailureLimit(t *testing.T) {
+	// setup
+	s, err := NewWithProviders(
+		&Config{
+			KeyBytes:     testKey,
+			FailureLimit: 2,
+		},
+		&timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)},
+		&random.CSPRNG{},
+	)
+	if err != nil {
+		t.Errorf("Got unexpected error from NewWithProviders: %v", err)
+	}
+	mc := &countingMetrics{Client: metrics.NewNop(), counts: map[string]int64{}}
+	s.metricsClient = mc
+
+	newRequest := func(remoteAddr string) *http.Request {
+		request, err := http.NewRequest("POST", "", strings.NewReader(`{"hello": "world"}`))
+		if err != nil {
+			t.Errorf("Got unexpected error from http.NewRequest: %v", err)
+		}
+		request.RemoteAddr = remoteAddr
+		return request
+	}
+
+	forge := func(request *http.Request) *http.Request {
+		request.Header.Set(XMailgunNonce, "000102030405060708090a0b0c0d0e0f")
+		request.Header.Set(XMailgunTimestamp, "1330837567")
+		request.Header.Set(XMailgunSignature, "0000000000000000000000000000000000000000000000000000000000000000")
+		return request
+	}
+
+	// two forgeries are checked and fail
+	for i := 0; i < 2; i++ {
+		err = s.AuthenticateRequest(forge(newRequest("10.0.0.1:1234")))
+		if err == nil || err == ErrTooManyFailures {
+			t.Errorf("[%v] Expected a signature failure, got: %v", i, err)
+		}
+	}
+
+	// the third is refused, even from another port
+	err = s.AuthenticateRequest(forge(newRequest("10.0.0.1:4321")))
+	if err != ErrTooManyFailures {
+		t.Errorf("Expected ErrTooManyFailures, got: %v", err)
+	}
+
+	// and so is a correctly signed request from the same client
+	request := newRequest("10.0.0.1:1234")
+	if err := s.SignRequest(request); err != nil {
+		t.Errorf("Got unexpected error from SignRequest: %v", err)
+	}
+	err = s.AuthenticateRequest(request)
+	if err != ErrTooManyFailures {
+		t.Errorf("Expected ErrTooManyFailures, got: %v", err)
+	}
+
+	// other clients are not affected
+	request = newRequest("10.0.0.2:1234")
+	if err := s.SignRequest(request); err != nil {
+		t.Errorf("Got unexpected error from SignRequest: %v", err)
+	}
+	err = s.AuthenticateRequest(request)
+	if err != nil {
+		t.Errorf("AuthenticateRequest failed to authenticate a correctly signed request: %v", err)
+	}
+
+	// check metrics
+	if g, w := mc.counts["failure"], int64(2); g != w {
+		t.Errorf("failure metric: Got %v, Want %v", g, w)
+	}
+	if g, w := mc.counts["throttled"], int64(2); g != w {
+		t.Errorf("throttled metric: Got %v, Want %v", g, w)
+	}
+	if g, w := mc.counts["success"], int64(1); g != w {
+		t.Errorf("success metric: Got %v, Want %v", g, w)
+	}
+}
+
+func TestAuthenticateRequestFailureLimitHeader(t *testing.T) {
+	// setup
+	s, err := NewWithProviders(
+		&Config{
+			KeyBytes:               testKey,
+			FailureLimit:           1,
+			FailureLimitHeaderName: "X-Mailgun-Key-Id",
+		},
+		&timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)},
+		&random.CSPRNG{},
+	)
+	if err != nil {
+		t.Errorf("Got unexpected error from NewWithProviders: %v", err)
+	}
+
+	request, err := http.NewRequest("POST", "", strings.NewReader(`{"hello": "world"}`))
+	if err != nil {
+		t.Errorf("Got unexpected error from http.NewRequest: %v", err)
+	}
+	request.RemoteAddr = "10.0.0.1:1234"
+	request.Header.Set("X-Mailgun-Key-Id", "key-1")
+
+	if g, w := s.limiterKey(request), "key-1"; g != w {
+		t.Errorf("limiterKey: Got %v, Want %v", g, w)
+	}
+
+	// fall back to the remote address without the header
+	request.Header.Del("X-Mailgun-Key-Id")
+	if g, w := s.limiterKey(request), "10.0.0.1"; g != w {
+		t.Errorf("limiterKey: Got %v, Want %v", g, w)
+	}
+}
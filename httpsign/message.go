@@ -0,0 +1,209 @@
+package httpsign
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// messageInfo is the HKDF info of the key messages are signed with. Without
+// attributes a message's signature input is the same as a request body's, and
+// attributes can stand in for the verb and URI or headers of a request, so
+// messages are signed with a key of their own and can't pass for requests.
+const messageInfo = "lemma httpsign message"
+
+// Envelope carries everything a receiver needs to authenticate a message that
+// was signed outside of HTTP, for example an event published to a queue. It
+// travels alongside the message body and attributes it was computed over.
+type Envelope struct {
+	Timestamp string `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
+	Version   string `json:"version"`
+}
+
+// SignMessage signs an arbitrary message body and a set of named attributes
+// with a nonce and timestamp and returns the resulting envelope.
+func (s *Service) SignMessage(body []byte, attributes map[string]string) (*Envelope, error) {
+	secretKey := s.currentKey()
+	if secretKey == nil {
+		return nil, fmt.Errorf("service not loaded with key.")
+	}
+	return s.SignMessageWithKey(body, attributes, secretKey)
+}
+
+// SignMessageWithKey signs an arbitrary message body and a set of named
+// attributes with the passed in key not the one initialized with.
+func (s *Service) SignMessageWithKey(body []byte, attributes map[string]string, secretKey []byte) (*Envelope, error) {
+	messageKey, err := deriveMessageKey(secretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, nonce, signature, err := s.sign(messageKey, false, "", "", body, attributeValues(attributes))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		Timestamp: timestamp,
+		Nonce:     nonce,
+		Signature: signature,
+		Version:   s.config.Algorithm.SignatureVersion(),
+	}, nil
+}
+
+// AuthenticateMessage checks that the envelope was produced for the given body
+// and attributes by an authorized sender, is recent, and has not been seen before.
+func (s *Service) AuthenticateMessage(body []byte, attributes map[string]string, e *Envelope) error {
+	secretKeys := s.verificationKeys()
+	if len(secretKeys) == 0 {
+		return fmt.Errorf("service not loaded with key.")
+	}
+	_, err := s.authenticateMessage(body, attributes, e, secretKeys)
+	return err
+}
+
+// AuthenticateMessageWithKey checks the envelope with the passed in key, not
+// the one initialized with.
+func (s *Service) AuthenticateMessageWithKey(body []byte, attributes map[string]string, e *Envelope, secretKey []byte) error {
+	_, err := s.authenticateMessage(body, attributes, e, [][]byte{secretKey})
+	return err
+}
+
+// SignMessageSession signs a message like SignMessage, and also returns the
+// sending side of a Session for the messages that follow it, like the
+// messages of a stream the signed message opens. The session's keys are
+// derived from the key and the envelope's nonce.
+func (s *Service) SignMessageSession(body []byte, attributes map[string]string) (*Envelope, *Session, error) {
+	secretKey := s.currentKey()
+	if secretKey == nil {
+		return nil, nil, fmt.Errorf("service not loaded with key.")
+	}
+
+	e, err := s.SignMessageWithKey(body, attributes, secretKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := s.newSession(s.config.Algorithm, secretKey, e.Nonce, clientToServerInfo, serverToClientInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return e, session, nil
+}
+
+// AuthenticateMessageSession authenticates a message like AuthenticateMessage
+// and returns the receiving side of the Session started by
+// SignMessageSession.
+func (s *Service) AuthenticateMessageSession(body []byte, attributes map[string]string, e *Envelope) (*Session, error) {
+	secretKeys := s.verificationKeys()
+	if len(secretKeys) == 0 {
+		return nil, fmt.Errorf("service not loaded with key.")
+	}
+
+	secretKey, err := s.authenticateMessage(body, attributes, e, secretKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	// the version was checked by authenticateMessage
+	algorithm, err := s.allowedAlgorithm(e.Version)
+	if err != nil {
+		return nil, err
+	}
+	return s.newSession(algorithm, secretKey, e.Nonce, serverToClientInfo, clientToServerInfo)
+}
+
+// authenticateMessage checks the envelope was made with any of secretKeys,
+// and returns the one it was made with.
+func (s *Service) authenticateMessage(body []byte, attributes map[string]string, e *Envelope,
+	secretKeys [][]byte) (secretKey []byte, err error) {
+	// Emit a success or failure metric on return.
+	defer func() {
+		if err == nil {
+			s.metricsClient.Inc("success", 1, 1)
+		} else {
+			s.metricsClient.Inc("failure", 1, 1)
+		}
+	}()
+
+	// check envelope fields
+	if e == nil {
+		return nil, fmt.Errorf("envelope is required")
+	}
+	if e.Signature == "" {
+		return nil, fmt.Errorf("envelope field not found: signature")
+	}
+	if e.Nonce == "" {
+		return nil, fmt.Errorf("envelope field not found: nonce")
+	}
+	if e.Timestamp == "" {
+		return nil, fmt.Errorf("envelope field not found: timestamp")
+	}
+	if e.Version == "" {
+		return nil, fmt.Errorf("envelope field not found: version")
+	}
+
+	// check the algorithm is allowed before doing any work
+	algorithm, err := s.allowedAlgorithm(e.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	messageKeys := make([][]byte, len(secretKeys))
+	for i, key := range secretKeys {
+		if messageKeys[i], err = deriveMessageKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	messageKey, err := s.authenticate(algorithm, messageKeys, false, "", "", e.Timestamp, e.Nonce, body,
+		attributeValues(attributes), e.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	// return the key the message key was derived from
+	for i, key := range messageKeys {
+		if bytes.Equal(key, messageKey) {
+			return secretKeys[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no key to check signature with")
+}
+
+// deriveMessageKey derives the key messages are signed with from secretKey.
+func deriveMessageKey(secretKey []byte) ([]byte, error) {
+	key := make([]byte, sha256.Size)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secretKey, nil, []byte(messageInfo)), key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// attributeValues flattens attributes into name, value pairs ordered by name
+// so both sides feed them into the signature in the same order.
+func attributeValues(attributes map[string]string) []string {
+	if len(attributes) < 1 {
+		return nil
+	}
+
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		values = append(values, name, attributes[name])
+	}
+
+	return values
+}
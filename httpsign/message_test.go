@@ -0,0 +1,211 @@
+package httpsign
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/timetools"
+)
+
+var _ = fmt.Printf // for testing
+
+func TestSignMessage(t *testing.T) {
+	// setup
+	s, err := NewWithProviders(
+		&Config{
+			KeyBytes:           testKey,
+			NonceCacheCapacity: CacheCapacity,
+			NonceCacheTimeout:  CacheTimeout,
+		},
+		&timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)},
+		&random.FakeRNG{},
+	)
+	if err != nil {
+		t.Errorf("Got unexpected error from NewWithProviders: %v", err)
+	}
+
+	// messages are signed with a key derived for messages
+	e, err := s.SignMessage([]byte(`{"hello": "world"}`), nil)
+	if err != nil {
+		t.Errorf("Got unexpected error from SignMessage: %v", err)
+	}
+	if g, w := e.Nonce, "000102030405060708090a0b0c0d0e0f"; g != w {
+		t.Errorf("Nonce from SignMessage: Got %s, Want %s", g, w)
+	}
+	if g, w := e.Timestamp, "1330837567"; g != w {
+		t.Errorf("Timestamp from SignMessage: Got %s, Want %s", g, w)
+	}
+	if g, w := e.Signature, "e31f6d79b1182808befae75095a4019583b56a1df169ffa17210cd1ca991acaa"; g != w {
+		t.Errorf("Signature from SignMessage: Got %s, Want %s", g, w)
+	}
+	if g, w := e.Version, SignatureVersion; g != w {
+		t.Errorf("Version from SignMessage: Got %s, Want %s", g, w)
+	}
+}
+
+func TestAuthenticateMessage(t *testing.T) {
+	// setup
+	s, err := NewWithProviders(
+		&Config{
+			KeyBytes:           testKey,
+			NonceCacheCapacity: CacheCapacity,
+			NonceCacheTimeout:  CacheTimeout,
+		},
+		&timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)},
+		&random.FakeRNG{},
+	)
+	if err != nil {
+		t.Errorf("Got unexpected error from NewWithProviders: %v", err)
+	}
+
+	body := []byte(`{"event": "delivered"}`)
+	attributes := map[string]string{"queue": "events", "account": "42"}
+
+	e, err := s.SignMessage(body, attributes)
+	if err != nil {
+		t.Errorf("Got unexpected error from SignMessage: %v", err)
+	}
+
+	// tampered attributes must fail
+	err = s.AuthenticateMessage(body, map[string]string{"queue": "events", "account": "43"}, e)
+	if err == nil {
+		t.Error("AuthenticateMessage authenticated a message with tampered attributes.")
+	}
+
+	// a missing attribute must fail
+	err = s.AuthenticateMessage(body, map[string]string{"queue": "events"}, e)
+	if err == nil {
+		t.Error("AuthenticateMessage authenticated a message with a missing attribute.")
+	}
+
+	// tampered body must fail
+	err = s.AuthenticateMessage([]byte(`{"event": "bounced"}`), attributes, e)
+	if err == nil {
+		t.Error("AuthenticateMessage authenticated a message with a tampered body.")
+	}
+
+	// unknown version must fail
+	err = s.AuthenticateMessage(body, attributes, &Envelope{e.Timestamp, e.Nonce, e.Signature, "1"})
+	if err == nil {
+		t.Error("AuthenticateMessage authenticated a message with an unknown version.")
+	}
+
+	// the real thing must pass
+	err = s.AuthenticateMessage(body, attributes, e)
+	if err != nil {
+		t.Errorf("AuthenticateMessage failed to authenticate a correctly signed message: %v", err)
+	}
+
+	// but only once
+	err = s.AuthenticateMessage(body, attributes, e)
+	if err == nil {
+		t.Error("AuthenticateMessage authenticated a replayed message.")
+	}
+}
+
+func TestMessageNotRequest(t *testing.T) {
+	// setup
+	s, err := NewWithProviders(
+		&Config{
+			KeyBytes:           testKey,
+			SignVerbAndURI:     true,
+			NonceCacheCapacity: CacheCapacity,
+			NonceCacheTimeout:  CacheTimeout,
+		},
+		&timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)},
+		&random.FakeRNG{},
+	)
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewWithProviders: %v", err)
+	}
+
+	// an attribute that stands in for the verb and uri has the same
+	// signature input as the request
+	body := []byte(`{"hello": "world"}`)
+	attributes := map[string]string{"POST": "/messages"}
+	newRequest := func() *http.Request {
+		request, err := http.NewRequest("POST", "/messages", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Got unexpected error from http.NewRequest: %v", err)
+		}
+		return request
+	}
+
+	// a message envelope must not authenticate a request
+	e, err := s.SignMessage(body, attributes)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SignMessage: %v", err)
+	}
+	request := newRequest()
+	request.Header.Set(XMailgunTimestamp, e.Timestamp)
+	request.Header.Set(XMailgunNonce, e.Nonce)
+	request.Header.Set(XMailgunSignature, e.Signature)
+	request.Header.Set(XMailgunSignatureVersion, e.Version)
+	if err := s.AuthenticateRequest(request); err == nil {
+		t.Error("AuthenticateRequest authenticated a message envelope.")
+	}
+
+	// and a request signature must not authenticate a message
+	request = newRequest()
+	if err := s.SignRequest(request); err != nil {
+		t.Fatalf("Got unexpected error from SignRequest: %v", err)
+	}
+	e = &Envelope{
+		Timestamp: request.Header.Get(XMailgunTimestamp),
+		Nonce:     request.Header.Get(XMailgunNonce),
+		Signature: request.Header.Get(XMailgunSignature),
+		Version:   request.Header.Get(XMailgunSignatureVersion),
+	}
+	if err := s.AuthenticateMessage(body, attributes, e); err == nil {
+		t.Error("AuthenticateMessage authenticated a request signature.")
+	}
+}
+
+func TestAuthenticateMessageExpired(t *testing.T) {
+	// setup
+	ftime := &timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)}
+	s, err := NewWithProviders(
+		&Config{
+			KeyBytes:           testKey,
+			NonceCacheCapacity: 100,
+			NonceCacheTimeout:  30,
+		},
+		ftime,
+		&random.FakeRNG{},
+	)
+	if err != nil {
+		t.Errorf("Got unexpected error from NewWithProviders: %v", err)
+	}
+
+	body := []byte("hello")
+	e, err := s.SignMessageWithKey(body, nil, []byte("abc"))
+	if err != nil {
+		t.Errorf("Got unexpected error from SignMessageWithKey: %v", err)
+	}
+
+	// message delivered a minute late
+	ftime.CurrentTime = time.Unix(1330837627, 0)
+
+	err = s.AuthenticateMessageWithKey(body, nil, e, []byte("abc"))
+	if err == nil {
+		t.Error("AuthenticateMessageWithKey authenticated an expired message.")
+	}
+}
+
+func TestAttributeValues(t *testing.T) {
+	got := attributeValues(map[string]string{"b": "2", "a": "1", "c": ""})
+	want := []string{"a", "1", "b", "2", "c", ""}
+
+	if len(got) != len(want) {
+		t.Fatalf("Got: %q, Want: %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Got: %q, Want: %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package httpsign
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// manifestPart describes one part of a signed multipart body.
+type manifestPart struct {
+	Name        string `json:"name"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	SHA256      string `json:"sha256"`
+}
+
+// SignMultipartRequest signs a multipart request. Instead of the body, the
+// signature covers a manifest of part names, filenames, content types, and
+// SHA-256 digests which is sent in the manifest header, so the receiver can authenticate the
+// request before reading the body and then check each part as it streams in.
+func (s *Service) SignMultipartRequest(r *http.Request) error {
+	secretKey := s.currentKey()
+	if secretKey == nil {
+		return fmt.Errorf("service not loaded with key.")
+	}
+	return s.SignMultipartRequestWithKey(r, secretKey)
+}
+
+// SignMultipartRequestWithKey signs a multipart request with the passed in key
+// not the one initialized with. If the request has GetBody set (as requests
+// created by http.NewRequest with an in-memory body do) the parts are read from
+// a copy of the body, otherwise the body is buffered in memory.
+func (s *Service) SignMultipartRequestWithKey(r *http.Request, secretKey []byte) error {
+	boundary, err := multipartBoundary(r)
+	if err != nil {
+		return err
+	}
+
+	// read the parts from a copy of the body if the request can make one
+	var body io.ReadCloser
+	if r.GetBody != nil {
+		body, err = r.GetBody()
+		if err != nil {
+			return err
+		}
+	} else {
+		bodyBytes, err := readBody(r)
+		if err != nil {
+			return err
+		}
+		body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+	}
+	defer body.Close()
+
+	manifest, err := buildManifest(multipart.NewReader(body, boundary))
+	if err != nil {
+		return err
+	}
+
+	// the encoded manifest is signed in place of the body
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	manifestHeader := base64.StdEncoding.EncodeToString(manifestBytes)
+	r.Header.Set(s.config.MultipartManifestHeaderName, manifestHeader)
+
+	return s.signRequest(r, secretKey, []byte(manifestHeader))
+}
+
+// AuthenticateMultipartRequest authenticates a request signed with
+// SignMultipartRequest without reading its body. The body must then be read
+// through the returned MultipartReader, which fails at the first part that
+// does not match the signed manifest.
+func (s *Service) AuthenticateMultipartRequest(r *http.Request) (*MultipartReader, error) {
+	secretKeys := s.verificationKeys()
+	if len(secretKeys) == 0 {
+		return nil, fmt.Errorf("service not loaded with key.")
+	}
+	return s.authenticateMultipartRequest(r, secretKeys)
+}
+
+// AuthenticateMultipartRequestWithKey authenticates a multipart request with
+// the passed in key, not the one initialized with.
+func (s *Service) AuthenticateMultipartRequestWithKey(r *http.Request, secretKey []byte) (*MultipartReader, error) {
+	return s.authenticateMultipartRequest(r, [][]byte{secretKey})
+}
+
+func (s *Service) authenticateMultipartRequest(r *http.Request, secretKeys [][]byte) (*MultipartReader, error) {
+	var manifestHeader string
+	_, err := s.authenticateRequest(r, secretKeys, func(r *http.Request) ([]byte, error) {
+		manifestHeader = r.Header.Get(s.config.MultipartManifestHeaderName)
+		if manifestHeader == "" {
+			return nil, fmt.Errorf("header not found: %v", s.config.MultipartManifestHeaderName)
+		}
+		return []byte(manifestHeader), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the manifest is only decoded once we know who sent it
+	manifestBytes, err := base64.StdEncoding.DecodeString(manifestHeader)
+	if err != nil {
+		return nil, fmt.Errorf("invalid multipart manifest: %v", err)
+	}
+	var manifest []manifestPart
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid multipart manifest: %v", err)
+	}
+
+	boundary, err := multipartBoundary(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MultipartReader{
+		reader:   multipart.NewReader(r.Body, boundary),
+		manifest: manifest,
+	}, nil
+}
+
+// MultipartReader streams the parts of an authenticated multipart body and
+// checks each one against the signed manifest. Once a part fails to match,
+// every following call returns the same error.
+type MultipartReader struct {
+	reader   *multipart.Reader
+	manifest []manifestPart
+	next     int
+	part     *Part
+	err      error
+}
+
+// NextPart returns the next part of the body, or io.EOF once every part in the
+// manifest has been read. Any unread data in the previous part is read and
+// checked first.
+func (m *MultipartReader) NextPart() (*Part, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	// finish checking the previous part
+	if m.part != nil {
+		if _, err := io.Copy(ioutil.Discard, m.part); err != nil {
+			m.err = err
+			return nil, err
+		}
+		m.part = nil
+	}
+
+	p, err := m.reader.NextPart()
+	if err == io.EOF {
+		if m.next < len(m.manifest) {
+			m.err = fmt.Errorf("multipart body ended after %v of %v parts", m.next, len(m.manifest))
+			return nil, m.err
+		}
+		m.err = io.EOF
+		return nil, io.EOF
+	}
+	if err != nil {
+		m.err = err
+		return nil, err
+	}
+
+	// check the part is the one we expect before handing it out
+	if m.next >= len(m.manifest) {
+		m.err = fmt.Errorf("part %v (%q) not in multipart manifest", m.next, p.FormName())
+		return nil, m.err
+	}
+	want := m.manifest[m.next]
+	if p.FormName() != want.Name || p.FileName() != want.Filename ||
+		p.Header.Get("Content-Type") != want.ContentType {
+		m.err = fmt.Errorf("part %v (%q) does not match multipart manifest", m.next, p.FormName())
+		return nil, m.err
+	}
+
+	m.part = &Part{
+		Part:   p,
+		index:  m.next,
+		digest: want.SHA256,
+		hash:   sha256.New(),
+		reader: m,
+	}
+	m.next++
+
+	return m.part, nil
+}
+
+// Part is a single part of an authenticated multipart body. Its digest is
+// checked when it is read to the end, so a handler must not act on the data
+// until Read has returned io.EOF.
+type Part struct {
+	*multipart.Part
+	index   int
+	digest  string
+	hash    hash.Hash
+	checked bool
+	reader  *MultipartReader
+}
+
+// Read reads the body of the part. Instead of io.EOF it returns an error if
+// the part does not match its digest in the manifest.
+func (p *Part) Read(b []byte) (int, error) {
+	if p.reader.err != nil && p.reader.err != io.EOF {
+		return 0, p.reader.err
+	}
+
+	n, err := p.Part.Read(b)
+	p.hash.Write(b[:n])
+
+	if err == io.EOF && !p.checked {
+		p.checked = true
+		if hex.EncodeToString(p.hash.Sum(nil)) != p.digest {
+			p.reader.err = fmt.Errorf("part %v (%q) does not match multipart manifest digest", p.index, p.FormName())
+			return n, p.reader.err
+		}
+	}
+
+	return n, err
+}
+
+// buildManifest reads every part and records its name, filename, content
+// type, and digest.
+func buildManifest(reader *multipart.Reader) ([]manifestPart, error) {
+	manifest := []manifestPart{}
+	for {
+		p, err := reader.NextPart()
+		if err == io.EOF {
+			return manifest, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		h := sha256.New()
+		if _, err := io.Copy(h, p); err != nil {
+			return nil, err
+		}
+
+		manifest = append(manifest, manifestPart{
+			Name:        p.FormName(),
+			Filename:    p.FileName(),
+			ContentType: p.Header.Get("Content-Type"),
+			SHA256:      hex.EncodeToString(h.Sum(nil)),
+		})
+	}
+}
+
+// multipartBoundary returns the boundary of a multipart request body.
+func multipartBoundary(r *http.Request) (string, error) {
+	if r.Body == nil {
+		return "", fmt.Errorf("multipart request has no body")
+	}
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return "", fmt.Errorf("invalid content type: %v", err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return "", fmt.Errorf("not a multipart request: %v", mediaType)
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return "", fmt.Errorf("multipart request has no boundary")
+	}
+
+	return boundary, nil
+}
@@ -0,0 +1,286 @@
+package httpsign
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/timetools"
+)
+
+var _ = fmt.Printf // for testing
+
+type testPart struct {
+	name     string
+	filename string
+	content  string
+}
+
+func newMultipartTestService(t *testing.T) *Service {
+	s, err := NewWithProviders(
+		&Config{
+			KeyBytes:           testKey,
+			NonceCacheCapacity: CacheCapacity,
+			NonceCacheTimeout:  CacheTimeout,
+		},
+		&timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)},
+		&random.CSPRNG{},
+	)
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewWithProviders: %v", err)
+	}
+	return s
+}
+
+func newMultipartBody(t *testing.T, parts []testPart) (string, []byte) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		var pw io.Writer
+		var err error
+		if p.filename != "" {
+			pw, err = w.CreateFormFile(p.name, p.filename)
+		} else {
+			pw, err = w.CreateFormField(p.name)
+		}
+		if err != nil {
+			t.Fatalf("Got unexpected error creating part: %v", err)
+		}
+		io.WriteString(pw, p.content)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Got unexpected error closing multipart writer: %v", err)
+	}
+	return w.FormDataContentType(), buf.Bytes()
+}
+
+func newMultipartRequest(t *testing.T, contentType string, body []byte) *http.Request {
+	r, err := http.NewRequest("POST", "/upload", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Got unexpected error from http.NewRequest: %v", err)
+	}
+	r.Header.Set("Content-Type", contentType)
+	return r
+}
+
+// readParts reads every part and returns their contents, stopping at the
+// first error.
+func readParts(m *MultipartReader) ([]string, error) {
+	var contents []string
+	for {
+		p, err := m.NextPart()
+		if err == io.EOF {
+			return contents, nil
+		}
+		if err != nil {
+			return contents, err
+		}
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			return contents, err
+		}
+		contents = append(contents, string(b))
+	}
+}
+
+var testParts = []testPart{
+	{"subject", "", "hello"},
+	{"attachment", "world.txt", "hello, world"},
+	{"text", "", "goodbye"},
+}
+
+func TestAuthenticateMultipartRequest(t *testing.T) {
+	s := newMultipartTestService(t)
+	contentType, body := newMultipartBody(t, testParts)
+
+	// with and without GetBody
+	for i, getBody := range []bool{true, false} {
+		r := newMultipartRequest(t, contentType, body)
+		if !getBody {
+			r.GetBody = nil
+		}
+
+		err := s.SignMultipartRequest(r)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from SignMultipartRequest: %v", i, err)
+		}
+		if r.Header.Get(XMailgunMultipartManifest) == "" {
+			t.Errorf("[%v] Manifest header not set", i)
+		}
+
+		m, err := s.AuthenticateMultipartRequest(r)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from AuthenticateMultipartRequest: %v", i, err)
+			continue
+		}
+		contents, err := readParts(m)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error reading parts: %v", i, err)
+		}
+		if g, w := len(contents), len(testParts); g != w {
+			t.Errorf("[%v] Parts: Got %v, Want %v", i, g, w)
+			continue
+		}
+		for j, p := range testParts {
+			if g, w := contents[j], p.content; g != w {
+				t.Errorf("[%v] Part %v: Got %q, Want %q", i, j, g, w)
+			}
+		}
+	}
+}
+
+func TestAuthenticateMultipartRequestSkippedPart(t *testing.T) {
+	s := newMultipartTestService(t)
+	contentType, body := newMultipartBody(t, testParts)
+	r := newMultipartRequest(t, contentType, body)
+
+	err := s.SignMultipartRequest(r)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SignMultipartRequest: %v", err)
+	}
+
+	// tamper with the second part and only read the third
+	tampered := bytes.Replace(body, []byte("hello, world"), []byte("hello, WORLD"), 1)
+	r.Body = ioutil.NopCloser(bytes.NewReader(tampered))
+
+	m, err := s.AuthenticateMultipartRequest(r)
+	if err != nil {
+		t.Fatalf("Got unexpected error from AuthenticateMultipartRequest: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := m.NextPart(); err != nil {
+			t.Fatalf("[%v] Got unexpected error from NextPart: %v", i, err)
+		}
+	}
+	if _, err := m.NextPart(); err == nil {
+		t.Errorf("NextPart should fail after skipping a tampered part")
+	}
+}
+
+func TestAuthenticateMultipartRequestTampered(t *testing.T) {
+	var tests = []struct {
+		inBody   func([]byte) []byte
+		outParts int
+	}{
+		// tampered part content
+		{func(b []byte) []byte {
+			return bytes.Replace(b, []byte("hello, world"), []byte("hello, WORLD"), 1)
+		}, 1},
+		// renamed part
+		{func(b []byte) []byte {
+			return bytes.Replace(b, []byte(`name="text"`), []byte(`name="html"`), 1)
+		}, 2},
+		// changed part content type
+		{func(b []byte) []byte {
+			return bytes.Replace(b, []byte("Content-Type: application/octet-stream"), []byte("Content-Type: text/html"), 1)
+		}, 1},
+		// missing last part
+		{func(b []byte) []byte {
+			_, body := newMultipartBody(t, testParts[:2])
+			return body
+		}, 2},
+		// extra part
+		{func(b []byte) []byte {
+			_, body := newMultipartBody(t, append(testParts, testPart{"extra", "", "extra"}))
+			return body
+		}, 3},
+	}
+
+	for i, tt := range tests {
+		s := newMultipartTestService(t)
+		contentType, body := newMultipartBody(t, testParts)
+		r := newMultipartRequest(t, contentType, body)
+
+		err := s.SignMultipartRequest(r)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from SignMultipartRequest: %v", i, err)
+			continue
+		}
+
+		// swap in the altered body, keeping the boundary
+		altered := tt.inBody(body)
+		boundary := body[2:bytes.IndexByte(body, '\r')]
+		altered = bytes.Replace(altered, altered[2:bytes.IndexByte(altered, '\r')], boundary, -1)
+		r.Body = ioutil.NopCloser(bytes.NewReader(altered))
+
+		// the headers are intact so authentication succeeds
+		m, err := s.AuthenticateMultipartRequest(r)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from AuthenticateMultipartRequest: %v", i, err)
+			continue
+		}
+
+		// reading the parts fails after the last good one
+		contents, err := readParts(m)
+		if err == nil {
+			t.Errorf("[%v] Reading parts should fail", i)
+		}
+		if g, w := len(contents), tt.outParts; g != w {
+			t.Errorf("[%v] Parts read before failing: Got %v, Want %v", i, g, w)
+		}
+
+		// and keeps failing
+		if _, err := m.NextPart(); err == nil {
+			t.Errorf("[%v] NextPart should keep failing", i)
+		}
+	}
+}
+
+func TestAuthenticateMultipartRequestForged(t *testing.T) {
+	s := newMultipartTestService(t)
+	contentType, body := newMultipartBody(t, testParts)
+
+	// forged manifest
+	r := newMultipartRequest(t, contentType, body)
+	err := s.SignMultipartRequest(r)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SignMultipartRequest: %v", err)
+	}
+	r.Header.Set(XMailgunMultipartManifest, "W10=")
+	if _, err := s.AuthenticateMultipartRequest(r); err == nil {
+		t.Errorf("AuthenticateMultipartRequest should fail with a forged manifest")
+	}
+
+	// missing manifest
+	r = newMultipartRequest(t, contentType, body)
+	err = s.SignMultipartRequest(r)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SignMultipartRequest: %v", err)
+	}
+	r.Header.Del(XMailgunMultipartManifest)
+	if _, err := s.AuthenticateMultipartRequest(r); err == nil {
+		t.Errorf("AuthenticateMultipartRequest should fail without a manifest")
+	}
+
+	// the body itself is not signed, so a multipart signature is not a
+	// signature of the request
+	r = newMultipartRequest(t, contentType, body)
+	err = s.SignMultipartRequest(r)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SignMultipartRequest: %v", err)
+	}
+	if err := s.AuthenticateRequest(r); err == nil {
+		t.Errorf("AuthenticateRequest should fail for a multipart signature")
+	}
+}
+
+func TestSignMultipartRequestNotMultipart(t *testing.T) {
+	s := newMultipartTestService(t)
+
+	r, err := http.NewRequest("POST", "/upload", strings.NewReader(`{"hello": "world"}`))
+	if err != nil {
+		t.Fatalf("Got unexpected error from http.NewRequest: %v", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	if err := s.SignMultipartRequest(r); err == nil {
+		t.Errorf("SignMultipartRequest should fail for a non-multipart request")
+	}
+}
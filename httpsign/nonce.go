@@ -1,47 +1,255 @@
 package httpsign
 
 import (
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 
+	"github.com/mailgun/metrics"
 	"github.com/mailgun/timetools"
-	"github.com/mailgun/ttlmap"
 )
 
+// ErrNonceReplayed is returned by Insert when the nonce is already in the cache.
+var ErrNonceReplayed = errors.New("nonce already in cache")
+
+// ErrNonceCacheFull is returned by Insert when the cache is full and its
+// overflow policy is OverflowReject.
+var ErrNonceCacheFull = errors.New("nonce cache full")
+
+// OverflowPolicy decides what a NonceCache does with a new nonce when it is
+// already holding capacity nonces that have not expired yet.
+type OverflowPolicy string
+
+const (
+	// OverflowEvict forgets the oldest nonce to make room, which fails open:
+	// the evicted nonce can be replayed until its timestamp expires. This is
+	// the default. Evictions are counted in the nonce_cache.evicted metric.
+	OverflowEvict OverflowPolicy = "evict"
+
+	// OverflowReject refuses the new nonce, which fails closed: requests are
+	// rejected until nonces expire. Counted in nonce_cache.rejected.
+	OverflowReject OverflowPolicy = "reject"
+
+	// OverflowGrow adds another capacity nonces of room, so memory grows with
+	// the request rate. Counted in nonce_cache.grown.
+	OverflowGrow OverflowPolicy = "grow"
+)
+
+// Valid reports if the policy is one NonceCache knows how to apply.
+func (p OverflowPolicy) Valid() bool {
+	switch p {
+	case OverflowEvict, OverflowReject, OverflowGrow:
+		return true
+	}
+	return false
+}
+
 type NonceCache struct {
 	sync.Mutex
-	cache        *ttlmap.TtlMap
-	cacheTTL     int
-	timeProvider timetools.TimeProvider
+	segments      []*nonceSegment
+	capacity      int
+	cacheTTL      int
+	policy        OverflowPolicy
+	evictions     int64
+	lastEvicted   int64 // when the most recently evicted nonce was added
+	newStore      StoreFactory
+	timeProvider  timetools.TimeProvider
+	metricsClient metrics.Client
+}
+
+// nonceSegment is a Store along with the expiry time of every nonce added to
+// it, oldest first. The TTL is the same for every nonce, so this is also the
+// order they expire and are evicted in by the Store.
+type nonceSegment struct {
+	cache    Store
+	capacity int
+	expiries []int64
 }
 
 // Return a new NonceCache. Allows you to control cache capacity, ttl, as well as the TimeProvider.
 func NewNonceCache(capacity int, cacheTTL int, timeProvider timetools.TimeProvider) (*NonceCache, error) {
-	c, err := ttlmap.NewMapWithProvider(capacity, timeProvider)
-	if err != nil {
+	return NewNonceCacheWithPolicy(capacity, cacheTTL, OverflowEvict, timeProvider)
+}
+
+// Return a new NonceCache that applies policy once it is full.
+func NewNonceCacheWithPolicy(capacity int, cacheTTL int, policy OverflowPolicy,
+	timeProvider timetools.TimeProvider) (*NonceCache, error) {
+
+	return NewNonceCacheWithStore(capacity, cacheTTL, policy, NewMemoryStore, timeProvider)
+}
+
+// Return a new NonceCache that keeps nonces in Stores made by newStore, one
+// for every capacity nonces.
+func NewNonceCacheWithStore(capacity int, cacheTTL int, policy OverflowPolicy, newStore StoreFactory,
+	timeProvider timetools.TimeProvider) (*NonceCache, error) {
+
+	if !policy.Valid() {
+		return nil, fmt.Errorf("unsupported overflow policy: %q", policy)
+	}
+
+	n := &NonceCache{
+		capacity:      capacity,
+		cacheTTL:      cacheTTL,
+		policy:        policy,
+		newStore:      newStore,
+		timeProvider:  timeProvider,
+		metricsClient: metrics.NewNop(),
+	}
+	if err := n.grow(); err != nil {
 		return nil, err
 	}
 
-	return &NonceCache{
-		cache:        c,
-		cacheTTL:     cacheTTL,
-		timeProvider: timeProvider,
-	}, nil
+	return n, nil
 }
 
 // InCache checks if a nonce is in the cache. If not, it adds it to the
-// cache and returns false. Otherwise it returns true.
+// cache and returns false. Otherwise it returns true. A nonce that is refused
+// because the cache is full is reported as in the cache.
 func (n *NonceCache) InCache(nonce string) bool {
+	return n.Insert(nonce) != nil
+}
+
+// Insert adds a nonce to the cache. It returns ErrNonceReplayed if the nonce
+// is already in the cache and ErrNonceCacheFull if there is no room for it.
+func (n *NonceCache) Insert(nonce string) error {
 	n.Lock()
 	defer n.Unlock()
 
+	now := n.timeProvider.UtcNow().Unix()
+
 	// check if the nonce is already in the cache
-	_, exists := n.cache.Get(nonce)
-	if exists {
-		return true
+	for _, segment := range n.segments {
+		if _, exists := segment.cache.Get(nonce); exists {
+			return ErrNonceReplayed
+		}
 	}
 
-	// it's not, so let's put it in the cache
-	n.cache.Set(nonce, "", n.cacheTTL)
+	// it's not, so make room for it
+	n.expire(now)
+	current := n.segments[len(n.segments)-1]
+	if len(current.expiries) >= current.capacity {
+		switch n.policy {
+		case OverflowReject:
+			n.metricsClient.Inc("nonce_cache.rejected", 1, 1)
+			return ErrNonceCacheFull
+		case OverflowGrow:
+			if err := n.grow(); err != nil {
+				return err
+			}
+			current = n.segments[len(n.segments)-1]
+			n.metricsClient.Inc("nonce_cache.grown", 1, 1)
+		default:
+			// the store evicts the nonce that expires first, which is the oldest
+			n.lastEvicted = current.expiries[0] - int64(n.cacheTTL)
+			current.expiries = current.expiries[1:]
+			n.evictions++
+			n.metricsClient.Inc("nonce_cache.evicted", 1, 1)
+		}
+	}
 
-	return false
+	// and put it in the cache
+	err := current.cache.Set(nonce, "", n.cacheTTL)
+	if err != nil {
+		return err
+	}
+	current.expiries = append(current.expiries, now+int64(n.cacheTTL))
+	n.metricsClient.Gauge("nonce_cache.occupancy", int64(n.occupancy()), 1)
+	n.metricsClient.Gauge("nonce_cache.replay_window", n.replayWindow(now), 1)
+
+	return nil
+}
+
+// Occupancy returns the number of nonces in the cache that have not expired.
+func (n *NonceCache) Occupancy() int {
+	n.Lock()
+	defer n.Unlock()
+
+	n.expire(n.timeProvider.UtcNow().Unix())
+	return n.occupancy()
+}
+
+// Capacity returns the number of nonces the cache can hold before its
+// overflow policy applies. It only changes when OverflowGrow adds room.
+func (n *NonceCache) Capacity() int {
+	n.Lock()
+	defer n.Unlock()
+
+	capacity := 0
+	for _, segment := range n.segments {
+		capacity += segment.capacity
+	}
+	return capacity
+}
+
+// Evictions returns the number of nonces evicted before they expired.
+func (n *NonceCache) Evictions() int64 {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.evictions
+}
+
+// ReplayWindow returns how far back the cache currently remembers nonces.
+// It is the cache TTL, unless nonces were evicted within the last TTL, in
+// which case requests older than the window may be replayed.
+func (n *NonceCache) ReplayWindow() time.Duration {
+	n.Lock()
+	defer n.Unlock()
+
+	return time.Duration(n.replayWindow(n.timeProvider.UtcNow().Unix())) * time.Second
+}
+
+// replayWindow returns the replay window at now in seconds.
+func (n *NonceCache) replayWindow(now int64) int64 {
+	window := int64(n.cacheTTL)
+	if n.evictions > 0 {
+		if since := now - n.lastEvicted; since < window {
+			window = since
+		}
+	}
+	return window
+}
+
+// expire forgets nonces that have expired, and drops grown segments once
+// everything in them has expired.
+func (n *NonceCache) expire(now int64) {
+	for _, segment := range n.segments {
+		i := 0
+		for i < len(segment.expiries) && segment.expiries[i] <= now {
+			i++
+		}
+		segment.expiries = segment.expiries[i:]
+	}
+
+	// the current segment is always kept
+	segments := n.segments[:0]
+	for i, segment := range n.segments {
+		if len(segment.expiries) > 0 || i == len(n.segments)-1 {
+			segments = append(segments, segment)
+		}
+	}
+	n.segments = segments
+}
+
+func (n *NonceCache) occupancy() int {
+	occupancy := 0
+	for _, segment := range n.segments {
+		occupancy += len(segment.expiries)
+	}
+	return occupancy
+}
+
+// grow adds an empty segment that new nonces are added to.
+func (n *NonceCache) grow() error {
+	c, err := n.newStore(n.capacity, n.timeProvider)
+	if err != nil {
+		return err
+	}
+
+	n.segments = append(n.segments, &nonceSegment{
+		cache:    c,
+		capacity: n.capacity,
+	})
+	return nil
 }
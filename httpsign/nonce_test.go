@@ -2,9 +2,13 @@ package httpsign
 
 import (
 	"fmt"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/metrics"
 	"github.com/mailgun/timetools"
 )
 
@@ -49,3 +53,169 @@ func TestInCache(t *testing.T) {
 		t.Error("Check should be valid, but failed.")
 	}
 }
+
+func TestNonceCacheOverflow(t *testing.T) {
+	var tests = []struct {
+		inPolicy        OverflowPolicy
+		outErr          error // inserting a third nonce
+		outReplayed     bool  // the first nonce is still remembered
+		outOccupancy    int
+		outCapacity     int
+		outEvictions    int64
+		outReplayWindow time.Duration // 3 seconds later
+	}{
+		{OverflowEvict, nil, false, 2, 2, 1, 3 * time.Second},
+		{OverflowReject, ErrNonceCacheFull, true, 2, 2, 0, 10 * time.Second},
+		{OverflowGrow, nil, true, 3, 4, 0, 10 * time.Second},
+	}
+
+	for i, tt := range tests {
+		ftime := &timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)}
+		nc, err := NewNonceCacheWithPolicy(2, 10, tt.inPolicy, ftime)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from NewNonceCacheWithPolicy: %v", i, err)
+			continue
+		}
+
+		// fill the cache
+		for _, nonce := range []string{"0", "1"} {
+			if err := nc.Insert(nonce); err != nil {
+				t.Errorf("[%v] Got unexpected error from Insert: %v", i, err)
+			}
+		}
+		if err := nc.Insert("1"); err != ErrNonceReplayed {
+			t.Errorf("[%v] Insert replayed nonce: Got %v, Want %v", i, err, ErrNonceReplayed)
+		}
+
+		// overflow it
+		if g, w := nc.Insert("2"), tt.outErr; g != w {
+			t.Errorf("[%v] Insert when full: Got %v, Want %v", i, g, w)
+		}
+		if g, w := nc.Occupancy(), tt.outOccupancy; g != w {
+			t.Errorf("[%v] Occupancy: Got %v, Want %v", i, g, w)
+		}
+		if g, w := nc.Capacity(), tt.outCapacity; g != w {
+			t.Errorf("[%v] Capacity: Got %v, Want %v", i, g, w)
+		}
+		if g, w := nc.Evictions(), tt.outEvictions; g != w {
+			t.Errorf("[%v] Evictions: Got %v, Want %v", i, g, w)
+		}
+
+		ftime.CurrentTime = ftime.CurrentTime.Add(3 * time.Second)
+		if g, w := nc.ReplayWindow(), tt.outReplayWindow; g != w {
+			t.Errorf("[%v] ReplayWindow: Got %v, Want %v", i, g, w)
+		}
+		if g, w := nc.InCache("0"), tt.outReplayed; g != w {
+			t.Errorf("[%v] First nonce in cache: Got %v, Want %v", i, g, w)
+		}
+
+		// once everything expires the cache is empty and back to its capacity
+		ftime.CurrentTime = ftime.CurrentTime.Add(20 * time.Second)
+		if err := nc.Insert("3"); err != nil {
+			t.Errorf("[%v] Got unexpected error from Insert: %v", i, err)
+		}
+		if g, w := nc.Occupancy(), 1; g != w {
+			t.Errorf("[%v] Occupancy after expiry: Got %v, Want %v", i, g, w)
+		}
+		if g, w := nc.Capacity(), 2; g != w {
+			t.Errorf("[%v] Capacity after expiry: Got %v, Want %v", i, g, w)
+		}
+		if g, w := nc.ReplayWindow(), 10*time.Second; g != w {
+			t.Errorf("[%v] ReplayWindow after expiry: Got %v, Want %v", i, g, w)
+		}
+	}
+}
+
+func TestNewNonceCacheWithPolicyInvalid(t *testing.T) {
+	ftime := &timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)}
+	if _, err := NewNonceCacheWithPolicy(2, 10, "drop", ftime); err == nil {
+		t.Error("NewNonceCacheWithPolicy accepted an unknown policy.")
+	}
+}
+
+// gaugeMetrics remembers the last value of every gauge.
+type gaugeMetrics struct {
+	metrics.Client
+	gauges map[string]int64
+}
+
+func (g *gaugeMetrics) Gauge(stat interface{}, value int64, rate float32) error {
+	g.gauges[stat.(string)] = value
+	return nil
+}
+
+func TestNonceCacheGauges(t *testing.T) {
+	ftime := &timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)}
+	nc, err := NewNonceCache(2, 10, ftime)
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewNonceCache: %v", err)
+	}
+	mc := &gaugeMetrics{Client: metrics.NewNop(), gauges: map[string]int64{}}
+	nc.metricsClient = mc
+
+	var tests = []struct {
+		inNonce         string
+		inAdvance       time.Duration
+		outOccupancy    int64
+		outReplayWindow int64
+	}{
+		{"0", 0, 1, 10},
+		{"1", 2 * time.Second, 2, 10},
+		// "0" is evicted 4 seconds after it was added
+		{"2", 2 * time.Second, 2, 4},
+		// then "1", 5 seconds after it was added
+		{"3", 3 * time.Second, 2, 5},
+	}
+
+	for i, tt := range tests {
+		ftime.CurrentTime = ftime.CurrentTime.Add(tt.inAdvance)
+		if err := nc.Insert(tt.inNonce); err != nil {
+			t.Errorf("[%v] Got unexpected error from Insert: %v", i, err)
+		}
+		if g, w := mc.gauges["nonce_cache.occupancy"], tt.outOccupancy; g != w {
+			t.Errorf("[%v] nonce_cache.occupancy: Got %v, Want %v", i, g, w)
+		}
+		if g, w := mc.gauges["nonce_cache.replay_window"], tt.outReplayWindow; g != w {
+			t.Errorf("[%v] nonce_cache.replay_window: Got %v, Want %v", i, g, w)
+		}
+	}
+}
+
+func TestAuthenticateRequestNonceCacheFull(t *testing.T) {
+	// setup
+	s, err := NewWithProviders(
+		&Config{
+			KeyBytes:           testKey,
+			NonceCacheCapacity: 1,
+			NonceCacheOverflow: OverflowReject,
+		},
+		&timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)},
+		&random.CSPRNG{},
+	)
+	if err != nil {
+		t.Errorf("Got unexpected error from NewWithProviders: %v", err)
+	}
+	mc := &countingMetrics{Client: metrics.NewNop(), counts: map[string]int64{}}
+	s.nonceCache.metricsClient = mc
+
+	for i, want := range []error{nil, ErrNonceCacheFull} {
+		request, err := http.NewRequest("POST", "", strings.NewReader(`{"hello": "world"}`))
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from http.NewRequest: %v", i, err)
+		}
+		err = s.SignRequest(request)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from SignRequest: %v", i, err)
+		}
+		if g, w := s.AuthenticateRequest(request), want; g != w {
+			t.Errorf("[%v] AuthenticateRequest: Got %v, Want %v", i, g, w)
+		}
+	}
+
+	if g, w := mc.counts["nonce_cache.rejected"], int64(1); g != w {
+		t.Errorf("nonce_cache.rejected: Got %v, Want %v", g, w)
+	}
+	if g, w := s.NonceCache().Occupancy(), 1; g != w {
+		t.Errorf("Occupancy: Got %v, Want %v", g, w)
+	}
+}
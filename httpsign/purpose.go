@@ -0,0 +1,50 @@
+package httpsign
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// purposeInfo prefixes the purpose in the HKDF info so httpsign subkeys never
+// collide with anything else derived from the same master key.
+const purposeInfo = "lemma httpsign purpose:"
+
+// PurposeKeySize is the size in bytes of keys returned by DeriveKey.
+const PurposeKeySize = 32
+
+// DeriveKey derives the subkey used to sign for purpose from a master key
+// with HKDF-SHA256. Signatures made with one purpose's subkey prove nothing
+// about any other purpose, even though both share the master key.
+func DeriveKey(masterKey []byte, purpose string) ([]byte, error) {
+	if purpose == "" {
+		return nil, fmt.Errorf("purpose is required")
+	}
+
+	key := make([]byte, PurposeKeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, masterKey, nil, []byte(purposeInfo+purpose)), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// bindPurpose returns the key and header values to sign with once the
+// configured purpose is applied: the key is replaced by the purpose subkey and
+// the purpose itself is signed ahead of the headers. Without a purpose both
+// are returned unchanged.
+func (s *Service) bindPurpose(secretKey []byte, headerValues []string) ([]byte, []string, error) {
+	if s.config.Purpose == "" {
+		return secretKey, headerValues, nil
+	}
+
+	key, err := DeriveKey(secretKey, s.config.Purpose)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, append([]string{s.config.Purpose}, headerValues...), nil
+}
@@ -0,0 +1,100 @@
+package httpsign
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/timetools"
+)
+
+var _ = fmt.Printf // for testing
+
+func TestDeriveKey(t *testing.T) {
+	var tests = []struct {
+		inPurpose string
+		outKey    string
+	}{
+		{"billing", "51702896ffab26ca365383a51aca0935b8e549e5493ef52ad6bac651fee9c4f4"},
+		{"webhooks", "d783b9df34bc5d27f0c25a6b14f91b6fbe905a40bea38a2b72e02698578c24de"},
+	}
+
+	for i, tt := range tests {
+		key, err := DeriveKey(testKey, tt.inPurpose)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from DeriveKey: %v", i, err)
+		}
+		if g, w := hex.EncodeToString(key), tt.outKey; g != w {
+			t.Errorf("[%v] Key from DeriveKey: Got %s, Want %s", i, g, w)
+		}
+	}
+
+	// a purpose is required
+	if _, err := DeriveKey(testKey, ""); err == nil {
+		t.Errorf("DeriveKey should fail without a purpose")
+	}
+}
+
+func TestAuthenticateRequestPurpose(t *testing.T) {
+	var tests = []struct {
+		inSignPurpose         string
+		inAuthenticatePurpose string
+		outValid              bool
+	}{
+		{"billing", "billing", true},
+		{"billing", "webhooks", false},
+		{"billing", "", false},
+		{"", "billing", false},
+		{"", "", true},
+	}
+
+	for i, tt := range tests {
+		newService := func(purpose string) *Service {
+			s, err := NewWithProviders(
+				&Config{
+					KeyBytes:           testKey,
+					Purpose:            purpose,
+					NonceCacheCapacity: CacheCapacity,
+					NonceCacheTimeout:  CacheTimeout,
+				},
+				&timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)},
+				&random.CSPRNG{},
+			)
+			if err != nil {
+				t.Fatalf("[%v] Got unexpected error from NewWithProviders: %v", i, err)
+			}
+			return s
+		}
+		signer := newService(tt.inSignPurpose)
+		authenticator := newService(tt.inAuthenticatePurpose)
+
+		// requests
+		request, err := http.NewRequest("POST", "", strings.NewReader(`{"hello": "world"}`))
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from http.NewRequest: %v", i, err)
+		}
+		err = signer.SignRequest(request)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from SignRequest: %v", i, err)
+		}
+		err = authenticator.AuthenticateRequest(request)
+		if g, w := err == nil, tt.outValid; g != w {
+			t.Errorf("[%v] Request valid: Got %v, Want %v (%v)", i, g, w, err)
+		}
+
+		// messages
+		body := []byte(`{"hello": "world"}`)
+		envelope, err := signer.SignMessage(body, nil)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from SignMessage: %v", i, err)
+		}
+		err = authenticator.AuthenticateMessage(body, nil, envelope)
+		if g, w := err == nil, tt.outValid; g != w {
+			t.Errorf("[%v] Message valid: Got %v, Want %v (%v)", i, g, w, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package httpsign
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/mailgun/lemma/internal/watch"
+)
+
+// currentKey returns the key requests are signed with.
+func (s *Service) currentKey() []byte {
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+
+	return s.secretKey
+}
+
+// verificationKeys returns the keys requests are authenticated with: the
+// current key, then the previous key while it is within its grace period.
+func (s *Service) verificationKeys() [][]byte {
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+
+	if s.secretKey == nil {
+		return nil
+	}
+	if s.previousKey != nil && s.timeProvider.UtcNow().Before(s.previousExpiry) {
+		return [][]byte{s.secretKey, s.previousKey}
+	}
+	return [][]byte{s.secretKey}
+}
+
+// ReloadKey reads the key from KeyPath (or KeySource) again and, if it
+// changed, starts signing with it. The previous key is still accepted for KeyGracePeriod
+// seconds. If the key can't be read the service keeps the key it has.
+func (s *Service) ReloadKey() (err error) {
+	defer func() {
+		if err == nil {
+			s.metricsClient.Inc("key_reload.success", 1, 1)
+		} else {
+			s.metricsClient.Inc("key_reload.failure", 1, 1)
+		}
+	}()
+
+	if s.config.KeyPath == "" && s.config.KeySource == nil {
+		return fmt.Errorf("no key path or key source to reload from")
+	}
+	keyBytes, err := loadKey(s.config)
+	if err != nil {
+		return err
+	}
+	if len(keyBytes) == 0 {
+		return fmt.Errorf("key is empty")
+	}
+
+	s.keyLock.Lock()
+	defer s.keyLock.Unlock()
+
+	if bytes.Equal(keyBytes, s.secretKey) {
+		return nil
+	}
+	s.previousKey = s.secretKey
+	s.previousExpiry = s.timeProvider.UtcNow().Add(time.Duration(s.config.KeyGracePeriod) * time.Second)
+	s.secretKey = keyBytes
+
+	return nil
+}
+
+// WatchKey checks the modification time of KeyPath every interval and
+// reloads the key when it changes, until the returned function is called.
+// Without a KeyPath the key is reloaded from KeySource every interval.
+// Reload failures are passed to onError, if it is not nil, and the service
+// keeps the key it has.
+func (s *Service) WatchKey(interval time.Duration, onError func(error)) (stop func()) {
+	return watch.File(s.config.KeyPath, interval, s.ReloadKey, onError)
+}
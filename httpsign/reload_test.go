@@ -0,0 +1,168 @@
+package httpsign
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/lemma/keysource"
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/metrics"
+	"github.com/mailgun/timetools"
+)
+
+var _ = fmt.Printf // for testing
+
+func TestReloadKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lemma")
+	if err != nil {
+		t.Fatalf("Got unexpected error from ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "test.key")
+	oldKey, newKey := []byte("old key"), []byte("new key")
+	ioutil.WriteFile(keyPath, oldKey, 0600)
+
+	ftime := &timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)}
+	s, err := NewWithProviders(&Config{KeyPath: keyPath, KeyGracePeriod: 10}, ftime, &random.CSPRNG{})
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewWithProviders: %v", err)
+	}
+	mc := &countingMetrics{Client: metrics.NewNop(), counts: map[string]int64{}}
+	s.metricsClient = mc
+
+	signed := func(key []byte) *http.Request {
+		request, err := http.NewRequest("POST", "", strings.NewReader(`{"hello": "world"}`))
+		if err != nil {
+			t.Fatalf("Got unexpected error from http.NewRequest: %v", err)
+		}
+		if err := s.SignRequestWithKey(request, key); err != nil {
+			t.Fatalf("Got unexpected error from SignRequestWithKey: %v", err)
+		}
+		return request
+	}
+
+	// a failed reload keeps the working key
+	ioutil.WriteFile(keyPath, []byte{}, 0600)
+	if err := s.ReloadKey(); err == nil {
+		t.Errorf("ReloadKey should fail with an empty key file")
+	}
+	if g, w := s.currentKey(), oldKey; !bytes.Equal(g, w) {
+		t.Errorf("Key after failed reload: Got %s, Want %s", g, w)
+	}
+
+	// rotate the key
+	ioutil.WriteFile(keyPath, newKey, 0600)
+	if err := s.ReloadKey(); err != nil {
+		t.Errorf("Got unexpected error from ReloadKey: %v", err)
+	}
+	if g, w := s.currentKey(), newKey; !bytes.Equal(g, w) {
+		t.Errorf("Key after reload: Got %s, Want %s", g, w)
+	}
+
+	// both keys are accepted during the grace period
+	for i, key := range [][]byte{newKey, oldKey} {
+		if err := s.AuthenticateRequest(signed(key)); err != nil {
+			t.Errorf("[%v] Got unexpected error from AuthenticateRequest: %v", i, err)
+		}
+	}
+
+	// only the new key after it
+	ftime.CurrentTime = ftime.CurrentTime.Add(10 * time.Second)
+	if err := s.AuthenticateRequest(signed(newKey)); err != nil {
+		t.Errorf("Got unexpected error from AuthenticateRequest: %v", err)
+	}
+	if err := s.AuthenticateRequest(signed(oldKey)); err == nil {
+		t.Errorf("AuthenticateRequest should reject the old key after the grace period")
+	}
+
+	if g, w := mc.counts["key_reload.failure"], int64(1); g != w {
+		t.Errorf("key_reload.failure: Got %v, Want %v", g, w)
+	}
+	if g, w := mc.counts["key_reload.success"], int64(1); g != w {
+		t.Errorf("key_reload.success: Got %v, Want %v", g, w)
+	}
+}
+
+func TestWatchKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lemma")
+	if err != nil {
+		t.Fatalf("Got unexpected error from ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "test.key")
+	ioutil.WriteFile(keyPath, []byte("old key"), 0600)
+
+	s, err := New(&Config{KeyPath: keyPath})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+
+	errs := make(chan error, 100)
+	stop := s.WatchKey(5*time.Millisecond, func(err error) { errs <- err })
+	defer stop()
+
+	// the new key is picked up
+	ioutil.WriteFile(keyPath, []byte("newer key"), 0600)
+	for i := 0; !bytes.Equal(s.currentKey(), []byte("newer key")); i++ {
+		if i > 200 {
+			t.Fatalf("Key was not reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// a missing key file is reported, and the key is kept
+	os.Remove(keyPath)
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Errorf("Missing key file was not reported")
+	}
+	if g, w := s.currentKey(), []byte("newer key"); !bytes.Equal(g, w) {
+		t.Errorf("Key after failed reload: Got %s, Want %s", g, w)
+	}
+}
+
+func TestReloadKeySource(t *testing.T) {
+	os.Setenv("LEMMA_TEST_KEY", "old key")
+	defer os.Unsetenv("LEMMA_TEST_KEY")
+
+	s, err := New(&Config{KeySource: keysource.NewEnv("LEMMA_TEST_KEY"), KeyGracePeriod: 10})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+	if g, w := s.currentKey(), []byte("old key"); !bytes.Equal(g, w) {
+		t.Errorf("Key: Got %s, Want %s", g, w)
+	}
+
+	// a failed reload keeps the working key
+	os.Unsetenv("LEMMA_TEST_KEY")
+	if err := s.ReloadKey(); err == nil {
+		t.Errorf("ReloadKey should fail with an unset key")
+	}
+
+	os.Setenv("LEMMA_TEST_KEY", "new key")
+	if err := s.ReloadKey(); err != nil {
+		t.Errorf("Got unexpected error from ReloadKey: %v", err)
+	}
+	if g, w := s.currentKey(), []byte("new key"); !bytes.Equal(g, w) {
+		t.Errorf("Key after reload: Got %s, Want %s", g, w)
+	}
+
+	// without a key path the source is polled
+	stop := s.WatchKey(5*time.Millisecond, nil)
+	defer stop()
+	os.Setenv("LEMMA_TEST_KEY", "newer key")
+	for i := 0; !bytes.Equal(s.currentKey(), []byte("newer key")); i++ {
+		if i > 200 {
+			t.Fatalf("Key was not reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
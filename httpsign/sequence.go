@@ -0,0 +1,193 @@
+package httpsign
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mailgun/timetools"
+)
+
+// ErrSequenceReplayed is returned by Insert when the sequence number was
+// already seen from the client, or is too far below the highest one seen to
+// tell.
+var ErrSequenceReplayed = errors.New("sequence number already seen")
+
+// SequenceWindow is how far below the highest sequence number seen from a
+// client a sequence number may be and still be accepted, once, to allow for
+// requests delivered out of order.
+const SequenceWindow = 64
+
+// SequenceCache detects replayed requests from clients that send strictly
+// increasing sequence numbers instead of random nonces. Instead of every
+// nonce it only remembers, per client, the highest sequence number seen and
+// which of the SequenceWindow sequence numbers below it were seen.
+type SequenceCache struct {
+	sync.Mutex
+	store    Store
+	cacheTTL int
+}
+
+// sequenceWindow is the state kept for a client. Bit i of Seen is set if
+// High-1-i was seen.
+type sequenceWindow struct {
+	High uint64
+	Seen uint64
+}
+
+// sequenceWindowLength is the length of an encoded sequenceWindow: High and
+// Seen, big-endian.
+const sequenceWindowLength = 16
+
+// encode returns the window as it is kept in the Store: hex, so it survives
+// Stores that serialize their values.
+func (w sequenceWindow) encode() string {
+	var b [sequenceWindowLength]byte
+	binary.BigEndian.PutUint64(b[:8], w.High)
+	binary.BigEndian.PutUint64(b[8:], w.Seen)
+	return hex.EncodeToString(b[:])
+}
+
+// decodeSequenceWindow parses a window read from the Store. Stores may give
+// back the string Insert set, or its bytes.
+func decodeSequenceWindow(value interface{}) (sequenceWindow, error) {
+	var encoded string
+	switch v := value.(type) {
+	case string:
+		encoded = v
+	case []byte:
+		encoded = string(v)
+	default:
+		return sequenceWindow{}, fmt.Errorf("unexpected sequence window type in store: %T", value)
+	}
+
+	b, err := hex.DecodeString(encoded)
+	if err != nil || len(b) != sequenceWindowLength {
+		return sequenceWindow{}, fmt.Errorf("invalid sequence window in store: %q", encoded)
+	}
+	return sequenceWindow{
+		High: binary.BigEndian.Uint64(b[:8]),
+		Seen: binary.BigEndian.Uint64(b[8:]),
+	}, nil
+}
+
+// Return a new SequenceCache that tracks up to capacity clients, each for
+// cacheTTL seconds after its last request.
+func NewSequenceCache(capacity int, cacheTTL int, newStore StoreFactory,
+	timeProvider timetools.TimeProvider) (*SequenceCache, error) {
+
+	store, err := newStore(capacity, timeProvider)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SequenceCache{
+		store:    store,
+		cacheTTL: cacheTTL,
+	}, nil
+}
+
+// Insert records that clientID sent sequence. It returns ErrSequenceReplayed
+// if sequence was already seen from the client, or is more than
+// SequenceWindow below the highest one seen.
+func (c *SequenceCache) Insert(clientID string, sequence uint64) error {
+	c.Lock()
+	defer c.Unlock()
+
+	var window sequenceWindow
+	value, exists := c.store.Get(clientID)
+	if exists {
+		var err error
+		if window, err = decodeSequenceWindow(value); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case !exists:
+		window = sequenceWindow{High: sequence}
+	case sequence > window.High:
+		// slide the window up, the old high is now shift-1 below
+		shift := sequence - window.High
+		if shift > SequenceWindow {
+			window.Seen = 0
+		} else {
+			window.Seen = window.Seen<<shift | 1<<(shift-1)
+		}
+		window.High = sequence
+	case sequence == window.High:
+		return ErrSequenceReplayed
+	default:
+		offset := window.High - sequence - 1
+		if offset >= SequenceWindow || window.Seen&(1<<offset) != 0 {
+			return ErrSequenceReplayed
+		}
+		window.Seen |= 1 << offset
+	}
+
+	return c.store.Set(clientID, window.encode(), c.cacheTTL)
+}
+
+// nextSequence returns the sequence number for the next signed request. It
+// starts at the time of the first request in nanoseconds, so it keeps
+// increasing across restarts, and goes up by one with every request.
+func (s *Service) nextSequence() uint64 {
+	s.sequenceLock.Lock()
+	defer s.sequenceLock.Unlock()
+
+	if s.sequence == 0 {
+		s.sequence = uint64(s.timeProvider.UtcNow().UnixNano())
+	}
+	s.sequence++
+
+	return s.sequence
+}
+
+// newNonce returns the nonce for the next signed request: the client ID and
+// a sequence number if ClientID is set, otherwise 128 random bits.
+func (s *Service) newNonce() (string, error) {
+	if s.config.ClientID != "" {
+		return s.config.ClientID + ":" + strconv.FormatUint(s.nextSequence(), 10), nil
+	}
+
+	// get 128-bit random number from /dev/urandom and base16 encode it
+	nonce, err := s.randomProvider.HexDigest(16)
+	if err != nil {
+		return "", fmt.Errorf("unable to get random : %v", err)
+	}
+	return nonce, nil
+}
+
+// checkNonce checks that the nonce of a request has not been seen before.
+// Random nonces are hex, so a nonce with a colon is a client ID and sequence
+// number.
+func (s *Service) checkNonce(nonce string) error {
+	i := strings.LastIndex(nonce, ":")
+	if i < 0 {
+		err := s.nonceCache.Insert(nonce)
+		if err == ErrNonceReplayed {
+			return fmt.Errorf("nonce already in cache: %v", nonce)
+		}
+		return err
+	}
+
+	sequence, err := strconv.ParseUint(nonce[i+1:], 10, 64)
+	if i == 0 || err != nil {
+		return fmt.Errorf("invalid sequence number: %v", nonce)
+	}
+	err = s.sequenceCache.Insert(nonce[:i], sequence)
+	if err == ErrSequenceReplayed {
+		return fmt.Errorf("sequence number already seen: %v", nonce)
+	}
+	return err
+}
+
+// SequenceCache returns the sequence windows of the clients seen by the
+// service.
+func (s *Service) SequenceCache() *SequenceCache {
+	return s.sequenceCache
+}
@@ -0,0 +1,217 @@
+package httpsign
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/timetools"
+)
+
+var _ = fmt.Printf // for testing
+
+func TestSequenceCacheInsert(t *testing.T) {
+	ftime := &timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)}
+	sc, err := NewSequenceCache(100, 10, NewMemoryStore, ftime)
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewSequenceCache: %v", err)
+	}
+
+	var tests = []struct {
+		inClientID string
+		inSequence uint64
+		outErr     error
+	}{
+		{"a", 1000, nil},
+		{"a", 1000, ErrSequenceReplayed}, // replayed high
+		{"a", 1001, nil},
+		{"a", 1003, nil},
+		{"a", 1002, nil},                 // out of order
+		{"a", 1002, ErrSequenceReplayed}, // replayed out of order
+		{"a", 1001, ErrSequenceReplayed}, // replayed below high
+		{"a", 999, nil},                  // before the first, but within the window
+		{"a", 1003 - SequenceWindow, nil},
+		{"a", 1002 - SequenceWindow, ErrSequenceReplayed}, // below the window
+		{"b", 1000, nil},                                  // clients are independent
+		{"a", 1003 + SequenceWindow, nil},
+		{"a", 1003, ErrSequenceReplayed}, // still remembered at the bottom of the window
+		{"a", 1002, ErrSequenceReplayed}, // the window slid past it
+		{"a", 1005, nil},                 // not seen, and within the window
+		{"a", 2000, nil},                 // a jump clears the window
+		{"a", 1999, nil},
+		{"a", 1003 + SequenceWindow, ErrSequenceReplayed},
+	}
+
+	for i, tt := range tests {
+		err := sc.Insert(tt.inClientID, tt.inSequence)
+		if err != tt.outErr {
+			t.Errorf("[%v] Insert(%v, %v): Got %v, Want %v", i, tt.inClientID, tt.inSequence, err, tt.outErr)
+		}
+	}
+
+	// clients are forgotten once their requests would have expired
+	ftime.CurrentTime = ftime.CurrentTime.Add(10 * time.Second)
+	if err := sc.Insert("a", 1000); err != nil {
+		t.Errorf("Got unexpected error from Insert after expiry: %v", err)
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	ftime := &timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)}
+
+	// setup a client that signs with sequence numbers
+	client, err := NewWithProviders(&Config{KeyBytes: testKey, ClientID: "client-1"}, ftime, &random.FakeRNG{})
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewWithProviders: %v", err)
+	}
+	server, err := NewWithProviders(&Config{KeyBytes: testKey}, ftime, &random.FakeRNG{})
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewWithProviders: %v", err)
+	}
+
+	signed := func() *http.Request {
+		request, err := http.NewRequest("POST", "", strings.NewReader(`{"hello": "world"}`))
+		if err != nil {
+			t.Fatalf("Got unexpected error from http.NewRequest: %v", err)
+		}
+		if err := client.SignRequest(request); err != nil {
+			t.Fatalf("Got unexpected error from SignRequest: %v", err)
+		}
+		return request
+	}
+
+	// sequence numbers start at the time of the first request and count up
+	first, second := signed(), signed()
+	if g, w := first.Header.Get(XMailgunNonce), "client-1:1330837567000000001"; g != w {
+		t.Errorf("Nonce: Got %v, Want %v", g, w)
+	}
+	if g, w := second.Header.Get(XMailgunNonce), "client-1:1330837567000000002"; g != w {
+		t.Errorf("Nonce: Got %v, Want %v", g, w)
+	}
+
+	// out of order delivery is fine, replays are not
+	for i, tt := range []struct {
+		inRequest *http.Request
+		outErr    bool
+	}{
+		{second, false},
+		{first, false},
+		{first, true},
+		{second, true},
+	} {
+		err := server.AuthenticateRequest(tt.inRequest)
+		if g, w := err != nil, tt.outErr; g != w {
+			t.Errorf("[%v] AuthenticateRequest failed: Got %v, Want %v (%v)", i, g, w, err)
+		}
+	}
+
+	// random nonces are still accepted
+	randomClient, err := NewWithProviders(&Config{KeyBytes: testKey}, ftime, &random.FakeRNG{})
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewWithProviders: %v", err)
+	}
+	request, _ := http.NewRequest("POST", "", strings.NewReader(`{"hello": "world"}`))
+	randomClient.SignRequest(request)
+	if err := server.AuthenticateRequest(request); err != nil {
+		t.Errorf("Got unexpected error from AuthenticateRequest: %v", err)
+	}
+}
+
+func TestCheckNonceInvalidSequence(t *testing.T) {
+	s, err := New(&Config{KeyBytes: testKey})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+
+	for i, nonce := range []string{":1", "client-1:", "client-1:abc", "client-1:-1"} {
+		if err := s.checkNonce(nonce); err == nil {
+			t.Errorf("[%v] checkNonce(%q) should have failed", i, nonce)
+		}
+	}
+}
+
+// jsonStore is a Store that keeps its values as JSON, like a Store backed by
+// a database or a cache server would.
+type jsonStore struct {
+	Store
+}
+
+func (j *jsonStore) Get(key string) (interface{}, bool) {
+	value, exists := j.Store.Get(key)
+	if !exists {
+		return nil, false
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(value.([]byte), &decoded); err != nil {
+		return nil, false
+	}
+	return decoded, true
+}
+
+func (j *jsonStore) Set(key string, value interface{}, ttlSeconds int) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return j.Store.Set(key, encoded, ttlSeconds)
+}
+
+// fixedStore is a Store that always returns value.
+type fixedStore struct {
+	Store
+	value interface{}
+}
+
+func (f *fixedStore) Get(key string) (interface{}, bool) {
+	return f.value, true
+}
+
+func TestSequenceCacheStore(t *testing.T) {
+	ftime := &timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)}
+	newJSONStore := func(capacity int, timeProvider timetools.TimeProvider) (Store, error) {
+		store, err := NewMemoryStore(capacity, timeProvider)
+		return &jsonStore{Store: store}, err
+	}
+	sc, err := NewSequenceCache(100, 10, newJSONStore, ftime)
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewSequenceCache: %v", err)
+	}
+
+	// windows survive a store that serializes them
+	var tests = []struct {
+		inSequence uint64
+		outErr     error
+	}{
+		{5, nil},
+		{5, ErrSequenceReplayed},
+		{5, ErrSequenceReplayed},
+		{7, nil},
+		{6, nil},
+		{6, ErrSequenceReplayed},
+		{5, ErrSequenceReplayed},
+	}
+	for i, tt := range tests {
+		if err := sc.Insert("a", tt.inSequence); err != tt.outErr {
+			t.Errorf("[%v] Insert(a, %v): Got %v, Want %v", i, tt.inSequence, err, tt.outErr)
+		}
+	}
+
+	// a value the cache didn't set is an error, not an empty window
+	for i, value := range []interface{}{nil, 42, "", "not hex", []byte("00")} {
+		newStore := func(capacity int, timeProvider timetools.TimeProvider) (Store, error) {
+			store, err := NewMemoryStore(capacity, timeProvider)
+			return &fixedStore{Store: store, value: value}, err
+		}
+		sc, err := NewSequenceCache(100, 10, newStore, ftime)
+		if err != nil {
+			t.Fatalf("Got unexpected error from NewSequenceCache: %v", err)
+		}
+		if err := sc.Insert("a", 5); err == nil || err == ErrSequenceReplayed {
+			t.Errorf("[%v] Insert with %#v in the store: Got %v, Want an error", i, value, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package httpsign
+
+import (
+	"sync"
+	"time"
+)
+
+// SkewEstimator learns how far the local clock is from the clock of the
+// services being called, so signed timestamps can be corrected instead of
+// being rejected until someone fixes the local clock.
+type SkewEstimator struct {
+	sync.Mutex
+	offset        time.Duration
+	maxCorrection time.Duration
+}
+
+// Return a new SkewEstimator that never corrects the clock by more than
+// maxCorrection in either direction.
+func NewSkewEstimator(maxCorrection time.Duration) *SkewEstimator {
+	return &SkewEstimator{
+		maxCorrection: maxCorrection,
+	}
+}
+
+// Observe records the time on the remote clock at local time now. Remote
+// clocks (like the HTTP Date header) only have second resolution, so
+// differences of less than a second are ignored.
+func (e *SkewEstimator) Observe(now time.Time, remote time.Time) {
+	offset := remote.Sub(now.Truncate(time.Second))
+	if offset > -time.Second && offset < time.Second {
+		offset = 0
+	}
+
+	// bound the correction
+	if offset > e.maxCorrection {
+		offset = e.maxCorrection
+	}
+	if offset < -e.maxCorrection {
+		offset = -e.maxCorrection
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	e.offset = offset
+}
+
+// Offset returns the correction to add to the local clock.
+func (e *SkewEstimator) Offset() time.Duration {
+	e.Lock()
+	defer e.Unlock()
+	return e.offset
+}
@@ -0,0 +1,89 @@
+package httpsign
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/timetools"
+)
+
+var _ = fmt.Printf // for testing
+
+func TestSkewEstimator(t *testing.T) {
+	e := NewSkewEstimator(60 * time.Second)
+	now := time.Unix(1330837567, 900000000)
+
+	var skewtests = []struct {
+		inRemote  time.Time
+		outOffset time.Duration
+	}{
+		// same second, just truncated by the remote clock
+		{time.Unix(1330837567, 0), 0},
+		// remote clock 10 seconds ahead
+		{time.Unix(1330837577, 0), 10 * time.Second},
+		// remote clock 30 seconds behind
+		{time.Unix(1330837537, 0), -30 * time.Second},
+		// corrections are bounded
+		{time.Unix(1330838567, 0), 60 * time.Second},
+		{time.Unix(1330836567, 0), -60 * time.Second},
+	}
+
+	for i, tt := range skewtests {
+		e.Observe(now, tt.inRemote)
+		if g, w := e.Offset(), tt.outOffset; g != w {
+			t.Errorf("[%v] Offset: Got %v, Want %v", i, g, w)
+		}
+	}
+}
+
+func TestSignRequestSkewCorrection(t *testing.T) {
+	ftime := &timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)}
+
+	s, err := NewWithProviders(
+		&Config{
+			KeyBytes:          testKey,
+			MaxSkewCorrection: 60,
+		},
+		ftime,
+		&random.FakeRNG{},
+	)
+	if err != nil {
+		t.Errorf("Got unexpected error from NewWithProviders: %v", err)
+	}
+
+	// server clock is 20 seconds ahead
+	s.ObserveServerTime(time.Unix(1330837587, 0))
+
+	request, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Errorf("Got unexpected error from http.NewRequest: %v", err)
+	}
+	err = s.SignRequest(request)
+	if err != nil {
+		t.Errorf("Got unexpected error from SignRequest: %v", err)
+	}
+
+	if g, w := request.Header.Get(XMailgunTimestamp), "1330837587"; g != w {
+		t.Errorf("Timestamp from SignRequest: Got %s, Want %s", g, w)
+	}
+}
+
+func TestObserveServerTimeDisabled(t *testing.T) {
+	s, err := NewWithProviders(
+		&Config{KeyBytes: testKey},
+		&timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)},
+		&random.FakeRNG{},
+	)
+	if err != nil {
+		t.Errorf("Got unexpected error from NewWithProviders: %v", err)
+	}
+
+	// without MaxSkewCorrection the clock is never corrected
+	s.ObserveServerTime(time.Unix(1330837587, 0))
+	if g, w := s.signingTime(), time.Unix(1330837567, 0); !g.Equal(w) {
+		t.Errorf("signingTime: Got %v, Want %v", g, w)
+	}
+}
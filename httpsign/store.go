@@ -0,0 +1,29 @@
+package httpsign
+
+import (
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+)
+
+// Store holds the state used to detect replayed requests: the nonces seen by
+// a NonceCache and the sequence windows of a SequenceCache. Entries are
+// forgotten ttlSeconds after they are last set. When a Store is full, Set
+// makes room by forgetting the entry that expires first, like a ttlmap does.
+// Values set are always strings, so a Store may serialize them.
+type Store interface {
+	Get(key string) (interface{}, bool)
+	Set(key string, value interface{}, ttlSeconds int) error
+}
+
+// StoreFactory returns a Store with room for capacity entries.
+type StoreFactory func(capacity int, timeProvider timetools.TimeProvider) (Store, error)
+
+// NewMemoryStore returns an in-memory Store backed by a ttlmap. It is the
+// default StoreFactory.
+func NewMemoryStore(capacity int, timeProvider timetools.TimeProvider) (Store, error) {
+	m, err := ttlmap.NewMapWithProvider(capacity, timeProvider)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,58 @@
+package httpsign
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/timetools"
+)
+
+var _ = fmt.Printf // for testing
+
+// recordingStore is a Store that remembers the keys set on it.
+type recordingStore struct {
+	Store
+	keys *[]string
+}
+
+func (r *recordingStore) Set(key string, value interface{}, ttlSeconds int) error {
+	*r.keys = append(*r.keys, key)
+	return r.Store.Set(key, value, ttlSeconds)
+}
+
+func TestReplayStore(t *testing.T) {
+	var keys []string
+	newStore := func(capacity int, timeProvider timetools.TimeProvider) (Store, error) {
+		store, err := NewMemoryStore(capacity, timeProvider)
+		return &recordingStore{Store: store, keys: &keys}, err
+	}
+
+	ftime := &timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)}
+	s, err := NewWithProviders(&Config{KeyBytes: testKey, ReplayStore: newStore}, ftime, &random.FakeRNG{})
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewWithProviders: %v", err)
+	}
+
+	// both nonces and sequence windows are kept in the store
+	sc, err := NewWithProviders(&Config{KeyBytes: testKey, ClientID: "client-1"}, ftime, &random.FakeRNG{})
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewWithProviders: %v", err)
+	}
+	for _, signer := range []*Service{s, sc} {
+		request, _ := http.NewRequest("POST", "", strings.NewReader(`{"hello": "world"}`))
+		if err := signer.SignRequest(request); err != nil {
+			t.Errorf("Got unexpected error from SignRequest: %v", err)
+		}
+		if err := s.AuthenticateRequest(request); err != nil {
+			t.Errorf("Got unexpected error from AuthenticateRequest: %v", err)
+		}
+	}
+
+	if g, w := strings.Join(keys, ","), "000102030405060708090a0b0c0d0e0f,client-1"; g != w {
+		t.Errorf("Keys stored: Got %v, Want %v", g, w)
+	}
+}
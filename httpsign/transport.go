@@ -0,0 +1,86 @@
+package httpsign
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+)
+
+// Transport is an http.RoundTripper that signs every request it sends with
+// Service. If the service has MaxSkewCorrection set, the transport learns the
+// clock skew from the Date header of every response, and retries a request
+// once if it was rejected because its timestamp was outside of the window of
+// the server's clock.
+type Transport struct {
+	Service *Service
+
+	// Base is used to send the signed requests, default: http.DefaultTransport
+	Base http.RoundTripper
+}
+
+// RoundTrip signs and sends a copy of the request, it does not modify r.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// read the body once so it can be sent again if the request is retried
+	var bodyBytes []byte
+	if r.Body != nil {
+		var err error
+		bodyBytes, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp, timestamp, err := t.send(r, bodyBytes)
+	if err != nil || t.Service.skew == nil {
+		return resp, err
+	}
+
+	// learn from the server's clock
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return resp, nil
+	}
+	t.Service.ObserveServerTime(serverTime)
+
+	// retry once if the timestamp is what the server rejected
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	if isValid, _ := t.Service.checkTimestampAt(timestamp, serverTime.Unix()); isValid {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	resp, _, err = t.send(r, bodyBytes)
+	return resp, err
+}
+
+// send signs a fresh copy of the request and sends it, returning the response
+// and the timestamp it was signed with.
+func (t *Transport) send(r *http.Request, bodyBytes []byte) (*http.Response, string, error) {
+	signed := r.Clone(r.Context())
+	if r.Body != nil {
+		signed.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+		signed.ContentLength = int64(len(bodyBytes))
+	}
+
+	err := t.Service.SignRequest(signed)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := t.base().RoundTrip(signed)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return resp, signed.Header.Get(t.Service.config.TimestampHeaderName), nil
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+	return t.Base
+}
@@ -0,0 +1,187 @@
+package httpsign
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/timetools"
+)
+
+var _ = fmt.Printf // for testing
+
+// newSkewedServer returns a server that authenticates requests against a clock
+// that is offset seconds away from 1330837567 and reports it in its Date header.
+func newSkewedServer(t *testing.T, offset int64, calls *int) *httptest.Server {
+	serverTime := time.Unix(1330837567+offset, 0)
+
+	s, err := NewWithProviders(
+		&Config{KeyBytes: testKey},
+		&timetools.FreezedTime{CurrentTime: serverTime},
+		&random.CSPRNG{},
+	)
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewWithProviders: %v", err)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		w.Header().Set("Date", serverTime.UTC().Format(http.TimeFormat))
+
+		err := s.AuthenticateRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprint(w, string(body))
+	}))
+}
+
+func TestTransport(t *testing.T) {
+	var calls int
+	ts := newSkewedServer(t, 0, &calls)
+	defer ts.Close()
+
+	s, err := NewWithProviders(
+		&Config{KeyBytes: testKey},
+		&timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)},
+		&random.CSPRNG{},
+	)
+	if err != nil {
+		t.Errorf("Got unexpected error from NewWithProviders: %v", err)
+	}
+
+	request, err := http.NewRequest("POST", ts.URL, strings.NewReader(`{"hello": "world"}`))
+	if err != nil {
+		t.Errorf("Got unexpected error from http.NewRequest: %v", err)
+	}
+
+	client := &http.Client{Transport: &Transport{Service: s}}
+	resp, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("Got unexpected error from client.Do: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if g, w := resp.StatusCode, http.StatusOK; g != w {
+		t.Errorf("StatusCode: Got %v, Want %v: %s", g, w, body)
+	}
+	if g, w := string(body), `{"hello": "world"}`; g != w {
+		t.Errorf("Body: Got %v, Want %v", g, w)
+	}
+
+	// the caller's request is left alone
+	if request.Header.Get(XMailgunSignature) != "" {
+		t.Error("Transport modified the original request.")
+	}
+}
+
+func TestTransportSkewRetry(t *testing.T) {
+	var calls int
+
+	// server clock is 200 seconds ahead, so our timestamps are too old
+	ts := newSkewedServer(t, 200, &calls)
+	defer ts.Close()
+
+	s, err := NewWithProviders(
+		&Config{
+			KeyBytes:          testKey,
+			MaxSkewCorrection: 300,
+		},
+		&timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)},
+		&random.CSPRNG{},
+	)
+	if err != nil {
+		t.Errorf("Got unexpected error from NewWithProviders: %v", err)
+	}
+	client := &http.Client{Transport: &Transport{Service: s}}
+
+	request, err := http.NewRequest("POST", ts.URL, strings.NewReader(`{"hello": "world"}`))
+	if err != nil {
+		t.Errorf("Got unexpected error from http.NewRequest: %v", err)
+	}
+
+	// first request is rejected, learned from, and retried
+	resp, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("Got unexpected error from client.Do: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if g, w := resp.StatusCode, http.StatusOK; g != w {
+		t.Errorf("StatusCode: Got %v, Want %v: %s", g, w, body)
+	}
+	if g, w := string(body), `{"hello": "world"}`; g != w {
+		t.Errorf("Body: Got %v, Want %v", g, w)
+	}
+	if g, w := calls, 2; g != w {
+		t.Errorf("Calls: Got %v, Want %v", g, w)
+	}
+
+	// later requests are signed with the corrected clock right away
+	request, err = http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Errorf("Got unexpected error from http.NewRequest: %v", err)
+	}
+	resp, err = client.Do(request)
+	if err != nil {
+		t.Fatalf("Got unexpected error from client.Do: %v", err)
+	}
+	resp.Body.Close()
+
+	if g, w := resp.StatusCode, http.StatusOK; g != w {
+		t.Errorf("StatusCode: Got %v, Want %v", g, w)
+	}
+	if g, w := calls, 3; g != w {
+		t.Errorf("Calls: Got %v, Want %v", g, w)
+	}
+}
+
+func TestTransportSkewBeyondCorrection(t *testing.T) {
+	var calls int
+
+	// server clock is further ahead than we are willing to correct
+	ts := newSkewedServer(t, 200, &calls)
+	defer ts.Close()
+
+	s, err := NewWithProviders(
+		&Config{
+			KeyBytes:          testKey,
+			MaxSkewCorrection: 30,
+		},
+		&timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)},
+		&random.CSPRNG{},
+	)
+	if err != nil {
+		t.Errorf("Got unexpected error from NewWithProviders: %v", err)
+	}
+	client := &http.Client{Transport: &Transport{Service: s}}
+
+	request, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Errorf("Got unexpected error from http.NewRequest: %v", err)
+	}
+
+	// retried once, then the rejection is returned
+	resp, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("Got unexpected error from client.Do: %v", err)
+	}
+	resp.Body.Close()
+
+	if g, w := resp.StatusCode, http.StatusUnauthorized; g != w {
+		t.Errorf("StatusCode: Got %v, Want %v", g, w)
+	}
+	if g, w := calls, 2; g != w {
+		t.Errorf("Calls: Got %v, Want %v", g, w)
+	}
+}
@@ -0,0 +1,143 @@
+package httpsign
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/timetools"
+)
+
+// vectorsPath is the cross-language test vector suite, see tools/lemmavectors.
+const vectorsPath = "../testdata/vectors-v1.json"
+
+type httpsignVector struct {
+	Name             string            `json:"name"`
+	Key              []byte            `json:"key"`
+	SignVerbAndURI   bool              `json:"sign_verb_and_uri"`
+	HeadersToSign    []string          `json:"headers_to_sign"`
+	Method           string            `json:"method"`
+	URI              string            `json:"uri"`
+	Headers          map[string]string `json:"headers"`
+	Body             []byte            `json:"body"`
+	Timestamp        string            `json:"timestamp"`
+	Nonce            string            `json:"nonce"`
+	Signature        string            `json:"signature"`
+	SignatureVersion string            `json:"signature_version"`
+	Algorithm        string            `json:"algorithm"`
+	Purpose          string            `json:"purpose"`
+}
+
+func readVectors(t *testing.T) []httpsignVector {
+	b, err := ioutil.ReadFile(vectorsPath)
+	if err != nil {
+		t.Fatalf("Unable to read test vectors: %v", err)
+	}
+
+	var vectors struct {
+		Version         int              `json:"version"`
+		HTTPSign        []httpsignVector `json:"httpsign"`
+		HTTPSignOptions []httpsignVector `json:"httpsign_options"`
+	}
+	err = json.Unmarshal(b, &vectors)
+	if err != nil {
+		t.Fatalf("Unable to parse test vectors: %v", err)
+	}
+	if vectors.Version != 1 {
+		t.Fatalf("Unexpected test vectors version: %v", vectors.Version)
+	}
+	if len(vectors.HTTPSign) == 0 || len(vectors.HTTPSignOptions) == 0 {
+		t.Fatal("No httpsign test vectors found")
+	}
+
+	return append(vectors.HTTPSign, vectors.HTTPSignOptions...)
+}
+
+// algorithm returns the algorithm the vector was signed with.
+func (v httpsignVector) algorithm() Algorithm {
+	if v.Algorithm == "" {
+		return HMACSHA256
+	}
+	return Algorithm(v.Algorithm)
+}
+
+func TestVectorsComputeMAC(t *testing.T) {
+	for _, v := range readVectors(t) {
+		headerValues := make([]string, len(v.HeadersToSign))
+		for i, name := range v.HeadersToSign {
+			headerValues[i] = v.Headers[name]
+		}
+
+		// a purpose signs with its subkey, and ahead of the headers
+		key := v.Key
+		if v.Purpose != "" {
+			var err error
+			if key, err = DeriveKey(v.Key, v.Purpose); err != nil {
+				t.Errorf("[%v] Got unexpected error from DeriveKey: %v", v.Name, err)
+				continue
+			}
+			headerValues = append([]string{v.Purpose}, headerValues...)
+		}
+
+		computedMAC, err := computeMAC(v.algorithm(), key, v.SignVerbAndURI, v.Method, v.URI, v.Timestamp, v.Nonce, v.Body, headerValues)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from computeMAC: %v", v.Name, err)
+		}
+		if g, w := hex.EncodeToString(computedMAC), v.Signature; g != w {
+			t.Errorf("[%v] Signature: Got %s, Want %s", v.Name, g, w)
+		}
+		if g, w := v.SignatureVersion, v.algorithm().SignatureVersion(); g != w {
+			t.Errorf("[%v] SignatureVersion: Got %s, Want %s", v.Name, g, w)
+		}
+	}
+}
+
+func TestVectorsAuthenticateRequest(t *testing.T) {
+	for _, v := range readVectors(t) {
+		timestamp, err := strconv.ParseInt(v.Timestamp, 10, 64)
+		if err != nil {
+			t.Errorf("[%v] Unable to parse timestamp: %v", v.Name, err)
+			continue
+		}
+
+		s, err := NewWithProviders(
+			&Config{
+				KeyBytes:       v.Key,
+				Algorithm:      v.algorithm(),
+				Purpose:        v.Purpose,
+				HeadersToSign:  v.HeadersToSign,
+				SignVerbAndURI: v.SignVerbAndURI,
+			},
+			&timetools.FreezedTime{CurrentTime: time.Unix(timestamp, 0)},
+			&random.FakeRNG{},
+		)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from NewWithProviders: %v", v.Name, err)
+			continue
+		}
+
+		request, err := http.NewRequest(v.Method, "http://localhost"+v.URI, bytes.NewReader(v.Body))
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from http.NewRequest: %v", v.Name, err)
+			continue
+		}
+		for name, value := range v.Headers {
+			request.Header.Set(name, value)
+		}
+		request.Header.Set(XMailgunTimestamp, v.Timestamp)
+		request.Header.Set(XMailgunNonce, v.Nonce)
+		request.Header.Set(XMailgunSignature, v.Signature)
+		request.Header.Set(XMailgunSignatureVersion, v.SignatureVersion)
+
+		err = s.AuthenticateRequest(request)
+		if err != nil {
+			t.Errorf("[%v] AuthenticateRequest failed to authenticate a test vector: %v", v.Name, err)
+		}
+	}
+}
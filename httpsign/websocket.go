@@ -0,0 +1,235 @@
+package httpsign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// HKDF info for the session keys of each direction, so a frame can't be
+// reflected back to the side that sent it.
+const clientToServerInfo = "lemma httpsign websocket client to server"
+const serverToClientInfo = "lemma httpsign websocket server to client"
+
+// sequenceSize is the size of the sequence number that prefixes every frame.
+const sequenceSize = 8
+
+// Session signs and authenticates the messages of a single WebSocket
+// connection. Its keys are derived from the key and nonce of the signed
+// upgrade request, so they are unique to the connection. Every message carries
+// a sequence number and must arrive in order exactly once.
+type Session struct {
+	algorithm Algorithm
+
+	sendLock sync.Mutex
+	sendKey  []byte
+	sendSeq  uint64
+
+	receiveLock sync.Mutex
+	receiveKey  []byte
+	receiveSeq  uint64
+}
+
+// NewClientSession returns the client side of the session for a connection
+// opened with r, an upgrade request already signed with SignRequest.
+func (s *Service) NewClientSession(r *http.Request) (*Session, error) {
+	secretKey := s.currentKey()
+	if secretKey == nil {
+		return nil, fmt.Errorf("service not loaded with key.")
+	}
+	return s.NewClientSessionWithKey(r, secretKey)
+}
+
+// NewClientSessionWithKey returns the client side of the session with the
+// passed in key, not the one initialized with.
+func (s *Service) NewClientSessionWithKey(r *http.Request, secretKey []byte) (*Session, error) {
+	nonce := r.Header.Get(s.config.NonceHeaderName)
+	if nonce == "" {
+		return nil, fmt.Errorf("header not found: %v", s.config.NonceHeaderName)
+	}
+
+	return s.newSession(s.config.Algorithm, secretKey, nonce, clientToServerInfo, serverToClientInfo)
+}
+
+// AuthenticateUpgradeRequest authenticates a WebSocket upgrade request and
+// returns the server side of the session for the connection.
+func (s *Service) AuthenticateUpgradeRequest(r *http.Request) (*Session, error) {
+	secretKeys := s.verificationKeys()
+	if len(secretKeys) == 0 {
+		return nil, fmt.Errorf("service not loaded with key.")
+	}
+	return s.authenticateUpgradeRequest(r, secretKeys)
+}
+
+// AuthenticateUpgradeRequestWithKey authenticates a WebSocket upgrade request
+// with the passed in key, not the one initialized with.
+func (s *Service) AuthenticateUpgradeRequestWithKey(r *http.Request, secretKey []byte) (*Session, error) {
+	return s.authenticateUpgradeRequest(r, [][]byte{secretKey})
+}
+
+// authenticateUpgradeRequest derives the session from whichever of
+// secretKeys the upgrade request was signed with.
+func (s *Service) authenticateUpgradeRequest(r *http.Request, secretKeys [][]byte) (*Session, error) {
+	secretKey, err := s.authenticateRequest(r, secretKeys, readBody)
+	if err != nil {
+		return nil, err
+	}
+
+	// the version was checked by authenticateRequest
+	version := r.Header.Get(s.config.SignatureVersionHeaderName)
+	if version == "" {
+		version = SignatureVersion
+	}
+	algorithm, err := algorithmFromVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := r.Header.Get(s.config.NonceHeaderName)
+	return s.newSession(algorithm, secretKey, nonce, serverToClientInfo, clientToServerInfo)
+}
+
+// newSession derives the send and receive keys for a connection, using the
+// nonce of the upgrade request as the salt.
+func (s *Service) newSession(algorithm Algorithm, secretKey []byte, nonce string,
+	sendInfo string, receiveInfo string) (*Session, error) {
+
+	secretKey, _, err := s.bindPurpose(secretKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sendKey, err := deriveSessionKey(secretKey, nonce, sendInfo)
+	if err != nil {
+		return nil, err
+	}
+	receiveKey, err := deriveSessionKey(secretKey, nonce, receiveInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		algorithm:  algorithm,
+		sendKey:    sendKey,
+		receiveKey: receiveKey,
+	}, nil
+}
+
+func deriveSessionKey(secretKey []byte, nonce string, info string) ([]byte, error) {
+	key := make([]byte, sha256.Size)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secretKey, []byte(nonce), []byte(info)), key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Sign returns the frame to send for payload: the next sequence number, the
+// payload, and a MAC over both.
+func (s *Session) Sign(payload []byte) ([]byte, error) {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
+	frame := make([]byte, sequenceSize, sequenceSize+len(payload))
+	binary.BigEndian.PutUint64(frame, s.sendSeq)
+	frame = append(frame, payload...)
+
+	mac, err := newMAC(s.algorithm, s.sendKey)
+	if err != nil {
+		return nil, err
+	}
+	mac.Write(frame)
+	frame = mac.Sum(frame)
+
+	s.sendSeq++
+
+	return frame, nil
+}
+
+// SignDetached returns a MAC over the next sequence number and payload, for
+// transports that carry the MAC apart from the payload. The sequence number
+// isn't sent, the other side must receive the payloads in the order they were
+// signed and check them with AuthenticateDetached.
+func (s *Session) SignDetached(payload []byte) ([]byte, error) {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
+	signature, err := sessionMAC(s.algorithm, s.sendKey, s.sendSeq, payload)
+	if err != nil {
+		return nil, err
+	}
+	s.sendSeq++
+
+	return signature, nil
+}
+
+// AuthenticateDetached checks the MAC made by SignDetached for the next
+// payload received from the other side.
+func (s *Session) AuthenticateDetached(payload []byte, signature []byte) error {
+	s.receiveLock.Lock()
+	defer s.receiveLock.Unlock()
+
+	expected, err := sessionMAC(s.algorithm, s.receiveKey, s.receiveSeq, payload)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, signature) {
+		return fmt.Errorf("message signature does not match")
+	}
+	s.receiveSeq++
+
+	return nil
+}
+
+// sessionMAC returns the MAC of a frame with sequence number seq and payload.
+func sessionMAC(algorithm Algorithm, key []byte, seq uint64, payload []byte) ([]byte, error) {
+	mac, err := newMAC(algorithm, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var prefix [sequenceSize]byte
+	binary.BigEndian.PutUint64(prefix[:], seq)
+	mac.Write(prefix[:])
+	mac.Write(payload)
+
+	return mac.Sum(nil), nil
+}
+
+// Authenticate checks a frame received from the other side and returns its
+// payload. Frames that were tampered with, replayed, reordered, or follow a
+// dropped frame are rejected.
+func (s *Session) Authenticate(frame []byte) ([]byte, error) {
+	s.receiveLock.Lock()
+	defer s.receiveLock.Unlock()
+
+	mac, err := newMAC(s.algorithm, s.receiveKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(frame) < sequenceSize+mac.Size() {
+		return nil, fmt.Errorf("frame too short: %v bytes", len(frame))
+	}
+
+	// check the mac
+	signed, signature := frame[:len(frame)-mac.Size()], frame[len(frame)-mac.Size():]
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return nil, fmt.Errorf("frame signature does not match")
+	}
+
+	// check sequence number
+	seq := binary.BigEndian.Uint64(signed)
+	if seq != s.receiveSeq {
+		return nil, fmt.Errorf("frame out of sequence: got %v, want %v", seq, s.receiveSeq)
+	}
+	s.receiveSeq++
+
+	return signed[sequenceSize:], nil
+}
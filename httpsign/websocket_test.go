@@ -0,0 +1,222 @@
+package httpsign
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/timetools"
+)
+
+var _ = fmt.Printf // for testing
+
+// newTestSessions signs an upgrade request and returns both sides of its session.
+func newTestSessions(t *testing.T, s *Service) (*Session, *Session) {
+	r, err := http.NewRequest("GET", "/stream", nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error from http.NewRequest: %v", err)
+	}
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+
+	err = s.SignRequest(r)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SignRequest: %v", err)
+	}
+	client, err := s.NewClientSession(r)
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewClientSession: %v", err)
+	}
+	server, err := s.AuthenticateUpgradeRequest(r)
+	if err != nil {
+		t.Fatalf("Got unexpected error from AuthenticateUpgradeRequest: %v", err)
+	}
+
+	return client, server
+}
+
+func newWebSocketTestService(t *testing.T, algorithm Algorithm) *Service {
+	s, err := NewWithProviders(
+		&Config{
+			KeyBytes:           testKey,
+			Algorithm:          algorithm,
+			NonceCacheCapacity: CacheCapacity,
+			NonceCacheTimeout:  CacheTimeout,
+		},
+		&timetools.FreezedTime{CurrentTime: time.Unix(1330837567, 0)},
+		&random.CSPRNG{},
+	)
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewWithProviders: %v", err)
+	}
+	return s
+}
+
+func TestSession(t *testing.T) {
+	for _, algorithm := range []Algorithm{HMACSHA256, HMACSHA512, BLAKE2b256} {
+		client, server := newTestSessions(t, newWebSocketTestService(t, algorithm))
+
+		for i, message := range []string{"hello", "", "world"} {
+			// client to server
+			frame, err := client.Sign([]byte(message))
+			if err != nil {
+				t.Errorf("[%v %v] Got unexpected error from Sign: %v", algorithm, i, err)
+			}
+			payload, err := server.Authenticate(frame)
+			if err != nil {
+				t.Errorf("[%v %v] Got unexpected error from Authenticate: %v", algorithm, i, err)
+			}
+			if g, w := string(payload), message; g != w {
+				t.Errorf("[%v %v] Payload: Got %q, Want %q", algorithm, i, g, w)
+			}
+
+			// server to client
+			frame, err = server.Sign([]byte(message))
+			if err != nil {
+				t.Errorf("[%v %v] Got unexpected error from Sign: %v", algorithm, i, err)
+			}
+			payload, err = client.Authenticate(frame)
+			if err != nil {
+				t.Errorf("[%v %v] Got unexpected error from Authenticate: %v", algorithm, i, err)
+			}
+			if g, w := string(payload), message; g != w {
+				t.Errorf("[%v %v] Payload: Got %q, Want %q", algorithm, i, g, w)
+			}
+		}
+	}
+}
+
+func TestSessionForged(t *testing.T) {
+	s := newWebSocketTestService(t, HMACSHA256)
+	client, server := newTestSessions(t, s)
+
+	first, _ := client.Sign([]byte("first"))
+	second, _ := client.Sign([]byte("second"))
+
+	// reordered
+	if _, err := server.Authenticate(second); err == nil {
+		t.Errorf("Authenticate should reject a frame out of order")
+	}
+
+	// tampered
+	tampered := append([]byte{}, first...)
+	tampered[sequenceSize] ^= 1
+	if _, err := server.Authenticate(tampered); err == nil {
+		t.Errorf("Authenticate should reject a tampered frame")
+	}
+
+	// truncated
+	if _, err := server.Authenticate(first[:sequenceSize]); err == nil {
+		t.Errorf("Authenticate should reject a truncated frame")
+	}
+
+	// in order
+	if _, err := server.Authenticate(first); err != nil {
+		t.Errorf("Got unexpected error from Authenticate: %v", err)
+	}
+
+	// replayed
+	if _, err := server.Authenticate(first); err == nil {
+		t.Errorf("Authenticate should reject a replayed frame")
+	}
+
+	// reflected back to the sender
+	reflected, _ := server.Sign([]byte("reflected"))
+	if _, err := server.Authenticate(reflected); err == nil {
+		t.Errorf("Authenticate should reject a frame sent by the same side")
+	}
+
+	// from another connection
+	other, _ := newTestSessions(t, s)
+	frame, _ := other.Sign([]byte("other"))
+	if _, err := server.Authenticate(frame); err == nil {
+		t.Errorf("Authenticate should reject a frame from another connection")
+	}
+}
+
+func TestSessionKeysDiffer(t *testing.T) {
+	s := newWebSocketTestService(t, HMACSHA256)
+	client, server := newTestSessions(t, s)
+	other, _ := newTestSessions(t, s)
+
+	if !bytes.Equal(client.sendKey, server.receiveKey) || !bytes.Equal(client.receiveKey, server.sendKey) {
+		t.Errorf("Client and server keys do not match")
+	}
+	if bytes.Equal(client.sendKey, client.receiveKey) {
+		t.Errorf("Send and receive keys should differ")
+	}
+	if bytes.Equal(client.sendKey, other.sendKey) {
+		t.Errorf("Keys of different connections should differ")
+	}
+}
+
+func TestAuthenticateUpgradeRequestForged(t *testing.T) {
+	s := newWebSocketTestService(t, HMACSHA256)
+
+	r, err := http.NewRequest("GET", "/stream", nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error from http.NewRequest: %v", err)
+	}
+	err = s.SignRequest(r)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SignRequest: %v", err)
+	}
+	r.Header.Set(XMailgunSignature, "0000000000000000000000000000000000000000000000000000000000000000")
+
+	if _, err := s.AuthenticateUpgradeRequest(r); err == nil {
+		t.Errorf("AuthenticateUpgradeRequest should fail with a forged signature")
+	}
+}
+
+func TestMessageSession(t *testing.T) {
+	s := newWebSocketTestService(t, HMACSHA256)
+	attributes := map[string]string{"method": "/pkg.Service/Watch"}
+
+	e, client, err := s.SignMessageSession(nil, attributes)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SignMessageSession: %v", err)
+	}
+	server, err := s.AuthenticateMessageSession(nil, attributes, e)
+	if err != nil {
+		t.Fatalf("Got unexpected error from AuthenticateMessageSession: %v", err)
+	}
+
+	// the opening message can't be replayed to start another session
+	if _, err := s.AuthenticateMessageSession(nil, attributes, e); err == nil {
+		t.Errorf("AuthenticateMessageSession should reject a replayed envelope")
+	}
+
+	first, _ := client.SignDetached([]byte("first"))
+	second, _ := client.SignDetached([]byte("second"))
+
+	var tests = []struct {
+		inPayload   string
+		inSignature []byte
+		outOK       bool
+	}{
+		{"second", second, false}, // reordered
+		{"tampered", first, false},
+		{"first", first[:len(first)-1], false},
+		{"first", first, true},
+		{"first", first, false}, // replayed
+		{"second", second, true},
+	}
+	for i, tt := range tests {
+		err := server.AuthenticateDetached([]byte(tt.inPayload), tt.inSignature)
+		if g, w := err == nil, tt.outOK; g != w {
+			t.Errorf("[%v] Authenticated: Got %v, Want %v (%v)", i, g, w, err)
+		}
+	}
+
+	// server to client, and not reflected back
+	reply, _ := server.SignDetached([]byte("reply"))
+	if err := server.AuthenticateDetached([]byte("reply"), reply); err == nil {
+		t.Errorf("AuthenticateDetached should reject a message sent by the same side")
+	}
+	if err := client.AuthenticateDetached([]byte("reply"), reply); err != nil {
+		t.Errorf("Got unexpected error from AuthenticateDetached: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Package configfile reads the httpsign and secret configs from files and the
+environment. It is shared by both packages.
+*/
+package configfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Errors lists every problem found with a config.
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return "invalid config: " + strings.Join(messages, "; ")
+}
+
+// LoadFile decodes a JSON (.json) or YAML (.yaml, .yml) file into v.
+// Unknown fields are an error.
+func LoadFile(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(v)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, v)
+	default:
+		return fmt.Errorf("unsupported config file type: %v", path)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to parse %v: %v", path, err)
+	}
+	return nil
+}
+
+// EnvReader reads prefixed environment variables and collects every error.
+// Variables that aren't set leave their value alone.
+type EnvReader struct {
+	Prefix string
+	Errs   Errors
+}
+
+func (e *EnvReader) lookup(name string) (string, bool) {
+	return os.LookupEnv(e.Prefix + name)
+}
+
+// String reads a string.
+func (e *EnvReader) String(name string, v *string) {
+	if s, ok := e.lookup(name); ok {
+		*v = s
+	}
+}
+
+// Strings reads a comma separated list.
+func (e *EnvReader) Strings(name string, v *[]string) {
+	s, ok := e.lookup(name)
+	if !ok || s == "" {
+		return
+	}
+	values := strings.Split(s, ",")
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	*v = values
+}
+
+// Bool reads a bool, as strconv.ParseBool does.
+func (e *EnvReader) Bool(name string, v *bool) {
+	if s, ok := e.lookup(name); ok {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			e.Errs = append(e.Errs, fmt.Errorf("%v%v: %q is not a bool", e.Prefix, name, s))
+			return
+		}
+		*v = b
+	}
+}
+
+// Int reads an integer.
+func (e *EnvReader) Int(name string, v *int) {
+	if s, ok := e.lookup(name); ok {
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			e.Errs = append(e.Errs, fmt.Errorf("%v%v: %q is not an integer", e.Prefix, name, s))
+			return
+		}
+		*v = i
+	}
+}
+
+// Float reads a number.
+func (e *EnvReader) Float(name string, v *float64) {
+	if s, ok := e.lookup(name); ok {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			e.Errs = append(e.Errs, fmt.Errorf("%v%v: %q is not a number", e.Prefix, name, s))
+			return
+		}
+		*v = f
+	}
+}
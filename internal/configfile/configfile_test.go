@@ -0,0 +1,101 @@
+package configfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var _ = fmt.Printf // for testing
+
+type testConfig struct {
+	Name  string   `json:"name" yaml:"name"`
+	Names []string `json:"names" yaml:"names"`
+}
+
+func TestLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.json":  `{"name": "a", "names": ["b", "c"]}`,
+		"config.yaml":  "name: a\nnames: [b, c]\n",
+		"config.YML":   "name: a\nnames: [b, c]\n",
+		"unknown.json": `{"name": "a", "other": 1}`,
+		"unknown.yaml": "name: a\nother: 1\n",
+		"broken.json":  `{"name": `,
+		"config.toml":  `name = "a"`,
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatalf("Got unexpected error from WriteFile: %v", err)
+		}
+	}
+
+	var tests = []struct {
+		inName string
+		outOK  bool
+	}{
+		{"config.json", true},
+		{"config.yaml", true},
+		{"config.YML", true},
+		{"unknown.json", false},
+		{"unknown.yaml", false},
+		{"broken.json", false},
+		{"config.toml", false},
+		{"missing.json", false},
+	}
+
+	for _, tt := range tests {
+		var config testConfig
+		err := LoadFile(filepath.Join(dir, tt.inName), &config)
+		if g, w := err == nil, tt.outOK; g != w {
+			t.Errorf("[%v] Loaded: Got %v, Want %v (%v)", tt.inName, g, w, err)
+		}
+		if tt.outOK && fmt.Sprint(config) != "{a [b c]}" {
+			t.Errorf("[%v] Config: Got %v, Want {a [b c]}", tt.inName, config)
+		}
+	}
+}
+
+func TestEnvReader(t *testing.T) {
+	env := map[string]string{
+		"TEST_STRING":   "a",
+		"TEST_STRINGS":  "b, c",
+		"TEST_BOOL":     "true",
+		"TEST_INT":      "42",
+		"TEST_FLOAT":    "0.5",
+		"TEST_BAD_BOOL": "yes",
+		"TEST_BAD_INT":  "4.2",
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+
+	e := &EnvReader{Prefix: "TEST_"}
+	var s string
+	unset := "default"
+	var list []string
+	var b bool
+	var i, badInt int
+	var f float64
+	var badBool bool
+
+	e.String("STRING", &s)
+	e.String("UNSET", &unset)
+	e.Strings("STRINGS", &list)
+	e.Bool("BOOL", &b)
+	e.Int("INT", &i)
+	e.Float("FLOAT", &f)
+	e.Bool("BAD_BOOL", &badBool)
+	e.Int("BAD_INT", &badInt)
+
+	if g, w := fmt.Sprintln(s, unset, list, b, i, f), "a default [b c] true 42 0.5\n"; g != w {
+		t.Errorf("Values: Got %v, Want %v", g, w)
+	}
+	if g, w := len(e.Errs), 2; g != w {
+		t.Errorf("Errors: Got %v, Want %v (%v)", g, w, e.Errs)
+	}
+	if g, w := e.Errs.Error(), `invalid config: TEST_BAD_BOOL: "yes" is not a bool; TEST_BAD_INT: "4.2" is not an integer`; g != w {
+		t.Errorf("Error: Got %v, Want %v", g, w)
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Package watch reloads keys when the file they are read from changes. It is
+shared by httpsign and secret.
+*/
+package watch
+
+import (
+	"os"
+	"time"
+)
+
+// File calls reload whenever the modification time or size of path changes,
+// or every interval if there is no path, until the returned function is
+// called. Reload failures are passed to onError, if it is not nil, and tried
+// again at the next interval.
+func File(path string, interval time.Duration, reload func() error, onError func(error)) (stop func()) {
+	done := make(chan struct{})
+
+	var lastModTime time.Time
+	var lastSize int64
+	if fi, err := os.Stat(path); path != "" && err == nil {
+		lastModTime, lastSize = fi.ModTime(), fi.Size()
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			if path == "" {
+				if err := reload(); err != nil && onError != nil {
+					onError(err)
+				}
+				continue
+			}
+
+			fi, err := os.Stat(path)
+			if err == nil && fi.ModTime().Equal(lastModTime) && fi.Size() == lastSize {
+				continue
+			}
+			if err == nil {
+				err = reload()
+			}
+			if err != nil {
+				// try again next time, the file may be half written
+				if onError != nil {
+					onError(err)
+				}
+				continue
+			}
+			lastModTime, lastSize = fi.ModTime(), fi.Size()
+		}
+	}()
+
+	return func() { close(done) }
+}
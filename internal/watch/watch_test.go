@@ -0,0 +1,73 @@
+package watch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var _ = fmt.Printf // for testing
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.key")
+	if err := os.WriteFile(path, []byte("first"), 0600); err != nil {
+		t.Fatalf("Got unexpected error from WriteFile: %v", err)
+	}
+
+	var reloads int32
+	fail := int32(1)
+	reload := func() error {
+		atomic.AddInt32(&reloads, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			return fmt.Errorf("half written")
+		}
+		return nil
+	}
+	errs := make(chan error, 100)
+	stop := File(path, 5*time.Millisecond, reload, func(err error) { errs <- err })
+	defer stop()
+
+	// nothing changed
+	time.Sleep(30 * time.Millisecond)
+	if g := atomic.LoadInt32(&reloads); g != 0 {
+		t.Errorf("Reloads before a change: Got %v, Want 0", g)
+	}
+
+	// a failed reload is tried again until it works, then not again
+	if err := os.WriteFile(path, []byte("second key"), 0600); err != nil {
+		t.Fatalf("Got unexpected error from WriteFile: %v", err)
+	}
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatalf("onError should be called when reload fails")
+	}
+	atomic.StoreInt32(&fail, 0)
+	time.Sleep(50 * time.Millisecond)
+	reloaded := atomic.LoadInt32(&reloads)
+	time.Sleep(50 * time.Millisecond)
+	if g, w := atomic.LoadInt32(&reloads), reloaded; g != w {
+		t.Errorf("Reloads once a reload worked: Got %v, Want %v", g, w)
+	}
+}
+
+func TestFileWithoutPath(t *testing.T) {
+	reloaded := make(chan struct{}, 100)
+	stop := File("", 5*time.Millisecond, func() error {
+		reloaded <- struct{}{}
+		return nil
+	}, nil)
+
+	// without a path every interval reloads
+	for i := 0; i < 2; i++ {
+		select {
+		case <-reloaded:
+		case <-time.After(time.Second):
+			t.Fatalf("[%v] File should reload every interval without a path", i)
+		}
+	}
+	stop()
+}
@@ -0,0 +1,211 @@
+/*
+Package keysource provides the key material used by httpsign and secret from
+files, environment variables, inherited file descriptors, systemd credentials,
+and HashiCorp Vault style secret managers. See README.md for more details.
+*/
+package keysource
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source provides key material. Key may be called again to pick up a
+// rotated key, sources that can only be read once return the same key.
+type Source interface {
+	Key() ([]byte, error)
+}
+
+// file reads the key from a file, like Config.KeyPath does.
+type file struct {
+	path string
+}
+
+// NewFile returns a Source that reads the key from a file. A trailing newline
+// is removed.
+func NewFile(path string) Source {
+	return &file{path: path}
+}
+
+func (f *file) Key() ([]byte, error) {
+	return readKeyFile(f.path)
+}
+
+// env reads the key from an environment variable.
+type env struct {
+	name string
+}
+
+// NewEnv returns a Source that reads the key from an environment variable.
+func NewEnv(name string) Source {
+	return &env{name: name}
+}
+
+func (e *env) Key() ([]byte, error) {
+	value := os.Getenv(e.name)
+	if value == "" {
+		return nil, fmt.Errorf("environment variable not set: %v", e.name)
+	}
+	return []byte(value), nil
+}
+
+// fd reads the key from an inherited file descriptor, once.
+type fd struct {
+	sync.Mutex
+	fd  uintptr
+	key []byte
+	err error
+}
+
+// NewFD returns a Source that reads the key from an inherited file
+// descriptor, like a pipe set up by the parent process. The descriptor is read
+// to the end and closed the first time Key is called, every later call
+// returns the same key. A trailing newline is removed.
+func NewFD(descriptor uintptr) Source {
+	return &fd{fd: descriptor}
+}
+
+func (f *fd) Key() ([]byte, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.key == nil && f.err == nil {
+		file := os.NewFile(f.fd, fmt.Sprintf("fd%v", f.fd))
+		if file == nil {
+			f.err = fmt.Errorf("invalid file descriptor: %v", f.fd)
+		} else {
+			defer file.Close()
+			var b []byte
+			b, f.err = ioutil.ReadAll(file)
+			if f.err == nil {
+				f.key = bytes.TrimSuffix(b, []byte("\n"))
+			}
+		}
+	}
+
+	return f.key, f.err
+}
+
+// systemdCredential reads the key from a systemd credential.
+type systemdCredential struct {
+	name string
+}
+
+// NewSystemdCredential returns a Source that reads the key from the systemd
+// credential with the given name, passed to the unit with LoadCredential= or
+// SetCredential=. A trailing newline is removed.
+func NewSystemdCredential(name string) Source {
+	return &systemdCredential{name: name}
+}
+
+func (c *systemdCredential) Key() ([]byte, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return nil, fmt.Errorf("no systemd credentials: CREDENTIALS_DIRECTORY not set")
+	}
+	return readKeyFile(filepath.Join(dir, c.name))
+}
+
+// VaultConfig is used to configure a Vault source.
+type VaultConfig struct {
+	Address string // default: VAULT_ADDR, for example https://vault.example.com:8200
+	Token   string // default: VAULT_TOKEN
+
+	// Path is the path of the secret, for example secret/data/lemma for a
+	// version 2 key value engine mounted at secret/.
+	Path  string
+	Field string // field of the secret that holds the key, default: key
+
+	Client *http.Client // default: a client with a 10 second timeout
+}
+
+// vault reads the key from a HashiCorp Vault style HTTP API.
+type vault struct {
+	config VaultConfig
+}
+
+// NewVault returns a Source that reads the key from a field of a secret in a
+// HashiCorp Vault (or compatible) key value engine. Every call to Key fetches
+// the secret again, so it picks up rotated keys.
+func NewVault(config VaultConfig) (Source, error) {
+	if config.Address == "" {
+		config.Address = os.Getenv("VAULT_ADDR")
+	}
+	if config.Token == "" {
+		config.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if config.Field == "" {
+		config.Field = "key"
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if config.Address == "" {
+		return nil, fmt.Errorf("vault address is required")
+	}
+	if config.Path == "" {
+		return nil, fmt.Errorf("vault secret path is required")
+	}
+
+	return &vault{config: config}, nil
+}
+
+func (v *vault) Key() ([]byte, error) {
+	url := strings.TrimSuffix(v.config.Address, "/") + "/v1/" + strings.TrimPrefix(v.config.Path, "/")
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if v.config.Token != "" {
+		request.Header.Set("X-Vault-Token", v.config.Token)
+	}
+
+	response, err := v.config.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to read vault secret %v: %v", v.config.Path, response.Status)
+	}
+
+	// version 1 engines return the fields in data, version 2 engines nest
+	// them in data.data next to the metadata
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("unable to parse vault secret %v: %v", v.config.Path, err)
+	}
+	fields := secret.Data
+	if nested, ok := fields["data"].(map[string]interface{}); ok {
+		fields = nested
+	}
+
+	value, ok := fields[v.config.Field].(string)
+	if !ok || value == "" {
+		return nil, fmt.Errorf("vault secret %v has no field: %v", v.config.Path, v.config.Field)
+	}
+
+	return []byte(value), nil
+}
+
+func readKeyFile(path string) ([]byte, error) {
+	keyBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// strip newline (\n or 0x0a) if it's at the end
+	return bytes.TrimSuffix(keyBytes, []byte("\n")), nil
+}
@@ -0,0 +1,179 @@
+package keysource
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var _ = fmt.Printf // for testing
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lemma")
+	if err != nil {
+		t.Fatalf("Got unexpected error from ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "test.key")
+	ioutil.WriteFile(keyPath, []byte("abc\n"), 0600)
+
+	key, err := NewFile(keyPath).Key()
+	if err != nil {
+		t.Errorf("Got unexpected error from Key: %v", err)
+	}
+	if g, w := string(key), "abc"; g != w {
+		t.Errorf("Key: Got %q, Want %q", g, w)
+	}
+
+	if _, err := NewFile(filepath.Join(dir, "missing.key")).Key(); err == nil {
+		t.Errorf("Key should fail with a missing file")
+	}
+}
+
+func TestEnv(t *testing.T) {
+	os.Setenv("LEMMA_TEST_KEY", "abc")
+	defer os.Unsetenv("LEMMA_TEST_KEY")
+
+	key, err := NewEnv("LEMMA_TEST_KEY").Key()
+	if err != nil {
+		t.Errorf("Got unexpected error from Key: %v", err)
+	}
+	if g, w := string(key), "abc"; g != w {
+		t.Errorf("Key: Got %q, Want %q", g, w)
+	}
+
+	if _, err := NewEnv("LEMMA_TEST_MISSING_KEY").Key(); err == nil {
+		t.Errorf("Key should fail with an unset variable")
+	}
+}
+
+func TestFD(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Got unexpected error from os.Pipe: %v", err)
+	}
+	w.Write([]byte("abc\n"))
+	w.Close()
+
+	source := NewFD(r.Fd())
+
+	// the descriptor is only read once
+	for i := 0; i < 2; i++ {
+		key, err := source.Key()
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from Key: %v", i, err)
+		}
+		if g, w := string(key), "abc"; g != w {
+			t.Errorf("[%v] Key: Got %q, Want %q", i, g, w)
+		}
+	}
+}
+
+func TestSystemdCredential(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lemma")
+	if err != nil {
+		t.Fatalf("Got unexpected error from ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "lemma-key"), []byte("abc\n"), 0600)
+
+	os.Unsetenv("CREDENTIALS_DIRECTORY")
+	if _, err := NewSystemdCredential("lemma-key").Key(); err == nil {
+		t.Errorf("Key should fail without CREDENTIALS_DIRECTORY")
+	}
+
+	os.Setenv("CREDENTIALS_DIRECTORY", dir)
+	defer os.Unsetenv("CREDENTIALS_DIRECTORY")
+
+	key, err := NewSystemdCredential("lemma-key").Key()
+	if err != nil {
+		t.Errorf("Got unexpected error from Key: %v", err)
+	}
+	if g, w := string(key), "abc"; g != w {
+		t.Errorf("Key: Got %q, Want %q", g, w)
+	}
+
+	if _, err := NewSystemdCredential("other-key").Key(); err == nil {
+		t.Errorf("Key should fail with a missing credential")
+	}
+}
+
+func TestVault(t *testing.T) {
+	// stand-in for the vault HTTP API
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors":["permission denied"]}`)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/lemma":
+			fmt.Fprint(w, `{"data":{"key":"v1 key","other":"other key"}}`)
+		case "/v1/secret/data/lemma":
+			fmt.Fprint(w, `{"data":{"data":{"key":"v2 key"},"metadata":{"version":3}}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[]}`)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		config VaultConfig
+		outKey string
+		outErr bool
+	}{
+		// key value engine version 1
+		{VaultConfig{Address: server.URL, Token: "s.token", Path: "secret/lemma"}, "v1 key", false},
+		{VaultConfig{Address: server.URL + "/", Token: "s.token", Path: "/secret/lemma", Field: "other"}, "other key", false},
+
+		// key value engine version 2
+		{VaultConfig{Address: server.URL, Token: "s.token", Path: "secret/data/lemma"}, "v2 key", false},
+
+		// errors
+		{VaultConfig{Address: server.URL, Token: "bad token", Path: "secret/lemma"}, "", true},
+		{VaultConfig{Address: server.URL, Token: "s.token", Path: "secret/missing"}, "", true},
+		{VaultConfig{Address: server.URL, Token: "s.token", Path: "secret/lemma", Field: "missing"}, "", true},
+	}
+
+	for i, tt := range tests {
+		source, err := NewVault(tt.config)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from NewVault: %v", i, err)
+			continue
+		}
+		key, err := source.Key()
+		if tt.outErr {
+			if err == nil {
+				t.Errorf("[%v] Key should have failed", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from Key: %v", i, err)
+		}
+		if g, w := string(key), tt.outKey; g != w {
+			t.Errorf("[%v] Key: Got %q, Want %q", i, g, w)
+		}
+	}
+}
+
+func TestVaultEnvironment(t *testing.T) {
+	os.Unsetenv("VAULT_ADDR")
+	if _, err := NewVault(VaultConfig{Path: "secret/lemma"}); err == nil {
+		t.Errorf("NewVault should fail without an address")
+	}
+
+	os.Setenv("VAULT_ADDR", "http://127.0.0.1:8200")
+	defer os.Unsetenv("VAULT_ADDR")
+	if _, err := NewVault(VaultConfig{}); err == nil {
+		t.Errorf("NewVault should fail without a path")
+	}
+	if _, err := NewVault(VaultConfig{Path: "secret/lemma"}); err != nil {
+		t.Errorf("Got unexpected error from NewVault: %v", err)
+	}
+}
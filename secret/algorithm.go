@@ -0,0 +1,212 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Algorithm is the authenticated cipher a message is sealed with. It is
+// recorded in the SealedData, and Open only opens messages sealed with one
+// of the AllowedAlgorithms.
+type Algorithm string
+
+const (
+	// Salsa20Poly1305 is NaCl secretbox, the default. It can't authenticate
+	// associated data. Messages sealed before the algorithm was recorded
+	// were sealed with it.
+	Salsa20Poly1305 Algorithm = "salsa20_poly1305"
+
+	// XChaCha20Poly1305 is compatible with libsodium's
+	// crypto_aead_xchacha20poly1305_ietf. SealWithAAD uses it unless the
+	// configured algorithm can authenticate associated data.
+	XChaCha20Poly1305 Algorithm = "xchacha20_poly1305"
+
+	// AES256GCM is AES-256 in Galois/Counter Mode with a 96-bit random nonce,
+	// for deployments that need FIPS approved algorithms. Random nonces
+	// limit a key to about 2^32 messages.
+	AES256GCM Algorithm = "aes256_gcm"
+
+	// Curve25519XSalsa20Poly1305 is NaCl box, used by SealTo and OpenFrom.
+	// It seals with a key pair instead of a secret key, so a Service can't
+	// seal or open with it.
+	Curve25519XSalsa20Poly1305 Algorithm = "curve25519_xsalsa20_poly1305"
+
+	// SealedBox is an anonymous NaCl sealed box, compatible with libsodium's
+	// crypto_box_seal, used by SealAnonymous and OpenAnonymous. It has no
+	// nonce, the ciphertext starts with an ephemeral public key.
+	SealedBox Algorithm = "sealed_box"
+)
+
+// algorithms is the registry of the ciphers secret can seal and open with.
+// IDs are used by the binary format and must never change.
+var algorithms = map[Algorithm]aeadAlgorithm{
+	Salsa20Poly1305:   {id: 1, nonceSize: NonceLength, newAEAD: newSecretbox},
+	XChaCha20Poly1305: {id: 2, nonceSize: chacha20poly1305.NonceSizeX, aad: true, newAEAD: newXChaCha20Poly1305},
+	AES256GCM:         {id: 3, nonceSize: 12, aad: true, newAEAD: newAES256GCM},
+
+	// public key algorithms, see box.go
+	Curve25519XSalsa20Poly1305: {id: 4, nonceSize: NonceLength},
+	SealedBox:                  {id: 5, nonceSize: 0},
+}
+
+// aeadAlgorithm describes a registered cipher.
+type aeadAlgorithm struct {
+	id        byte
+	nonceSize int
+	aad       bool // can authenticate associated data
+
+	// newAEAD is nil for public key algorithms
+	newAEAD func(secretKey *[SecretKeyLength]byte) (cipher.AEAD, error)
+}
+
+// Valid reports if the algorithm is one secret knows how to seal and open
+// with a secret key.
+func (a Algorithm) Valid() bool {
+	algorithm, ok := algorithms[a]
+	return ok && algorithm.newAEAD != nil
+}
+
+// NonceSize returns the length of the nonces the algorithm uses.
+func (a Algorithm) NonceSize() int {
+	return algorithms[a].nonceSize
+}
+
+// SupportsAAD reports if the algorithm can authenticate associated data.
+func (a Algorithm) SupportsAAD() bool {
+	return algorithms[a].aad
+}
+
+// algorithmByID returns the algorithm with the binary format ID.
+func algorithmByID(id byte) (Algorithm, bool) {
+	for algorithm, a := range algorithms {
+		if a.id == id {
+			return algorithm, true
+		}
+	}
+	return "", false
+}
+
+// aadAlgorithm returns the algorithm SealWithAAD seals with when Seal seals
+// with a: a itself if it supports associated data, XChaCha20Poly1305 if not.
+func (a Algorithm) aadAlgorithm() Algorithm {
+	if a.SupportsAAD() {
+		return a
+	}
+	return XChaCha20Poly1305
+}
+
+// checkAllowedAlgorithms returns an error if allowed is missing an algorithm
+// a service sealing with algorithm seals with, as it couldn't open what it
+// sealed.
+func checkAllowedAlgorithms(algorithm Algorithm, allowed []Algorithm) error {
+	for _, a := range []Algorithm{algorithm, algorithm.aadAlgorithm()} {
+		if !algorithmIn(a, allowed) {
+			return fmt.Errorf("%q is sealed with but not allowed", a)
+		}
+	}
+	return nil
+}
+
+// algorithmIn reports if algorithm is in list.
+func algorithmIn(algorithm Algorithm, list []Algorithm) bool {
+	for _, a := range list {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// seal encrypts and authenticates plaintext, and authenticates aad.
+func (a Algorithm) seal(plaintext []byte, aad []byte, nonce []byte,
+	secretKey *[SecretKeyLength]byte) ([]byte, error) {
+
+	aead, err := a.newAEAD(secretKey, aad, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, plaintext, aad), nil
+}
+
+// open authenticates ciphertext and aad, and decrypts ciphertext.
+func (a Algorithm) open(ciphertext []byte, aad []byte, nonce []byte,
+	secretKey *[SecretKeyLength]byte) ([]byte, error) {
+
+	aead, err := a.newAEAD(secretKey, aad, nonce)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt message")
+	}
+	return plaintext, nil
+}
+
+// newAEAD checks the algorithm can handle aad and nonce, and returns its
+// cipher keyed with secretKey.
+func (a Algorithm) newAEAD(secretKey *[SecretKeyLength]byte, aad []byte, nonce []byte) (cipher.AEAD, error) {
+	algorithm, ok := algorithms[a]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm: %q", a)
+	}
+	if algorithm.newAEAD == nil {
+		return nil, fmt.Errorf("%v needs a key pair, not a secret key", a)
+	}
+	if len(aad) > 0 && !algorithm.aad {
+		return nil, fmt.Errorf("%v can't authenticate associated data", a)
+	}
+	if len(nonce) != algorithm.nonceSize {
+		return nil, fmt.Errorf("wrong nonce length for %v: %v", a, len(nonce))
+	}
+	return algorithm.newAEAD(secretKey)
+}
+
+func newXChaCha20Poly1305(secretKey *[SecretKeyLength]byte) (cipher.AEAD, error) {
+	return chacha20poly1305.NewX(secretKey[:])
+}
+
+func newAES256GCM(secretKey *[SecretKeyLength]byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secretKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// secretboxAEAD adapts NaCl secretbox to cipher.AEAD, without associated data.
+type secretboxAEAD struct {
+	secretKey *[SecretKeyLength]byte
+}
+
+func newSecretbox(secretKey *[SecretKeyLength]byte) (cipher.AEAD, error) {
+	return &secretboxAEAD{secretKey: secretKey}, nil
+}
+
+func (s *secretboxAEAD) NonceSize() int {
+	return NonceLength
+}
+
+func (s *secretboxAEAD) Overhead() int {
+	return secretbox.Overhead
+}
+
+func (s *secretboxAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	var n [NonceLength]byte
+	copy(n[:], nonce)
+	return secretbox.Seal(dst, plaintext, &n, s.secretKey)
+}
+
+func (s *secretboxAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	var n [NonceLength]byte
+	copy(n[:], nonce)
+	plaintext, ok := secretbox.Open(dst, ciphertext, &n, s.secretKey)
+	if !ok {
+		return nil, fmt.Errorf("unable to decrypt message")
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,303 @@
+package secret
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mailgun/lemma/random"
+)
+
+var _ = fmt.Printf // for testing
+
+func TestXChaCha20Poly1305Vector(t *testing.T) {
+	// test vector from draft-irtf-cfrg-xchacha, appendix A.3.1
+	key, _ := hex.DecodeString("808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f")
+	nonce, _ := hex.DecodeString("404142434445464748494a4b4c4d4e4f5051525354555657")
+	aad, _ := hex.DecodeString("50515253c0c1c2c3c4c5c6c7")
+	plaintext := []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+	want, _ := hex.DecodeString("bd6d179d3e83d43b9576579493c0e939572a1700252bfaccbed2902c21396cbb" +
+		"731c7f1b0b4aa6440bf3a82f4eda7e39ae64c6708c54c216cb96b72e1213b452" +
+		"2f8c9ba40db5d945b11b69b982c1bb9e3f3fac2bc369488f76b2383565d3fff9" +
+		"21f9664c97637da9768812f615c68b13b52e" +
+		"c0875924c1c7987947deafd8780acf49")
+
+	keyBytes, _ := KeySliceToArray(key)
+
+	got, err := XChaCha20Poly1305.seal(plaintext, aad, nonce, keyBytes)
+	if err != nil {
+		t.Fatalf("Got unexpected error from seal: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Ciphertext: Got %x, Want %x", got, want)
+	}
+
+	opened, err := XChaCha20Poly1305.open(want, aad, nonce, keyBytes)
+	if err != nil {
+		t.Errorf("Got unexpected error from open: %v", err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Errorf("Plaintext: Got %q, Want %q", opened, plaintext)
+	}
+}
+
+func TestSealWithAAD(t *testing.T) {
+	key, err := (&random.CSPRNG{}).Bytes(SecretKeyLength)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Bytes: %v", err)
+	}
+	keyBytes, _ := KeySliceToArray(key)
+	ss, err := New(&Config{KeyBytes: keyBytes})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+	s := ss.(AADSecretService)
+
+	message := []byte("hello, box!")
+	withAAD, err := s.SealWithAAD(message, []byte("users/42"))
+	if err != nil {
+		t.Fatalf("Got unexpected error from SealWithAAD: %v", err)
+	}
+	withoutAAD, err := s.Seal(message)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Seal: %v", err)
+	}
+
+	if g, w := toSealedBytes(withAAD).AlgorithmID(), XChaCha20Poly1305; g != w {
+		t.Errorf("AlgorithmID: Got %v, Want %v", g, w)
+	}
+	if g, w := toSealedBytes(withoutAAD).AlgorithmID(), Salsa20Poly1305; g != w {
+		t.Errorf("AlgorithmID: Got %v, Want %v", g, w)
+	}
+
+	var tests = []struct {
+		inSealed SealedData
+		inAAD    []byte
+		outOK    bool
+	}{
+		{withAAD, []byte("users/42"), true},
+		{withAAD, []byte("users/43"), false}, // copied to another record
+		{withAAD, nil, false},
+		{withoutAAD, nil, true}, // ciphertexts sealed without associated data still open
+		{withoutAAD, []byte{}, true},
+		{withoutAAD, []byte("users/42"), false},
+	}
+
+	for i, tt := range tests {
+		out, err := s.OpenWithAAD(tt.inSealed, tt.inAAD)
+		if g, w := err == nil, tt.outOK; g != w {
+			t.Errorf("[%v] Opened: Got %v, Want %v (%v)", i, g, w, err)
+		}
+		if tt.outOK && !bytes.Equal(out, message) {
+			t.Errorf("[%v] Plaintext: Got %q, Want %q", i, out, message)
+		}
+	}
+
+	// Open is OpenWithAAD with no associated data
+	if _, err := s.Open(withAAD); err == nil {
+		t.Errorf("Open should fail for a message sealed with associated data")
+	}
+	if _, err := s.Open(withoutAAD); err != nil {
+		t.Errorf("Got unexpected error from Open: %v", err)
+	}
+
+	// the algorithm survives encoding
+	encoded, err := SealedDataToString(withAAD)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SealedDataToString: %v", err)
+	}
+	decoded, err := StringToSealedData(encoded)
+	if err != nil {
+		t.Fatalf("Got unexpected error from StringToSealedData: %v", err)
+	}
+	if _, err := OpenWithAAD(decoded, []byte("users/42"), keyBytes); err != nil {
+		t.Errorf("Got unexpected error from OpenWithAAD: %v", err)
+	}
+}
+
+func TestOpenUnsupportedAlgorithm(t *testing.T) {
+	var key [SecretKeyLength]byte
+	sealed := &SealedBytes{Ciphertext: []byte("x"), Nonce: make([]byte, NonceLength), Algorithm: "rot13"}
+	if _, err := Open(sealed, &key); err == nil {
+		t.Errorf("Open should fail with an unsupported algorithm")
+	}
+}
+
+// testSealedData is SealedData that isn't a *SealedBytes.
+type testSealedData struct {
+	ciphertext []byte
+	nonce      []byte
+}
+
+func (e *testSealedData) CiphertextBytes() []byte { return e.ciphertext }
+func (e *testSealedData) CiphertextHex() string   { return string(e.ciphertext) }
+func (e *testSealedData) NonceBytes() []byte      { return e.nonce }
+func (e *testSealedData) NonceHex() string        { return string(e.nonce) }
+
+func TestOpenOtherSealedData(t *testing.T) {
+	key := randomKey(t)
+	sealed, err := Seal([]byte("hello, world"), key)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Seal: %v", err)
+	}
+
+	// SealedData other than *SealedBytes is opened with Salsa20Poly1305
+	other := &testSealedData{ciphertext: sealed.CiphertextBytes(), nonce: sealed.NonceBytes()}
+	if out, err := Open(other, key); err != nil || string(out) != "hello, world" {
+		t.Errorf("Open: Got %q, %v, Want %q", out, err, "hello, world")
+	}
+}
+
+func TestAES256GCMVector(t *testing.T) {
+	// test case 16 from the GCM specification
+	key, _ := hex.DecodeString("feffe9928665731c6d6a8f9467308308feffe9928665731c6d6a8f9467308308")
+	nonce, _ := hex.DecodeString("cafebabefacedbaddecaf888")
+	aad, _ := hex.DecodeString("feedfacedeadbeeffeedfacedeadbeefabaddad2")
+	plaintext, _ := hex.DecodeString("d9313225f88406e5a55909c5aff5269a86a7a9531534f7da2e4c303d8a318a72" +
+		"1c3c0c95956809532fcf0e2449a6b525b16aedf5aa0de657ba637b39")
+	want, _ := hex.DecodeString("522dc1f099567d07f47f37a32a84427d643a8cdcbfe5c0c97598a2bd2555d1aa" +
+		"8cb08e48590dbb3da7b08b1056828838c5f61e6393ba7a0abcc9f662" +
+		"76fc6ece0f4e1768cddf8853bb2d551b")
+
+	keyBytes, _ := KeySliceToArray(key)
+
+	got, err := AES256GCM.seal(plaintext, aad, nonce, keyBytes)
+	if err != nil {
+		t.Fatalf("Got unexpected error from seal: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Ciphertext: Got %x, Want %x", got, want)
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	key, err := (&random.CSPRNG{}).Bytes(SecretKeyLength)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Bytes: %v", err)
+	}
+	keyBytes, _ := KeySliceToArray(key)
+
+	var tests = []struct {
+		inAlgorithm     Algorithm
+		outNonceSize    int
+		outAADAlgorithm Algorithm
+	}{
+		{"", 24, XChaCha20Poly1305},
+		{Salsa20Poly1305, 24, XChaCha20Poly1305},
+		{XChaCha20Poly1305, 24, XChaCha20Poly1305},
+		{AES256GCM, 12, AES256GCM},
+	}
+
+	for i, tt := range tests {
+		ss, err := New(&Config{KeyBytes: keyBytes, Algorithm: tt.inAlgorithm})
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from New: %v", i, err)
+			continue
+		}
+		s := ss.(AADSecretService)
+
+		sealed, err := s.Seal([]byte("hello, box!"))
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from Seal: %v", i, err)
+			continue
+		}
+		if g, w := len(sealed.NonceBytes()), tt.outNonceSize; g != w {
+			t.Errorf("[%v] Nonce length: Got %v, Want %v", i, g, w)
+		}
+		if _, err := s.Open(sealed); err != nil {
+			t.Errorf("[%v] Got unexpected error from Open: %v", i, err)
+		}
+
+		sealed, err = s.SealWithAAD([]byte("hello, box!"), []byte("users/42"))
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from SealWithAAD: %v", i, err)
+			continue
+		}
+		if g, w := toSealedBytes(sealed).AlgorithmID(), tt.outAADAlgorithm; g != w {
+			t.Errorf("[%v] AAD algorithm: Got %v, Want %v", i, g, w)
+		}
+		if _, err := s.OpenWithAAD(sealed, []byte("users/42")); err != nil {
+			t.Errorf("[%v] Got unexpected error from OpenWithAAD: %v", i, err)
+		}
+	}
+}
+
+func TestAllowedAlgorithms(t *testing.T) {
+	key, err := (&random.CSPRNG{}).Bytes(SecretKeyLength)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Bytes: %v", err)
+	}
+	keyBytes, _ := KeySliceToArray(key)
+
+	sealed := map[Algorithm]SealedData{}
+	for _, algorithm := range []Algorithm{Salsa20Poly1305, XChaCha20Poly1305, AES256GCM} {
+		s, err := New(&Config{KeyBytes: keyBytes, Algorithm: algorithm})
+		if err != nil {
+			t.Fatalf("Got unexpected error from New: %v", err)
+		}
+		if sealed[algorithm], err = s.Seal([]byte("hello, box!")); err != nil {
+			t.Fatalf("Got unexpected error from Seal: %v", err)
+		}
+	}
+
+	var tests = []struct {
+		inConfig *Config
+		outOpens []Algorithm
+	}{
+		// by default the algorithms the service seals with, and the original
+		{&Config{KeyBytes: keyBytes}, []Algorithm{Salsa20Poly1305, XChaCha20Poly1305}},
+		{&Config{KeyBytes: keyBytes, Algorithm: AES256GCM}, []Algorithm{Salsa20Poly1305, AES256GCM}},
+		{&Config{KeyBytes: keyBytes, Algorithm: AES256GCM, AllowedAlgorithms: []Algorithm{AES256GCM}}, []Algorithm{AES256GCM}},
+		{&Config{KeyBytes: keyBytes, AllowedAlgorithms: []Algorithm{Salsa20Poly1305, XChaCha20Poly1305}}, []Algorithm{Salsa20Poly1305, XChaCha20Poly1305}},
+	}
+
+	for i, tt := range tests {
+		s, err := New(tt.inConfig)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from New: %v", i, err)
+			continue
+		}
+		for algorithm, sd := range sealed {
+			_, err := s.Open(sd)
+			if g, w := err == nil, algorithmIn(algorithm, tt.outOpens); g != w {
+				t.Errorf("[%v] Opened %v: Got %v, Want %v (%v)", i, algorithm, g, w, err)
+			}
+		}
+	}
+
+	// a nonce of the wrong length is rejected, not padded
+	tampered := &SealedBytes{
+		Ciphertext: sealed[AES256GCM].CiphertextBytes(),
+		Nonce:      append(sealed[AES256GCM].NonceBytes(), make([]byte, 12)...),
+		Algorithm:  AES256GCM,
+	}
+	s, err := New(&Config{KeyBytes: keyBytes, Algorithm: AES256GCM})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+	if _, err := s.Open(tampered); err == nil || !strings.Contains(err.Error(), "nonce length") {
+		t.Errorf("Open should fail with the wrong nonce length: %v", err)
+	}
+
+	for i, config := range []*Config{
+		{KeyBytes: keyBytes, Algorithm: "rot13"},
+		{KeyBytes: keyBytes, AllowedAlgorithms: []Algorithm{"rot13"}},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("[%v] New should fail with an unsupported algorithm", i)
+		}
+	}
+
+	// the service must be able to open what Seal and SealWithAAD seal
+	for i, config := range []*Config{
+		{KeyBytes: keyBytes, AllowedAlgorithms: []Algorithm{Salsa20Poly1305}},
+		{KeyBytes: keyBytes, AllowedAlgorithms: []Algorithm{XChaCha20Poly1305}},
+		{KeyBytes: keyBytes, Algorithm: AES256GCM, AllowedAlgorithms: []Algorithm{Salsa20Poly1305, XChaCha20Poly1305}},
+	} {
+		if _, err := New(config); err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("[%v] New should fail when an algorithm sealed with isn't allowed: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package secret
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// GenerateKeyPair returns a new X25519 key pair for SealTo, OpenFrom,
+// SealAnonymous and OpenAnonymous. The public key can be shared, the private
+// key must be kept as secret as a secret key.
+func GenerateKeyPair() (publicKey *[PublicKeyLength]byte, privateKey *[PrivateKeyLength]byte, err error) {
+	publicKey, privateKey, err = box.GenerateKey(randomReader{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate key pair: %v", err)
+	}
+	return publicKey, privateKey, nil
+}
+
+// SealTo takes plaintext and returns ciphertext encrypted to the recipient's
+// public key and authenticated with the sender's private key. Only the
+// recipient can open it, and OpenFrom checks it came from the sender.
+func SealTo(value []byte, recipientPublicKey *[PublicKeyLength]byte,
+	senderPrivateKey *[PrivateKeyLength]byte) (SealedData, error) {
+
+	if recipientPublicKey == nil || senderPrivateKey == nil {
+		return nil, fmt.Errorf("key is nil")
+	}
+
+	nonce, err := randomProvider.Bytes(NonceLength)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %v", err)
+	}
+	nonceArray, err := nonceSliceToArray(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SealedBytes{
+		Ciphertext: box.Seal(nil, value, nonceArray, recipientPublicKey, senderPrivateKey),
+		Nonce:      nonce,
+		Algorithm:  Curve25519XSalsa20Poly1305,
+	}, nil
+}
+
+// OpenFrom authenticates a message sealed with SealTo by the sender and, if
+// it is valid, decrypts it with the recipient's private key.
+func OpenFrom(e SealedData, senderPublicKey *[PublicKeyLength]byte,
+	recipientPrivateKey *[PrivateKeyLength]byte) ([]byte, error) {
+
+	if senderPublicKey == nil || recipientPrivateKey == nil {
+		return nil, fmt.Errorf("key is nil")
+	}
+	if algorithm := toSealedBytes(e).AlgorithmID(); algorithm != Curve25519XSalsa20Poly1305 {
+		return nil, fmt.Errorf("algorithm not allowed: %q", algorithm)
+	}
+
+	nonce, err := nonceSliceToArray(e.NonceBytes())
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, ok := box.Open(nil, e.CiphertextBytes(), nonce, senderPublicKey, recipientPrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unable to decrypt message")
+	}
+	return plaintext, nil
+}
+
+// SealAnonymous takes plaintext and returns ciphertext encrypted to the
+// recipient's public key. The sender needs no key pair and can't open the
+// message again, useful for producers that should only be able to write.
+// The message isn't authenticated as coming from anyone in particular.
+func SealAnonymous(value []byte, recipientPublicKey *[PublicKeyLength]byte) (SealedData, error) {
+	if recipientPublicKey == nil {
+		return nil, fmt.Errorf("key is nil")
+	}
+
+	ciphertext, err := box.SealAnonymous(nil, value, recipientPublicKey, randomReader{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to seal message: %v", err)
+	}
+
+	return &SealedBytes{
+		Ciphertext: ciphertext,
+		Algorithm:  SealedBox,
+	}, nil
+}
+
+// OpenAnonymous authenticates a message sealed with SealAnonymous and, if it
+// is valid, decrypts it with the recipient's key pair.
+func OpenAnonymous(e SealedData, recipientPublicKey *[PublicKeyLength]byte,
+	recipientPrivateKey *[PrivateKeyLength]byte) ([]byte, error) {
+
+	if recipientPublicKey == nil || recipientPrivateKey == nil {
+		return nil, fmt.Errorf("key is nil")
+	}
+	if algorithm := toSealedBytes(e).AlgorithmID(); algorithm != SealedBox {
+		return nil, fmt.Errorf("algorithm not allowed: %q", algorithm)
+	}
+
+	plaintext, ok := box.OpenAnonymous(nil, e.CiphertextBytes(), recipientPublicKey, recipientPrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unable to decrypt message")
+	}
+	return plaintext, nil
+}
+
+// randomReader reads from the package random provider, so tests can control
+// the key pairs and ephemeral keys box generates.
+type randomReader struct{}
+
+func (randomReader) Read(p []byte) (int, error) {
+	b, err := randomProvider.Bytes(len(p))
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, b), nil
+}
@@ -0,0 +1,199 @@
+package secret
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/mailgun/lemma/random"
+	"golang.org/x/crypto/nacl/box"
+)
+
+var _ = fmt.Printf // for testing
+
+// fixedRNG always returns the start of the same bytes.
+type fixedRNG struct {
+	b []byte
+}
+
+func (f *fixedRNG) Bytes(bytes int) ([]byte, error) {
+	return append([]byte{}, f.b[:bytes]...), nil
+}
+
+func (f *fixedRNG) HexDigest(bytes int) (string, error) {
+	return hex.EncodeToString(f.b[:bytes]), nil
+}
+
+func TestGenerateKeyPair(t *testing.T) {
+	// test vector from RFC 7748, section 6.1
+	privateKey, _ := hex.DecodeString("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	wantPublicKey, _ := hex.DecodeString("8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a")
+
+	defer func(rp random.RandomProvider) { randomProvider = rp }(randomProvider)
+	randomProvider = &fixedRNG{b: privateKey}
+
+	gotPublicKey, gotPrivateKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Got unexpected error from GenerateKeyPair: %v", err)
+	}
+	if !bytes.Equal(gotPrivateKey[:], privateKey) {
+		t.Errorf("Private key: Got %x, Want %x", gotPrivateKey[:], privateKey)
+	}
+	if !bytes.Equal(gotPublicKey[:], wantPublicKey) {
+		t.Errorf("Public key: Got %x, Want %x", gotPublicKey[:], wantPublicKey)
+	}
+}
+
+func TestSealTo(t *testing.T) {
+	senderPublicKey, senderPrivateKey, _ := box.GenerateKey(rand.Reader)
+	recipientPublicKey, recipientPrivateKey, _ := box.GenerateKey(rand.Reader)
+	otherPublicKey, otherPrivateKey, _ := box.GenerateKey(rand.Reader)
+
+	message := []byte("hello, box!")
+	sealed, err := SealTo(message, recipientPublicKey, senderPrivateKey)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SealTo: %v", err)
+	}
+	if g, w := toSealedBytes(sealed).AlgorithmID(), Curve25519XSalsa20Poly1305; g != w {
+		t.Errorf("AlgorithmID: Got %v, Want %v", g, w)
+	}
+
+	// survives encoding
+	encoded, err := SealedDataToCompactString(sealed)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SealedDataToCompactString: %v", err)
+	}
+	decoded, err := StringToSealedData(encoded)
+	if err != nil {
+		t.Fatalf("Got unexpected error from StringToSealedData: %v", err)
+	}
+
+	var tests = []struct {
+		inSealed              SealedData
+		inSenderPublicKey     *[PublicKeyLength]byte
+		inRecipientPrivateKey *[PrivateKeyLength]byte
+		outOK                 bool
+	}{
+		{sealed, senderPublicKey, recipientPrivateKey, true},
+		{decoded, senderPublicKey, recipientPrivateKey, true},
+		{sealed, otherPublicKey, recipientPrivateKey, false}, // wrong sender
+		{sealed, senderPublicKey, otherPrivateKey, false},    // wrong recipient
+		{sealed, senderPublicKey, senderPrivateKey, false},   // the sender can't open it
+		{&SealedBytes{Ciphertext: sealed.CiphertextBytes(), Nonce: sealed.NonceBytes()}, senderPublicKey, recipientPrivateKey, false},
+	}
+
+	for i, tt := range tests {
+		out, err := OpenFrom(tt.inSealed, tt.inSenderPublicKey, tt.inRecipientPrivateKey)
+		if g, w := err == nil, tt.outOK; g != w {
+			t.Errorf("[%v] Opened: Got %v, Want %v (%v)", i, g, w, err)
+		}
+		if tt.outOK && !bytes.Equal(out, message) {
+			t.Errorf("[%v] Plaintext: Got %q, Want %q", i, out, message)
+		}
+	}
+}
+
+func TestSealAnonymous(t *testing.T) {
+	recipientPublicKey, recipientPrivateKey, _ := box.GenerateKey(rand.Reader)
+	otherPublicKey, otherPrivateKey, _ := box.GenerateKey(rand.Reader)
+
+	message := []byte("hello, box!")
+	sealed, err := SealAnonymous(message, recipientPublicKey)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SealAnonymous: %v", err)
+	}
+	if g, w := len(sealed.CiphertextBytes()), len(message)+box.AnonymousOverhead; g != w {
+		t.Errorf("Ciphertext length: Got %v, Want %v", g, w)
+	}
+
+	encoded, err := SealedDataToCompactString(sealed)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SealedDataToCompactString: %v", err)
+	}
+	decoded, err := StringToSealedData(encoded)
+	if err != nil {
+		t.Fatalf("Got unexpected error from StringToSealedData: %v", err)
+	}
+
+	tampered := append([]byte{}, sealed.CiphertextBytes()...)
+	tampered[len(tampered)-1] ^= 1
+
+	var tests = []struct {
+		inSealed     SealedData
+		inPublicKey  *[PublicKeyLength]byte
+		inPrivateKey *[PrivateKeyLength]byte
+		outOK        bool
+	}{
+		{sealed, recipientPublicKey, recipientPrivateKey, true},
+		{decoded, recipientPublicKey, recipientPrivateKey, true},
+		{sealed, otherPublicKey, otherPrivateKey, false},
+		{&SealedBytes{Ciphertext: tampered, Algorithm: SealedBox}, recipientPublicKey, recipientPrivateKey, false},
+	}
+
+	for i, tt := range tests {
+		out, err := OpenAnonymous(tt.inSealed, tt.inPublicKey, tt.inPrivateKey)
+		if g, w := err == nil, tt.outOK; g != w {
+			t.Errorf("[%v] Opened: Got %v, Want %v (%v)", i, g, w, err)
+		}
+		if tt.outOK && !bytes.Equal(out, message) {
+			t.Errorf("[%v] Plaintext: Got %q, Want %q", i, out, message)
+		}
+	}
+
+	// an anonymous message doesn't open as a message from a sender
+	if _, err := OpenFrom(sealed, recipientPublicKey, recipientPrivateKey); err == nil {
+		t.Errorf("OpenFrom should fail with an anonymous message")
+	}
+}
+
+func TestPublicKeyAlgorithmsNeedKeyPair(t *testing.T) {
+	recipientPublicKey, _, _ := box.GenerateKey(rand.Reader)
+	sealed, err := SealAnonymous([]byte("hello, box!"), recipientPublicKey)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SealAnonymous: %v", err)
+	}
+
+	keyBytes := randomKey(t)
+	if _, err := Open(sealed, keyBytes); err == nil {
+		t.Errorf("Open should fail with a public key algorithm")
+	}
+	for _, algorithm := range []Algorithm{Curve25519XSalsa20Poly1305, SealedBox} {
+		if _, err := New(&Config{KeyBytes: keyBytes, Algorithm: algorithm}); err == nil {
+			t.Errorf("New should fail with public key algorithm %v", algorithm)
+		}
+		if _, err := New(&Config{KeyBytes: keyBytes, AllowedAlgorithms: []Algorithm{algorithm}}); err == nil {
+			t.Errorf("New should fail with allowed public key algorithm %v", algorithm)
+		}
+	}
+}
+
+func TestPublicKeyEncoding(t *testing.T) {
+	publicKey, privateKey, _ := box.GenerateKey(rand.Reader)
+
+	gotPublicKey, err := EncodedStringToPublicKey(PublicKeyToEncodedString(publicKey))
+	if err != nil {
+		t.Fatalf("Got unexpected error from EncodedStringToPublicKey: %v", err)
+	}
+	if *gotPublicKey != *publicKey {
+		t.Errorf("Public key: Got %x, Want %x", gotPublicKey[:], publicKey[:])
+	}
+
+	gotPrivateKey, err := EncodedStringToPrivateKey(PrivateKeyToEncodedString(privateKey))
+	if err != nil {
+		t.Fatalf("Got unexpected error from EncodedStringToPrivateKey: %v", err)
+	}
+	if *gotPrivateKey != *privateKey {
+		t.Errorf("Private key: Got %x, Want %x", gotPrivateKey[:], privateKey[:])
+	}
+
+	for _, encoded := range []string{"AAEC", "not base64"} {
+		if _, err := EncodedStringToPublicKey(encoded); err == nil {
+			t.Errorf("EncodedStringToPublicKey should fail: %q", encoded)
+		}
+		if _, err := EncodedStringToPrivateKey(encoded); err == nil {
+			t.Errorf("EncodedStringToPrivateKey should fail: %q", encoded)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package secret
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mailgun/lemma/internal/configfile"
+)
+
+// EnvPrefix prefixes the names of the environment variables read by
+// LoadConfigEnv, for example LEMMA_SECRET_KEY_PATH.
+const EnvPrefix = "LEMMA_SECRET_"
+
+// ConfigErrors lists every problem found with a config.
+type ConfigErrors = configfile.Errors
+
+// LoadConfigFile reads a config from a JSON (.json) or YAML (.yaml, .yml)
+// file and validates it. Field names are the snake case of the Config
+// fields, like key_path and emit_stats. Unknown fields are an error.
+func LoadConfigFile(path string) (*Config, error) {
+	config := &Config{}
+	if err := configfile.LoadFile(path, config); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// LoadConfigEnv reads a config from environment variables named after the
+// snake case of the Config fields with the EnvPrefix, like
+// LEMMA_SECRET_KEY_PATH. Lists are comma separated. Every variable that
+// can't be parsed is reported along with any validation errors.
+func LoadConfigEnv() (*Config, error) {
+	config := &Config{}
+	env := &configfile.EnvReader{Prefix: EnvPrefix}
+
+	env.String("KEY_RING_PATH", &config.KeyRingPath)
+	env.String("KEY_PATH", &config.KeyPath)
+	env.Int("KEY_GRACE_PERIOD", &config.KeyGracePeriod)
+	env.Int("STREAM_CHUNK_SIZE", &config.StreamChunkSize)
+
+	var algorithm string
+	var allowedAlgorithms []string
+	env.String("ALGORITHM", &algorithm)
+	env.Strings("ALLOWED_ALGORITHMS", &allowedAlgorithms)
+	config.Algorithm = Algorithm(algorithm)
+	for _, a := range allowedAlgorithms {
+		config.AllowedAlgorithms = append(config.AllowedAlgorithms, Algorithm(a))
+	}
+	env.Bool("EMIT_STATS", &config.EmitStats)
+	env.String("STATSD_HOST", &config.StatsdHost)
+	env.Int("STATSD_PORT", &config.StatsdPort)
+	env.String("STATSD_PREFIX", &config.StatsdPrefix)
+
+	errs := append(env.Errs, config.validate()...)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return config, nil
+}
+
+// Validate checks the config for every problem New would run into and
+// returns them all as ConfigErrors.
+func (c *Config) Validate() error {
+	if errs := c.validate(); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c *Config) validate() ConfigErrors {
+	var errs ConfigErrors
+
+	// key
+	if c.KeyRingPath == "" && c.KeyRing == nil && c.KeyPath == "" && c.KeySource == nil && c.KeyBytes == nil && c.KeyWrapper == nil {
+		errs = append(errs, fmt.Errorf("a key is required: key_path, key_ring_path, KeyRing, KeySource, KeyBytes, or KeyWrapper"))
+	}
+	if c.KeyRingPath != "" {
+		if _, err := os.Stat(c.KeyRingPath); err != nil {
+			errs = append(errs, fmt.Errorf("key_ring_path: %v", err))
+		}
+	}
+	if c.KeyRing != nil {
+		if err := c.KeyRing.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("key_ring: %v", err))
+		}
+	}
+	if c.KeyPath != "" {
+		if _, err := os.Stat(c.KeyPath); err != nil {
+			errs = append(errs, fmt.Errorf("key_path: %v", err))
+		}
+	}
+	if c.KeyGracePeriod < 0 {
+		errs = append(errs, fmt.Errorf("key_grace_period must not be negative"))
+	}
+
+	// streams
+	if c.StreamChunkSize < 0 || c.StreamChunkSize > MaxStreamChunkSize {
+		errs = append(errs, fmt.Errorf("stream_chunk_size must be between 0 and %v", MaxStreamChunkSize))
+	}
+
+	// algorithms
+	if c.Algorithm != "" && !c.Algorithm.Valid() {
+		errs = append(errs, fmt.Errorf("algorithm: unsupported algorithm: %q", c.Algorithm))
+	}
+	for i, algorithm := range c.AllowedAlgorithms {
+		if !algorithm.Valid() {
+			errs = append(errs, fmt.Errorf("allowed_algorithms[%v]: unsupported algorithm: %q", i, algorithm))
+		}
+	}
+	if len(c.AllowedAlgorithms) > 0 {
+		algorithm := c.Algorithm
+		if algorithm == "" {
+			algorithm = Salsa20Poly1305
+		}
+		if err := checkAllowedAlgorithms(algorithm, c.AllowedAlgorithms); err != nil {
+			errs = append(errs, fmt.Errorf("allowed_algorithms: %v", err))
+		}
+	}
+
+	// metrics
+	if c.EmitStats {
+		if c.StatsdHost == "" {
+			errs = append(errs, fmt.Errorf("statsd_host is required to emit stats"))
+		}
+		if c.StatsdPort < 1 || c.StatsdPort > 65535 {
+			errs = append(errs, fmt.Errorf("statsd_port must be between 1 and 65535 to emit stats"))
+		}
+	}
+
+	return errs
+}
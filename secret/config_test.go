@@ -0,0 +1,158 @@
+package secret
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var _ = fmt.Printf // for testing
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lemma")
+	if err != nil {
+		t.Fatalf("Got unexpected error from ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := filepath.Join(dir, "test.key")
+	ioutil.WriteFile(keyPath, []byte("AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"key_path": "`+keyPath+`", "statsd_prefix": "app"}`), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "config.yml"), []byte("key_path: "+keyPath+"\nstatsd_prefix: app\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "invalid.json"), []byte(`{"emit_stats": true}`), 0600)
+
+	want := &Config{KeyPath: keyPath, StatsdPrefix: "app"}
+	for _, name := range []string{"config.json", "config.yml"} {
+		config, err := LoadConfigFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from LoadConfigFile: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(config, want) {
+			t.Errorf("[%v] Config: Got %+v, Want %+v", name, config, want)
+		}
+	}
+
+	// key, statsd host, and statsd port are all reported
+	_, err = LoadConfigFile(filepath.Join(dir, "invalid.json"))
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("Expected ConfigErrors, got: %v", err)
+	}
+	if g, w := len(errs), 3; g != w {
+		t.Errorf("Errors: Got %v, Want %v (%v)", g, w, errs)
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	os.Setenv("LEMMA_SECRET_KEY_PATH", "/does/not/exist")
+	defer os.Unsetenv("LEMMA_SECRET_KEY_PATH")
+	os.Setenv("LEMMA_SECRET_EMIT_STATS", "yes")
+	defer os.Unsetenv("LEMMA_SECRET_EMIT_STATS")
+
+	// key path and emit stats are both reported
+	_, err := LoadConfigEnv()
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("Expected ConfigErrors, got: %v", err)
+	}
+	if g, w := len(errs), 2; g != w {
+		t.Errorf("Errors: Got %v, Want %v (%v)", g, w, errs)
+	}
+
+	// valid
+	keyFile, err := ioutil.TempFile("", "lemma")
+	if err != nil {
+		t.Fatalf("Got unexpected error from ioutil.TempFile: %v", err)
+	}
+	defer os.Remove(keyFile.Name())
+	os.Setenv("LEMMA_SECRET_KEY_PATH", keyFile.Name())
+	os.Setenv("LEMMA_SECRET_EMIT_STATS", "false")
+	os.Setenv("LEMMA_SECRET_ALGORITHM", "aes256_gcm")
+	defer os.Unsetenv("LEMMA_SECRET_ALGORITHM")
+	os.Setenv("LEMMA_SECRET_ALLOWED_ALGORITHMS", "aes256_gcm, salsa20_poly1305")
+	defer os.Unsetenv("LEMMA_SECRET_ALLOWED_ALGORITHMS")
+
+	config, err := LoadConfigEnv()
+	if err != nil {
+		t.Fatalf("Got unexpected error from LoadConfigEnv: %v", err)
+	}
+	if g, w := config.KeyPath, keyFile.Name(); g != w {
+		t.Errorf("KeyPath: Got %v, Want %v", g, w)
+	}
+	if g, w := config.Algorithm, AES256GCM; g != w {
+		t.Errorf("Algorithm: Got %v, Want %v", g, w)
+	}
+	if g, w := fmt.Sprint(config.AllowedAlgorithms), "[aes256_gcm salsa20_poly1305]"; g != w {
+		t.Errorf("AllowedAlgorithms: Got %v, Want %v", g, w)
+	}
+
+	// unsupported algorithms are reported
+	os.Setenv("LEMMA_SECRET_ALGORITHM", "rot13")
+	if _, err := LoadConfigEnv(); err == nil {
+		t.Errorf("LoadConfigEnv should fail with an unsupported algorithm")
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	var key [SecretKeyLength]byte
+	wrapper := &localKeyWrapper{kek: &key}
+
+	// any one of the keys is enough
+	for i, config := range []*Config{
+		{KeyBytes: &key},
+		{KeyRing: &KeyRing{Primary: "a", Keys: map[string]*[SecretKeyLength]byte{"a": &key}}},
+		{KeyWrapper: wrapper},
+	} {
+		if err := config.Validate(); err != nil {
+			t.Errorf("[%v] Got unexpected error from Validate: %v", i, err)
+		}
+	}
+
+	// without one, every option is named
+	err := (&Config{}).Validate()
+	if err == nil {
+		t.Fatalf("Validate should fail without a key")
+	}
+	for _, option := range []string{"key_path", "key_ring_path", "KeyRing", "KeySource", "KeyBytes", "KeyWrapper"} {
+		if !strings.Contains(err.Error(), option) {
+			t.Errorf("Error should name %v: %v", option, err)
+		}
+	}
+}
+
+func TestValidateAllowedAlgorithms(t *testing.T) {
+	var key [SecretKeyLength]byte
+
+	var tests = []struct {
+		inAlgorithm Algorithm
+		inAllowed   []Algorithm
+		outErr      bool
+	}{
+		{"", nil, false},
+		{"", []Algorithm{Salsa20Poly1305, XChaCha20Poly1305}, false},
+		{AES256GCM, []Algorithm{AES256GCM}, false},
+		{XChaCha20Poly1305, []Algorithm{XChaCha20Poly1305}, false},
+		// SealWithAAD seals with XChaCha20Poly1305
+		{"", []Algorithm{Salsa20Poly1305}, true},
+		{Salsa20Poly1305, []Algorithm{Salsa20Poly1305, AES256GCM}, true},
+		// Seal seals with Algorithm
+		{AES256GCM, []Algorithm{Salsa20Poly1305, XChaCha20Poly1305}, true},
+		{"", []Algorithm{XChaCha20Poly1305}, true},
+	}
+
+	for i, tt := range tests {
+		config := &Config{KeyBytes: &key, Algorithm: tt.inAlgorithm, AllowedAlgorithms: tt.inAllowed}
+		err := config.Validate()
+		if g, w := err != nil, tt.outErr; g != w {
+			t.Errorf("[%v] Validate: Got %v, Want error %v", i, err, w)
+		}
+		if err != nil && !strings.Contains(err.Error(), "allowed_algorithms") {
+			t.Errorf("[%v] Error should name allowed_algorithms: %v", i, err)
+		}
+	}
+}
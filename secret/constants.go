@@ -1,4 +1,6 @@
 package secret
 
-const NonceLength = 24     // length of nonce
-const SecretKeyLength = 32 // lenght of secret key
+const NonceLength = 24      // length of nonce
+const SecretKeyLength = 32  // lenght of secret key
+const PublicKeyLength = 32  // length of public key
+const PrivateKeyLength = 32 // length of private key
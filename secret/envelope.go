@@ -0,0 +1,175 @@
+package secret
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// KeyWrapper wraps (encrypts) and unwraps data keys with a key encryption key
+// (KEK) that never leaves it, like a KMS. With a KeyWrapper configured every
+// Seal creates a new data key, seals the message with it, and sends the
+// wrapped data key along in the SealedData. Open unwraps it again, so the
+// service never holds the KEK.
+type KeyWrapper interface {
+	WrapKey(dataKey *[SecretKeyLength]byte) ([]byte, error)
+	UnwrapKey(wrappedKey []byte) (*[SecretKeyLength]byte, error)
+}
+
+// localKeyWrapper wraps data keys with a KEK it holds.
+type localKeyWrapper struct {
+	kek *[SecretKeyLength]byte
+}
+
+// NewLocalKeyWrapper returns a KeyWrapper that wraps data keys with the KEK
+// read from keyPath, using XChaCha20Poly1305. Useful for development and
+// tests, or to keep the KEK apart from the keys it protects.
+func NewLocalKeyWrapper(keyPath string) (KeyWrapper, error) {
+	kek, err := ReadKeyFromDisk(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return &localKeyWrapper{kek: kek}, nil
+}
+
+// WrapKey returns the nonce followed by the sealed data key.
+func (l *localKeyWrapper) WrapKey(dataKey *[SecretKeyLength]byte) ([]byte, error) {
+	nonce, err := randomProvider.Bytes(XChaCha20Poly1305.NonceSize())
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %v", err)
+	}
+	wrapped, err := XChaCha20Poly1305.seal(dataKey[:], nil, nonce, l.kek)
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce, wrapped...), nil
+}
+
+func (l *localKeyWrapper) UnwrapKey(wrappedKey []byte) (*[SecretKeyLength]byte, error) {
+	nonceSize := XChaCha20Poly1305.NonceSize()
+	if len(wrappedKey) < nonceSize {
+		return nil, fmt.Errorf("wrapped key too short: %v bytes", len(wrappedKey))
+	}
+	dataKey, err := XChaCha20Poly1305.open(wrappedKey[nonceSize:], nil, wrappedKey[:nonceSize], l.kek)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap key")
+	}
+	return KeySliceToArray(dataKey)
+}
+
+// KMSConfig is used to configure a KMS key wrapper.
+type KMSConfig struct {
+	Address string // default: VAULT_ADDR, for example https://vault.example.com:8200
+	Token   string // default: VAULT_TOKEN
+
+	Mount string // path the transit engine is mounted at, default: transit
+	Key   string // name of the KEK
+
+	Client *http.Client // default: a client with a 10 second timeout
+}
+
+// kms wraps data keys with a HashiCorp Vault style transit engine.
+type kms struct {
+	config KMSConfig
+}
+
+// NewKMSKeyWrapper returns a KeyWrapper that wraps data keys with a named key
+// of a HashiCorp Vault (or compatible) transit engine. Every Seal and Open
+// makes a request to it.
+func NewKMSKeyWrapper(config KMSConfig) (KeyWrapper, error) {
+	if config.Address == "" {
+		config.Address = os.Getenv("VAULT_ADDR")
+	}
+	if config.Token == "" {
+		config.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if config.Mount == "" {
+		config.Mount = "transit"
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if config.Address == "" {
+		return nil, fmt.Errorf("kms address is required")
+	}
+	if config.Key == "" {
+		return nil, fmt.Errorf("kms key name is required")
+	}
+
+	return &kms{config: config}, nil
+}
+
+// WrapKey returns the ciphertext the transit engine returned, like
+// vault:v1:...
+func (k *kms) WrapKey(dataKey *[SecretKeyLength]byte) ([]byte, error) {
+	var response struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	request := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dataKey[:])}
+	if err := k.post("encrypt", request, &response); err != nil {
+		return nil, err
+	}
+	if response.Data.Ciphertext == "" {
+		return nil, fmt.Errorf("kms returned no ciphertext")
+	}
+	return []byte(response.Data.Ciphertext), nil
+}
+
+func (k *kms) UnwrapKey(wrappedKey []byte) (*[SecretKeyLength]byte, error) {
+	var response struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	request := map[string]string{"ciphertext": string(wrappedKey)}
+	if err := k.post("decrypt", request, &response); err != nil {
+		return nil, err
+	}
+	dataKey, err := base64.StdEncoding.DecodeString(response.Data.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode kms plaintext: %v", err)
+	}
+	return KeySliceToArray(dataKey)
+}
+
+// post sends request to the encrypt or decrypt endpoint of the key, and
+// decodes the reply into response.
+func (k *kms) post(operation string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(k.config.Address, "/") + "/v1/" + strings.Trim(k.config.Mount, "/") +
+		"/" + operation + "/" + k.config.Key
+	r, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if k.config.Token != "" {
+		r.Header.Set("X-Vault-Token", k.config.Token)
+	}
+
+	resp, err := k.config.Client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to %v with kms key %v: %v", operation, k.config.Key, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("unable to parse kms response: %v", err)
+	}
+	return nil
+}
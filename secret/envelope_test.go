@@ -0,0 +1,244 @@
+package secret
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var _ = fmt.Printf // for testing
+
+func TestEnvelope(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lemma")
+	if err != nil {
+		t.Fatalf("Got unexpected error from ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	kekPath := filepath.Join(dir, "kek.key")
+	kek := writeKey(t, kekPath)
+
+	keyWrapper, err := NewLocalKeyWrapper(kekPath)
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewLocalKeyWrapper: %v", err)
+	}
+	ss, err := New(&Config{KeyWrapper: keyWrapper})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+	s := ss.(AADSecretService)
+
+	sealed, err := s.Seal([]byte("hello, world"))
+	if err != nil {
+		t.Fatalf("Got unexpected error from Seal: %v", err)
+	}
+	if len(toSealedBytes(sealed).WrappedKeyBytes()) == 0 {
+		t.Fatalf("Seal should include the wrapped data key")
+	}
+	withAAD, err := s.SealWithAAD([]byte("hello, world"), []byte("users/42"))
+	if err != nil {
+		t.Fatalf("Got unexpected error from SealWithAAD: %v", err)
+	}
+
+	// the wrapped key survives both encodings
+	compact, err := SealedDataToCompactString(sealed)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SealedDataToCompactString: %v", err)
+	}
+	fromCompact, err := StringToSealedData(compact)
+	if err != nil {
+		t.Fatalf("Got unexpected error from StringToSealedData: %v", err)
+	}
+	legacy, err := SealedDataToString(sealed)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SealedDataToString: %v", err)
+	}
+	fromLegacy, err := StringToSealedData(legacy)
+	if err != nil {
+		t.Fatalf("Got unexpected error from StringToSealedData: %v", err)
+	}
+
+	// a message sealed with the KEK itself doesn't open
+	withKEK, err := Seal([]byte("hello, world"), kek)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Seal: %v", err)
+	}
+
+	tamperedKey := append([]byte{}, toSealedBytes(sealed).WrappedKeyBytes()...)
+	tamperedKey[len(tamperedKey)-1] ^= 1
+
+	var tests = []struct {
+		inSealed SealedData
+		inAAD    []byte
+		outOK    bool
+	}{
+		{sealed, nil, true},
+		{fromCompact, nil, true},
+		{fromLegacy, nil, true},
+		{withAAD, []byte("users/42"), true},
+		{withAAD, []byte("users/43"), false},
+		{withKEK, nil, false},
+		{&SealedBytes{Ciphertext: sealed.CiphertextBytes(), Nonce: sealed.NonceBytes(), WrappedKey: tamperedKey}, nil, false},
+	}
+
+	for i, tt := range tests {
+		out, err := s.OpenWithAAD(tt.inSealed, tt.inAAD)
+		if g, w := err == nil, tt.outOK; g != w {
+			t.Errorf("[%v] Opened: Got %v, Want %v (%v)", i, g, w, err)
+		}
+		if tt.outOK && string(out) != "hello, world" {
+			t.Errorf("[%v] Plaintext: Got %q, Want %q", i, out, "hello, world")
+		}
+	}
+
+	// without the key wrapper the data key can't be unwrapped
+	if _, err := Open(sealed, kek); err == nil {
+		t.Errorf("Open should fail without the key wrapper")
+	}
+
+	// streams need a key
+	if _, err := s.(*Service).SealStream(ioutil.Discard); err == nil {
+		t.Errorf("SealStream should fail with only a key wrapper")
+	}
+}
+
+func TestEnvelopeReseal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lemma")
+	if err != nil {
+		t.Fatalf("Got unexpected error from ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	kekPath := filepath.Join(dir, "kek.key")
+	writeKey(t, kekPath)
+	keyBytes := randomKey(t)
+
+	keyWrapper, err := NewLocalKeyWrapper(kekPath)
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewLocalKeyWrapper: %v", err)
+	}
+	s, err := New(&Config{KeyBytes: keyBytes, KeyWrapper: keyWrapper})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+
+	// messages sealed before envelope encryption still open, and are
+	// resealed with it
+	sealed, err := Seal([]byte("hello, world"), keyBytes)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Seal: %v", err)
+	}
+	resealed, changed, err := s.(*Service).Reseal(sealed)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Reseal: %v", err)
+	}
+	if !changed || len(toSealedBytes(resealed).WrappedKeyBytes()) == 0 {
+		t.Errorf("Reseal should reseal with envelope encryption")
+	}
+	if _, changed, _ := s.(*Service).Reseal(resealed); changed {
+		t.Errorf("Reseal should not reseal a message sealed with envelope encryption")
+	}
+}
+
+func TestKMSKeyWrapper(t *testing.T) {
+	// a stand-in for a transit engine, that seals with its own key
+	kek := randomKey(t)
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+
+		var request map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var data map[string]string
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/lemma":
+			plaintext, _ := base64.StdEncoding.DecodeString(request["plaintext"])
+			sealed, _ := Seal(plaintext, kek)
+			encoded, _ := SealedDataToCompactString(sealed)
+			data = map[string]string{"ciphertext": "vault:v1:" + encoded}
+		case "/v1/transit/decrypt/lemma":
+			sealed, err := StringToSealedData(strings.TrimPrefix(request["ciphertext"], "vault:v1:"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			plaintext, err := Open(sealed, kek)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data = map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	defer server.Close()
+
+	keyWrapper, err := NewKMSKeyWrapper(KMSConfig{Address: server.URL, Token: "s.token", Key: "lemma"})
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewKMSKeyWrapper: %v", err)
+	}
+	s, err := New(&Config{KeyWrapper: keyWrapper})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+
+	sealed, err := s.Seal([]byte("hello, world"))
+	if err != nil {
+		t.Fatalf("Got unexpected error from Seal: %v", err)
+	}
+	if !strings.HasPrefix(string(toSealedBytes(sealed).WrappedKeyBytes()), "vault:v1:") {
+		t.Errorf("WrappedKeyBytes: Got %q, Want the kms ciphertext", toSealedBytes(sealed).WrappedKeyBytes())
+	}
+	out, err := s.Open(sealed)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Open: %v", err)
+	}
+	if g, w := string(out), "hello, world"; g != w {
+		t.Errorf("Plaintext: Got %v, Want %v", g, w)
+	}
+	if g, w := strings.Join(requests, ","), "POST /v1/transit/encrypt/lemma,POST /v1/transit/decrypt/lemma"; g != w {
+		t.Errorf("Requests: Got %v, Want %v", g, w)
+	}
+
+	// kms errors are passed on
+	var tests = []KMSConfig{
+		{Address: server.URL, Token: "s.wrong", Key: "lemma"},
+		{Address: server.URL, Token: "s.token", Key: "other"},
+	}
+	for i, config := range tests {
+		keyWrapper, err := NewKMSKeyWrapper(config)
+		if err != nil {
+			t.Fatalf("[%v] Got unexpected error from NewKMSKeyWrapper: %v", i, err)
+		}
+		s, err := New(&Config{KeyWrapper: keyWrapper})
+		if err != nil {
+			t.Fatalf("[%v] Got unexpected error from New: %v", i, err)
+		}
+		if _, err := s.Seal([]byte("hello, world")); err == nil {
+			t.Errorf("[%v] Seal should fail when the kms fails", i)
+		}
+		if _, err := s.Open(sealed); err == nil {
+			t.Errorf("[%v] Open should fail when the kms fails", i)
+		}
+	}
+
+	if _, err := NewKMSKeyWrapper(KMSConfig{Address: server.URL}); err == nil {
+		t.Errorf("NewKMSKeyWrapper should fail without a key name")
+	}
+}
@@ -0,0 +1,326 @@
+package secret
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// FieldError is returned by EncryptFields and DecryptFields when a field
+// can't be sealed or opened. Path is the field's path from the struct passed
+// in, like Addresses[1].Street.
+type FieldError struct {
+	Path string
+	Err  error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("field %v: %v", e.Path, e.Err)
+}
+
+// EncryptFields seals every string, *string and []byte field of the struct v
+// points to that is tagged `lemma:"encrypt"`, following nested structs,
+// slices, arrays and pointers. Empty fields and nil pointers are left alone.
+//
+// By default the sealed value replaces the plaintext: a string field holds
+// SealedDataToCompactString, a []byte field the binary format. With
+// `lemma:"encrypt,field=Other"` it is stored in the string, *string or []byte
+// field Other of the same struct instead, and the plaintext field is cleared:
+//
+//	type User struct {
+//		Name        string
+//		Email       string `lemma:"encrypt,field=SealedEmail" json:"-"`
+//		SealedEmail string
+//		Token       []byte `lemma:"encrypt"`
+//	}
+//
+// Every field is sealed with SealWithAAD, with the field's path as associated
+// data, so a sealed value only opens in the field it was sealed for. The path
+// leaves out slice and array indexes, like Addresses[].Street, so elements
+// can be added, removed and reordered while they are sealed.
+//
+// If a field can't be sealed, the error is a *FieldError and the fields
+// already sealed are put back, so v is left as it was. EncryptFields doesn't
+// know if a field is already sealed, calling it twice seals twice.
+func (s *Service) EncryptFields(v interface{}) error {
+	return s.EncryptFieldsWithAAD(v, nil)
+}
+
+// DecryptFields opens every field sealed by EncryptFields, putting the
+// plaintext back in the tagged field. Like EncryptFields, it leaves v as it
+// was if a field can't be opened.
+func (s *Service) DecryptFields(v interface{}) error {
+	return s.DecryptFieldsWithAAD(v, nil)
+}
+
+// EncryptFieldsWithAAD is EncryptFields, with aad authenticated along with
+// every field's path. Pass something that identifies the record, like its
+// ID, so sealed values can't be copied to another record either.
+func (s *Service) EncryptFieldsWithAAD(v interface{}, aad []byte) error {
+	return walkFields(v, func(w *fieldWalker, path string, field reflect.Value, companion reflect.Value) error {
+		return s.encryptField(w, fieldAAD(path, aad), field, companion)
+	})
+}
+
+// DecryptFieldsWithAAD opens every field sealed by EncryptFieldsWithAAD with
+// the same aad.
+func (s *Service) DecryptFieldsWithAAD(v interface{}, aad []byte) error {
+	return walkFields(v, func(w *fieldWalker, path string, field reflect.Value, companion reflect.Value) error {
+		return s.decryptField(w, fieldAAD(path, aad), field, companion)
+	})
+}
+
+// fieldAAD returns the associated data a field is sealed with: its path
+// without indexes, then the caller's associated data. Paths never contain a
+// zero byte.
+func fieldAAD(path string, aad []byte) []byte {
+	out := make([]byte, 0, len(path)+1+len(aad))
+	out = append(out, path...)
+	out = append(out, 0)
+	return append(out, aad...)
+}
+
+func (s *Service) encryptField(w *fieldWalker, aad []byte, field reflect.Value, companion reflect.Value) error {
+	plaintext := fieldBytes(field)
+	if len(plaintext) == 0 {
+		return nil
+	}
+
+	sealed, err := s.SealWithAAD(plaintext, aad)
+	if err != nil {
+		return err
+	}
+
+	dst := field
+	if companion.IsValid() {
+		dst = companion
+		w.set(field, reflect.Zero(field.Type()))
+	}
+
+	var encoded []byte
+	if dst.Kind() == reflect.Slice {
+		encoded, err = toSealedBytes(sealed).MarshalBinary()
+	} else {
+		var compact string
+		compact, err = SealedDataToCompactString(sealed)
+		encoded = []byte(compact)
+	}
+	if err != nil {
+		return err
+	}
+	w.set(dst, fieldValue(dst.Type(), encoded))
+	return nil
+}
+
+func (s *Service) decryptField(w *fieldWalker, aad []byte, field reflect.Value, companion reflect.Value) error {
+	src := field
+	if companion.IsValid() {
+		src = companion
+	}
+	encoded := fieldBytes(src)
+	if len(encoded) == 0 {
+		return nil
+	}
+
+	var sealed SealedData
+	if src.Kind() == reflect.Slice {
+		var sb SealedBytes
+		if err := sb.UnmarshalBinary(encoded); err != nil {
+			return err
+		}
+		sealed = &sb
+	} else {
+		var err error
+		if sealed, err = StringToSealedData(string(encoded)); err != nil {
+			return err
+		}
+	}
+
+	plaintext, err := s.OpenWithAAD(sealed, aad)
+	if err != nil {
+		return err
+	}
+
+	if companion.IsValid() {
+		w.set(companion, reflect.Zero(companion.Type()))
+	}
+	w.set(field, fieldValue(field.Type(), plaintext))
+	return nil
+}
+
+// fieldBytes returns the contents of a string, *string or []byte field.
+func fieldBytes(field reflect.Value) []byte {
+	switch field.Kind() {
+	case reflect.String:
+		return []byte(field.String())
+	case reflect.Ptr:
+		if field.IsNil() {
+			return nil
+		}
+		return []byte(field.Elem().String())
+	}
+	return field.Bytes()
+}
+
+// fieldValue returns a value of the string, *string or []byte type t holding
+// b. A *string points to a new string, the old one may be shared.
+func fieldValue(t reflect.Type, b []byte) reflect.Value {
+	switch t.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(string(b)).Convert(t)
+	case reflect.Ptr:
+		p := reflect.New(t.Elem())
+		p.Elem().SetString(string(b))
+		return p
+	}
+	return reflect.ValueOf(b).Convert(t)
+}
+
+// walkFields calls fn with the path without indexes of every field tagged
+// `lemma:"encrypt"` in the struct v points to, and its companion field if it
+// has one. fn changes fields through the walker, so they can be put back if a
+// later field fails.
+func walkFields(v interface{}, fn fieldFunc) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("fields can only be sealed through a non-nil pointer, got: %T", v)
+	}
+
+	w := &fieldWalker{fn: fn, seen: map[uintptr]bool{}}
+	if err := w.walk("", "", rv); err != nil {
+		w.rollback()
+		return err
+	}
+	return nil
+}
+
+type fieldFunc func(w *fieldWalker, path string, field reflect.Value, companion reflect.Value) error
+
+// fieldWalker follows structs, slices, arrays and pointers, remembering the
+// pointers it has followed so cycles are only walked once, and the values of
+// the fields it changed.
+type fieldWalker struct {
+	fn   fieldFunc
+	seen map[uintptr]bool
+	undo []func()
+}
+
+// set sets field to value, remembering the old value.
+func (w *fieldWalker) set(field reflect.Value, value reflect.Value) {
+	old := reflect.New(field.Type()).Elem()
+	old.Set(field)
+	w.undo = append(w.undo, func() { field.Set(old) })
+	field.Set(value)
+}
+
+// rollback puts back every field set, last first.
+func (w *fieldWalker) rollback() {
+	for i := len(w.undo) - 1; i >= 0; i-- {
+		w.undo[i]()
+	}
+	w.undo = nil
+}
+
+// walk follows v. path is reported in errors, aadPath is path without the
+// indexes.
+func (w *fieldWalker) walk(path string, aadPath string, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || w.seen[v.Pointer()] {
+			return nil
+		}
+		w.seen[v.Pointer()] = true
+		return w.walk(path, aadPath, v.Elem())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := w.walk(fmt.Sprintf("%v[%v]", path, i), aadPath+"[]", v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		return w.walkStruct(path, aadPath, v)
+	}
+	return nil
+}
+
+func (w *fieldWalker) walkStruct(path string, aadPath string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		fieldPath, fieldAADPath := sf.Name, sf.Name
+		if path != "" {
+			fieldPath = path + "." + sf.Name
+			fieldAADPath = aadPath + "." + sf.Name
+		}
+
+		tag, ok := sf.Tag.Lookup("lemma")
+		if !ok {
+			if sf.PkgPath == "" {
+				if err := w.walk(fieldPath, fieldAADPath, v.Field(i)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		companion, err := taggedField(v, sf, tag)
+		if err == nil {
+			err = w.fn(w, fieldAADPath, v.Field(i), companion)
+		}
+		if err != nil {
+			return &FieldError{Path: fieldPath, Err: err}
+		}
+	}
+	return nil
+}
+
+// taggedField checks a field tagged `lemma:"..."` can be sealed, and returns
+// its companion field if it has one.
+func taggedField(v reflect.Value, sf reflect.StructField, tag string) (reflect.Value, error) {
+	options := strings.Split(tag, ",")
+	if options[0] != "encrypt" {
+		return reflect.Value{}, fmt.Errorf("unsupported lemma tag: %q", tag)
+	}
+	if sf.PkgPath != "" {
+		return reflect.Value{}, fmt.Errorf("unexported fields can't be sealed")
+	}
+	if !isSealable(sf.Type) {
+		return reflect.Value{}, fmt.Errorf("only string, *string and []byte fields can be sealed, not %v", sf.Type)
+	}
+
+	var companion reflect.Value
+	for _, option := range options[1:] {
+		name := strings.TrimPrefix(option, "field=")
+		if name == option {
+			return reflect.Value{}, fmt.Errorf("unsupported lemma tag option: %q", option)
+		}
+
+		csf, ok := v.Type().FieldByName(name)
+		if !ok || len(csf.Index) != 1 || name == sf.Name {
+			return reflect.Value{}, fmt.Errorf("no companion field: %v", name)
+		}
+		if csf.PkgPath != "" || !isSealable(csf.Type) {
+			return reflect.Value{}, fmt.Errorf("companion field %v must be an exported string, *string or []byte", name)
+		}
+		companion = v.FieldByIndex(csf.Index)
+	}
+
+	return companion, nil
+}
+
+// isSealable returns whether a field of type t can hold a plaintext or a
+// sealed value.
+func isSealable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.Uint8
+	case reflect.Ptr:
+		return t.Elem().Kind() == reflect.String
+	}
+	return false
+}
@@ -0,0 +1,341 @@
+package secret
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var _ = fmt.Printf // for testing
+
+type testAddress struct {
+	City   string
+	Street string `lemma:"encrypt"`
+}
+
+type testUser struct {
+	Name         string
+	Email        string `lemma:"encrypt,field=SealedEmail"`
+	SealedEmail  string
+	Token        []byte `lemma:"encrypt"`
+	Secret       []byte `lemma:"encrypt,field=SealedSecret"`
+	SealedSecret []byte
+	Empty        string  `lemma:"encrypt"`
+	Phone        *string `lemma:"encrypt"`
+	Fax          *string `lemma:"encrypt"`
+
+	Home      testAddress
+	Work      *testAddress
+	Previous  []testAddress
+	Contacts  []*testUser
+	Addresses [2]testAddress
+}
+
+func newTestUser() *testUser {
+	phone := "555-0100"
+	return &testUser{
+		Phone:  &phone,
+		Name:   "Alice",
+		Email:  "alice@example.com",
+		Token:  []byte("token"),
+		Secret: []byte("secret"),
+		Home:   testAddress{City: "Austin", Street: "1 Main St"},
+		Work:   &testAddress{City: "Austin", Street: "2 Congress Ave"},
+		Previous: []testAddress{
+			{City: "Boston", Street: "3 Beacon St"},
+			{City: "Denver"},
+		},
+		Contacts:  []*testUser{{Name: "Bob", Email: "bob@example.com"}, nil},
+		Addresses: [2]testAddress{{Street: "4 Elm St"}},
+	}
+}
+
+func TestEncryptFields(t *testing.T) {
+	s, err := newFieldsService(t)
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+
+	user := newTestUser()
+	user.Contacts = append(user.Contacts, user) // cycles are walked once
+	if err := s.EncryptFieldsWithAAD(user, []byte("user-1")); err != nil {
+		t.Fatalf("Got unexpected error from EncryptFields: %v", err)
+	}
+
+	// untagged fields are left alone, tagged fields are sealed in place or
+	// in their companion field
+	if g, w := user.Name, "Alice"; g != w {
+		t.Errorf("Name: Got %v, Want %v", g, w)
+	}
+	if g, w := user.Home.City, "Austin"; g != w {
+		t.Errorf("Home.City: Got %v, Want %v", g, w)
+	}
+	if user.Email != "" || user.SealedEmail == "" {
+		t.Errorf("Email: Got %q, %q, Want the email sealed in SealedEmail", user.Email, user.SealedEmail)
+	}
+	if user.Fax != nil {
+		t.Errorf("Fax: Got %q, Want nil", *user.Fax)
+	}
+	if len(user.Secret) != 0 || len(user.SealedSecret) == 0 {
+		t.Errorf("Secret: Got %q, %q, Want the secret sealed in SealedSecret", user.Secret, user.SealedSecret)
+	}
+	if g, w := user.Empty, ""; g != w {
+		t.Errorf("Empty: Got %q, Want %q", g, w)
+	}
+	if g, w := user.Previous[1].Street, ""; g != w {
+		t.Errorf("Previous[1].Street: Got %q, Want %q", g, w)
+	}
+	var sealedTests = []struct {
+		inPath   string
+		inValue  string
+		outPlain string
+	}{
+		{"Token", string(user.Token), "token"},
+		{"Phone", *user.Phone, "555-0100"},
+		{"Home.Street", user.Home.Street, "1 Main St"},
+		{"Work.Street", user.Work.Street, "2 Congress Ave"},
+		{"Previous[0].Street", user.Previous[0].Street, "3 Beacon St"},
+		{"Contacts[0].Email", user.Contacts[0].SealedEmail, "bob@example.com"},
+		{"Addresses[0].Street", user.Addresses[0].Street, "4 Elm St"},
+	}
+	for _, tt := range sealedTests {
+		if tt.inValue == "" || strings.Contains(tt.inValue, tt.outPlain) {
+			t.Errorf("%v: Got %q, Want it sealed", tt.inPath, tt.inValue)
+		}
+	}
+
+	// the sealed strings can be opened on their own, with the field's path
+	// and the record's associated data
+	sealed, err := StringToSealedData(user.Home.Street)
+	if err != nil {
+		t.Fatalf("Got unexpected error from StringToSealedData: %v", err)
+	}
+	if out, err := s.OpenWithAAD(sealed, []byte("Home.Street\x00user-1")); err != nil || string(out) != "1 Main St" {
+		t.Errorf("Home.Street: Got %q, %v, Want %q", out, err, "1 Main St")
+	}
+
+	if err := s.DecryptFieldsWithAAD(user, []byte("user-1")); err != nil {
+		t.Fatalf("Got unexpected error from DecryptFields: %v", err)
+	}
+	user.Contacts = user.Contacts[:2]
+	if g, w := user, newTestUser(); !reflect.DeepEqual(g, w) {
+		t.Errorf("DecryptFields: Got %+v, Want %+v", g, w)
+	}
+}
+
+// newFieldsService returns a Service with a random key.
+func newFieldsService(t *testing.T) (*Service, error) {
+	s, err := New(&Config{KeyBytes: randomKey(t)})
+	if err != nil {
+		return nil, err
+	}
+	return s.(*Service), nil
+}
+
+func TestDecryptFieldsSwapped(t *testing.T) {
+	s, err := newFieldsService(t)
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+
+	alice, bob := newTestUser(), newTestUser()
+	bob.Home.Street = "5 Oak St"
+	if err := s.EncryptFieldsWithAAD(alice, []byte("user-1")); err != nil {
+		t.Fatalf("Got unexpected error from EncryptFields: %v", err)
+	}
+	if err := s.EncryptFieldsWithAAD(bob, []byte("user-2")); err != nil {
+		t.Fatalf("Got unexpected error from EncryptFields: %v", err)
+	}
+
+	var tests = []struct {
+		inSwap func(u *testUser)
+		inAAD  string
+		outErr string
+	}{
+		// a value copied to another field
+		{func(u *testUser) { u.Work.Street = u.Home.Street }, "user-1", "Work.Street"},
+		// a value copied to a field of another element
+		{func(u *testUser) { u.Addresses[1].Street = u.Previous[0].Street }, "user-1", "Addresses[1].Street"},
+		// a value copied from another record
+		{func(u *testUser) { u.Home.Street = bob.Home.Street }, "user-1", "Home.Street"},
+		// the wrong record
+		{func(u *testUser) {}, "user-2", "Email"},
+	}
+
+	for i, tt := range tests {
+		// DecryptFields fails, so it leaves what user shares with alice alone
+		user := *alice
+		work := *alice.Work
+		user.Work = &work
+		tt.inSwap(&user)
+
+		err := s.DecryptFieldsWithAAD(&user, []byte(tt.inAAD))
+		var fieldErr *FieldError
+		if !errors.As(err, &fieldErr) {
+			t.Errorf("[%v] DecryptFields: Got %v, Want a FieldError", i, err)
+			continue
+		}
+		if g, w := fieldErr.Path, tt.outErr; g != w {
+			t.Errorf("[%v] Path: Got %v, Want %v", i, g, w)
+		}
+	}
+}
+
+func TestDecryptFieldsReordered(t *testing.T) {
+	s, err := newFieldsService(t)
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+
+	user := newTestUser()
+	user.Previous = []testAddress{{Street: "3 Beacon St"}, {Street: "6 Pine St"}, {Street: "7 Lake Dr"}}
+	if err := s.EncryptFieldsWithAAD(user, []byte("user-1")); err != nil {
+		t.Fatalf("Got unexpected error from EncryptFields: %v", err)
+	}
+
+	// the paths leave indexes out, so elements can be removed and reordered
+	// while they are sealed
+	user.Previous = []testAddress{user.Previous[2], user.Previous[0]}
+	if err := s.DecryptFieldsWithAAD(user, []byte("user-1")); err != nil {
+		t.Fatalf("Got unexpected error from DecryptFields: %v", err)
+	}
+	want := []testAddress{{Street: "7 Lake Dr"}, {Street: "3 Beacon St"}}
+	if g, w := user.Previous, want; !reflect.DeepEqual(g, w) {
+		t.Errorf("Previous: Got %+v, Want %+v", g, w)
+	}
+}
+
+func TestEncryptFieldsRollback(t *testing.T) {
+	s, err := newFieldsService(t)
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+
+	type broken struct {
+		User testUser
+		Age  int `lemma:"encrypt"`
+	}
+
+	// the user's fields are sealed before Age fails, and are put back
+	in := &broken{User: *newTestUser(), Age: 42}
+	err = s.EncryptFields(in)
+	var fieldErr *FieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Path != "Age" {
+		t.Fatalf("EncryptFields: Got %v, Want a FieldError for Age", err)
+	}
+	if g, w := &in.User, newTestUser(); !reflect.DeepEqual(g, w) {
+		t.Errorf("EncryptFields: Got %+v, Want %+v", g, w)
+	}
+
+	// the same when opening
+	user := newTestUser()
+	if err := s.EncryptFields(user); err != nil {
+		t.Fatalf("Got unexpected error from EncryptFields: %v", err)
+	}
+	sealed := *user
+	user.Addresses[0].Street = "not sealed"
+	sealed.Addresses = user.Addresses
+	if err := s.DecryptFields(user); err == nil {
+		t.Fatalf("DecryptFields should fail with a field that isn't sealed")
+	}
+	if g, w := user, &sealed; !reflect.DeepEqual(g, w) {
+		t.Errorf("DecryptFields: Got %+v, Want %+v", g, w)
+	}
+}
+
+func TestDecryptFieldsError(t *testing.T) {
+	s, err := newFieldsService(t)
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+	other, err := newFieldsService(t)
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+
+	user := newTestUser()
+	if err := s.EncryptFieldsWithAAD(user, []byte("user-1")); err != nil {
+		t.Fatalf("Got unexpected error from EncryptFields: %v", err)
+	}
+	user.Previous[0].Street = "not sealed"
+
+	err = other.DecryptFieldsWithAAD(user, []byte("user-1"))
+	var fieldErr *FieldError
+	if !errors.As(err, &fieldErr) {
+		t.Fatalf("DecryptFields: Got %v, Want a FieldError", err)
+	}
+	if g, w := fieldErr.Path, "Email"; g != w {
+		t.Errorf("Path: Got %v, Want %v", g, w)
+	}
+
+	err = s.DecryptFieldsWithAAD(user, []byte("user-1"))
+	if !errors.As(err, &fieldErr) {
+		t.Fatalf("DecryptFields: Got %v, Want a FieldError", err)
+	}
+	if g, w := fieldErr.Path, "Previous[0].Street"; g != w {
+		t.Errorf("Path: Got %v, Want %v", g, w)
+	}
+}
+
+func TestEncryptFieldsInvalid(t *testing.T) {
+	s, err := newFieldsService(t)
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+
+	type wrongType struct {
+		Age int `lemma:"encrypt"`
+	}
+	type wrongTag struct {
+		Name string `lemma:"hash"`
+	}
+	type wrongOption struct {
+		Name string `lemma:"encrypt,aad"`
+	}
+	type noCompanion struct {
+		Name string `lemma:"encrypt,field=Sealed"`
+	}
+	type wrongCompanion struct {
+		Name   string `lemma:"encrypt,field=Sealed"`
+		Sealed int
+	}
+	type unexported struct {
+		name string `lemma:"encrypt"`
+	}
+	type nested struct {
+		Users []wrongType
+	}
+
+	var tests = []struct {
+		in      interface{}
+		outPath string
+	}{
+		{&wrongType{Age: 42}, "Age"},
+		{&wrongTag{Name: "Alice"}, "Name"},
+		{&wrongOption{Name: "Alice"}, "Name"},
+		{&noCompanion{Name: "Alice"}, "Name"},
+		{&wrongCompanion{Name: "Alice"}, "Name"},
+		{&unexported{name: "Alice"}, "name"},
+		{&nested{Users: []wrongType{{}, {}}}, "Users[0].Age"},
+	}
+
+	for i, tt := range tests {
+		err := s.EncryptFields(tt.in)
+		var fieldErr *FieldError
+		if !errors.As(err, &fieldErr) {
+			t.Errorf("[%v] EncryptFields: Got %v, Want a FieldError", i, err)
+			continue
+		}
+		if g, w := fieldErr.Path, tt.outPath; g != w {
+			t.Errorf("[%v] Path: Got %v, Want %v", i, g, w)
+		}
+	}
+
+	for i, v := range []interface{}{nil, testUser{}, (*testUser)(nil)} {
+		if err := s.EncryptFields(v); err == nil {
+			t.Errorf("[%v] EncryptFields should fail without a pointer", i)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"strings"
 )
 
 // NewKey returns a new key that can be used to encrypt and decrypt messages.
@@ -34,6 +35,46 @@ func KeyToEncodedString(keybytes *[SecretKeyLength]byte) string {
 	return base64.StdEncoding.EncodeToString(keybytes[:])
 }
 
+// EncodedStringToPublicKey converts a base64-encoded string into a public key.
+func EncodedStringToPublicKey(encodedKey string) (*[PublicKeyLength]byte, error) {
+	keySlice, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(keySlice) != PublicKeyLength {
+		return nil, fmt.Errorf("wrong public key length: %v", len(keySlice))
+	}
+
+	var publicKey [PublicKeyLength]byte
+	copy(publicKey[:], keySlice)
+	return &publicKey, nil
+}
+
+// PublicKeyToEncodedString converts a public key into a base64-encoded string
+func PublicKeyToEncodedString(publicKey *[PublicKeyLength]byte) string {
+	return base64.StdEncoding.EncodeToString(publicKey[:])
+}
+
+// EncodedStringToPrivateKey converts a base64-encoded string into a private key.
+func EncodedStringToPrivateKey(encodedKey string) (*[PrivateKeyLength]byte, error) {
+	keySlice, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(keySlice) != PrivateKeyLength {
+		return nil, fmt.Errorf("wrong private key length: %v", len(keySlice))
+	}
+
+	var privateKey [PrivateKeyLength]byte
+	copy(privateKey[:], keySlice)
+	return &privateKey, nil
+}
+
+// PrivateKeyToEncodedString converts a private key into a base64-encoded string
+func PrivateKeyToEncodedString(privateKey *[PrivateKeyLength]byte) string {
+	return base64.StdEncoding.EncodeToString(privateKey[:])
+}
+
 // Given SealedData returns equivalent URL safe base64 encoded string.
 func SealedDataToString(sealedData SealedData) (string, error) {
 	b, err := json.Marshal(sealedData)
@@ -44,15 +85,32 @@ func SealedDataToString(sealedData SealedData) (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
-// Given a URL safe base64 encoded string, returns SealedData.
+// Given SealedData returns the URL safe base64 (without padding) of its
+// binary format. It is about half as long as SealedDataToString, which older
+// versions of lemma can still read. StringToSealedData reads both.
+func SealedDataToCompactString(sealedData SealedData) (string, error) {
+	b, err := toSealedBytes(sealedData).MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Given a URL safe base64 encoded string, returns SealedData. Reads both
+// SealedDataToString and SealedDataToCompactString output.
 func StringToSealedData(encodedBytes string) (SealedData, error) {
-	bytes, err := base64.URLEncoding.DecodeString(encodedBytes)
+	bytes, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encodedBytes, "="))
 	if err != nil {
 		return nil, err
 	}
 
 	var sb SealedBytes
-	err = json.Unmarshal(bytes, &sb)
+	if len(bytes) > 0 && bytes[0] == '{' {
+		err = json.Unmarshal(bytes, &sb)
+	} else {
+		err = sb.UnmarshalBinary(bytes)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,217 @@
+package secret
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// KeyRing holds keys by ID. Seal uses the Primary key and records its ID in
+// the sealed data, and Open picks the key by the recorded ID, so a new
+// primary key can be added without losing access to messages sealed with
+// the old ones.
+//
+// A KeyRing is stored as JSON, with base64 encoded keys:
+//
+//	{"primary": "2017-06", "keys": {"2017-01": "...", "2017-06": "..."}}
+type KeyRing struct {
+	Primary string
+	Keys    map[string]*[SecretKeyLength]byte
+}
+
+// keyRingJSON is how a KeyRing is stored.
+type keyRingJSON struct {
+	Primary string            `json:"primary"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// Rotate adds a new random key with the given ID and makes it the primary
+// key. Messages sealed with the other keys can still be opened until they are
+// resealed, see Service.ResealAll.
+func (k *KeyRing) Rotate(id string) error {
+	if _, ok := k.Keys[id]; ok {
+		return fmt.Errorf("key id already in key ring: %q", id)
+	}
+
+	key, err := NewKey()
+	if err != nil {
+		return err
+	}
+
+	if k.Keys == nil {
+		k.Keys = map[string]*[SecretKeyLength]byte{}
+	}
+	k.Keys[id] = key
+	k.Primary = id
+
+	return k.Validate()
+}
+
+// Validate checks the primary key is in the key ring, and that every key ID
+// fits in the binary format.
+func (k *KeyRing) Validate() error {
+	for id, key := range k.Keys {
+		if id == "" || len(id) > 255 {
+			return fmt.Errorf("key id must be 1 to 255 bytes: %q", id)
+		}
+		if key == nil {
+			return fmt.Errorf("key is nil: %q", id)
+		}
+	}
+	if _, ok := k.Keys[k.Primary]; !ok {
+		return fmt.Errorf("primary key not in key ring: %q", k.Primary)
+	}
+	return nil
+}
+
+func (k *KeyRing) MarshalJSON() ([]byte, error) {
+	kj := keyRingJSON{Primary: k.Primary, Keys: map[string]string{}}
+	for id, key := range k.Keys {
+		kj.Keys[id] = KeyToEncodedString(key)
+	}
+	return json.Marshal(kj)
+}
+
+func (k *KeyRing) UnmarshalJSON(b []byte) error {
+	var kj keyRingJSON
+	if err := json.Unmarshal(b, &kj); err != nil {
+		return err
+	}
+
+	keys := map[string]*[SecretKeyLength]byte{}
+	for id, encodedKey := range kj.Keys {
+		key, err := EncodedStringToKey(encodedKey)
+		if err != nil {
+			return fmt.Errorf("invalid key %q: %v", id, err)
+		}
+		keys[id] = key
+	}
+
+	*k = KeyRing{Primary: kj.Primary, Keys: keys}
+	return nil
+}
+
+// ReadKeyRingFromDisk reads a key ring stored as JSON and validates it.
+func ReadKeyRingFromDisk(path string) (*KeyRing, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var k KeyRing
+	if err := json.Unmarshal(b, &k); err != nil {
+		return nil, fmt.Errorf("unable to parse key ring %v: %v", path, err)
+	}
+	if err := k.Validate(); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// clone copies the key ring, so changes to it don't reach the service.
+func (k *KeyRing) clone() *KeyRing {
+	c := &KeyRing{Primary: k.Primary, Keys: map[string]*[SecretKeyLength]byte{}}
+	for id, key := range k.Keys {
+		c.Keys[id] = key
+	}
+	return c
+}
+
+// ids returns the key IDs in order.
+func (k *KeyRing) ids() []string {
+	var ids []string
+	for id := range k.Keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ResealReport summarizes a ResealAll.
+type ResealReport struct {
+	// KeyUsage is how many messages were sealed with each key ID before they
+	// were resealed. Messages sealed without a key ID are counted under "".
+	KeyUsage map[string]int
+
+	Resealed  int // sealed again with the primary key
+	Unchanged int // already sealed with the primary key and algorithm
+}
+
+// KeyUsage counts how many messages were sealed with each key ID. Messages
+// sealed without a key ID are counted under "".
+func KeyUsage(sealed []SealedData) map[string]int {
+	usage := map[string]int{}
+	for _, sd := range sealed {
+		usage[toSealedBytes(sd).KeyID]++
+	}
+	return usage
+}
+
+// Reseal opens a message and, unless it is already sealed with the primary
+// key (or envelope encryption) and the configured algorithm, seals it again
+// with them. It reports if the message was resealed.
+func (s *Service) Reseal(sealed SealedData) (SealedData, bool, error) {
+	return s.reseal(sealed, nil)
+}
+
+// ResealWithAAD is like Reseal, for messages sealed with associated data.
+func (s *Service) ResealWithAAD(sealed SealedData, aad []byte) (SealedData, bool, error) {
+	return s.reseal(sealed, aad)
+}
+
+// ResealAll reseals every message that isn't sealed with the primary key and
+// the configured algorithm, and reports which keys they used. The messages
+// are returned in the same order. It stops at the first message that can't
+// be opened, once every message is resealed the old keys can be removed from
+// the key ring.
+func (s *Service) ResealAll(sealed []SealedData) ([]SealedData, *ResealReport, error) {
+	report := &ResealReport{KeyUsage: KeyUsage(sealed)}
+
+	resealed := make([]SealedData, len(sealed))
+	for i, sd := range sealed {
+		var changed bool
+		var err error
+		resealed[i], changed, err = s.reseal(sd, nil)
+		if err != nil {
+			return nil, report, fmt.Errorf("unable to reseal message %v: %v", i, err)
+		}
+		if changed {
+			report.Resealed++
+		} else {
+			report.Unchanged++
+		}
+	}
+
+	return resealed, report, nil
+}
+
+func (s *Service) reseal(sealed SealedData, aad []byte) (SealedData, bool, error) {
+	algorithm := s.algorithm
+	if len(aad) > 0 {
+		algorithm = s.aadAlgorithm
+	}
+	keyID, _ := s.primaryKey()
+	if s.keyWrapper != nil {
+		keyID = ""
+	}
+	sb := toSealedBytes(sealed)
+	enveloped := len(sb.WrappedKey) > 0
+	if sb.KeyID == keyID && sb.AlgorithmID() == algorithm && enveloped == (s.keyWrapper != nil) {
+		// make sure it still opens
+		if _, err := s.open(sealed, aad); err != nil {
+			return nil, false, err
+		}
+		return sealed, false, nil
+	}
+
+	plaintext, err := s.open(sealed, aad)
+	if err != nil {
+		return nil, false, err
+	}
+	resealed, err := s.seal(algorithm, plaintext, aad)
+	if err != nil {
+		return nil, false, err
+	}
+	return resealed, true, nil
+}
@@ -0,0 +1,358 @@
+package secret
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mailgun/lemma/random"
+)
+
+var _ = fmt.Printf // for testing
+
+// randomKey returns a new random key. It doesn't use NewKey, which other
+// tests make return the same key every time.
+func randomKey(t *testing.T) *[SecretKeyLength]byte {
+	keySlice, err := (&random.CSPRNG{}).Bytes(SecretKeyLength)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Bytes: %v", err)
+	}
+	key, err := KeySliceToArray(keySlice)
+	if err != nil {
+		t.Fatalf("Got unexpected error from KeySliceToArray: %v", err)
+	}
+	return key
+}
+
+func TestKeyRing(t *testing.T) {
+	keyRing := &KeyRing{
+		Primary: "2017-01",
+		Keys:    map[string]*[SecretKeyLength]byte{"2017-01": randomKey(t)},
+	}
+	ss, err := New(&Config{KeyRing: keyRing})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+	oldService := ss.(*Service)
+
+	sealedOld, err := oldService.Seal([]byte("hello, world"))
+	if err != nil {
+		t.Fatalf("Got unexpected error from Seal: %v", err)
+	}
+	if g, w := toSealedBytes(sealedOld).KeyIDString(), "2017-01"; g != w {
+		t.Errorf("KeyIDString: Got %v, Want %v", g, w)
+	}
+
+	// add a new primary key, the service has its own copy of the key ring
+	keyRing.Keys["2017-06"] = randomKey(t)
+	keyRing.Primary = "2017-06"
+	if g, w := oldService.keyRing.Primary, "2017-01"; g != w {
+		t.Errorf("Primary: Got %v, Want %v", g, w)
+	}
+
+	ss, err = New(&Config{KeyRing: keyRing})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+	s := ss.(*Service)
+
+	sealedNew, err := s.Seal([]byte("hello, world"))
+	if err != nil {
+		t.Fatalf("Got unexpected error from Seal: %v", err)
+	}
+	if g, w := toSealedBytes(sealedNew).KeyIDString(), "2017-06"; g != w {
+		t.Errorf("KeyIDString: Got %v, Want %v", g, w)
+	}
+
+	// the key id survives the compact encoding
+	encoded, err := SealedDataToCompactString(sealedNew)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SealedDataToCompactString: %v", err)
+	}
+	decoded, err := StringToSealedData(encoded)
+	if err != nil {
+		t.Fatalf("Got unexpected error from StringToSealedData: %v", err)
+	}
+
+	var tests = []struct {
+		inService *Service
+		inSealed  SealedData
+		outOK     bool
+	}{
+		{s, sealedOld, true},
+		{s, sealedNew, true},
+		{s, decoded, true},
+		{oldService, sealedOld, true},
+		{oldService, sealedNew, false}, // unknown key id
+		{s, &SealedBytes{Ciphertext: sealedOld.CiphertextBytes(), Nonce: sealedOld.NonceBytes()}, true}, // no key id
+		{s, &SealedBytes{Ciphertext: sealedOld.CiphertextBytes(), Nonce: sealedOld.NonceBytes(), KeyID: "2017-06"}, false},
+	}
+
+	for i, tt := range tests {
+		out, err := tt.inService.Open(tt.inSealed)
+		if g, w := err == nil, tt.outOK; g != w {
+			t.Errorf("[%v] Opened: Got %v, Want %v (%v)", i, g, w, err)
+		}
+		if tt.outOK && string(out) != "hello, world" {
+			t.Errorf("[%v] Plaintext: Got %q, Want %q", i, out, "hello, world")
+		}
+	}
+
+	// streams don't record the key id
+	var buf strings.Builder
+	w, err := oldService.SealStream(&buf)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SealStream: %v", err)
+	}
+	w.Write([]byte("hello, world"))
+	w.Close()
+	r, err := s.OpenStream(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatalf("Got unexpected error from OpenStream: %v", err)
+	}
+	if out, err := ioutil.ReadAll(r); err != nil || string(out) != "hello, world" {
+		t.Errorf("OpenStream: Got %q, %v, Want %q", out, err, "hello, world")
+	}
+}
+
+func TestKeyRingValidate(t *testing.T) {
+	key := randomKey(t)
+
+	var tests = []struct {
+		in    *KeyRing
+		outOK bool
+	}{
+		{&KeyRing{Primary: "a", Keys: map[string]*[SecretKeyLength]byte{"a": key}}, true},
+		{&KeyRing{Primary: "b", Keys: map[string]*[SecretKeyLength]byte{"a": key}}, false},
+		{&KeyRing{Primary: "a", Keys: map[string]*[SecretKeyLength]byte{"a": key, "": key}}, false},
+		{&KeyRing{Primary: "a", Keys: map[string]*[SecretKeyLength]byte{"a": key, strings.Repeat("k", 256): key}}, false},
+		{&KeyRing{Primary: "a", Keys: map[string]*[SecretKeyLength]byte{"a": nil}}, false},
+		{&KeyRing{}, false},
+	}
+
+	for i, tt := range tests {
+		err := tt.in.Validate()
+		if g, w := err == nil, tt.outOK; g != w {
+			t.Errorf("[%v] Valid: Got %v, Want %v (%v)", i, g, w, err)
+		}
+		if _, err := New(&Config{KeyRing: tt.in}); (err == nil) != tt.outOK {
+			t.Errorf("[%v] New: Got %v, Want ok %v", i, err, tt.outOK)
+		}
+	}
+}
+
+func TestKeyRingRotate(t *testing.T) {
+	var keyRing KeyRing
+	for _, id := range []string{"2017-01", "2017-06"} {
+		if err := keyRing.Rotate(id); err != nil {
+			t.Fatalf("Got unexpected error from Rotate: %v", err)
+		}
+		if g, w := keyRing.Primary, id; g != w {
+			t.Errorf("Primary: Got %v, Want %v", g, w)
+		}
+	}
+	if g, w := strings.Join(keyRing.ids(), ","), "2017-01,2017-06"; g != w {
+		t.Errorf("ids: Got %v, Want %v", g, w)
+	}
+	if err := keyRing.Rotate("2017-01"); err == nil {
+		t.Errorf("Rotate should fail with a key id already in the key ring")
+	}
+}
+
+func TestKeyRingPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lemma")
+	if err != nil {
+		t.Fatalf("Got unexpected error from ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyRingPath := filepath.Join(dir, "keyring.json")
+
+	keyRing := &KeyRing{Primary: "a", Keys: map[string]*[SecretKeyLength]byte{"a": randomKey(t)}}
+	writeKeyRing(t, keyRingPath, keyRing)
+
+	ss, err := New(&Config{KeyRingPath: keyRingPath})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+	s := ss.(*Service)
+
+	sealedA, err := s.Seal([]byte("hello, world"))
+	if err != nil {
+		t.Fatalf("Got unexpected error from Seal: %v", err)
+	}
+
+	// reloading picks up the new primary key
+	keyRing.Keys["b"] = randomKey(t)
+	keyRing.Primary = "b"
+	writeKeyRing(t, keyRingPath, keyRing)
+	if err := s.ReloadKey(); err != nil {
+		t.Fatalf("Got unexpected error from ReloadKey: %v", err)
+	}
+	sealedB, err := s.Seal([]byte("hello, world"))
+	if err != nil {
+		t.Fatalf("Got unexpected error from Seal: %v", err)
+	}
+	if g, w := toSealedBytes(sealedB).KeyIDString(), "b"; g != w {
+		t.Errorf("KeyIDString: Got %v, Want %v", g, w)
+	}
+	if _, err := s.Open(sealedA); err != nil {
+		t.Errorf("Got unexpected error from Open: %v", err)
+	}
+
+	// a key removed from the key ring stops opening messages
+	delete(keyRing.Keys, "a")
+	writeKeyRing(t, keyRingPath, keyRing)
+	if err := s.ReloadKey(); err != nil {
+		t.Fatalf("Got unexpected error from ReloadKey: %v", err)
+	}
+	if _, err := s.Open(sealedA); err == nil {
+		t.Errorf("Open should fail with a key removed from the key ring")
+	}
+
+	// an invalid key ring is not loaded
+	ioutil.WriteFile(keyRingPath, []byte(`{"primary": "c", "keys": {}}`), 0600)
+	if err := s.ReloadKey(); err == nil {
+		t.Errorf("ReloadKey should fail with an invalid key ring")
+	}
+	if _, err := s.Open(sealedB); err != nil {
+		t.Errorf("Got unexpected error from Open: %v", err)
+	}
+}
+
+func TestResealAll(t *testing.T) {
+	keyRing := &KeyRing{Primary: "a", Keys: map[string]*[SecretKeyLength]byte{"a": randomKey(t)}}
+	ss, err := New(&Config{KeyRing: keyRing})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+
+	var sealed []SealedData
+	for i := 0; i < 3; i++ {
+		sd, err := ss.Seal([]byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatalf("Got unexpected error from Seal: %v", err)
+		}
+		sealed = append(sealed, sd)
+	}
+	// sealed before the service had a key ring
+	sd, err := Seal([]byte("3"), keyRing.Keys["a"])
+	if err != nil {
+		t.Fatalf("Got unexpected error from Seal: %v", err)
+	}
+	sealed = append(sealed, sd)
+
+	keyRing.Keys["b"] = randomKey(t)
+	keyRing.Primary = "b"
+	ss, err = New(&Config{KeyRing: keyRing})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+	s := ss.(*Service)
+
+	sd, err = s.Seal([]byte("4"))
+	if err != nil {
+		t.Fatalf("Got unexpected error from Seal: %v", err)
+	}
+	sealed = append(sealed, sd)
+
+	if g, w := fmt.Sprint(KeyUsage(sealed)), "map[:1 a:3 b:1]"; g != w {
+		t.Errorf("KeyUsage: Got %v, Want %v", g, w)
+	}
+
+	resealed, report, err := s.ResealAll(sealed)
+	if err != nil {
+		t.Fatalf("Got unexpected error from ResealAll: %v", err)
+	}
+	if g, w := fmt.Sprint(report.KeyUsage), "map[:1 a:3 b:1]"; g != w {
+		t.Errorf("KeyUsage: Got %v, Want %v", g, w)
+	}
+	if g, w := report.Resealed, 4; g != w {
+		t.Errorf("Resealed: Got %v, Want %v", g, w)
+	}
+	if g, w := report.Unchanged, 1; g != w {
+		t.Errorf("Unchanged: Got %v, Want %v", g, w)
+	}
+	if g, w := fmt.Sprint(KeyUsage(resealed)), "map[b:5]"; g != w {
+		t.Errorf("KeyUsage after reseal: Got %v, Want %v", g, w)
+	}
+	if resealed[4] != sealed[4] {
+		t.Errorf("Message already sealed with the primary key should be unchanged")
+	}
+
+	// once everything is resealed the old key can go
+	delete(keyRing.Keys, "a")
+	ss, err = New(&Config{KeyRing: keyRing})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+	for i, sd := range resealed {
+		out, err := ss.Open(sd)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from Open: %v", i, err)
+		}
+		if g, w := string(out), fmt.Sprint(i); g != w {
+			t.Errorf("[%v] Plaintext: Got %v, Want %v", i, g, w)
+		}
+	}
+
+	// it stops at the first message that doesn't open
+	_, _, err = ss.(*Service).ResealAll(sealed)
+	if err == nil || !strings.Contains(err.Error(), "message 0") {
+		t.Errorf("ResealAll should fail at message 0: %v", err)
+	}
+}
+
+func TestResealAlgorithm(t *testing.T) {
+	keyBytes := randomKey(t)
+	sealed, err := Seal([]byte("hello, world"), keyBytes)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Seal: %v", err)
+	}
+
+	// resealing also moves messages to the configured algorithm
+	ss, err := New(&Config{KeyBytes: keyBytes, Algorithm: AES256GCM})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+	s := ss.(*Service)
+
+	resealed, changed, err := s.Reseal(sealed)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Reseal: %v", err)
+	}
+	if !changed {
+		t.Errorf("Reseal should reseal a message sealed with another algorithm")
+	}
+	if g, w := toSealedBytes(resealed).AlgorithmID(), AES256GCM; g != w {
+		t.Errorf("AlgorithmID: Got %v, Want %v", g, w)
+	}
+	if _, changed, _ = s.Reseal(resealed); changed {
+		t.Errorf("Reseal should not reseal a message sealed with the configured algorithm")
+	}
+
+	withAAD, err := s.SealWithAAD([]byte("hello, world"), []byte("users/42"))
+	if err != nil {
+		t.Fatalf("Got unexpected error from SealWithAAD: %v", err)
+	}
+	if _, _, err := s.ResealWithAAD(withAAD, []byte("users/43")); err == nil {
+		t.Errorf("ResealWithAAD should fail with the wrong associated data")
+	}
+	if _, _, err := s.ResealWithAAD(withAAD, []byte("users/42")); err != nil {
+		t.Errorf("Got unexpected error from ResealWithAAD: %v", err)
+	}
+}
+
+// writeKeyRing writes keyRing to path as JSON.
+func writeKeyRing(t *testing.T, path string, keyRing *KeyRing) {
+	b, err := json.Marshal(keyRing)
+	if err != nil {
+		t.Fatalf("Got unexpected error from json.Marshal: %v", err)
+	}
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatalf("Got unexpected error from ioutil.WriteFile: %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+package secret
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KDF is a passphrase based key derivation function.
+type KDF string
+
+const (
+	// Argon2id is the default, it is memory hard and resists GPU and side
+	// channel attacks.
+	Argon2id KDF = "argon2id"
+
+	// Scrypt is memory hard, for when Argon2id isn't available elsewhere.
+	Scrypt KDF = "scrypt"
+
+	// PBKDF2SHA256 is PBKDF2 with HMAC-SHA-256, for deployments that need
+	// FIPS approved algorithms. It is not memory hard, so it needs many more
+	// iterations.
+	PBKDF2SHA256 KDF = "pbkdf2-sha256"
+)
+
+// KDFSaltLength is the length of the salts NewKDFParams generates, and the
+// shortest salt DeriveKey accepts.
+const KDFSaltLength = 16
+
+// Default, minimum and maximum KDF parameters. The defaults follow RFC 9106 for
+// Argon2id and the OWASP password storage recommendations for the others. The
+// maximums stop parameters read from untrusted input from exhausting memory
+// or CPU: neither Argon2id nor scrypt may use more than MaxKDFMemory.
+const (
+	Argon2idMemory       = 64 * 1024 // KiB
+	Argon2idTime         = 3
+	Argon2idThreads      = 4
+	MinArgon2idMemory    = 19 * 1024 // KiB
+	MinArgon2idTime      = 2
+	MaxArgon2idMemory    = MaxKDFMemory / 1024 // KiB
+	MaxArgon2idTime      = 16
+	MaxArgon2idThreads   = 8
+	ScryptLogN           = 17
+	ScryptBlockSize      = 8
+	ScryptParallelism    = 1
+	MinScryptLogN        = 15
+	MinScryptBlockSize   = 8
+	MaxScryptLogN        = 20
+	MaxScryptBlockSize   = 16
+	MaxScryptParallelism = 4
+	PBKDF2Iterations     = 600000
+	MinPBKDF2Iterations  = 100000
+	MaxPBKDF2Iterations  = 10000000
+	MaxKDFMemory         = 1 << 30 // bytes
+)
+
+// KDFParams are the parameters a key was derived with. Store them next to
+// what the key sealed, as the string returned by String, to derive the same
+// key from the passphrase again:
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$<salt>
+//	$scrypt$ln=17,r=8,p=1$<salt>
+//	$pbkdf2-sha256$i=600000$<salt>
+//
+// The salt is base64 without padding, like the PHC string format.
+type KDFParams struct {
+	KDF  KDF
+	Salt []byte
+
+	// Argon2id
+	Memory  uint32 // KiB
+	Time    uint32 // passes over the memory
+	Threads uint8
+
+	// Scrypt
+	LogN        int // log2 of the cost parameter N
+	BlockSize   int // r
+	Parallelism int // p
+
+	// PBKDF2SHA256
+	Iterations int
+}
+
+// NewKDFParams returns the default parameters for kdf (Argon2id if empty)
+// with a new random salt.
+func NewKDFParams(kdf KDF) (*KDFParams, error) {
+	salt, err := randomProvider.Bytes(KDFSaltLength)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate salt: %v", err)
+	}
+
+	switch kdf {
+	case Argon2id, "":
+		return &KDFParams{KDF: Argon2id, Salt: salt, Memory: Argon2idMemory, Time: Argon2idTime, Threads: Argon2idThreads}, nil
+	case Scrypt:
+		return &KDFParams{KDF: Scrypt, Salt: salt, LogN: ScryptLogN, BlockSize: ScryptBlockSize, Parallelism: ScryptParallelism}, nil
+	case PBKDF2SHA256:
+		return &KDFParams{KDF: PBKDF2SHA256, Salt: salt, Iterations: PBKDF2Iterations}, nil
+	}
+	return nil, fmt.Errorf("unsupported kdf: %q", kdf)
+}
+
+// DeriveKey derives a key from passphrase with params, after checking the
+// parameters aren't weaker than the minimums.
+func DeriveKey(passphrase []byte, params *KDFParams) (*[SecretKeyLength]byte, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	return params.deriveKey(passphrase)
+}
+
+// deriveKey derives a key from passphrase without checking the parameters.
+func (p *KDFParams) deriveKey(passphrase []byte) (*[SecretKeyLength]byte, error) {
+	var keySlice []byte
+	var err error
+	switch p.KDF {
+	case Argon2id:
+		keySlice = argon2.IDKey(passphrase, p.Salt, p.Time, p.Memory, p.Threads, SecretKeyLength)
+	case Scrypt:
+		keySlice, err = scrypt.Key(passphrase, p.Salt, 1<<uint(p.LogN), p.BlockSize, p.Parallelism, SecretKeyLength)
+	case PBKDF2SHA256:
+		keySlice = pbkdf2.Key(passphrase, p.Salt, p.Iterations, SecretKeyLength, sha256.New)
+	default:
+		err = fmt.Errorf("unsupported kdf: %q", p.KDF)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive key: %v", err)
+	}
+
+	return KeySliceToArray(keySlice)
+}
+
+// Validate checks the parameters are within the minimums and maximums.
+func (p *KDFParams) Validate() error {
+	if len(p.Salt) < KDFSaltLength {
+		return fmt.Errorf("salt must be at least %v bytes: %v", KDFSaltLength, len(p.Salt))
+	}
+
+	switch p.KDF {
+	case Argon2id:
+		if p.Memory < MinArgon2idMemory || p.Memory > MaxArgon2idMemory {
+			return fmt.Errorf("argon2id memory must be between %v and %v KiB: %v", MinArgon2idMemory, MaxArgon2idMemory, p.Memory)
+		}
+		if p.Time < MinArgon2idTime || p.Time > MaxArgon2idTime {
+			return fmt.Errorf("argon2id time must be between %v and %v: %v", MinArgon2idTime, MaxArgon2idTime, p.Time)
+		}
+		if p.Threads < 1 || p.Threads > MaxArgon2idThreads {
+			return fmt.Errorf("argon2id threads must be between 1 and %v: %v", MaxArgon2idThreads, p.Threads)
+		}
+	case Scrypt:
+		if p.LogN < MinScryptLogN || p.LogN > MaxScryptLogN {
+			return fmt.Errorf("scrypt ln must be between %v and %v: %v", MinScryptLogN, MaxScryptLogN, p.LogN)
+		}
+		if p.BlockSize < MinScryptBlockSize || p.BlockSize > MaxScryptBlockSize {
+			return fmt.Errorf("scrypt r must be between %v and %v: %v", MinScryptBlockSize, MaxScryptBlockSize, p.BlockSize)
+		}
+		if p.Parallelism < 1 || p.Parallelism > MaxScryptParallelism {
+			return fmt.Errorf("scrypt p must be between 1 and %v: %v", MaxScryptParallelism, p.Parallelism)
+		}
+		// scrypt needs 128*N*r bytes
+		if memory := int64(128) << uint(p.LogN) * int64(p.BlockSize); memory > MaxKDFMemory {
+			return fmt.Errorf("scrypt ln=%v, r=%v needs more than %v bytes of memory: %v", p.LogN, p.BlockSize, MaxKDFMemory, memory)
+		}
+	case PBKDF2SHA256:
+		if p.Iterations < MinPBKDF2Iterations || p.Iterations > MaxPBKDF2Iterations {
+			return fmt.Errorf("pbkdf2 iterations must be between %v and %v: %v", MinPBKDF2Iterations, MaxPBKDF2Iterations, p.Iterations)
+		}
+	default:
+		return fmt.Errorf("unsupported kdf: %q", p.KDF)
+	}
+
+	return nil
+}
+
+// String encodes the parameters in the PHC string format.
+func (p *KDFParams) String() string {
+	salt := base64.RawStdEncoding.EncodeToString(p.Salt)
+
+	switch p.KDF {
+	case Argon2id:
+		return fmt.Sprintf("$%v$v=%v$m=%v,t=%v,p=%v$%v", p.KDF, argon2.Version, p.Memory, p.Time, p.Threads, salt)
+	case Scrypt:
+		return fmt.Sprintf("$%v$ln=%v,r=%v,p=%v$%v", p.KDF, p.LogN, p.BlockSize, p.Parallelism, salt)
+	}
+	return fmt.Sprintf("$%v$i=%v$%v", p.KDF, p.Iterations, salt)
+}
+
+// ParseKDFParams decodes parameters encoded by String, and validates them.
+func ParseKDFParams(s string) (*KDFParams, error) {
+	fields := strings.Split(s, "$")
+	if len(fields) < 4 || fields[0] != "" {
+		return nil, fmt.Errorf("invalid kdf params: %q", s)
+	}
+
+	p := &KDFParams{KDF: KDF(fields[1])}
+	fields = fields[2:]
+
+	// only argon2id has a version
+	if p.KDF == Argon2id {
+		if fields[0] != fmt.Sprintf("v=%v", argon2.Version) {
+			return nil, fmt.Errorf("unsupported argon2id version: %q", fields[0])
+		}
+		fields = fields[1:]
+	}
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid kdf params: %q", s)
+	}
+
+	values, err := parseKDFValues(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	switch p.KDF {
+	case Argon2id:
+		p.Memory, p.Time, p.Threads = uint32(values["m"]), uint32(values["t"]), uint8(values["p"])
+		err = checkKDFValues(values, "m", "t", "p")
+		if err == nil && values["p"] > 255 {
+			err = fmt.Errorf("argon2id threads must be at most 255: %v", values["p"])
+		}
+	case Scrypt:
+		p.LogN, p.BlockSize, p.Parallelism = int(values["ln"]), int(values["r"]), int(values["p"])
+		err = checkKDFValues(values, "ln", "r", "p")
+	case PBKDF2SHA256:
+		p.Iterations = int(values["i"])
+		err = checkKDFValues(values, "i")
+	default:
+		err = fmt.Errorf("unsupported kdf: %q", p.KDF)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Salt, err = base64.RawStdEncoding.DecodeString(fields[1]); err != nil {
+		return nil, fmt.Errorf("invalid kdf salt: %v", err)
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseKDFValues parses comma separated name=value pairs.
+func parseKDFValues(s string) (map[string]uint64, error) {
+	values := map[string]uint64{}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid kdf parameter: %q", pair)
+		}
+		if _, ok := values[kv[0]]; ok {
+			return nil, fmt.Errorf("duplicate kdf parameter: %q", kv[0])
+		}
+		value, err := strconv.ParseUint(kv[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kdf parameter: %q", pair)
+		}
+		values[kv[0]] = value
+	}
+	return values, nil
+}
+
+// checkKDFValues checks values has exactly the named parameters.
+func checkKDFValues(values map[string]uint64, names ...string) error {
+	for _, name := range names {
+		if _, ok := values[name]; !ok {
+			return fmt.Errorf("missing kdf parameter: %q", name)
+		}
+	}
+	if len(values) != len(names) {
+		return fmt.Errorf("unexpected kdf parameters, want: %v", strings.Join(names, ","))
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package secret
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var _ = fmt.Printf // for testing
+
+func TestDeriveKeyVectors(t *testing.T) {
+	var tests = []struct {
+		inParams     *KDFParams
+		inPassphrase string
+		outKey       string
+	}{
+		// argon2id test vector from the reference implementation
+		{&KDFParams{KDF: Argon2id, Salt: []byte("somesalt"), Memory: 65536, Time: 2, Threads: 1}, "password",
+			"09316115d5cf24ed5a15a31a3ba326e5cf32edc24702987c02b6566f61913cf7"},
+		// RFC 7914, section 12
+		{&KDFParams{KDF: Scrypt, Salt: []byte("NaCl"), LogN: 10, BlockSize: 8, Parallelism: 16}, "password",
+			"fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b373162"},
+		// RFC 7914, section 11
+		{&KDFParams{KDF: PBKDF2SHA256, Salt: []byte("salt"), Iterations: 1}, "passwd",
+			"55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+	}
+
+	for i, tt := range tests {
+		key, err := tt.inParams.deriveKey([]byte(tt.inPassphrase))
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from deriveKey: %v", i, err)
+			continue
+		}
+		if g, w := hex.EncodeToString(key[:]), tt.outKey; g != w {
+			t.Errorf("[%v] Key: Got %v, Want %v", i, g, w)
+		}
+
+		// the vectors are weaker than the minimums
+		if _, err := DeriveKey([]byte(tt.inPassphrase), tt.inParams); err == nil {
+			t.Errorf("[%v] DeriveKey should fail with weak parameters", i)
+		}
+	}
+}
+
+func TestNewKDFParams(t *testing.T) {
+	var tests = []struct {
+		inKDF  KDF
+		outKDF KDF
+		outFmt string
+	}{
+		{"", Argon2id, "$argon2id$v=19$m=65536,t=3,p=4$"},
+		{Argon2id, Argon2id, "$argon2id$v=19$m=65536,t=3,p=4$"},
+		{Scrypt, Scrypt, "$scrypt$ln=17,r=8,p=1$"},
+		{PBKDF2SHA256, PBKDF2SHA256, "$pbkdf2-sha256$i=600000$"},
+	}
+
+	for i, tt := range tests {
+		params, err := NewKDFParams(tt.inKDF)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from NewKDFParams: %v", i, err)
+			continue
+		}
+		if g, w := params.KDF, tt.outKDF; g != w {
+			t.Errorf("[%v] KDF: Got %v, Want %v", i, g, w)
+		}
+		if g, w := len(params.Salt), KDFSaltLength; g != w {
+			t.Errorf("[%v] Salt length: Got %v, Want %v", i, g, w)
+		}
+		if err := params.Validate(); err != nil {
+			t.Errorf("[%v] Got unexpected error from Validate: %v", i, err)
+		}
+
+		encoded := params.String()
+		if !strings.HasPrefix(encoded, tt.outFmt) {
+			t.Errorf("[%v] String: Got %v, Want prefix %v", i, encoded, tt.outFmt)
+		}
+		parsed, err := ParseKDFParams(encoded)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from ParseKDFParams: %v", i, err)
+			continue
+		}
+		if g, w := fmt.Sprint(parsed), fmt.Sprint(params); g != w {
+			t.Errorf("[%v] Parsed: Got %v, Want %v", i, g, w)
+		}
+	}
+
+	if _, err := NewKDFParams("bcrypt"); err == nil {
+		t.Errorf("NewKDFParams should fail with an unsupported kdf")
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	salt := bytes.Repeat([]byte{0x5a}, KDFSaltLength)
+
+	for i, params := range []*KDFParams{
+		{KDF: Argon2id, Salt: salt, Memory: MinArgon2idMemory, Time: MinArgon2idTime, Threads: 1},
+		{KDF: Scrypt, Salt: salt, LogN: MinScryptLogN, BlockSize: MinScryptBlockSize, Parallelism: 1},
+		{KDF: PBKDF2SHA256, Salt: salt, Iterations: MinPBKDF2Iterations},
+	} {
+		parsed, err := ParseKDFParams(params.String())
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from ParseKDFParams: %v", i, err)
+			continue
+		}
+
+		// stored parameters derive the same key again
+		key, err := DeriveKey([]byte("correct horse battery staple"), params)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from DeriveKey: %v", i, err)
+			continue
+		}
+		again, err := DeriveKey([]byte("correct horse battery staple"), parsed)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from DeriveKey: %v", i, err)
+			continue
+		}
+		if *key != *again {
+			t.Errorf("[%v] DeriveKey should derive the same key from the same parameters", i)
+		}
+
+		other, err := DeriveKey([]byte("correct horse battery stable"), params)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from DeriveKey: %v", i, err)
+			continue
+		}
+		if *key == *other {
+			t.Errorf("[%v] DeriveKey should derive different keys from different passphrases", i)
+		}
+	}
+}
+
+func TestParseKDFParamsInvalid(t *testing.T) {
+	salt := "WlpaWlpaWlpaWlpaWlpaWg"
+
+	var tests = []string{
+		"",
+		"argon2id$v=19$m=65536,t=3,p=4$" + salt,
+		"$bcrypt$v=19$m=65536,t=3,p=4$" + salt,
+		"$argon2id$v=16$m=65536,t=3,p=4$" + salt,        // old version
+		"$argon2id$m=65536,t=3,p=4$" + salt,             // no version
+		"$argon2id$v=19$m=65536,t=3$" + salt,            // missing parameter
+		"$argon2id$v=19$m=65536,t=3,p=4,x=1$" + salt,    // unknown parameter
+		"$argon2id$v=19$m=65536,t=3,t=4$" + salt,        // duplicate parameter
+		"$argon2id$v=19$m=65536,t=3,p=256$" + salt,      // too many threads
+		"$argon2id$v=19$m=65536,t=3,p=0$" + salt,        // no threads
+		"$argon2id$v=19$m=1024,t=3,p=4$" + salt,         // too little memory
+		"$argon2id$v=19$m=65536,t=1,p=4$" + salt,        // too few passes
+		"$argon2id$v=19$m=4194304,t=64,p=255$" + salt,   // 4 GiB
+		"$argon2id$v=19$m=1048577,t=3,p=4$" + salt,      // just over 1 GiB
+		"$argon2id$v=19$m=65536,t=17,p=4$" + salt,       // too many passes
+		"$argon2id$v=19$m=65536,t=3,p=9$" + salt,        // too many threads
+		"$argon2id$v=19$m=65536,t=3,p=4$c29tZXNhbHQ",    // short salt
+		"$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$x", // hash
+		"$argon2id$v=19$m=-1,t=3,p=4$" + salt,
+		"$argon2id$v=19$m=65536,t=3,p=4$***",
+		"$scrypt$ln=10,r=8,p=1$" + salt,        // too cheap
+		"$scrypt$ln=40,r=8,p=1$" + salt,        // too expensive
+		"$scrypt$ln=24,r=32,p=16$" + salt,      // 64 GiB
+		"$scrypt$ln=20,r=16,p=1$" + salt,       // 2 GiB
+		"$scrypt$ln=17,r=8,p=16$" + salt,       // too parallel
+		"$scrypt$ln=17,r=64,p=1$" + salt,       // big blocks
+		"$scrypt$ln=17,r=1,p=1$" + salt,        // small blocks
+		"$scrypt$ln=17,r=8$" + salt,            // missing parameter
+		"$pbkdf2-sha256$i=1000$" + salt,        // too few iterations
+		"$pbkdf2-sha256$i=99999999999$" + salt, // too many iterations
+		"$pbkdf2-sha256$iterations=600000$" + salt,
+	}
+
+	for i, tt := range tests {
+		if _, err := ParseKDFParams(tt); err == nil {
+			t.Errorf("[%v] ParseKDFParams should fail: %q", i, tt)
+		}
+	}
+
+	// the most expensive parameters accepted use at most 1 GiB
+	for i, tt := range []string{
+		"$argon2id$v=19$m=1048576,t=16,p=8$" + salt,
+		"$scrypt$ln=20,r=8,p=4$" + salt,
+		"$scrypt$ln=16,r=16,p=4$" + salt,
+	} {
+		if _, err := ParseKDFParams(tt); err != nil {
+			t.Errorf("[%v] Got unexpected error from ParseKDFParams(%q): %v", i, tt, err)
+		}
+	}
+}
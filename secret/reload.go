@@ -0,0 +1,135 @@
+package secret
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mailgun/lemma/internal/watch"
+)
+
+// currentKey returns the key messages are sealed with.
+func (s *Service) currentKey() *[SecretKeyLength]byte {
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+
+	return s.secretKey
+}
+
+// primaryKey returns the key messages are sealed with and its ID, which is
+// empty without a key ring.
+func (s *Service) primaryKey() (string, *[SecretKeyLength]byte) {
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+
+	if s.keyRing == nil {
+		return "", s.secretKey
+	}
+	return s.keyRing.Primary, s.secretKey
+}
+
+// openKeys returns the keys a message sealed with keyID is opened with. With
+// a key ring that is the key with that ID, or if the message has no key ID
+// the primary key and then the rest of the key ring. Otherwise it is the
+// current key, then the previous key while it is within its grace period.
+func (s *Service) openKeys(keyID string) ([]*[SecretKeyLength]byte, error) {
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+
+	if s.keyRing != nil {
+		if keyID != "" {
+			secretKey, ok := s.keyRing.Keys[keyID]
+			if !ok {
+				return nil, fmt.Errorf("unknown key id: %q", keyID)
+			}
+			return []*[SecretKeyLength]byte{secretKey}, nil
+		}
+
+		keys := []*[SecretKeyLength]byte{s.secretKey}
+		for _, id := range s.keyRing.ids() {
+			if id != s.keyRing.Primary {
+				keys = append(keys, s.keyRing.Keys[id])
+			}
+		}
+		return keys, nil
+	}
+
+	if s.secretKey == nil {
+		return nil, fmt.Errorf("no key to open message with")
+	}
+	if s.previousKey != nil && s.timeProvider.UtcNow().Before(s.previousExpiry) {
+		return []*[SecretKeyLength]byte{s.secretKey, s.previousKey}, nil
+	}
+	return []*[SecretKeyLength]byte{s.secretKey}, nil
+}
+
+// ReloadKey reads the key from KeyPath (or KeySource) again and, if it
+// changed, starts sealing with it. The previous key can still open messages
+// for KeyGracePeriod seconds. With a KeyRingPath the whole key ring is read
+// again instead, and keys removed from it stop opening messages right away.
+// If the key can't be read the service keeps the key it has.
+//
+// New returns a SecretService, use a type assertion to get at ReloadKey:
+//
+//	s.(*secret.Service).ReloadKey()
+func (s *Service) ReloadKey() (err error) {
+	defer func() {
+		if err == nil {
+			s.metricsClient.Inc("key_reload.success", 1, 1)
+		} else {
+			s.metricsClient.Inc("key_reload.failure", 1, 1)
+		}
+	}()
+
+	if s.keyRingPath != "" {
+		return s.reloadKeyRing()
+	}
+	if s.keyPath == "" && s.keySource == nil {
+		return fmt.Errorf("no key path or key source to reload from")
+	}
+	keyBytes, err := loadKey(s.keyPath, s.keySource)
+	if err != nil {
+		return err
+	}
+
+	s.keyLock.Lock()
+	defer s.keyLock.Unlock()
+
+	if *keyBytes == *s.secretKey {
+		return nil
+	}
+	s.previousKey = s.secretKey
+	s.previousExpiry = s.timeProvider.UtcNow().Add(s.keyGracePeriod)
+	s.secretKey = keyBytes
+
+	return nil
+}
+
+// WatchKey checks the modification time of KeyPath (or KeyRingPath) every
+// interval and reloads the key when it changes, until the returned function
+// is called. Without a KeyPath the key is reloaded from KeySource every
+// interval. Reload failures are passed to onError, if it is not nil, and the
+// service keeps the key it has.
+func (s *Service) WatchKey(interval time.Duration, onError func(error)) (stop func()) {
+	path := s.keyPath
+	if s.keyRingPath != "" {
+		path = s.keyRingPath
+	}
+	return watch.File(path, interval, s.ReloadKey, onError)
+}
+
+// reloadKeyRing reads the key ring from keyRingPath and starts sealing with
+// its primary key.
+func (s *Service) reloadKeyRing() error {
+	keyRing, err := ReadKeyRingFromDisk(s.keyRingPath)
+	if err != nil {
+		return err
+	}
+
+	s.keyLock.Lock()
+	defer s.keyLock.Unlock()
+
+	s.keyRing = keyRing
+	s.secretKey = keyRing.Keys[keyRing.Primary]
+
+	return nil
+}
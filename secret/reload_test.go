@@ -0,0 +1,171 @@
+package secret
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mailgun/lemma/keysource"
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/timetools"
+)
+
+var _ = fmt.Printf // for testing
+
+// writeKey writes a new random key to path. It doesn't use NewKey, which
+// other tests make return the same key every time.
+func writeKey(t *testing.T, path string) *[SecretKeyLength]byte {
+	keySlice, err := (&random.CSPRNG{}).Bytes(SecretKeyLength)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Bytes: %v", err)
+	}
+	key, err := KeySliceToArray(keySlice)
+	if err != nil {
+		t.Fatalf("Got unexpected error from KeySliceToArray: %v", err)
+	}
+	err = ioutil.WriteFile(path, []byte(KeyToEncodedString(key)), 0600)
+	if err != nil {
+		t.Fatalf("Got unexpected error from ioutil.WriteFile: %v", err)
+	}
+	return key
+}
+
+func TestReloadKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lemma")
+	if err != nil {
+		t.Fatalf("Got unexpected error from ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "test.key")
+
+	for i, grace := range []int{60, 0} {
+		writeKey(t, keyPath)
+		clock := &timetools.FreezedTime{CurrentTime: time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)}
+		ss, err := NewWithProviders(&Config{KeyPath: keyPath, KeyGracePeriod: grace}, clock, &random.CSPRNG{})
+		if err != nil {
+			t.Fatalf("[%v] Got unexpected error from NewWithProviders: %v", i, err)
+		}
+		s := ss.(*Service)
+
+		sealedOld, err := s.Seal([]byte("hello, world"))
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from Seal: %v", i, err)
+		}
+
+		// a failed reload keeps the working key
+		ioutil.WriteFile(keyPath, []byte("not a key"), 0600)
+		if err := s.ReloadKey(); err == nil {
+			t.Errorf("[%v] ReloadKey should fail with an invalid key", i)
+		}
+		if _, err := s.Open(sealedOld); err != nil {
+			t.Errorf("[%v] Got unexpected error from Open after failed reload: %v", i, err)
+		}
+
+		// rotate the key
+		newKey := writeKey(t, keyPath)
+		if err := s.ReloadKey(); err != nil {
+			t.Errorf("[%v] Got unexpected error from ReloadKey: %v", i, err)
+		}
+		sealedNew, err := s.Seal([]byte("hello, world"))
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from Seal: %v", i, err)
+		}
+		if _, err := Open(sealedNew, newKey); err != nil {
+			t.Errorf("[%v] Message was not sealed with the new key: %v", i, err)
+		}
+
+		// the old key only opens messages during the grace period
+		_, err = s.Open(sealedOld)
+		if g, w := err == nil, grace > 0; g != w {
+			t.Errorf("[%v] Opened with old key: Got %v, Want %v (%v)", i, g, w, err)
+		}
+
+		// and not once it is over
+		clock.CurrentTime = clock.CurrentTime.Add(time.Duration(grace) * time.Second)
+		if _, err := s.Open(sealedOld); err == nil {
+			t.Errorf("[%v] Open should fail with the old key after the grace period", i)
+		}
+	}
+}
+
+func TestWatchKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lemma")
+	if err != nil {
+		t.Fatalf("Got unexpected error from ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "test.key")
+	writeKey(t, keyPath)
+
+	ss, err := New(&Config{KeyPath: keyPath})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+	s := ss.(*Service)
+
+	errs := make(chan error, 100)
+	stop := s.WatchKey(5*time.Millisecond, func(err error) { errs <- err })
+	defer stop()
+
+	// an invalid key is reported, and the key is kept
+	oldKey := s.currentKey()
+	ioutil.WriteFile(keyPath, []byte("not a key"), 0600)
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Errorf("Invalid key was not reported")
+	}
+	if s.currentKey() != oldKey {
+		t.Errorf("Key changed after failed reload")
+	}
+
+	// the new key is picked up
+	newKey := writeKey(t, keyPath)
+	for i := 0; *s.currentKey() != *newKey; i++ {
+		if i > 200 {
+			t.Fatalf("Key was not reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReloadKeySource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lemma")
+	if err != nil {
+		t.Fatalf("Got unexpected error from ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "test.key")
+	writeKey(t, keyPath)
+
+	ss, err := New(&Config{KeySource: keysource.NewFile(keyPath), KeyGracePeriod: 60})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+	s := ss.(*Service)
+
+	sealedOld, err := s.Seal([]byte("hello, world"))
+	if err != nil {
+		t.Errorf("Got unexpected error from Seal: %v", err)
+	}
+
+	// a key source must provide a base64 encoded key
+	ioutil.WriteFile(keyPath, []byte("not a key"), 0600)
+	if err := s.ReloadKey(); err == nil {
+		t.Errorf("ReloadKey should fail with an invalid key")
+	}
+
+	newKey := writeKey(t, keyPath)
+	if err := s.ReloadKey(); err != nil {
+		t.Errorf("Got unexpected error from ReloadKey: %v", err)
+	}
+	if *s.currentKey() != *newKey {
+		t.Errorf("Key was not reloaded from the key source")
+	}
+	if _, err := s.Open(sealedOld); err != nil {
+		t.Errorf("Got unexpected error from Open during the grace period: %v", err)
+	}
+}
@@ -12,10 +12,13 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/mailgun/lemma/keysource"
 	"github.com/mailgun/lemma/random"
 	"github.com/mailgun/metrics"
-	"golang.org/x/crypto/nacl/secretbox"
+	"github.com/mailgun/timetools"
 )
 
 // SecretSevice is an interface for encrypting/decrypting and authenticating messages.
@@ -27,6 +30,21 @@ type SecretService interface {
 	Open(SealedData) ([]byte, error)
 }
 
+// AADSecretService is a SecretService that can also authenticate associated
+// data. The services returned by New implement it.
+type AADSecretService interface {
+	SecretService
+
+	// SealWithAAD is like Seal, but also authenticates the associated data
+	// (without encrypting it or including it in the ciphertext), like the ID
+	// of the record the ciphertext is stored in.
+	SealWithAAD(value []byte, aad []byte) (SealedData, error)
+
+	// OpenWithAAD is like Open, but only opens ciphertexts sealed with the
+	// same associated data.
+	OpenWithAAD(sealed SealedData, aad []byte) ([]byte, error)
+}
+
 // SealedData respresents an encrypted and authenticated message.
 type SealedData interface {
 	CiphertextBytes() []byte
@@ -36,22 +54,68 @@ type SealedData interface {
 	NonceHex() string
 }
 
-// Config is used to configure a secret service. It contains either the key path
-// or key bytes to use.
+// Config is used to configure a secret service. It contains either the key
+// ring path, key ring, key path, key source or key bytes to use, and or a key
+// wrapper.
 type Config struct {
-	KeyPath  string
-	KeyBytes *[SecretKeyLength]byte
-
-	EmitStats    bool   // toggle emitting metrics or not
-	StatsdHost   string // hostname of statsd server
-	StatsdPort   int    // port of statsd server
-	StatsdPrefix string // prefix to prepend to metrics
+	// KeyRingPath is a key ring stored as JSON, see KeyRing. Messages are
+	// sealed with its primary key and record the key ID.
+	KeyRingPath string `json:"key_ring_path" yaml:"key_ring_path"`
+
+	// KeyRing is used if `KeyRingPath` is an empty string.
+	KeyRing *KeyRing `json:"-" yaml:"-"`
+
+	KeyPath string `json:"key_path" yaml:"key_path"`
+
+	// KeySource provides the base64 encoded key, for example from an
+	// environment variable or a secret manager (see the keysource package).
+	// Ignored if `KeyPath` is not an empty string.
+	KeySource keysource.Source `json:"-" yaml:"-"`
+
+	KeyBytes *[SecretKeyLength]byte `json:"-" yaml:"-"`
+
+	// KeyWrapper turns on envelope encryption: every message is sealed with
+	// a new data key, wrapped by the KeyWrapper. The other keys are only
+	// needed to open messages sealed without envelope encryption.
+	KeyWrapper KeyWrapper `json:"-" yaml:"-"`
+
+	// KeyGracePeriod is how many seconds the previous key can still open
+	// messages after the key is reloaded, see ReloadKey and WatchKey.
+	KeyGracePeriod int `json:"key_grace_period" yaml:"key_grace_period"`
+
+	// StreamChunkSize is how many bytes of plaintext SealStream seals at a
+	// time, default: StreamChunkSize. Larger chunks have less overhead, but
+	// OpenStream holds a whole chunk in memory.
+	StreamChunkSize int `json:"stream_chunk_size" yaml:"stream_chunk_size"`
+
+	// Algorithm is used to seal messages, default: Salsa20Poly1305.
+	// SealWithAAD uses it too if it can authenticate associated data,
+	// otherwise XChaCha20Poly1305.
+	Algorithm Algorithm `json:"algorithm" yaml:"algorithm"`
+
+	// AllowedAlgorithms are opened, messages sealed with any other algorithm
+	// are rejected. default: the algorithms the service seals with, and
+	// Salsa20Poly1305 so messages sealed before the algorithm was recorded
+	// still open. If set, it must include the algorithms the service seals
+	// with, or the service couldn't open what it sealed.
+	AllowedAlgorithms []Algorithm `json:"allowed_algorithms" yaml:"allowed_algorithms"`
+
+	EmitStats    bool   `json:"emit_stats" yaml:"emit_stats"`       // toggle emitting metrics or not
+	StatsdHost   string `json:"statsd_host" yaml:"statsd_host"`     // hostname of statsd server
+	StatsdPort   int    `json:"statsd_port" yaml:"statsd_port"`     // port of statsd server
+	StatsdPrefix string `json:"statsd_prefix" yaml:"statsd_prefix"` // prefix to prepend to metrics
 }
 
-// SealedBytes contains the ciphertext and nonce for a sealed message.
+// SealedBytes contains the ciphertext and nonce for a sealed message, the
+// algorithm it was sealed with if it isn't Salsa20Poly1305, the ID of the
+// key it was sealed with if the key has one, and the wrapped data key if it
+// was sealed with envelope encryption.
 type SealedBytes struct {
 	Ciphertext []byte
 	Nonce      []byte
+	Algorithm  Algorithm `json:",omitempty"`
+	KeyID      string    `json:",omitempty"`
+	WrappedKey []byte    `json:",omitempty"`
 }
 
 func (s *SealedBytes) CiphertextBytes() []byte {
@@ -70,30 +134,124 @@ func (s *SealedBytes) NonceHex() string {
 	return base64.URLEncoding.EncodeToString(s.Nonce)
 }
 
+// AlgorithmID returns the algorithm the message was sealed with. SealedData
+// that isn't a *SealedBytes was sealed with Salsa20Poly1305.
+func (s *SealedBytes) AlgorithmID() Algorithm {
+	if s.Algorithm == "" {
+		return Salsa20Poly1305
+	}
+	return s.Algorithm
+}
+
+// KeyIDString returns the ID of the key the message was sealed with, or an
+// empty string if the key has no ID.
+func (s *SealedBytes) KeyIDString() string {
+	return s.KeyID
+}
+
+// WrappedKeyBytes returns the wrapped data key the message was sealed with,
+// or nil if it wasn't sealed with envelope encryption.
+func (s *SealedBytes) WrappedKeyBytes() []byte {
+	return s.WrappedKey
+}
+
 // A Service can be used to seal/open (encrypt/decrypt and authenticate) messages.
 type Service struct {
-	secretKey     *[SecretKeyLength]byte
-	metricsClient metrics.Client
+	keyLock           sync.RWMutex
+	secretKey         *[SecretKeyLength]byte
+	previousKey       *[SecretKeyLength]byte // can still open until previousExpiry after a reload
+	previousExpiry    time.Time
+	keyRing           *KeyRing // nil without a key ring
+	keyRingPath       string
+	keyPath           string
+	keySource         keysource.Source
+	keyWrapper        KeyWrapper // nil without envelope encryption
+	keyGracePeriod    time.Duration
+	streamChunkSize   int
+	algorithm         Algorithm
+	aadAlgorithm      Algorithm // used by SealWithAAD
+	allowedAlgorithms []Algorithm
+	metricsClient     metrics.Client
+	timeProvider      timetools.TimeProvider // times the key grace period
+	randomProvider    random.RandomProvider
 }
 
-// New returns a new Service. Config can not be nil.
+// New returns a new Service. Config can not be nil. If you need control over
+// setting time and random providers, use NewWithProviders.
 func New(config *Config) (SecretService, error) {
+	return NewWithProviders(config, &timetools.RealTime{}, randomProvider)
+}
+
+// NewWithProviders returns a new Service. Provides control over the time
+// provider used for the key grace period, and the random provider used to
+// generate nonces.
+func NewWithProviders(config *Config, timeProvider timetools.TimeProvider,
+	randomProvider random.RandomProvider) (SecretService, error) {
+
 	var err error
 	var keyBytes *[SecretKeyLength]byte
+	var keyRing *KeyRing
 	var metricsClient metrics.Client
 
-	// Read in key from KeyPath or if not given, try getting them from KeyBytes.
-	if config.KeyPath != "" {
-		if keyBytes, err = ReadKeyFromDisk(config.KeyPath); err != nil {
+	// Read in the key ring from KeyRingPath or KeyRing, or the key from
+	// KeyPath or KeySource, or if not given, try getting them from KeyBytes.
+	if config.KeyRingPath != "" {
+		if keyRing, err = ReadKeyRingFromDisk(config.KeyRingPath); err != nil {
+			return nil, err
+		}
+		keyBytes = keyRing.Keys[keyRing.Primary]
+	} else if config.KeyRing != nil {
+		if err = config.KeyRing.Validate(); err != nil {
+			return nil, err
+		}
+		keyRing = config.KeyRing.clone()
+		keyBytes = keyRing.Keys[keyRing.Primary]
+	} else if config.KeyPath != "" || config.KeySource != nil {
+		if keyBytes, err = loadKey(config.KeyPath, config.KeySource); err != nil {
 			return nil, err
 		}
 	} else {
-		if config.KeyBytes == nil {
+		if config.KeyBytes == nil && config.KeyWrapper == nil {
 			return nil, errors.New("No key bytes provided.")
 		}
 		keyBytes = config.KeyBytes
 	}
 
+	streamChunkSize := config.StreamChunkSize
+	if streamChunkSize < 1 {
+		streamChunkSize = StreamChunkSize
+	}
+	if streamChunkSize > MaxStreamChunkSize {
+		return nil, fmt.Errorf("stream chunk size is larger than %v: %v", MaxStreamChunkSize, streamChunkSize)
+	}
+
+	// pick the algorithms to seal with, and the ones to open
+	algorithm := config.Algorithm
+	if algorithm == "" {
+		algorithm = Salsa20Poly1305
+	}
+	if !algorithm.Valid() {
+		return nil, fmt.Errorf("unsupported algorithm: %q", algorithm)
+	}
+	aadAlgorithm := algorithm.aadAlgorithm()
+	allowedAlgorithms := config.AllowedAlgorithms
+	if len(allowedAlgorithms) == 0 {
+		allowedAlgorithms = []Algorithm{algorithm}
+		for _, a := range []Algorithm{aadAlgorithm, Salsa20Poly1305} {
+			if !algorithmIn(a, allowedAlgorithms) {
+				allowedAlgorithms = append(allowedAlgorithms, a)
+			}
+		}
+	}
+	for _, a := range allowedAlgorithms {
+		if !a.Valid() {
+			return nil, fmt.Errorf("unsupported algorithm: %q", a)
+		}
+	}
+	if err := checkAllowedAlgorithms(algorithm, allowedAlgorithms); err != nil {
+		return nil, fmt.Errorf("allowed algorithms: %v", err)
+	}
+
 	// setup metrics service
 	if config.EmitStats {
 		// get hostname of box
@@ -120,8 +278,20 @@ func New(config *Config) (SecretService, error) {
 	}
 
 	return &Service{
-		secretKey:     keyBytes,
-		metricsClient: metricsClient,
+		secretKey:         keyBytes,
+		keyRing:           keyRing,
+		keyRingPath:       config.KeyRingPath,
+		keyPath:           config.KeyPath,
+		keySource:         config.KeySource,
+		keyWrapper:        config.KeyWrapper,
+		keyGracePeriod:    time.Duration(config.KeyGracePeriod) * time.Second,
+		streamChunkSize:   streamChunkSize,
+		algorithm:         algorithm,
+		aadAlgorithm:      aadAlgorithm,
+		allowedAlgorithms: allowedAlgorithms,
+		metricsClient:     metricsClient,
+		timeProvider:      timeProvider,
+		randomProvider:    randomProvider,
 	}, nil
 }
 
@@ -157,27 +327,107 @@ func Open(e SealedData, secretKey *[SecretKeyLength]byte) ([]byte, error) {
 	return secretService.Open(e)
 }
 
+// SealWithAAD takes plaintext, associated data, and a key and returns
+// encrypted and authenticated ciphertext. Useful for one off sealing
+// purposes, otherwise create a secret.Service to seal multiple times.
+func SealWithAAD(value []byte, aad []byte, secretKey *[SecretKeyLength]byte) (SealedData, error) {
+	if secretKey == nil {
+		return nil, fmt.Errorf("secret key is nil")
+	}
+
+	secretService, err := New(&Config{KeyBytes: secretKey})
+	if err != nil {
+		return nil, err
+	}
+
+	return secretService.(*Service).SealWithAAD(value, aad)
+}
+
+// OpenWithAAD authenticates the ciphertext and associated data and if valid,
+// decrypts and returns plaintext. Useful for one off opening purposes,
+// otherwise create a secret.Service to open multiple times.
+func OpenWithAAD(e SealedData, aad []byte, secretKey *[SecretKeyLength]byte) ([]byte, error) {
+	if secretKey == nil {
+		return nil, fmt.Errorf("secret key is nil")
+	}
+
+	secretService, err := New(&Config{KeyBytes: secretKey})
+	if err != nil {
+		return nil, err
+	}
+
+	return secretService.(*Service).OpenWithAAD(e, aad)
+}
+
 // Seal takes plaintext and returns encrypted and authenticated ciphertext.
 func (s *Service) Seal(value []byte) (SealedData, error) {
+	return s.seal(s.algorithm, value, nil)
+}
+
+// SealWithAAD takes plaintext and associated data and returns encrypted and
+// authenticated ciphertext. The associated data is authenticated but not
+// encrypted, and it isn't part of the ciphertext: OpenWithAAD must be given
+// the same associated data.
+func (s *Service) SealWithAAD(value []byte, aad []byte) (SealedData, error) {
+	return s.seal(s.aadAlgorithm, value, aad)
+}
+
+func (s *Service) seal(algorithm Algorithm, value []byte, aad []byte) (SealedData, error) {
 	// generate nonce
-	nonce, err := generateNonce()
+	nonce, err := s.randomProvider.Bytes(algorithm.NonceSize())
 	if err != nil {
 		return nil, fmt.Errorf("unable to generate nonce: %v", err)
 	}
 
-	// use nacl secret box to encrypt plaintext
-	var encrypted []byte
-	encrypted = secretbox.Seal(encrypted, value, nonce, s.secretKey)
+	// encrypt plaintext with the primary key, or a new data key wrapped by
+	// the key wrapper
+	keyID, secretKey := s.primaryKey()
+	var wrappedKey []byte
+	if s.keyWrapper != nil {
+		keyID = ""
+		dataKey, err := s.randomProvider.Bytes(SecretKeyLength)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate data key: %v", err)
+		}
+		if secretKey, err = KeySliceToArray(dataKey); err != nil {
+			return nil, err
+		}
+		if wrappedKey, err = s.keyWrapper.WrapKey(secretKey); err != nil {
+			return nil, fmt.Errorf("unable to wrap data key: %v", err)
+		}
+	}
+	encrypted, err := algorithm.seal(value, aad, nonce, secretKey)
+	if err != nil {
+		return nil, err
+	}
 
-	// return sealed ciphertext
-	return &SealedBytes{
+	// return sealed ciphertext, leaving out the default algorithm so it can
+	// still be read by older versions
+	sealed := &SealedBytes{
 		Ciphertext: encrypted,
-		Nonce:      nonce[:],
-	}, nil
+		Nonce:      nonce,
+		KeyID:      keyID,
+		WrappedKey: wrappedKey,
+	}
+	if algorithm != Salsa20Poly1305 {
+		sealed.Algorithm = algorithm
+	}
+	return sealed, nil
 }
 
 // Open authenticates the ciphertext and if valid, decrypts and returns plaintext.
-func (s *Service) Open(e SealedData) (byt []byte, err error) {
+func (s *Service) Open(e SealedData) ([]byte, error) {
+	return s.open(e, nil)
+}
+
+// OpenWithAAD authenticates the ciphertext and associated data and if valid,
+// decrypts and returns plaintext. Messages sealed by Seal open with no
+// associated data.
+func (s *Service) OpenWithAAD(e SealedData, aad []byte) ([]byte, error) {
+	return s.open(e, aad)
+}
+
+func (s *Service) open(e SealedData, aad []byte) (byt []byte, err error) {
 	// once function is complete, check if we are returning err or not.
 	// if we are, return emit a failure metric, if not a success metric.
 	defer func() {
@@ -188,20 +438,57 @@ func (s *Service) Open(e SealedData) (byt []byte, err error) {
 		}
 	}()
 
-	// convert nonce to an array
-	nonce, err := nonceSliceToArray(e.NonceBytes())
+	// only open algorithms that are allowed
+	algorithm := toSealedBytes(e).AlgorithmID()
+	if !algorithmIn(algorithm, s.allowedAlgorithms) {
+		return nil, fmt.Errorf("algorithm not allowed: %q", algorithm)
+	}
+
+	// decrypt with the data key the message was sealed with, or the key with
+	// its key id, or without a key id the current key, or the previous one
+	// during its grace period
+	var secretKeys []*[SecretKeyLength]byte
+	if sb := toSealedBytes(e); len(sb.WrappedKey) > 0 {
+		secretKeys, err = s.unwrapKey(sb.WrappedKey)
+	} else {
+		secretKeys, err = s.openKeys(sb.KeyID)
+	}
 	if err != nil {
 		return nil, err
 	}
+	for _, secretKey := range secretKeys {
+		byt, err = algorithm.open(e.CiphertextBytes(), aad, e.NonceBytes(), secretKey)
+		if err == nil {
+			return byt, nil
+		}
+	}
+
+	return nil, err
+}
 
-	// decrypt
-	var decrypted []byte
-	decrypted, ok := secretbox.Open(decrypted, e.CiphertextBytes(), nonce, s.secretKey)
-	if !ok {
-		return nil, fmt.Errorf("unable to decrypt message")
+// unwrapKey unwraps the data key a message was sealed with.
+func (s *Service) unwrapKey(wrappedKey []byte) ([]*[SecretKeyLength]byte, error) {
+	if s.keyWrapper == nil {
+		return nil, fmt.Errorf("no key wrapper to unwrap data key")
 	}
+	dataKey, err := s.keyWrapper.UnwrapKey(wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap data key: %v", err)
+	}
+	return []*[SecretKeyLength]byte{dataKey}, nil
+}
 
-	return decrypted, nil
+// loadKey reads the key from keyPath, or keySource if there is no keyPath.
+func loadKey(keyPath string, keySource keysource.Source) (*[SecretKeyLength]byte, error) {
+	if keyPath != "" {
+		return ReadKeyFromDisk(keyPath)
+	}
+
+	keyBytes, err := keySource.Key()
+	if err != nil {
+		return nil, err
+	}
+	return EncodedStringToKey(strings.TrimSpace(string(keyBytes)))
 }
 
 func ReadKeyFromDisk(keypath string) (*[SecretKeyLength]byte, error) {
@@ -244,16 +531,6 @@ func nonceSliceToArray(bytes []byte) (*[NonceLength]byte, error) {
 	return &nonceBytes, nil
 }
 
-func generateNonce() (*[NonceLength]byte, error) {
-	// get b-bytes of random from /dev/urandom
-	bytes, err := randomProvider.Bytes(NonceLength)
-	if err != nil {
-		return nil, err
-	}
-
-	return nonceSliceToArray(bytes)
-}
-
 var randomProvider random.RandomProvider
 
 // init sets the package level randomProvider to be a real csprng. this is done
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/timetools"
 )
 
 var _ = fmt.Printf // for testing
@@ -64,3 +65,23 @@ func TestEncryptDecryptCyclePackage(t *testing.T) {
 		t.Errorf("Contents do not match: %v, %v", message, out)
 	}
 }
+
+func TestNewWithProviders(t *testing.T) {
+	var key [SecretKeyLength]byte
+
+	s, err := NewWithProviders(&Config{KeyBytes: &key}, &timetools.RealTime{}, &random.FakeRNG{})
+	if err != nil {
+		t.Errorf("Got unexpected response from NewWithProviders: %v", err)
+	}
+
+	sealed, err := s.Seal([]byte("hello, box!"))
+	if err != nil {
+		t.Errorf("Got unexpected response from Seal: %v", err)
+	}
+
+	// the nonce must come from the given random provider
+	wantNonce, _ := (&random.FakeRNG{}).Bytes(NonceLength)
+	if g, w := sealed.NonceBytes(), wantNonce; subtle.ConstantTimeCompare(g, w) != 1 {
+		t.Errorf("Got nonce: %v, Want: %v", g, w)
+	}
+}
@@ -0,0 +1,223 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+)
+
+// DeterministicKeyLength is the length of a DeterministicKey: two AES-256
+// keys, one for S2V and one for CTR mode.
+const DeterministicKeyLength = 64
+
+// DeterministicKey is a key for DeterministicCipher. It is a different type
+// from the secret keys Seal uses, so a key can't be used for both.
+type DeterministicKey [DeterministicKeyLength]byte
+
+// NewDeterministicKey returns a new key for a DeterministicCipher.
+func NewDeterministicKey() (*DeterministicKey, error) {
+	bytes, err := randomProvider.Bytes(DeterministicKeyLength)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate random: %v", err)
+	}
+
+	var key DeterministicKey
+	copy(key[:], bytes)
+	return &key, nil
+}
+
+// EncodedStringToDeterministicKey converts a base64-encoded string into a
+// deterministic key.
+func EncodedStringToDeterministicKey(encodedKey string) (*DeterministicKey, error) {
+	keySlice, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(keySlice) != DeterministicKeyLength {
+		return nil, fmt.Errorf("wrong deterministic key length: %v", len(keySlice))
+	}
+
+	var key DeterministicKey
+	copy(key[:], keySlice)
+	return &key, nil
+}
+
+// DeterministicKeyToEncodedString converts a deterministic key into a
+// base64-encoded string
+func DeterministicKeyToEncodedString(key *DeterministicKey) string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+// DeterministicCipher is AES-SIV (RFC 5297) with AES-256: deterministic
+// authenticated encryption, for fields that must be looked up by equality,
+// like WHERE email = ?.
+//
+// Unlike Seal it doesn't use a nonce, so the same plaintext and associated
+// data always give the same ciphertext. That is the point, but it means
+// anyone who can see the ciphertexts learns which values are equal (and
+// their lengths), though nothing else about them. Use Seal for anything that
+// isn't looked up, and pass the table and column as associated data so equal
+// values in different columns don't match.
+type DeterministicCipher struct {
+	mac cipher.Block // S2V
+	ctr cipher.Block
+}
+
+// NewDeterministicCipher returns an AES-SIV cipher for key.
+func NewDeterministicCipher(key *DeterministicKey) (*DeterministicCipher, error) {
+	if key == nil {
+		return nil, fmt.Errorf("deterministic key is nil")
+	}
+	return newSIV(key[:])
+}
+
+// newSIV returns an AES-SIV cipher for a key of 32, 48 or 64 bytes, the
+// first half for S2V and the second half for CTR mode.
+func newSIV(key []byte) (*DeterministicCipher, error) {
+	if len(key) != 32 && len(key) != 48 && len(key) != 64 {
+		return nil, fmt.Errorf("wrong siv key length: %v", len(key))
+	}
+
+	mac, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	ctr, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeterministicCipher{mac: mac, ctr: ctr}, nil
+}
+
+// Seal encrypts and authenticates plaintext, and authenticates the
+// associated data. It returns the 16 byte synthetic IV followed by the
+// ciphertext.
+func (d *DeterministicCipher) Seal(plaintext []byte, associatedData ...[]byte) []byte {
+	v := d.s2v(plaintext, associatedData)
+
+	out := make([]byte, aes.BlockSize+len(plaintext))
+	copy(out, v[:])
+	d.xorKeyStream(out[aes.BlockSize:], plaintext, v)
+
+	return out
+}
+
+// Open authenticates ciphertext and associated data and, if they are valid,
+// decrypts and returns plaintext.
+func (d *DeterministicCipher) Open(ciphertext []byte, associatedData ...[]byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, fmt.Errorf("ciphertext too short: %v bytes", len(ciphertext))
+	}
+
+	var v [aes.BlockSize]byte
+	copy(v[:], ciphertext)
+
+	plaintext := make([]byte, len(ciphertext)-aes.BlockSize)
+	d.xorKeyStream(plaintext, ciphertext[aes.BlockSize:], v)
+
+	t := d.s2v(plaintext, associatedData)
+	if subtle.ConstantTimeCompare(t[:], v[:]) != 1 {
+		return nil, fmt.Errorf("unable to decrypt message")
+	}
+	return plaintext, nil
+}
+
+// xorKeyStream encrypts or decrypts src into dst in CTR mode, starting at
+// the synthetic IV with the 31st and 63rd bits cleared.
+func (d *DeterministicCipher) xorKeyStream(dst []byte, src []byte, v [aes.BlockSize]byte) {
+	q := v
+	q[8] &= 0x7f
+	q[12] &= 0x7f
+	cipher.NewCTR(d.ctr, q[:]).XORKeyStream(dst, src)
+}
+
+// s2v is the S2V pseudo random function, over the associated data and then
+// the plaintext.
+func (d *DeterministicCipher) s2v(plaintext []byte, associatedData [][]byte) [aes.BlockSize]byte {
+	var zero [aes.BlockSize]byte
+	dd := cmac(d.mac, zero[:])
+
+	for _, ad := range associatedData {
+		dd = dbl(dd)
+		mac := cmac(d.mac, ad)
+		xorBlock(&dd, mac[:])
+	}
+
+	var t []byte
+	if len(plaintext) >= aes.BlockSize {
+		// xor the last block of the plaintext with D
+		t = append([]byte{}, plaintext...)
+		end := t[len(t)-aes.BlockSize:]
+		for i := range end {
+			end[i] ^= dd[i]
+		}
+	} else {
+		// xor the padded plaintext with dbl(D)
+		dd = dbl(dd)
+		padded := make([]byte, aes.BlockSize)
+		copy(padded, plaintext)
+		padded[len(plaintext)] = 0x80
+		xorBlock(&dd, padded)
+		t = dd[:]
+	}
+
+	return cmac(d.mac, t)
+}
+
+// cmac is AES-CMAC (RFC 4493).
+func cmac(block cipher.Block, message []byte) [aes.BlockSize]byte {
+	// derive the subkeys
+	var l [aes.BlockSize]byte
+	block.Encrypt(l[:], l[:])
+	k1 := dbl(l)
+	k2 := dbl(k1)
+
+	// the last block is xored with k1 if it is complete, otherwise it is
+	// padded and xored with k2
+	n := (len(message) + aes.BlockSize - 1) / aes.BlockSize
+	if n == 0 {
+		n = 1
+	}
+	var last [aes.BlockSize]byte
+	rest := message[(n-1)*aes.BlockSize:]
+	if len(rest) == aes.BlockSize {
+		copy(last[:], rest)
+		xorBlock(&last, k1[:])
+	} else {
+		copy(last[:], rest)
+		last[len(rest)] = 0x80
+		xorBlock(&last, k2[:])
+	}
+
+	var x [aes.BlockSize]byte
+	for i := 0; i < n-1; i++ {
+		xorBlock(&x, message[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		block.Encrypt(x[:], x[:])
+	}
+	xorBlock(&x, last[:])
+	block.Encrypt(x[:], x[:])
+
+	return x
+}
+
+// dbl multiplies a block by x in GF(2^128).
+func dbl(b [aes.BlockSize]byte) [aes.BlockSize]byte {
+	var out [aes.BlockSize]byte
+	carry := b[0] >> 7
+	for i := 0; i < aes.BlockSize-1; i++ {
+		out[i] = b[i]<<1 | b[i+1]>>7
+	}
+	out[aes.BlockSize-1] = b[aes.BlockSize-1] << 1
+	out[aes.BlockSize-1] ^= 0x87 * carry
+	return out
+}
+
+// xorBlock xors src into dst.
+func xorBlock(dst *[aes.BlockSize]byte, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
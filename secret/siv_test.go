@@ -0,0 +1,153 @@
+package secret
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+var _ = fmt.Printf // for testing
+
+func TestCMACVectors(t *testing.T) {
+	// test vectors from RFC 4493, section 4
+	key, _ := hex.DecodeString("2b7e151628aed2a6abf7158809cf4f3c")
+	message, _ := hex.DecodeString("6bc1bee22e409f96e93d7e117393172a" +
+		"ae2d8a571e03ac9c9eb76fac45af8e51" +
+		"30c81c46a35ce411e5fbc1191a0a52ef" +
+		"f69f2445df4f9b17ad2b417be66c3710")
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("Got unexpected error from aes.NewCipher: %v", err)
+	}
+
+	var tests = []struct {
+		inLength int
+		outMAC   string
+	}{
+		{0, "bb1d6929e95937287fa37d129b756746"},
+		{16, "070a16b46b4d4144f79bdd9dd04a287c"},
+		{40, "dfa66747de9ae63030ca32611497c827"},
+		{64, "51f0bebf7e3b9d92fc49741779363cfe"},
+	}
+
+	for _, tt := range tests {
+		mac := cmac(block, message[:tt.inLength])
+		if g, w := hex.EncodeToString(mac[:]), tt.outMAC; g != w {
+			t.Errorf("[%v] CMAC: Got %v, Want %v", tt.inLength, g, w)
+		}
+	}
+}
+
+func TestSIVVector(t *testing.T) {
+	// deterministic authenticated encryption example from RFC 5297, A.1
+	key, _ := hex.DecodeString("fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0" +
+		"f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff")
+	ad, _ := hex.DecodeString("101112131415161718191a1b1c1d1e1f" +
+		"2021222324252627")
+	plaintext, _ := hex.DecodeString("112233445566778899aabbccddee")
+	want, _ := hex.DecodeString("85632d07c6e8f37f950acd320a2ecc93" +
+		"40c02b9690c4dc04daef7f6afe5c")
+
+	d, err := newSIV(key)
+	if err != nil {
+		t.Fatalf("Got unexpected error from newSIV: %v", err)
+	}
+
+	got := d.Seal(plaintext, ad)
+	if !bytes.Equal(got, want) {
+		t.Errorf("Ciphertext: Got %x, Want %x", got, want)
+	}
+
+	opened, err := d.Open(want, ad)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Open: %v", err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Errorf("Plaintext: Got %x, Want %x", opened, plaintext)
+	}
+}
+
+func TestDeterministicCipher(t *testing.T) {
+	key, err := EncodedStringToDeterministicKey(
+		"AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8gISIjJCUmJygpKissLS4vMDEyMzQ1Njc4OTo7PD0+Pw==")
+	if err != nil {
+		t.Fatalf("Got unexpected error from EncodedStringToDeterministicKey: %v", err)
+	}
+	d, err := NewDeterministicCipher(key)
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewDeterministicCipher: %v", err)
+	}
+
+	column := []byte("users.email")
+	sealed := d.Seal([]byte("alice@example.com"), column)
+
+	// equal values give equal ciphertexts, so they can be looked up
+	if again := d.Seal([]byte("alice@example.com"), column); !bytes.Equal(again, sealed) {
+		t.Errorf("Seal should be deterministic: Got %x, Want %x", again, sealed)
+	}
+	if other := d.Seal([]byte("bob@example.com"), column); bytes.Equal(other, sealed) {
+		t.Errorf("Seal should give different ciphertexts for different values")
+	}
+	if other := d.Seal([]byte("alice@example.com"), []byte("users.backup_email")); bytes.Equal(other, sealed) {
+		t.Errorf("Seal should give different ciphertexts for different associated data")
+	}
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+
+	var tests = []struct {
+		inCiphertext []byte
+		inAD         [][]byte
+		outOK        bool
+	}{
+		{sealed, [][]byte{column}, true},
+		{sealed, nil, false},
+		{sealed, [][]byte{[]byte("users.name")}, false},
+		{sealed, [][]byte{column, nil}, false},
+		{tampered, [][]byte{column}, false},
+		{sealed[:15], [][]byte{column}, false},
+		{d.Seal(nil), nil, true},
+		{d.Seal([]byte("x"), nil), [][]byte{nil}, true},
+	}
+
+	for i, tt := range tests {
+		_, err := d.Open(tt.inCiphertext, tt.inAD...)
+		if g, w := err == nil, tt.outOK; g != w {
+			t.Errorf("[%v] Opened: Got %v, Want %v (%v)", i, g, w, err)
+		}
+	}
+
+	out, err := d.Open(sealed, column)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Open: %v", err)
+	}
+	if g, w := string(out), "alice@example.com"; g != w {
+		t.Errorf("Plaintext: Got %v, Want %v", g, w)
+	}
+}
+
+func TestDeterministicKey(t *testing.T) {
+	key, err := NewDeterministicKey()
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewDeterministicKey: %v", err)
+	}
+
+	decoded, err := EncodedStringToDeterministicKey(DeterministicKeyToEncodedString(key))
+	if err != nil {
+		t.Fatalf("Got unexpected error from EncodedStringToDeterministicKey: %v", err)
+	}
+	if *decoded != *key {
+		t.Errorf("Key: Got %x, Want %x", decoded[:], key[:])
+	}
+
+	// a secret key is not a deterministic key
+	if _, err := EncodedStringToDeterministicKey("AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="); err == nil {
+		t.Errorf("EncodedStringToDeterministicKey should fail with a secret key")
+	}
+	if _, err := NewDeterministicCipher(nil); err == nil {
+		t.Errorf("NewDeterministicCipher should fail with a nil key")
+	}
+}
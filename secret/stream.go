@@ -0,0 +1,318 @@
+package secret
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mailgun/lemma/random"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// A sealed stream starts with a header: the StreamVersion, the chunk size as
+// a 32-bit big endian integer, and a random nonce prefix. Then come the
+// chunks, each sealed with XChaCha20-Poly1305 and the header as associated
+// data, so a changed header fails to open too. Every chunk holds chunk size
+// bytes of plaintext, except the last one which may hold fewer (or none). The
+// nonce of a chunk is the prefix, the chunk counter as a 64-bit big endian
+// integer, and 1 for the last chunk or 0 for the others, so chunks that are
+// reordered, dropped, or truncated from the end fail to open.
+//
+// Streams are always sealed with XChaCha20-Poly1305, whatever the Algorithm
+// of the Service, so a Service only seals and opens streams if it is one of
+// its AllowedAlgorithms. Streams of version 1 had their chunks sealed with
+// secretbox and the header wasn't authenticated, they are still opened.
+const (
+	StreamVersion      = 2
+	streamVersion1     = 1
+	StreamChunkSize    = 64 * 1024        // default plaintext bytes per chunk
+	MaxStreamChunkSize = 16 * 1024 * 1024 // largest chunk size accepted when opening
+
+	streamPrefixLength = NonceLength - 8 - 1
+	streamHeaderLength = 1 + 4 + streamPrefixLength
+)
+
+// ErrStreamTruncated is returned when a sealed stream ends before its last
+// chunk.
+var ErrStreamTruncated = errors.New("sealed stream truncated")
+
+// SealStream returns a writer that seals everything written to it with
+// secretKey and writes it to w. Close must be called to write the last
+// chunk, it does not close w. Useful for one off sealing of large payloads,
+// otherwise create a secret.Service.
+func SealStream(w io.Writer, secretKey *[SecretKeyLength]byte) (io.WriteCloser, error) {
+	if secretKey == nil {
+		return nil, fmt.Errorf("secret key is nil")
+	}
+	return newStreamWriter(w, secretKey, StreamChunkSize, randomProvider)
+}
+
+// OpenStream returns a reader that opens the sealed stream read from r with
+// secretKey. Plaintext is only returned once the chunk it is in has been
+// authenticated, and reading fails if the stream was modified or truncated.
+func OpenStream(r io.Reader, secretKey *[SecretKeyLength]byte) (io.Reader, error) {
+	if secretKey == nil {
+		return nil, fmt.Errorf("secret key is nil")
+	}
+	return newStreamReader(r, []*[SecretKeyLength]byte{secretKey}, nil)
+}
+
+// SealStream returns a writer that seals everything written to it and writes
+// it to w, in chunks of StreamChunkSize bytes. Close must be called to write
+// the last chunk, it does not close w. Streams can't be sealed with envelope
+// encryption, so it fails if a KeyWrapper is configured, even alongside a key.
+func (s *Service) SealStream(w io.Writer) (io.WriteCloser, error) {
+	secretKey := s.currentKey()
+	if s.keyWrapper != nil || secretKey == nil {
+		return nil, fmt.Errorf("streams can't be sealed with envelope encryption")
+	}
+	if !algorithmIn(XChaCha20Poly1305, s.allowedAlgorithms) {
+		return nil, fmt.Errorf("streams are sealed with %v, which is not allowed", XChaCha20Poly1305)
+	}
+	return newStreamWriter(w, secretKey, s.streamChunkSize, s.randomProvider)
+}
+
+// OpenStream returns a reader that opens the sealed stream read from r.
+// Plaintext is only returned once the chunk it is in has been authenticated,
+// and reading fails if the stream was modified or truncated.
+func (s *Service) OpenStream(r io.Reader) (io.Reader, error) {
+	secretKeys, err := s.openKeys("")
+	if err != nil {
+		return nil, err
+	}
+	return newStreamReader(r, secretKeys, s.allowedAlgorithms)
+}
+
+// streamWriter seals a stream a chunk at a time.
+type streamWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte // authenticated with every chunk
+	nonce   [NonceLength]byte
+	counter uint64
+	chunk   []byte // plaintext of the next chunk
+	sealed  []byte
+	closed  bool
+	err     error
+}
+
+func newStreamWriter(w io.Writer, secretKey *[SecretKeyLength]byte, chunkSize int,
+	randomProvider random.RandomProvider) (*streamWriter, error) {
+
+	if chunkSize < 1 || chunkSize > MaxStreamChunkSize {
+		return nil, fmt.Errorf("invalid stream chunk size: %v", chunkSize)
+	}
+
+	aead, err := chacha20poly1305.NewX(secretKey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, err := randomProvider.Bytes(streamPrefixLength)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %v", err)
+	}
+
+	header := make([]byte, streamHeaderLength)
+	header[0] = StreamVersion
+	binary.BigEndian.PutUint32(header[1:5], uint32(chunkSize))
+	copy(header[5:], prefix)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	sw := &streamWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		chunk:  make([]byte, 0, chunkSize),
+		sealed: make([]byte, 0, chunkSize+aead.Overhead()),
+	}
+	copy(sw.nonce[:], prefix)
+
+	return sw, nil
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, fmt.Errorf("write to closed stream")
+	}
+	if sw.err != nil {
+		return 0, sw.err
+	}
+
+	n := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data arrives, the last chunk
+		// is sealed by Close
+		if len(sw.chunk) == cap(sw.chunk) {
+			if sw.err = sw.seal(false); sw.err != nil {
+				return n, sw.err
+			}
+		}
+
+		c := copy(sw.chunk[len(sw.chunk):cap(sw.chunk)], p)
+		sw.chunk = sw.chunk[:len(sw.chunk)+c]
+		p = p[c:]
+		n += c
+	}
+
+	return n, nil
+}
+
+// Close seals and writes the last chunk. It does not close the underlying
+// writer.
+func (sw *streamWriter) Close() error {
+	if sw.closed {
+		return nil
+	}
+	sw.closed = true
+	if sw.err != nil {
+		return sw.err
+	}
+
+	return sw.seal(true)
+}
+
+func (sw *streamWriter) seal(final bool) error {
+	setStreamNonce(&sw.nonce, sw.counter, final)
+	sw.counter++
+
+	sw.sealed = sw.aead.Seal(sw.sealed[:0], sw.nonce[:], sw.chunk, sw.header)
+	sw.chunk = sw.chunk[:0]
+
+	_, err := sw.w.Write(sw.sealed)
+	return err
+}
+
+// streamReader opens a sealed stream a chunk at a time.
+type streamReader struct {
+	r         *bufio.Reader
+	aeads     []cipher.AEAD // one per key, the first chunk picks the key for the rest
+	aad       []byte        // the header, nil for version 1
+	nonce     [NonceLength]byte
+	counter   uint64
+	sealed    []byte
+	plaintext []byte // opened and not yet read
+	done      bool
+	err       error
+}
+
+// newStreamReader reads the header of a sealed stream. If allowedAlgorithms
+// isn't nil, the stream's algorithm must be one of them.
+func newStreamReader(r io.Reader, secretKeys []*[SecretKeyLength]byte,
+	allowedAlgorithms []Algorithm) (*streamReader, error) {
+
+	header := make([]byte, streamHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrStreamTruncated
+		}
+		return nil, err
+	}
+
+	// version 1 chunks are sealed with secretbox, without the header
+	algorithm, aad := XChaCha20Poly1305, header
+	switch header[0] {
+	case StreamVersion:
+	case streamVersion1:
+		algorithm, aad = Salsa20Poly1305, nil
+	default:
+		return nil, fmt.Errorf("unsupported stream version: %v", header[0])
+	}
+	if allowedAlgorithms != nil && !algorithmIn(algorithm, allowedAlgorithms) {
+		return nil, fmt.Errorf("algorithm not allowed: %q", algorithm)
+	}
+	chunkSize := binary.BigEndian.Uint32(header[1:5])
+	if chunkSize < 1 || chunkSize > MaxStreamChunkSize {
+		return nil, fmt.Errorf("invalid stream chunk size: %v", chunkSize)
+	}
+
+	aeads := make([]cipher.AEAD, len(secretKeys))
+	for i, secretKey := range secretKeys {
+		aead, err := algorithms[algorithm].newAEAD(secretKey)
+		if err != nil {
+			return nil, err
+		}
+		aeads[i] = aead
+	}
+
+	sr := &streamReader{
+		r:      bufio.NewReader(r),
+		aeads:  aeads,
+		aad:    aad,
+		sealed: make([]byte, int(chunkSize)+tagLength),
+	}
+	copy(sr.nonce[:], header[5:])
+
+	return sr, nil
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	for len(sr.plaintext) == 0 {
+		if sr.err != nil {
+			return 0, sr.err
+		}
+		if sr.done {
+			return 0, io.EOF
+		}
+		sr.err = sr.open()
+	}
+
+	n := copy(p, sr.plaintext)
+	sr.plaintext = sr.plaintext[n:]
+	return n, nil
+}
+
+// open reads and opens the next chunk.
+func (sr *streamReader) open() error {
+	n, err := io.ReadFull(sr.r, sr.sealed)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		// a short chunk is the last one
+		sr.done = true
+	case err != nil:
+		return err
+	default:
+		// so is a full one at the end of the stream
+		if _, err := sr.r.Peek(1); err == io.EOF {
+			sr.done = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if n < tagLength {
+		return ErrStreamTruncated
+	}
+
+	setStreamNonce(&sr.nonce, sr.counter, sr.done)
+	sr.counter++
+
+	for i, aead := range sr.aeads {
+		plaintext, err := aead.Open(nil, sr.nonce[:], sr.sealed[:n], sr.aad)
+		if err == nil {
+			sr.aeads = sr.aeads[i : i+1]
+			sr.plaintext = plaintext
+			return nil
+		}
+	}
+
+	if sr.done {
+		// the last chunk we have might not be the last one that was sealed
+		return fmt.Errorf("unable to decrypt stream chunk %v, it may be truncated", sr.counter-1)
+	}
+	return fmt.Errorf("unable to decrypt stream chunk %v", sr.counter-1)
+}
+
+// setStreamNonce sets the counter and final flag of a stream nonce, after
+// the prefix.
+func setStreamNonce(nonce *[NonceLength]byte, counter uint64, final bool) {
+	binary.BigEndian.PutUint64(nonce[streamPrefixLength:NonceLength-1], counter)
+	nonce[NonceLength-1] = 0
+	if final {
+		nonce[NonceLength-1] = 1
+	}
+}
@@ -0,0 +1,284 @@
+package secret
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/timetools"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+var _ = fmt.Printf // for testing
+
+const testChunkSize = 16
+
+// sealTestStream seals plaintext in testChunkSize chunks, writing it a few
+// bytes at a time.
+func sealTestStream(t *testing.T, s *Service, plaintext []byte) []byte {
+	var sealed bytes.Buffer
+	w, err := s.SealStream(&sealed)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SealStream: %v", err)
+	}
+	for p := plaintext; len(p) > 0; {
+		n := 7
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatalf("Got unexpected error from Write: %v", err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Got unexpected error from Close: %v", err)
+	}
+	return sealed.Bytes()
+}
+
+func newStreamService(t *testing.T) *Service {
+	key, err := (&random.CSPRNG{}).Bytes(SecretKeyLength)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Bytes: %v", err)
+	}
+	keyBytes, _ := KeySliceToArray(key)
+	s, err := NewWithProviders(&Config{KeyBytes: keyBytes, StreamChunkSize: testChunkSize}, &timetools.RealTime{}, &random.CSPRNG{})
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewWithProviders: %v", err)
+	}
+	return s.(*Service)
+}
+
+func TestStreamCycle(t *testing.T) {
+	s := newStreamService(t)
+
+	for _, size := range []int{0, 1, testChunkSize - 1, testChunkSize, testChunkSize + 1, 3 * testChunkSize, 100} {
+		plaintext, _ := (&random.CSPRNG{}).Bytes(size)
+		sealed := sealTestStream(t, s, plaintext)
+
+		// header, then every chunk grows by the Poly1305 tag
+		chunks := size/testChunkSize + 1
+		if size > 0 && size%testChunkSize == 0 {
+			chunks--
+		}
+		if g, w := len(sealed), streamHeaderLength+size+chunks*16; g != w {
+			t.Errorf("[%v] Sealed length: Got %v, Want %v", size, g, w)
+		}
+
+		r, err := s.OpenStream(bytes.NewReader(sealed))
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from OpenStream: %v", size, err)
+			continue
+		}
+		opened, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from ReadAll: %v", size, err)
+		}
+		if !bytes.Equal(opened, plaintext) {
+			t.Errorf("[%v] Opened: Got %x, Want %x", size, opened, plaintext)
+		}
+	}
+}
+
+func TestStreamCyclePackage(t *testing.T) {
+	key, err := (&random.CSPRNG{}).Bytes(SecretKeyLength)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Bytes: %v", err)
+	}
+	keyBytes, _ := KeySliceToArray(key)
+
+	var sealed bytes.Buffer
+	w, err := SealStream(&sealed, keyBytes)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SealStream: %v", err)
+	}
+	io.WriteString(w, "hello, world")
+	w.Close()
+
+	r, err := OpenStream(&sealed, keyBytes)
+	if err != nil {
+		t.Fatalf("Got unexpected error from OpenStream: %v", err)
+	}
+	opened, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Errorf("Got unexpected error from ReadAll: %v", err)
+	}
+	if g, w := string(opened), "hello, world"; g != w {
+		t.Errorf("Opened: Got %v, Want %v", g, w)
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	s := newStreamService(t)
+	plaintext := bytes.Repeat([]byte("a"), 3*testChunkSize+5)
+	sealed := sealTestStream(t, s, plaintext)
+
+	sealedChunk := testChunkSize + 16
+	chunk := func(i int) []byte {
+		start := streamHeaderLength + i*sealedChunk
+		end := start + sealedChunk
+		if end > len(sealed) {
+			end = len(sealed)
+		}
+		return sealed[start:end]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	header := sealed[:streamHeaderLength]
+	flipped := append([]byte{}, sealed...)
+	flipped[streamHeaderLength+sealedChunk+3] ^= 1
+
+	var tests = []struct {
+		name     string
+		inSealed []byte
+		outRead  int // plaintext released before the error
+	}{
+		{"flipped bit", flipped, testChunkSize},
+		{"truncated at a chunk", join(header, chunk(0), chunk(1)), testChunkSize},
+		{"truncated in a chunk", sealed[:len(sealed)-1], 3 * testChunkSize},
+		{"dropped chunk", join(header, chunk(0), chunk(2), chunk(3)), testChunkSize},
+		{"reordered chunks", join(header, chunk(1), chunk(0), chunk(2), chunk(3)), 0},
+		{"no chunks", header, 0},
+		{"trailing data", join(sealed, []byte("x")), 3 * testChunkSize},
+	}
+
+	for _, tt := range tests {
+		r, err := s.OpenStream(bytes.NewReader(tt.inSealed))
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from OpenStream: %v", tt.name, err)
+			continue
+		}
+		opened, err := ioutil.ReadAll(r)
+		if err == nil {
+			t.Errorf("[%v] ReadAll should have failed", tt.name)
+		}
+		if g, w := len(opened), tt.outRead; g != w {
+			t.Errorf("[%v] Plaintext released: Got %v, Want %v", tt.name, g, w)
+		}
+	}
+}
+
+func TestStreamInvalidHeader(t *testing.T) {
+	s := newStreamService(t)
+	sealed := sealTestStream(t, s, []byte("hello, world"))
+
+	badVersion := append([]byte{}, sealed...)
+	badVersion[0] = StreamVersion + 1
+	badChunkSize := append([]byte{}, sealed...)
+	badChunkSize[1] = 0xff
+
+	for i, inSealed := range [][]byte{sealed[:streamHeaderLength-1], badVersion, badChunkSize} {
+		if _, err := s.OpenStream(bytes.NewReader(inSealed)); err == nil {
+			t.Errorf("[%v] OpenStream should have failed", i)
+		}
+	}
+}
+
+func TestStreamTamperedHeader(t *testing.T) {
+	s := newStreamService(t)
+	plaintext := []byte("hello, world")
+	sealed := sealTestStream(t, s, plaintext)
+
+	// a header that still parses, with a larger chunk size the single chunk
+	// fits in, must not open
+	tampered := append([]byte{}, sealed...)
+	tampered[4]++
+	r, err := s.OpenStream(bytes.NewReader(tampered))
+	if err != nil {
+		t.Fatalf("Got unexpected error from OpenStream: %v", err)
+	}
+	if opened, err := ioutil.ReadAll(r); err == nil || len(opened) != 0 {
+		t.Errorf("ReadAll: Got %q, %v, Want an error", opened, err)
+	}
+}
+
+func TestStreamWrongKey(t *testing.T) {
+	sealed := sealTestStream(t, newStreamService(t), []byte("hello, world"))
+
+	r, err := newStreamService(t).OpenStream(bytes.NewReader(sealed))
+	if err != nil {
+		t.Fatalf("Got unexpected error from OpenStream: %v", err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Errorf("ReadAll should fail with the wrong key")
+	}
+}
+
+func TestStreamKeyWrapper(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewKey: %v", err)
+	}
+	kek, err := NewKey()
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewKey: %v", err)
+	}
+
+	// the key is only there to open messages sealed before envelope
+	// encryption, streams must not be sealed with it
+	s, err := New(&Config{KeyBytes: key, KeyWrapper: &localKeyWrapper{kek: kek}})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+	if _, err := s.(*Service).SealStream(ioutil.Discard); err == nil {
+		t.Errorf("SealStream should fail with a KeyWrapper")
+	}
+}
+
+func TestStreamVersion1(t *testing.T) {
+	s := newStreamService(t)
+	key := s.currentKey()
+
+	// a version 1 stream, its chunks sealed with secretbox
+	plaintext := []byte("hello, world, hello, world")
+	sealed := []byte{1, 0, 0, 0, testChunkSize}
+	var nonce [NonceLength]byte
+	copy(nonce[:], bytes.Repeat([]byte{7}, streamPrefixLength))
+	sealed = append(sealed, nonce[:streamPrefixLength]...)
+	for i, chunk := range [][]byte{plaintext[:testChunkSize], plaintext[testChunkSize:]} {
+		setStreamNonce(&nonce, uint64(i), i == 1)
+		sealed = secretbox.Seal(sealed, chunk, &nonce, key)
+	}
+
+	r, err := s.OpenStream(bytes.NewReader(sealed))
+	if err != nil {
+		t.Fatalf("Got unexpected error from OpenStream: %v", err)
+	}
+	opened, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Errorf("Got unexpected error from ReadAll: %v", err)
+	}
+	if g, w := string(opened), string(plaintext); g != w {
+		t.Errorf("Opened: Got %v, Want %v", g, w)
+	}
+
+	// new streams are version 2
+	if g, w := sealTestStream(t, s, plaintext)[0], byte(StreamVersion); g != w {
+		t.Errorf("Version: Got %v, Want %v", g, w)
+	}
+}
+
+func TestStreamAllowedAlgorithms(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatalf("Got unexpected error from NewKey: %v", err)
+	}
+	sealed := sealTestStream(t, newStreamService(t), []byte("hello, world"))
+
+	// a service pinned to AES256GCM neither seals nor opens streams
+	s, err := New(&Config{KeyBytes: key, Algorithm: AES256GCM, AllowedAlgorithms: []Algorithm{AES256GCM}})
+	if err != nil {
+		t.Fatalf("Got unexpected error from New: %v", err)
+	}
+	if _, err := s.(*Service).SealStream(ioutil.Discard); err == nil {
+		t.Errorf("SealStream should fail without %v allowed", XChaCha20Poly1305)
+	}
+	if _, err := s.(*Service).OpenStream(bytes.NewReader(sealed)); err == nil {
+		t.Errorf("OpenStream should fail without %v allowed", XChaCha20Poly1305)
+	}
+}
@@ -0,0 +1,186 @@
+package secret
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// vectorsPath is the cross-language test vector suite, see tools/lemmavectors.
+const vectorsPath = "../testdata/vectors-v1.json"
+
+type secretVector struct {
+	Name       string `json:"name"`
+	Key        []byte `json:"key"`
+	Nonce      []byte `json:"nonce"`
+	Plaintext  []byte `json:"plaintext"`
+	Ciphertext []byte `json:"ciphertext"`
+	Sealed     string `json:"sealed"`
+}
+
+type secretBinaryVector struct {
+	Name       string `json:"name"`
+	Algorithm  string `json:"algorithm"`
+	Key        []byte `json:"key"`
+	KeyID      string `json:"key_id"`
+	KEK        []byte `json:"kek"`
+	WrappedKey []byte `json:"wrapped_key"`
+	Nonce      []byte `json:"nonce"`
+	Plaintext  []byte `json:"plaintext"`
+	AAD        []byte `json:"aad"`
+	Ciphertext []byte `json:"ciphertext"`
+	Sealed     []byte `json:"sealed"`
+	Compact    string `json:"compact"`
+}
+
+func readVectors(t *testing.T) []secretVector {
+	b, err := ioutil.ReadFile(vectorsPath)
+	if err != nil {
+		t.Fatalf("Unable to read test vectors: %v", err)
+	}
+
+	var vectors struct {
+		Version int            `json:"version"`
+		Secret  []secretVector `json:"secret"`
+	}
+	err = json.Unmarshal(b, &vectors)
+	if err != nil {
+		t.Fatalf("Unable to parse test vectors: %v", err)
+	}
+	if vectors.Version != 1 {
+		t.Fatalf("Unexpected test vectors version: %v", vectors.Version)
+	}
+	if len(vectors.Secret) == 0 {
+		t.Fatal("No secret test vectors found")
+	}
+
+	return vectors.Secret
+}
+
+func TestVectorsSeal(t *testing.T) {
+	for _, v := range readVectors(t) {
+		key, err := KeySliceToArray(v.Key)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from KeySliceToArray: %v", v.Name, err)
+			continue
+		}
+		nonce, err := nonceSliceToArray(v.Nonce)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from nonceSliceToArray: %v", v.Name, err)
+			continue
+		}
+
+		if g, w := secretbox.Seal(nil, v.Plaintext, nonce, key), v.Ciphertext; !bytes.Equal(g, w) {
+			t.Errorf("[%v] Ciphertext: Got %x, Want %x", v.Name, g, w)
+		}
+
+		gotSealed, err := SealedDataToString(&SealedBytes{Ciphertext: v.Ciphertext, Nonce: v.Nonce})
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from SealedDataToString: %v", v.Name, err)
+		}
+		if g, w := gotSealed, v.Sealed; g != w {
+			t.Errorf("[%v] Sealed: Got %s, Want %s", v.Name, g, w)
+		}
+	}
+}
+
+func TestVectorsOpen(t *testing.T) {
+	for _, v := range readVectors(t) {
+		key, err := KeySliceToArray(v.Key)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from KeySliceToArray: %v", v.Name, err)
+			continue
+		}
+
+		sealed, err := StringToSealedData(v.Sealed)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from StringToSealedData: %v", v.Name, err)
+			continue
+		}
+
+		plaintext, err := Open(sealed, key)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from Open: %v", v.Name, err)
+			continue
+		}
+		if g, w := plaintext, v.Plaintext; !bytes.Equal(g, w) {
+			t.Errorf("[%v] Plaintext: Got %x, Want %x", v.Name, g, w)
+		}
+	}
+}
+
+func TestVectorsBinary(t *testing.T) {
+	b, err := ioutil.ReadFile(vectorsPath)
+	if err != nil {
+		t.Fatalf("Unable to read test vectors: %v", err)
+	}
+	var vectors struct {
+		SecretBinary []secretBinaryVector `json:"secret_binary"`
+	}
+	if err := json.Unmarshal(b, &vectors); err != nil {
+		t.Fatalf("Unable to parse test vectors: %v", err)
+	}
+	if len(vectors.SecretBinary) == 0 {
+		t.Fatal("No secret_binary test vectors found")
+	}
+
+	for _, v := range vectors.SecretBinary {
+		// encoding the fields gives the binary format and the compact string
+		sealed := &SealedBytes{
+			Ciphertext: v.Ciphertext,
+			Nonce:      v.Nonce,
+			KeyID:      v.KeyID,
+			WrappedKey: v.WrappedKey,
+		}
+		if Algorithm(v.Algorithm) != Salsa20Poly1305 {
+			sealed.Algorithm = Algorithm(v.Algorithm)
+		}
+		gotSealed, err := sealed.MarshalBinary()
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from MarshalBinary: %v", v.Name, err)
+			continue
+		}
+		if g, w := gotSealed, v.Sealed; !bytes.Equal(g, w) {
+			t.Errorf("[%v] Sealed: Got %x, Want %x", v.Name, g, w)
+		}
+		gotCompact, err := SealedDataToCompactString(sealed)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from SealedDataToCompactString: %v", v.Name, err)
+		}
+		if g, w := gotCompact, v.Compact; g != w {
+			t.Errorf("[%v] Compact: Got %s, Want %s", v.Name, g, w)
+		}
+
+		// and the ciphertext opens with the key, or the data key it wraps
+		key := v.Key
+		if v.KEK != nil {
+			kek, err := KeySliceToArray(v.KEK)
+			if err != nil {
+				t.Errorf("[%v] Got unexpected error from KeySliceToArray: %v", v.Name, err)
+				continue
+			}
+			dataKey, err := (&localKeyWrapper{kek: kek}).UnwrapKey(v.WrappedKey)
+			if err != nil {
+				t.Errorf("[%v] Got unexpected error from UnwrapKey: %v", v.Name, err)
+				continue
+			}
+			key = dataKey[:]
+		}
+		keyArray, err := KeySliceToArray(key)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from KeySliceToArray: %v", v.Name, err)
+			continue
+		}
+		plaintext, err := Algorithm(v.Algorithm).open(v.Ciphertext, v.AAD, v.Nonce, keyArray)
+		if err != nil {
+			t.Errorf("[%v] Got unexpected error from open: %v", v.Name, err)
+			continue
+		}
+		if g, w := plaintext, v.Plaintext; !bytes.Equal(g, w) {
+			t.Errorf("[%v] Plaintext: Got %x, Want %x", v.Name, g, w)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package secret
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The binary format of a sealed message is:
+//
+//	version      1 byte, WireVersion
+//	algorithm    1 byte, the ID of the algorithm it was sealed with
+//	key ID       1 byte length, then up to 255 bytes
+//	wrapped key  only in WireVersionEnvelope, 2 byte big endian length, then
+//	             1 to 65535 bytes
+//	nonce        the nonce size of the algorithm
+//	ciphertext   the rest
+//
+// The legacy format is the base64 of the JSON of SealedBytes, so decoded it
+// always starts with '{', which is never a version.
+const WireVersion = 0xa1
+
+// WireVersionEnvelope is the version of the binary format for messages
+// sealed with envelope encryption, which carry the wrapped data key.
+const WireVersionEnvelope = 0xa2
+
+// tagLength is the length of the authentication tag every algorithm adds to
+// the ciphertext.
+const tagLength = 16
+
+// MarshalBinary encodes the sealed message in the binary format.
+//
+// SealedBytes doesn't implement encoding.TextMarshaler so encoding/json
+// keeps encoding its fields like it always has. Use SealedDataToCompactString
+// for the text form of the binary format.
+func (s *SealedBytes) MarshalBinary() ([]byte, error) {
+	algorithm, ok := algorithms[s.AlgorithmID()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm: %q", s.AlgorithmID())
+	}
+	if len(s.Nonce) != algorithm.nonceSize {
+		return nil, fmt.Errorf("wrong nonce length for %v: %v", s.AlgorithmID(), len(s.Nonce))
+	}
+	if len(s.KeyID) > 255 {
+		return nil, fmt.Errorf("key id is longer than 255 bytes: %v", len(s.KeyID))
+	}
+	if len(s.WrappedKey) > 65535 {
+		return nil, fmt.Errorf("wrapped key is longer than 65535 bytes: %v", len(s.WrappedKey))
+	}
+
+	version := byte(WireVersion)
+	if len(s.WrappedKey) > 0 {
+		version = WireVersionEnvelope
+	}
+
+	b := make([]byte, 0, 5+len(s.KeyID)+len(s.WrappedKey)+len(s.Nonce)+len(s.Ciphertext))
+	b = append(b, version, algorithm.id, byte(len(s.KeyID)))
+	b = append(b, s.KeyID...)
+	if version == WireVersionEnvelope {
+		var wrappedKeyLength [2]byte
+		binary.BigEndian.PutUint16(wrappedKeyLength[:], uint16(len(s.WrappedKey)))
+		b = append(b, wrappedKeyLength[:]...)
+		b = append(b, s.WrappedKey...)
+	}
+	b = append(b, s.Nonce...)
+	b = append(b, s.Ciphertext...)
+
+	return b, nil
+}
+
+// UnmarshalBinary decodes a sealed message in the binary format.
+func (s *SealedBytes) UnmarshalBinary(data []byte) error {
+	if len(data) < 3 {
+		return fmt.Errorf("sealed data too short: %v bytes", len(data))
+	}
+	version := data[0]
+	if version != WireVersion && version != WireVersionEnvelope {
+		return fmt.Errorf("unsupported sealed data version: %#x", version)
+	}
+	algorithm, ok := algorithmByID(data[1])
+	if !ok {
+		return fmt.Errorf("unsupported algorithm id: %v", data[1])
+	}
+
+	keyIDLength := int(data[2])
+	data = data[3:]
+	if len(data) < keyIDLength {
+		return fmt.Errorf("sealed data too short for key id")
+	}
+	keyID := string(data[:keyIDLength])
+	data = data[keyIDLength:]
+
+	var wrappedKey []byte
+	if version == WireVersionEnvelope {
+		if len(data) < 2 {
+			return fmt.Errorf("sealed data too short for wrapped key")
+		}
+		wrappedKeyLength := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if wrappedKeyLength == 0 || len(data) < wrappedKeyLength {
+			return fmt.Errorf("sealed data too short for wrapped key")
+		}
+		wrappedKey = append([]byte{}, data[:wrappedKeyLength]...)
+		data = data[wrappedKeyLength:]
+	}
+
+	nonceSize := algorithm.NonceSize()
+	if len(data) < nonceSize+tagLength {
+		return fmt.Errorf("sealed data too short for nonce and ciphertext")
+	}
+
+	*s = SealedBytes{
+		Ciphertext: append([]byte{}, data[nonceSize:]...),
+		Nonce:      append([]byte{}, data[:nonceSize]...),
+		KeyID:      keyID,
+		WrappedKey: wrappedKey,
+	}
+	if algorithm != Salsa20Poly1305 {
+		s.Algorithm = algorithm
+	}
+
+	return nil
+}
+
+// toSealedBytes returns sealedData as SealedBytes.
+func toSealedBytes(sealedData SealedData) *SealedBytes {
+	if sb, ok := sealedData.(*SealedBytes); ok {
+		return sb
+	}
+
+	// anything else only has a ciphertext and a nonce, sealed with
+	// Salsa20Poly1305 without a key ID or envelope encryption
+	return &SealedBytes{
+		Ciphertext: sealedData.CiphertextBytes(),
+		Nonce:      sealedData.NonceBytes(),
+	}
+}
@@ -0,0 +1,229 @@
+package secret
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mailgun/lemma/random"
+)
+
+var _ = fmt.Printf // for testing
+
+func TestMarshalBinaryCycle(t *testing.T) {
+	key, err := (&random.CSPRNG{}).Bytes(SecretKeyLength)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Bytes: %v", err)
+	}
+	keyBytes, _ := KeySliceToArray(key)
+
+	for _, algorithm := range []Algorithm{Salsa20Poly1305, XChaCha20Poly1305, AES256GCM} {
+		for _, keyID := range []string{"", "2017-06"} {
+			s, err := New(&Config{KeyBytes: keyBytes, Algorithm: algorithm})
+			if err != nil {
+				t.Fatalf("Got unexpected error from New: %v", err)
+			}
+			sealed, err := s.Seal([]byte("hello, box!"))
+			if err != nil {
+				t.Fatalf("Got unexpected error from Seal: %v", err)
+			}
+			sealed.(*SealedBytes).KeyID = keyID
+
+			compact, err := SealedDataToCompactString(sealed)
+			if err != nil {
+				t.Errorf("[%v %q] Got unexpected error from SealedDataToCompactString: %v", algorithm, keyID, err)
+				continue
+			}
+			legacy, _ := SealedDataToString(sealed)
+			if len(compact) > len(legacy)*2/3 {
+				t.Errorf("[%v %q] Compact string is %v bytes, legacy string %v", algorithm, keyID, len(compact), len(legacy))
+			}
+
+			decoded, err := StringToSealedData(compact)
+			if err != nil {
+				t.Errorf("[%v %q] Got unexpected error from StringToSealedData: %v", algorithm, keyID, err)
+				continue
+			}
+			if g, w := fmt.Sprint(decoded), fmt.Sprint(sealed); g != w {
+				t.Errorf("[%v %q] Decoded: Got %v, Want %v", algorithm, keyID, g, w)
+			}
+			if _, err := s.Open(decoded); err != nil {
+				t.Errorf("[%v %q] Got unexpected error from Open: %v", algorithm, keyID, err)
+			}
+		}
+	}
+}
+
+func TestMarshalBinaryLayout(t *testing.T) {
+	sb := &SealedBytes{
+		Ciphertext: bytes.Repeat([]byte{0xcc}, 16),
+		Nonce:      bytes.Repeat([]byte{0xaa}, 12),
+		Algorithm:  AES256GCM,
+		KeyID:      "k1",
+	}
+
+	b, err := sb.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Got unexpected error from MarshalBinary: %v", err)
+	}
+	want := append([]byte{WireVersion, 3, 2, 'k', '1'}, append(sb.Nonce, sb.Ciphertext...)...)
+	if !bytes.Equal(b, want) {
+		t.Errorf("MarshalBinary: Got %x, Want %x", b, want)
+	}
+}
+
+func TestMarshalBinaryEnvelopeLayout(t *testing.T) {
+	sb := &SealedBytes{
+		Ciphertext: bytes.Repeat([]byte{0xcc}, 16),
+		Nonce:      bytes.Repeat([]byte{0xaa}, 24),
+		WrappedKey: []byte("wk"),
+	}
+
+	b, err := sb.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Got unexpected error from MarshalBinary: %v", err)
+	}
+	want := append([]byte{WireVersionEnvelope, 1, 0, 0, 2, 'w', 'k'}, append(sb.Nonce, sb.Ciphertext...)...)
+	if !bytes.Equal(b, want) {
+		t.Errorf("MarshalBinary: Got %x, Want %x", b, want)
+	}
+
+	var decoded SealedBytes
+	if err := decoded.UnmarshalBinary(b); err != nil {
+		t.Fatalf("Got unexpected error from UnmarshalBinary: %v", err)
+	}
+	if g, w := fmt.Sprint(&decoded), fmt.Sprint(sb); g != w {
+		t.Errorf("Decoded: Got %v, Want %v", g, w)
+	}
+}
+
+func TestMarshalBinaryInvalid(t *testing.T) {
+	var tests = []*SealedBytes{
+		{Ciphertext: make([]byte, 16), Nonce: make([]byte, 12)},                                  // wrong nonce length
+		{Ciphertext: make([]byte, 16), Nonce: make([]byte, 24), Algorithm: "rot13"},              // unsupported algorithm
+		{Ciphertext: make([]byte, 16), Nonce: make([]byte, 24), KeyID: strings.Repeat("k", 256)}, // key id too long
+		{Ciphertext: make([]byte, 16), Nonce: make([]byte, 24), WrappedKey: make([]byte, 65536)}, // wrapped key too long
+	}
+
+	for i, tt := range tests {
+		if _, err := tt.MarshalBinary(); err == nil {
+			t.Errorf("[%v] MarshalBinary should have failed", i)
+		}
+	}
+}
+
+func TestUnmarshalBinaryInvalid(t *testing.T) {
+	nonce := make([]byte, NonceLength)
+	tag := make([]byte, tagLength)
+
+	var tests = []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"too short", []byte{WireVersion, 1}},
+		{"wrong version", append([]byte{0xa0, 1, 0}, append(nonce, tag...)...)},
+		{"legacy json", []byte(`{"Ciphertext":"AAEC"}`)},
+		{"unknown algorithm", append([]byte{WireVersion, 99, 0}, append(nonce, tag...)...)},
+		{"short key id", []byte{WireVersion, 1, 10, 'k'}},
+		{"short nonce", append([]byte{WireVersion, 1, 0}, nonce[:10]...)},
+		{"no tag", append([]byte{WireVersion, 1, 0}, append(nonce, tag[:15]...)...)},
+		{"no wrapped key length", []byte{WireVersionEnvelope, 1, 0, 0}},
+		{"empty wrapped key", append([]byte{WireVersionEnvelope, 1, 0, 0, 0}, append(nonce, tag...)...)},
+		{"short wrapped key", append([]byte{WireVersionEnvelope, 1, 0, 0, 200}, append(nonce, tag...)...)},
+	}
+
+	for _, tt := range tests {
+		var sb SealedBytes
+		if err := sb.UnmarshalBinary(tt.in); err == nil {
+			t.Errorf("[%v] UnmarshalBinary should have failed", tt.name)
+		}
+	}
+}
+
+func TestStringToSealedDataLegacy(t *testing.T) {
+	key, err := (&random.CSPRNG{}).Bytes(SecretKeyLength)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Bytes: %v", err)
+	}
+	keyBytes, _ := KeySliceToArray(key)
+
+	sealed, err := Seal([]byte("hello, box!"), keyBytes)
+	if err != nil {
+		t.Fatalf("Got unexpected error from Seal: %v", err)
+	}
+
+	// messages encoded before the binary format still decode, and messages
+	// without a key id or algorithm still encode the same way
+	legacy, err := SealedDataToString(sealed)
+	if err != nil {
+		t.Fatalf("Got unexpected error from SealedDataToString: %v", err)
+	}
+	legacyJSON, _ := base64.URLEncoding.DecodeString(legacy)
+	if g, w := strings.Join(jsonKeys(t, legacyJSON), ","), "Ciphertext,Nonce"; g != w {
+		t.Errorf("Legacy fields: Got %v, Want %v", g, w)
+	}
+	decoded, err := StringToSealedData(legacy)
+	if err != nil {
+		t.Fatalf("Got unexpected error from StringToSealedData: %v", err)
+	}
+	if _, err := Open(decoded, keyBytes); err != nil {
+		t.Errorf("Got unexpected error from Open: %v", err)
+	}
+}
+
+// jsonKeys returns the sorted keys of a JSON object.
+func jsonKeys(t *testing.T, b []byte) []string {
+	var object map[string]interface{}
+	if err := json.Unmarshal(b, &object); err != nil {
+		t.Fatalf("Got unexpected error from json.Unmarshal: %v", err)
+	}
+	var keys []string
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func FuzzUnmarshalBinary(f *testing.F) {
+	sb := &SealedBytes{Ciphertext: make([]byte, 20), Nonce: make([]byte, 24), KeyID: "k1"}
+	b, _ := sb.MarshalBinary()
+	f.Add(b)
+	f.Add([]byte{WireVersion, 3, 0})
+	sb.WrappedKey = []byte("wk")
+	b, _ = sb.MarshalBinary()
+	f.Add(b)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var sb SealedBytes
+		if err := sb.UnmarshalBinary(data); err != nil {
+			return
+		}
+
+		// anything that decodes encodes back to the same bytes
+		b, err := sb.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Got unexpected error from MarshalBinary: %v", err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("MarshalBinary: Got %x, Want %x", b, data)
+		}
+	})
+}
+
+func FuzzStringToSealedData(f *testing.F) {
+	f.Add("eyJDaXBoZXJ0ZXh0IjoiQUFFQyIsIk5vbmNlIjoiQUFFQ0F3UUZCZ2NJQ1FvTERBME9EeEFSRWhNVUZSWVhHQmthR3h3ZEhoOD0ifQ==")
+	f.Add("oQEAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, s string) {
+		// must not panic
+		StringToSealedData(s)
+	})
+}
@@ -1,35 +1,46 @@
 package main
 
 import (
+	"bufio"
 	"crypto/sha256"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 
 	"golang.org/x/crypto/pbkdf2"
 
-	"github.com/mailgun/lemma/random"
 	"github.com/mailgun/lemma/secret"
 )
 
 type EncodedCiphertext struct {
+	// KeyParams are the parameters the key was derived from the passphrase
+	// with, see secret.KDFParams. Files written before it was added have
+	// KeySalt and KeyIter for PBKDF#2 instead.
+	KeyParams    string `json:"key_params,omitempty"`
 	KeySalt      []byte `json:"key_salt,omitempty"`
 	KeyIter      int    `json:"key_iter_count,omitempty"`
 	KeyAlgorithm string `json:"key_algorithm,omitempty"`
 
-	CiphertextNonce []byte `json:"ciphertext_nonce"`
-	Ciphertext      []byte `json:"ciphertext"`
+	CiphertextNonce []byte `json:"ciphertext_nonce,omitempty"`
+	Ciphertext      []byte `json:"ciphertext,omitempty"`
 	CipherAlgorithm string `json:"cipher_algorithm"`
 }
 
+// Streamed files start with an EncodedCiphertext without the ciphertext on a
+// single line, followed by the sealed stream. Files streamed before chunks
+// were sealed with XChaCha20-Poly1305 have the old label, and still decrypt.
+const streamAlgorithm = "xchacha20_poly1305_stream"
+const streamAlgorithmV1 = "salsa20_poly1305_stream"
+
 func main() {
-	mode, keypath, itercount, inputpath, outputpath := parseArguments(os.Args)
+	mode, keypath, kdf, itercount, cipher, stream, inputpath, outputpath := parseArguments(os.Args)
 
 	switch mode {
 	case "encrypt":
-		encrypt(keypath, itercount, inputpath, outputpath)
+		encrypt(keypath, kdf, itercount, cipher, stream, inputpath, outputpath)
 	case "decrypt":
 		decrypt(keypath, inputpath, outputpath)
 	}
@@ -37,7 +48,7 @@ func main() {
 
 func usage() {
 	fmt.Printf(`
-lemmacmd is a tool that uses authenticated encryption (Salsa20 with Poly1305) to encrypt/decrypt small files on disk.
+lemmacmd is a tool that uses authenticated encryption (Salsa20 with Poly1305 by default) to encrypt/decrypt files on disk.
 
 Usage:
     lemmacmd command [flags]
@@ -50,11 +61,15 @@ The flags are:
     in          path to file to be read in
     out         path to file to be written out
     keypath     path to base64-encoded 32-byte key on disk, if no path is provided, a passphrase will be used
-    itercount   if a passphrase is used, iteration count for PBKDF#2, the default is 524288
+    kdf         if a passphrase is used, argon2id (default), scrypt, or pbkdf2-sha256, decrypt reads it from the file
+    itercount   if a passphrase is used with pbkdf2-sha256, iteration count, the default is 600000
+    cipher      salsa20_poly1305 (default), xchacha20_poly1305, or aes256_gcm, decrypt reads it from the file
+    stream      encrypt in chunks so large files are not read into memory, always with xchacha20_poly1305, decrypt detects it
 `)
 }
 
-func parseArguments(args []string) (mode string, keypath string, itercount int, input string, output string) {
+func parseArguments(args []string) (mode string, keypath string, kdf secret.KDF, itercount int,
+	cipher secret.Algorithm, stream bool, input string, output string) {
 	if len(args) < 2 {
 		usage()
 		os.Exit(255)
@@ -66,7 +81,10 @@ func parseArguments(args []string) (mode string, keypath string, itercount int,
 	in := fs.String("in", "", "path to file to be read in")
 	out := fs.String("out", "", "path to file to be written out")
 	key := fs.String("keypath", "", "path to base64-encoded 32-byte key on disk, if no path is provided, a passphrase will be used")
-	iter := fs.Int("itercount", 524288, "if a passphrase is used, iteration count for pbkdf#2")
+	keyDerivation := fs.String("kdf", string(secret.Argon2id), "if a passphrase is used, argon2id, scrypt, or pbkdf2-sha256")
+	iter := fs.Int("itercount", secret.PBKDF2Iterations, "if a passphrase is used with pbkdf2-sha256, iteration count")
+	algorithm := fs.String("cipher", string(secret.Salsa20Poly1305), "salsa20_poly1305, xchacha20_poly1305, or aes256_gcm")
+	streamed := fs.Bool("stream", false, "encrypt in chunks so large files are not read into memory")
 
 	err := fs.Parse(args[2:])
 	if err != nil {
@@ -76,6 +94,16 @@ func parseArguments(args []string) (mode string, keypath string, itercount int,
 	if mode != "encrypt" && mode != "decrypt" {
 		fmt.Printf("lemmacmd: mode must be encrypt or decrypt, not: %q\n", mode)
 	}
+	if !secret.Algorithm(*algorithm).Valid() {
+		fmt.Printf("lemmacmd: unsupported cipher: %q\n", *algorithm)
+		os.Exit(255)
+	}
+	cipherSet := false
+	fs.Visit(func(f *flag.Flag) { cipherSet = cipherSet || f.Name == "cipher" })
+	if *streamed && cipherSet && secret.Algorithm(*algorithm) != secret.XChaCha20Poly1305 {
+		fmt.Printf("lemmacmd: streams are always sealed with %v\n", secret.XChaCha20Poly1305)
+		os.Exit(255)
+	}
 	if *in == "" {
 		fmt.Printf("lemmacmd: input path required\n")
 	}
@@ -87,35 +115,46 @@ func parseArguments(args []string) (mode string, keypath string, itercount int,
 		os.Exit(255)
 	}
 
-	return mode, *key, *iter, *in, *out
+	return mode, *key, secret.KDF(*keyDerivation), *iter, secret.Algorithm(*algorithm), *streamed, *in, *out
 }
 
-func encrypt(keypath string, itercount int, inputpath string, outputpath string) {
-	salt, err := (&random.CSPRNG{}).Bytes(16)
-	if err != nil {
-		fmt.Printf("lemmacmd: unable to generate salt: %v\n", err)
-		os.Exit(255)
-	}
+func encrypt(keypath string, kdf secret.KDF, itercount int, cipher secret.Algorithm, stream bool,
+	inputpath string, outputpath string) {
 
-	key, isPass, err := generateKey(keypath, salt, itercount)
+	key, params, err := encryptionKey(keypath, kdf, itercount)
 	if err != nil {
 		fmt.Printf("lemmacmd: unable to generate or read in key: %v\n", err)
 		os.Exit(255)
 	}
 
+	if stream {
+		err = encryptStream(key, params, inputpath, outputpath)
+		if err != nil {
+			fmt.Printf("lemmacmd: unable to encrypt file: %v\n", err)
+			os.Exit(255)
+		}
+		return
+	}
+
 	plaintextBytes, err := ioutil.ReadFile(inputpath)
 	if err != nil {
 		fmt.Printf("lemmacmd: unable to read plaintext file %q: %v\n", inputpath, err)
 		os.Exit(255)
 	}
 
-	sealedData, err := secret.Seal(plaintextBytes, key)
+	s, err := secret.New(&secret.Config{KeyBytes: key, Algorithm: cipher})
+	if err != nil {
+		fmt.Printf("lemmacmd: unable to build secret service: %v\n", err)
+		os.Exit(255)
+	}
+
+	sealedData, err := s.Seal(plaintextBytes)
 	if err != nil {
 		fmt.Printf("lemmacmd: unable to seal plaintext: %v\n", err)
 		os.Exit(255)
 	}
 
-	err = writeCiphertext(salt, itercount, isPass, sealedData, outputpath)
+	err = writeCiphertext(params, sealedData, outputpath)
 	if err != nil {
 		fmt.Printf("lemmacmd: unable to write sealed data to disk: %v\n", err)
 		os.Exit(255)
@@ -123,19 +162,48 @@ func encrypt(keypath string, itercount int, inputpath string, outputpath string)
 }
 
 func decrypt(keypath string, inputpath string, outputpath string) {
-	keySalt, keyIter, sealedData, err := readCiphertext(inputpath)
+	ec, r, err := readStreamHeader(inputpath)
+	if err != nil {
+		fmt.Printf("lemmacmd: unable to read ciphertext file: %v\n", err)
+		os.Exit(255)
+	}
+	if ec != nil {
+		defer r.Close()
+
+		key, err := decryptionKey(keypath, ec)
+		if err != nil {
+			fmt.Printf("lemmacmd: unable to build key: %v\n", err)
+			os.Exit(255)
+		}
+
+		err = decryptStream(key, r, outputpath)
+		if err != nil {
+			fmt.Printf("lemmacmd: unable to open ciphertext: %v\n", err)
+			os.Exit(255)
+		}
+		return
+	}
+
+	ec, sealedData, err := readCiphertext(inputpath)
 	if err != nil {
 		fmt.Printf("lemmacmd: unable to read ciphertext file: %v\n", err)
 		os.Exit(255)
 	}
 
-	key, _, err := generateKey(keypath, keySalt, keyIter)
+	key, err := decryptionKey(keypath, ec)
 	if err != nil {
 		fmt.Printf("lemmacmd: unable to build key: %v\n", err)
 		os.Exit(255)
 	}
 
-	plaintextBytes, err := secret.Open(sealedData, key)
+	// open with the cipher recorded in the file
+	s, err := secret.New(&secret.Config{KeyBytes: key, Algorithm: sealedData.AlgorithmID()})
+	if err != nil {
+		fmt.Printf("lemmacmd: unable to build secret service: %v\n", err)
+		os.Exit(255)
+	}
+
+	plaintextBytes, err := s.Open(sealedData)
 	if err != nil {
 		fmt.Printf("lemmacmd: unable to open ciphertext: %v\n", err)
 		os.Exit(255)
@@ -148,47 +216,78 @@ func decrypt(keypath string, inputpath string, outputpath string) {
 	}
 }
 
-// Returns key from keypath or uses salt + passphrase to generate key using a KDF.
-func generateKey(keypath string, salt []byte, keyiter int) (key *[secret.SecretKeyLength]byte, isPass bool, err error) {
+// Returns key from keypath, or derives a key from a passphrase with new
+// parameters for the KDF, which are returned so they can be written to the
+// file.
+func encryptionKey(keypath string, kdf secret.KDF, itercount int) (*[secret.SecretKeyLength]byte, *secret.KDFParams, error) {
 	// if a keypath is given try and use it
 	if keypath != "" {
 		key, err := secret.ReadKeyFromDisk(keypath)
 		if err != nil {
-			return nil, false, fmt.Errorf("unable to build secret service: %v", err)
+			return nil, nil, fmt.Errorf("unable to build secret service: %v", err)
 		}
-		return key, false, nil
+		return key, nil, nil
 	}
 
-	// otherwise read in a passphrase from disk and use that, remember to reset your terminal afterwards
-	var passphrase string
-	fmt.Printf("Passphrase: ")
-	fmt.Scanln(&passphrase)
+	params, err := secret.NewKDFParams(kdf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if params.KDF == secret.PBKDF2SHA256 {
+		params.Iterations = itercount
+	}
 
-	// derive key and return it
-	keySlice := pbkdf2.Key([]byte(passphrase), salt, keyiter, 32, sha256.New)
-	keyBytes, err := secret.KeySliceToArray(keySlice)
+	key, err := secret.DeriveKey(readPassphrase(), params)
 	if err != nil {
-		return nil, true, err
+		return nil, nil, err
 	}
+	return key, params, nil
+}
 
-	return keyBytes, true, nil
+// Returns key from keypath, or derives it from a passphrase with the
+// parameters in the file.
+func decryptionKey(keypath string, ec *EncodedCiphertext) (*[secret.SecretKeyLength]byte, error) {
+	// if a keypath is given try and use it
+	if keypath != "" {
+		key, err := secret.ReadKeyFromDisk(keypath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to build secret service: %v", err)
+		}
+		return key, nil
+	}
+
+	if ec.KeyParams != "" {
+		params, err := secret.ParseKDFParams(ec.KeyParams)
+		if err != nil {
+			return nil, err
+		}
+		return secret.DeriveKey(readPassphrase(), params)
+	}
+
+	// files written before the KDF parameters were recorded used PBKDF#2
+	keySlice := pbkdf2.Key(readPassphrase(), ec.KeySalt, ec.KeyIter, 32, sha256.New)
+	return secret.KeySliceToArray(keySlice)
+}
+
+// Reads in a passphrase from stdin, remember to reset your terminal afterwards.
+func readPassphrase() []byte {
+	var passphrase string
+	fmt.Printf("Passphrase: ")
+	fmt.Scanln(&passphrase)
+	return []byte(passphrase)
 }
 
 // Encodes all data needed to decrypt message into a JSON string and writes it to disk.
-func writeCiphertext(salt []byte, keyiter int, isPass bool, sealed secret.SealedData, filename string) error {
+func writeCiphertext(params *secret.KDFParams, sealed secret.SealedData, filename string) error {
 	// fill in the ciphertext fields
 	ec := EncodedCiphertext{
 		CiphertextNonce: sealed.NonceBytes(),
 		Ciphertext:      sealed.CiphertextBytes(),
-		CipherAlgorithm: "salsa20_poly1305",
+		CipherAlgorithm: string(sealed.(*secret.SealedBytes).AlgorithmID()),
 	}
 
 	// if we used a passphrase, also set the passphrase fields
-	if isPass == true {
-		ec.KeySalt = salt
-		ec.KeyIter = keyiter
-		ec.KeyAlgorithm = "pbkdf#2"
-	}
+	setKeyParams(&ec, params)
 
 	// marshal encoded ciphertext into a json string
 	b, err := json.MarshalIndent(ec, "", "   ")
@@ -200,23 +299,128 @@ func writeCiphertext(salt []byte, keyiter int, isPass bool, sealed secret.Sealed
 	return ioutil.WriteFile(filename, b, 0600)
 }
 
+// Records the KDF parameters, if a passphrase was used.
+func setKeyParams(ec *EncodedCiphertext, params *secret.KDFParams) {
+	if params != nil {
+		ec.KeyParams = params.String()
+		ec.KeyAlgorithm = string(params.KDF)
+	}
+}
+
 // Reads in encoded ciphertext from disk and breaks into component parts.
-func readCiphertext(filename string) ([]byte, int, *secret.SealedBytes, error) {
+func readCiphertext(filename string) (*EncodedCiphertext, *secret.SealedBytes, error) {
 	plaintextBytes, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return nil, 0, nil, err
+		return nil, nil, err
 	}
 
 	var ec EncodedCiphertext
 	err = json.Unmarshal(plaintextBytes, &ec)
 	if err != nil {
-		return nil, 0, nil, err
+		return nil, nil, err
 	}
 
 	sealedBytes := &secret.SealedBytes{
 		Ciphertext: ec.Ciphertext,
 		Nonce:      ec.CiphertextNonce,
+		Algorithm:  secret.Algorithm(ec.CipherAlgorithm),
+	}
+
+	return &ec, sealedBytes, nil
+}
+
+// Seals the input file a chunk at a time and writes it to disk after a
+// header with all data needed to decrypt it.
+func encryptStream(key *[secret.SecretKeyLength]byte, params *secret.KDFParams,
+	inputpath string, outputpath string) error {
+
+	in, err := os.Open(inputpath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(outputpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// write the header on a line of its own
+	ec := EncodedCiphertext{CipherAlgorithm: streamAlgorithm}
+	setKeyParams(&ec, params)
+	b, err := json.Marshal(ec)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	// then the sealed stream
+	w, err := secret.SealStream(out, key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// Opens the sealed stream and writes the plaintext to disk. The output file
+// is removed if the stream can't be opened, it may have been truncated.
+func decryptStream(key *[secret.SecretKeyLength]byte, r io.Reader, outputpath string) error {
+	plaintext, err := secret.OpenStream(r, key)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(outputpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, plaintext)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outputpath)
+		return err
+	}
+
+	return nil
+}
+
+// Reads the header of a streamed file. Returns a nil header if the file is
+// not streamed, otherwise the header and the file positioned at the sealed
+// stream.
+func readStreamHeader(filename string) (*EncodedCiphertext, io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, nil, err
+	}
+
+	var ec EncodedCiphertext
+	if json.Unmarshal(line, &ec) != nil || (ec.CipherAlgorithm != streamAlgorithm && ec.CipherAlgorithm != streamAlgorithmV1) {
+		f.Close()
+		return nil, nil, nil
 	}
 
-	return ec.KeySalt, ec.KeyIter, sealedBytes, nil
+	return &ec, struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
 }
@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mailgun/lemma/httpsign"
+	"github.com/mailgun/lemma/random"
+	"github.com/mailgun/lemma/secret"
+	"github.com/mailgun/timetools"
+)
+
+// VectorsVersion is the version of the test vector format this tool reads and writes.
+const VectorsVersion = 1
+
+// All vectors are generated at this time with this seed so the output is stable.
+const vectorsTimestamp = 1330837567
+const vectorsSeed = 1
+
+// Vectors is the test vectors file. The lists after Secret were added after
+// version 1 was published, and only add vectors: the vectors already in the
+// file don't change, and readers that don't know a list can skip it.
+type Vectors struct {
+	Version         int                  `json:"version"`
+	HTTPSign        []HTTPSignVector     `json:"httpsign"`
+	Secret          []SecretVector       `json:"secret"`
+	HTTPSignOptions []HTTPSignVector     `json:"httpsign_options"`
+	SecretBinary    []SecretBinaryVector `json:"secret_binary"`
+}
+
+// HTTPSignVector is a signed request. Binary fields (key and body) are base64
+// encoded, everything else is exactly what went into or came out of httpsign.
+type HTTPSignVector struct {
+	Name             string            `json:"name"`
+	Key              []byte            `json:"key"`
+	SignVerbAndURI   bool              `json:"sign_verb_and_uri"`
+	HeadersToSign    []string          `json:"headers_to_sign"`
+	Method           string            `json:"method"`
+	URI              string            `json:"uri"`
+	Headers          map[string]string `json:"headers"`
+	Body             []byte            `json:"body"`
+	Timestamp        string            `json:"timestamp"`
+	Nonce            string            `json:"nonce"`
+	Signature        string            `json:"signature"`
+	SignatureVersion string            `json:"signature_version"`
+	Algorithm        string            `json:"algorithm,omitempty"` // default: hmac-sha256
+	Purpose          string            `json:"purpose,omitempty"`
+}
+
+// SecretVector is a sealed message. Binary fields are base64 encoded, Sealed
+// is the output of secret.SealedDataToString.
+type SecretVector struct {
+	Name       string `json:"name"`
+	Key        []byte `json:"key"`
+	Nonce      []byte `json:"nonce"`
+	Plaintext  []byte `json:"plaintext"`
+	Ciphertext []byte `json:"ciphertext"`
+	Sealed     string `json:"sealed"`
+}
+
+// SecretBinaryVector is a message sealed in the binary format. Binary fields
+// are base64 encoded. With envelope encryption Key is empty, the data key is
+// wrapped with KEK like secret.NewLocalKeyWrapper does: the XChaCha20-Poly1305
+// nonce followed by the sealed data key. Sealed is the output of
+// SealedBytes.MarshalBinary, Compact of secret.SealedDataToCompactString.
+type SecretBinaryVector struct {
+	Name       string `json:"name"`
+	Algorithm  string `json:"algorithm"`
+	Key        []byte `json:"key,omitempty"`
+	KeyID      string `json:"key_id,omitempty"`
+	KEK        []byte `json:"kek,omitempty"`
+	WrappedKey []byte `json:"wrapped_key,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Plaintext  []byte `json:"plaintext"`
+	AAD        []byte `json:"aad,omitempty"`
+	Ciphertext []byte `json:"ciphertext"`
+	Sealed     []byte `json:"sealed"`
+	Compact    string `json:"compact"`
+}
+
+type httpsignCase struct {
+	name           string
+	key            []byte
+	algorithm      httpsign.Algorithm
+	purpose        string
+	signVerbAndURI bool
+	headers        [][2]string
+	method         string
+	uri            string
+	body           []byte
+}
+
+type secretCase struct {
+	name      string
+	plaintext []byte
+}
+
+type secretBinaryCase struct {
+	name      string
+	algorithm secret.Algorithm
+	keyID     string
+	envelope  bool
+	aad       []byte
+	plaintext []byte
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(255)
+	}
+
+	fs := flag.NewFlagSet("fs", flag.ExitOnError)
+	path := fs.String("path", "", "path to the test vectors file")
+	err := fs.Parse(os.Args[2:])
+	if err != nil {
+		fmt.Printf("lemmavectors: unable to parse flags: %v\n", err)
+		os.Exit(255)
+	}
+	if *path == "" {
+		fmt.Printf("lemmavectors: path required\n")
+		usage()
+		os.Exit(255)
+	}
+
+	switch os.Args[1] {
+	case "generate":
+		err = generate(*path)
+	case "verify":
+		err = verify(*path)
+	default:
+		fmt.Printf("lemmavectors: command must be generate or verify, not: %q\n", os.Args[1])
+		usage()
+		os.Exit(255)
+	}
+	if err != nil {
+		fmt.Printf("lemmavectors: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Printf(`
+lemmavectors generates and verifies the test vectors used to check that lemma
+implementations in different languages agree with each other.
+
+Usage:
+    lemmavectors command [flags]
+
+The commands are:
+    generate    write a fresh set of test vectors
+    verify      check every test vector in a file
+
+The flags are:
+    path        path to the test vectors file
+`)
+}
+
+func generate(path string) error {
+	rng := &random.SeededRNG{Seed: vectorsSeed}
+
+	vectors := Vectors{Version: VectorsVersion}
+
+	cases, err := httpsignCases(rng)
+	if err != nil {
+		return err
+	}
+	for _, c := range cases {
+		v, err := signVector(c, rng)
+		if err != nil {
+			return fmt.Errorf("unable to sign %q: %v", c.name, err)
+		}
+		vectors.HTTPSign = append(vectors.HTTPSign, v)
+	}
+
+	for _, c := range secretCases() {
+		v, err := sealVector(c, rng)
+		if err != nil {
+			return fmt.Errorf("unable to seal %q: %v", c.name, err)
+		}
+		vectors.Secret = append(vectors.Secret, v)
+	}
+
+	// the lists added since version 1 come last, so the random bytes they use
+	// don't change the vectors before them
+	for _, c := range httpsignOptionCases() {
+		v, err := signVector(c, rng)
+		if err != nil {
+			return fmt.Errorf("unable to sign %q: %v", c.name, err)
+		}
+		vectors.HTTPSignOptions = append(vectors.HTTPSignOptions, v)
+	}
+
+	for _, c := range secretBinaryCases() {
+		v, err := sealBinaryVector(c, rng)
+		if err != nil {
+			return fmt.Errorf("unable to seal %q: %v", c.name, err)
+		}
+		vectors.SecretBinary = append(vectors.SecretBinary, v)
+	}
+
+	b, err := json.MarshalIndent(vectors, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+func verify(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var vectors Vectors
+	err = json.Unmarshal(b, &vectors)
+	if err != nil {
+		return err
+	}
+	if vectors.Version != VectorsVersion {
+		return fmt.Errorf("unsupported test vectors version: %v", vectors.Version)
+	}
+
+	failed := 0
+	for _, v := range vectors.HTTPSign {
+		if err := verifySignature(v); err != nil {
+			fmt.Printf("FAIL httpsign %q: %v\n", v.Name, err)
+			failed++
+		}
+	}
+	for _, v := range vectors.Secret {
+		if err := verifySealed(v); err != nil {
+			fmt.Printf("FAIL secret %q: %v\n", v.Name, err)
+			failed++
+		}
+	}
+	for _, v := range vectors.HTTPSignOptions {
+		if err := verifySignature(v); err != nil {
+			fmt.Printf("FAIL httpsign_options %q: %v\n", v.Name, err)
+			failed++
+		}
+	}
+	for _, v := range vectors.SecretBinary {
+		if err := verifySealedBinary(v); err != nil {
+			fmt.Printf("FAIL secret_binary %q: %v\n", v.Name, err)
+			failed++
+		}
+	}
+
+	total := len(vectors.HTTPSign) + len(vectors.Secret) + len(vectors.HTTPSignOptions) + len(vectors.SecretBinary)
+	if failed > 0 {
+		return fmt.Errorf("%v of %v test vectors failed", failed, total)
+	}
+
+	fmt.Printf("ok %v test vectors\n", total)
+	return nil
+}
+
+func httpsignCases(rng random.RandomProvider) ([]httpsignCase, error) {
+	testKey := []byte("042DAD12E0BE4625AC0B2C3F7172DBA8")
+
+	randomKey, err := rng.Bytes(32)
+	if err != nil {
+		return nil, err
+	}
+	longKey, err := rng.Bytes(100)
+	if err != nil {
+		return nil, err
+	}
+
+	binaryBody := make([]byte, 256)
+	for i := range binaryBody {
+		binaryBody[i] = byte(i)
+	}
+	largeBody, err := rng.Bytes(4096)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonBody := []byte(`{"hello": "world"}`)
+
+	return []httpsignCase{
+		{name: "body: json", key: testKey, method: "POST", uri: "/", body: jsonBody},
+		{name: "body: empty", key: testKey, method: "GET", uri: "/"},
+		{name: "body: binary", key: testKey, method: "POST", uri: "/", body: binaryBody},
+		{name: "body: large", key: testKey, method: "PUT", uri: "/", body: largeBody},
+		{name: "body: delimiters", key: testKey, method: "POST", uri: "/", body: []byte("10|1330837567|32|")},
+		{name: "body: unicode", key: testKey, method: "POST", uri: "/", body: []byte("héllo, wörld ✉")},
+		{name: "key: random", key: randomKey, method: "POST", uri: "/", body: jsonBody},
+		{name: "key: short", key: []byte("abc"), method: "POST", uri: "/", body: jsonBody},
+		{name: "key: longer than block size", key: longKey, method: "POST", uri: "/", body: jsonBody},
+		{name: "headers: one", key: testKey, method: "POST", uri: "/", body: jsonBody,
+			headers: [][2]string{{"X-Mailgun-Foo", "bar"}}},
+		{name: "headers: order", key: testKey, method: "POST", uri: "/", body: jsonBody,
+			headers: [][2]string{{"X-Mailgun-Foo", "bar"}, {"Content-Type", "application/json"}, {"X-Mailgun-Account", "42"}}},
+		{name: "headers: empty value", key: testKey, method: "POST", uri: "/", body: jsonBody,
+			headers: [][2]string{{"X-Mailgun-Foo", ""}}},
+		{name: "headers: delimiters and unicode", key: testKey, method: "POST", uri: "/", body: jsonBody,
+			headers: [][2]string{{"X-Mailgun-Foo", "5|a|b ✉"}}},
+		{name: "verb and uri: path", key: testKey, signVerbAndURI: true, method: "POST", uri: "/messages", body: jsonBody},
+		{name: "verb and uri: query", key: testKey, signVerbAndURI: true, method: "GET", uri: "/path?key=value&key=value"},
+		{name: "verb and uri: escaped", key: testKey, signVerbAndURI: true, method: "DELETE", uri: "/d%C3%A9j%C3%A0/a%2Fb?q=%7C"},
+		{name: "verb and uri: root", key: testKey, signVerbAndURI: true, method: "OPTIONS", uri: "/"},
+		{name: "verb and uri: with headers", key: testKey, signVerbAndURI: true, method: "PATCH", uri: "/v3/domains?limit=10", body: jsonBody,
+			headers: [][2]string{{"X-Mailgun-Foo", "bar"}, {"X-Mailgun-Account", "42"}}},
+	}, nil
+}
+
+// httpsignOptionCases are signed with the other algorithms, or for a purpose.
+func httpsignOptionCases() []httpsignCase {
+	testKey := []byte("042DAD12E0BE4625AC0B2C3F7172DBA8")
+	jsonBody := []byte(`{"hello": "world"}`)
+	headers := [][2]string{{"X-Mailgun-Foo", "bar"}, {"X-Mailgun-Account", "42"}}
+
+	return []httpsignCase{
+		{name: "algorithm: hmac-sha512", key: testKey, algorithm: httpsign.HMACSHA512, method: "POST", uri: "/", body: jsonBody},
+		{name: "algorithm: hmac-sha512 with verb, uri and headers", key: testKey, algorithm: httpsign.HMACSHA512,
+			signVerbAndURI: true, method: "PATCH", uri: "/v3/domains?limit=10", body: jsonBody, headers: headers},
+		{name: "algorithm: blake2b-256", key: testKey, algorithm: httpsign.BLAKE2b256, method: "POST", uri: "/", body: jsonBody},
+		{name: "algorithm: blake2b-256 with verb, uri and headers", key: testKey, algorithm: httpsign.BLAKE2b256,
+			signVerbAndURI: true, method: "PATCH", uri: "/v3/domains?limit=10", body: jsonBody, headers: headers},
+		{name: "purpose: body", key: testKey, purpose: "billing-api", method: "POST", uri: "/", body: jsonBody},
+		{name: "purpose: verb, uri and headers", key: testKey, purpose: "billing-api",
+			signVerbAndURI: true, method: "PATCH", uri: "/v3/domains?limit=10", body: jsonBody, headers: headers},
+		{name: "purpose: unicode", key: testKey, purpose: "fäcturation ✉", method: "POST", uri: "/", body: jsonBody},
+		{name: "purpose: hmac-sha512", key: testKey, algorithm: httpsign.HMACSHA512, purpose: "billing-api",
+			method: "POST", uri: "/", body: jsonBody},
+	}
+}
+
+func secretCases() []secretCase {
+	binary := make([]byte, 1024)
+	for i := range binary {
+		binary[i] = byte(i)
+	}
+
+	return []secretCase{
+		{name: "plaintext: empty", plaintext: []byte{}},
+		{name: "plaintext: short", plaintext: []byte("hello, box!")},
+		{name: "plaintext: unicode", plaintext: []byte("héllo, wörld ✉")},
+		{name: "plaintext: binary", plaintext: binary},
+	}
+}
+
+// secretBinaryCases are sealed with every algorithm, with a key ring, and
+// with envelope encryption.
+func secretBinaryCases() []secretBinaryCase {
+	plaintext := []byte("hello, box!")
+
+	return []secretBinaryCase{
+		{name: "algorithm: salsa20_poly1305", algorithm: secret.Salsa20Poly1305, plaintext: plaintext},
+		{name: "algorithm: xchacha20_poly1305", algorithm: secret.XChaCha20Poly1305, plaintext: plaintext},
+		{name: "algorithm: aes256_gcm", algorithm: secret.AES256GCM, plaintext: plaintext},
+		{name: "plaintext: empty", algorithm: secret.XChaCha20Poly1305, plaintext: []byte{}},
+		{name: "key id", algorithm: secret.Salsa20Poly1305, keyID: "2012-03", plaintext: plaintext},
+		{name: "key id: aes256_gcm", algorithm: secret.AES256GCM, keyID: "2012-03", plaintext: plaintext},
+		{name: "wrapped key", algorithm: secret.Salsa20Poly1305, envelope: true, plaintext: plaintext},
+		{name: "wrapped key: xchacha20_poly1305", algorithm: secret.XChaCha20Poly1305, envelope: true, plaintext: plaintext},
+		{name: "aad: xchacha20_poly1305", algorithm: secret.XChaCha20Poly1305, aad: []byte("user-1"), plaintext: plaintext},
+		{name: "aad: aes256_gcm with key id", algorithm: secret.AES256GCM, keyID: "2012-03", aad: []byte("user-1"),
+			plaintext: plaintext},
+	}
+}
+
+func signVector(c httpsignCase, rng random.RandomProvider) (HTTPSignVector, error) {
+	headerNames := make([]string, 0, len(c.headers))
+	headers := make(map[string]string, len(c.headers))
+	for _, h := range c.headers {
+		headerNames = append(headerNames, h[0])
+		headers[h[0]] = h[1]
+	}
+
+	s, err := httpsign.NewWithProviders(
+		&httpsign.Config{
+			KeyBytes:       c.key,
+			Algorithm:      c.algorithm,
+			Purpose:        c.purpose,
+			HeadersToSign:  headerNames,
+			SignVerbAndURI: c.signVerbAndURI,
+		},
+		&timetools.FreezedTime{CurrentTime: time.Unix(vectorsTimestamp, 0)},
+		rng,
+	)
+	if err != nil {
+		return HTTPSignVector{}, err
+	}
+
+	r, err := newRequest(c.method, c.uri, headers, c.body)
+	if err != nil {
+		return HTTPSignVector{}, err
+	}
+
+	err = s.SignRequest(r)
+	if err != nil {
+		return HTTPSignVector{}, err
+	}
+
+	body := c.body
+	if body == nil {
+		body = []byte{}
+	}
+
+	return HTTPSignVector{
+		Name:             c.name,
+		Key:              c.key,
+		SignVerbAndURI:   c.signVerbAndURI,
+		HeadersToSign:    headerNames,
+		Method:           c.method,
+		URI:              r.URL.RequestURI(),
+		Headers:          headers,
+		Body:             body,
+		Timestamp:        r.Header.Get(httpsign.XMailgunTimestamp),
+		Nonce:            r.Header.Get(httpsign.XMailgunNonce),
+		Signature:        r.Header.Get(httpsign.XMailgunSignature),
+		SignatureVersion: r.Header.Get(httpsign.XMailgunSignatureVersion),
+		Algorithm:        string(c.algorithm),
+		Purpose:          c.purpose,
+	}, nil
+}
+
+func verifySignature(v HTTPSignVector) error {
+	timestamp, err := parseTimestamp(v.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	s, err := httpsign.NewWithProviders(
+		&httpsign.Config{
+			KeyBytes:       v.Key,
+			Algorithm:      httpsign.Algorithm(v.Algorithm),
+			Purpose:        v.Purpose,
+			HeadersToSign:  v.HeadersToSign,
+			SignVerbAndURI: v.SignVerbAndURI,
+		},
+		&timetools.FreezedTime{CurrentTime: timestamp},
+		&random.CSPRNG{},
+	)
+	if err != nil {
+		return err
+	}
+
+	r, err := newRequest(v.Method, v.URI, v.Headers, v.Body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set(httpsign.XMailgunTimestamp, v.Timestamp)
+	r.Header.Set(httpsign.XMailgunNonce, v.Nonce)
+	r.Header.Set(httpsign.XMailgunSignature, v.Signature)
+	r.Header.Set(httpsign.XMailgunSignatureVersion, v.SignatureVersion)
+
+	return s.AuthenticateRequest(r)
+}
+
+func sealVector(c secretCase, rng random.RandomProvider) (SecretVector, error) {
+	keySlice, err := rng.Bytes(secret.SecretKeyLength)
+	if err != nil {
+		return SecretVector{}, err
+	}
+	key, err := secret.KeySliceToArray(keySlice)
+	if err != nil {
+		return SecretVector{}, err
+	}
+
+	s, err := secret.NewWithProviders(&secret.Config{KeyBytes: key}, &timetools.RealTime{}, rng)
+	if err != nil {
+		return SecretVector{}, err
+	}
+
+	sealed, err := s.Seal(c.plaintext)
+	if err != nil {
+		return SecretVector{}, err
+	}
+
+	sealedString, err := secret.SealedDataToString(sealed)
+	if err != nil {
+		return SecretVector{}, err
+	}
+
+	return SecretVector{
+		Name:       c.name,
+		Key:        keySlice,
+		Nonce:      sealed.NonceBytes(),
+		Plaintext:  c.plaintext,
+		Ciphertext: sealed.CiphertextBytes(),
+		Sealed:     sealedString,
+	}, nil
+}
+
+func verifySealed(v SecretVector) error {
+	key, err := secret.KeySliceToArray(v.Key)
+	if err != nil {
+		return err
+	}
+
+	// the string encoding must decode to the raw nonce and ciphertext
+	sealed, err := secret.StringToSealedData(v.Sealed)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sealed.NonceBytes(), v.Nonce) {
+		return fmt.Errorf("sealed nonce does not match nonce")
+	}
+	if !bytes.Equal(sealed.CiphertextBytes(), v.Ciphertext) {
+		return fmt.Errorf("sealed ciphertext does not match ciphertext")
+	}
+
+	plaintext, err := secret.Open(sealed, key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(plaintext, v.Plaintext) {
+		return fmt.Errorf("opened plaintext does not match plaintext")
+	}
+
+	return nil
+}
+
+func sealBinaryVector(c secretBinaryCase, rng random.RandomProvider) (SecretBinaryVector, error) {
+	keySlice, err := rng.Bytes(secret.SecretKeyLength)
+	if err != nil {
+		return SecretBinaryVector{}, err
+	}
+	key, err := secret.KeySliceToArray(keySlice)
+	if err != nil {
+		return SecretBinaryVector{}, err
+	}
+
+	config, err := binaryConfig(c.algorithm, key, c.keyID, c.envelope, rng)
+	if err != nil {
+		return SecretBinaryVector{}, err
+	}
+	s, err := secret.NewWithProviders(config, &timetools.RealTime{}, rng)
+	if err != nil {
+		return SecretBinaryVector{}, err
+	}
+
+	var sealed secret.SealedData
+	if c.aad != nil {
+		sealed, err = s.(secret.AADSecretService).SealWithAAD(c.plaintext, c.aad)
+	} else {
+		sealed, err = s.Seal(c.plaintext)
+	}
+	if err != nil {
+		return SecretBinaryVector{}, err
+	}
+
+	binary, err := sealed.(*secret.SealedBytes).MarshalBinary()
+	if err != nil {
+		return SecretBinaryVector{}, err
+	}
+	compact, err := secret.SealedDataToCompactString(sealed)
+	if err != nil {
+		return SecretBinaryVector{}, err
+	}
+
+	v := SecretBinaryVector{
+		Name:       c.name,
+		Algorithm:  string(c.algorithm),
+		Key:        keySlice,
+		KeyID:      sealed.(*secret.SealedBytes).KeyID,
+		WrappedKey: sealed.(*secret.SealedBytes).WrappedKey,
+		Nonce:      sealed.NonceBytes(),
+		Plaintext:  c.plaintext,
+		AAD:        c.aad,
+		Ciphertext: sealed.CiphertextBytes(),
+		Sealed:     binary,
+		Compact:    compact,
+	}
+	if c.envelope {
+		v.Key, v.KEK = nil, keySlice
+	}
+	return v, nil
+}
+
+func verifySealedBinary(v SecretBinaryVector) error {
+	// the binary format must decode to the vector's fields
+	var sealed secret.SealedBytes
+	if err := sealed.UnmarshalBinary(v.Sealed); err != nil {
+		return err
+	}
+	switch {
+	case string(sealed.AlgorithmID()) != v.Algorithm:
+		return fmt.Errorf("sealed algorithm %q does not match algorithm", sealed.AlgorithmID())
+	case sealed.KeyID != v.KeyID:
+		return fmt.Errorf("sealed key id %q does not match key id", sealed.KeyID)
+	case !bytes.Equal(sealed.WrappedKey, v.WrappedKey):
+		return fmt.Errorf("sealed wrapped key does not match wrapped key")
+	case !bytes.Equal(sealed.Nonce, v.Nonce):
+		return fmt.Errorf("sealed nonce does not match nonce")
+	case !bytes.Equal(sealed.Ciphertext, v.Ciphertext):
+		return fmt.Errorf("sealed ciphertext does not match ciphertext")
+	}
+
+	// and so must the compact string
+	compact, err := secret.StringToSealedData(v.Compact)
+	if err != nil {
+		return err
+	}
+	b, err := compact.(*secret.SealedBytes).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b, v.Sealed) {
+		return fmt.Errorf("compact string does not match sealed")
+	}
+
+	key := v.Key
+	if v.KEK != nil {
+		key = v.KEK
+	}
+	keyArray, err := secret.KeySliceToArray(key)
+	if err != nil {
+		return err
+	}
+	config, err := binaryConfig(secret.Algorithm(v.Algorithm), keyArray, v.KeyID, v.KEK != nil, &random.CSPRNG{})
+	if err != nil {
+		return err
+	}
+	s, err := secret.New(config)
+	if err != nil {
+		return err
+	}
+
+	var plaintext []byte
+	if v.AAD != nil {
+		plaintext, err = s.(secret.AADSecretService).OpenWithAAD(&sealed, v.AAD)
+	} else {
+		plaintext, err = s.Open(&sealed)
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(plaintext, v.Plaintext) {
+		return fmt.Errorf("opened plaintext does not match plaintext")
+	}
+
+	return nil
+}
+
+// binaryConfig returns the config of a service that seals with algorithm and
+// key: under keyID in a key ring if there is one, or as the KEK of envelope
+// encryption.
+func binaryConfig(algorithm secret.Algorithm, key *[secret.SecretKeyLength]byte, keyID string, envelope bool,
+	rng random.RandomProvider) (*secret.Config, error) {
+
+	config := &secret.Config{Algorithm: algorithm}
+	switch {
+	case envelope:
+		kek, err := secret.NewWithProviders(&secret.Config{KeyBytes: key, Algorithm: secret.XChaCha20Poly1305}, &timetools.RealTime{}, rng)
+		if err != nil {
+			return nil, err
+		}
+		config.KeyWrapper = &keyWrapper{kek: kek}
+	case keyID != "":
+		config.KeyRing = &secret.KeyRing{Primary: keyID, Keys: map[string]*[secret.SecretKeyLength]byte{keyID: key}}
+	default:
+		config.KeyBytes = key
+	}
+	return config, nil
+}
+
+// keyWrapper wraps data keys like secret.NewLocalKeyWrapper, with the random
+// bytes of the service it seals them with.
+type keyWrapper struct {
+	kek secret.SecretService
+}
+
+func (k *keyWrapper) WrapKey(dataKey *[secret.SecretKeyLength]byte) ([]byte, error) {
+	sealed, err := k.kek.Seal(dataKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return append(sealed.NonceBytes(), sealed.CiphertextBytes()...), nil
+}
+
+func (k *keyWrapper) UnwrapKey(wrappedKey []byte) (*[secret.SecretKeyLength]byte, error) {
+	nonceSize := secret.XChaCha20Poly1305.NonceSize()
+	if len(wrappedKey) < nonceSize {
+		return nil, fmt.Errorf("wrapped key too short: %v bytes", len(wrappedKey))
+	}
+	dataKey, err := k.kek.Open(&secret.SealedBytes{
+		Ciphertext: wrappedKey[nonceSize:],
+		Nonce:      wrappedKey[:nonceSize],
+		Algorithm:  secret.XChaCha20Poly1305,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return secret.KeySliceToArray(dataKey)
+}
+
+func newRequest(method string, uri string, headers map[string]string, body []byte) (*http.Request, error) {
+	r, err := http.NewRequest(method, "http://localhost"+uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		r.Body = nil
+	}
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+
+	return r, nil
+}
+
+func parseTimestamp(timestamp string) (time.Time, error) {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to parse timestamp %q: %v", timestamp, err)
+	}
+	return time.Unix(unix, 0), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/mailgun/lemma/httpsign"
+)
+
+func main() {
+	mode := flag.String("mode", "", "sign or verify")
+	listen := flag.String("listen", "", "address to listen on, for example :8080")
+	upstream := flag.String("upstream", "", "URL requests are forwarded to")
+	configPath := flag.String("config", "", "path to the httpsign configuration file, JSON or YAML")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 10*time.Second, "time allowed to read request headers")
+	readTimeout := flag.Duration("read-timeout", time.Minute, "time allowed to read a whole request")
+	writeTimeout := flag.Duration("write-timeout", time.Minute, "time allowed to write a response")
+	flag.Parse()
+	if *mode == "" || *listen == "" || *upstream == "" || *configPath == "" {
+		usage()
+		os.Exit(255)
+	}
+
+	config, err := httpsign.LoadConfigFile(*configPath)
+	if err != nil {
+		fmt.Printf("signproxy: %v\n", err)
+		os.Exit(255)
+	}
+
+	handler, err := newHandler(*mode, *upstream, config)
+	if err != nil {
+		fmt.Printf("signproxy: %v\n", err)
+		os.Exit(255)
+	}
+
+	log.Printf("signproxy: %v mode, listening on %v, forwarding to %v", *mode, *listen, *upstream)
+	server := newServer(*listen, handler, *readHeaderTimeout, *readTimeout, *writeTimeout)
+	log.Fatal(server.ListenAndServe())
+}
+
+func usage() {
+	fmt.Printf(`
+signproxy is a reverse proxy that signs requests on their way to a service, or
+authenticates requests on their way into a service.
+
+Usage:
+    signproxy -mode sign|verify -listen address -upstream url
+              -config path/to/httpsign.yaml [-read-header-timeout 10s]
+              [-read-timeout 1m] [-write-timeout 1m]
+
+The configuration file is an httpsign config, see httpsign.LoadConfigFile.
+
+`)
+}
+
+// newServer returns a server for handler that drops clients that are too
+// slow sending a request or reading the response, so they can't hold
+// connections open forever.
+func newServer(addr string, handler http.Handler, readHeaderTimeout time.Duration,
+	readTimeout time.Duration, writeTimeout time.Duration) *http.Server {
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+	}
+}
+
+// newHandler returns a reverse proxy to the upstream that signs or verifies
+// requests depending on the mode.
+func newHandler(mode string, upstreamURL string, config *httpsign.Config) (http.Handler, error) {
+	if mode != "sign" && mode != "verify" {
+		return nil, fmt.Errorf("mode must be sign or verify, not: %q", mode)
+	}
+	upstream, err := url.Parse(upstreamURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream: %v", err)
+	}
+
+	auths, err := httpsign.New(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// forward to the upstream with its Host, not the one the proxy was
+	// reached with, so virtual hosted and TLS upstreams route the request
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(upstream)
+			r.SetXForwarded()
+		},
+	}
+
+	// sign everything forwarded upstream
+	if mode == "sign" {
+		proxy.Transport = &httpsign.Transport{Service: auths}
+		return proxy, nil
+	}
+
+	// only forward requests that authenticate
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := auths.AuthenticateRequest(r)
+		if err == httpsign.ErrTooManyFailures {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			log.Printf("signproxy: rejected %v %v from %v: %v", r.Method, r.URL, r.RemoteAddr, err)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}), nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/lemma/httpsign"
+)
+
+var _ = fmt.Printf // for testing
+
+var testKey = []byte("042DAD12E0BE4625AC0B2C3F7172DBA8")
+
+// upstreamRequest is what the upstream saw of a request.
+type upstreamRequest struct {
+	host string
+	body string
+	err  error
+}
+
+// newUpstream starts an upstream that authenticates requests with auths, if
+// set, and records them.
+func newUpstream(t *testing.T, auths *httpsign.Service) (*httptest.Server, chan upstreamRequest) {
+	requests := make(chan upstreamRequest, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		if auths != nil {
+			err = auths.AuthenticateRequest(r)
+		}
+		body, _ := io.ReadAll(r.Body)
+		requests <- upstreamRequest{host: r.Host, body: string(body), err: err}
+		fmt.Fprint(w, "upstream")
+	}))
+	return upstream, requests
+}
+
+// newTestConfig writes a key and an httpsign config file that uses it, and
+// loads the config as main does.
+func newTestConfig(t *testing.T) *httpsign.Config {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "test.key")
+	if err := os.WriteFile(keyPath, testKey, 0600); err != nil {
+		t.Fatalf("Got unexpected error from WriteFile: %v", err)
+	}
+	configPath := filepath.Join(dir, "httpsign.yaml")
+	config := fmt.Sprintf("key_path: %v\nsign_verb_and_uri: true\n", keyPath)
+	if err := os.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatalf("Got unexpected error from WriteFile: %v", err)
+	}
+
+	c, err := httpsign.LoadConfigFile(configPath)
+	if err != nil {
+		t.Fatalf("Got unexpected error from LoadConfigFile: %v", err)
+	}
+	return c
+}
+
+func newTestService(t *testing.T) *httpsign.Service {
+	auths, err := httpsign.New(&httpsign.Config{KeyBytes: testKey, SignVerbAndURI: true})
+	if err != nil {
+		t.Fatalf("Got unexpected error from httpsign.New: %v", err)
+	}
+	return auths
+}
+
+func TestSignMode(t *testing.T) {
+	upstream, requests := newUpstream(t, newTestService(t))
+	defer upstream.Close()
+
+	handler, err := newHandler("sign", upstream.URL, newTestConfig(t))
+	if err != nil {
+		t.Fatalf("Got unexpected error from newHandler: %v", err)
+	}
+	proxy := httptest.NewServer(handler)
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/messages", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("Got unexpected error from Post: %v", err)
+	}
+	resp.Body.Close()
+
+	got := <-requests
+	if got.err != nil {
+		t.Errorf("Upstream should authenticate the forwarded request: %v", got.err)
+	}
+	if g, w := got.body, "hello"; g != w {
+		t.Errorf("Body: Got %v, Want %v", g, w)
+	}
+	upstreamURL, _ := url.Parse(upstream.URL)
+	if g, w := got.host, upstreamURL.Host; g != w {
+		t.Errorf("Host: Got %v, Want %v", g, w)
+	}
+	if g, w := resp.StatusCode, http.StatusOK; g != w {
+		t.Errorf("Status: Got %v, Want %v", g, w)
+	}
+}
+
+func TestVerifyMode(t *testing.T) {
+	upstream, requests := newUpstream(t, nil)
+	defer upstream.Close()
+
+	handler, err := newHandler("verify", upstream.URL, newTestConfig(t))
+	if err != nil {
+		t.Fatalf("Got unexpected error from newHandler: %v", err)
+	}
+	proxy := httptest.NewServer(handler)
+	defer proxy.Close()
+
+	auths := newTestService(t)
+	var tests = []struct {
+		inSign     bool
+		inTamper   bool
+		outStatus  int
+		outForward bool
+	}{
+		{true, false, http.StatusOK, true},
+		{false, false, http.StatusUnauthorized, false},
+		{true, true, http.StatusUnauthorized, false},
+	}
+
+	for i, tt := range tests {
+		request, _ := http.NewRequest("POST", proxy.URL+"/messages", strings.NewReader("hello"))
+		if tt.inSign {
+			if err := auths.SignRequest(request); err != nil {
+				t.Fatalf("[%v] Got unexpected error from SignRequest: %v", i, err)
+			}
+		}
+		if tt.inTamper {
+			request.Body = io.NopCloser(strings.NewReader("tampered"))
+			request.ContentLength = int64(len("tampered"))
+		}
+
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("[%v] Got unexpected error from Do: %v", i, err)
+		}
+		resp.Body.Close()
+		if g, w := resp.StatusCode, tt.outStatus; g != w {
+			t.Errorf("[%v] Status: Got %v, Want %v", i, g, w)
+		}
+
+		select {
+		case got := <-requests:
+			if !tt.outForward {
+				t.Errorf("[%v] Request should not be forwarded", i)
+			}
+			upstreamURL, _ := url.Parse(upstream.URL)
+			if g, w := got.host, upstreamURL.Host; g != w {
+				t.Errorf("[%v] Host: Got %v, Want %v", i, g, w)
+			}
+			if g, w := got.body, "hello"; g != w {
+				t.Errorf("[%v] Body: Got %v, Want %v", i, g, w)
+			}
+		default:
+			if tt.outForward {
+				t.Errorf("[%v] Request should be forwarded", i)
+			}
+		}
+	}
+}
+
+func TestInvalidMode(t *testing.T) {
+	if _, err := newHandler("forward", "http://127.0.0.1", newTestConfig(t)); err == nil {
+		t.Errorf("newHandler should fail with an invalid mode")
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	upstream, _ := newUpstream(t, nil)
+	defer upstream.Close()
+
+	handler, err := newHandler("verify", upstream.URL, newTestConfig(t))
+	if err != nil {
+		t.Fatalf("Got unexpected error from newHandler: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Got unexpected error from Listen: %v", err)
+	}
+	server := newServer(listener.Addr().String(), handler, 50*time.Millisecond, time.Minute, time.Minute)
+	go server.Serve(listener)
+	defer server.Close()
+
+	// a client that never finishes its headers is disconnected
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Got unexpected error from Dial: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "POST /messages HTTP/1.1\r\nHost: proxy\r\n")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("Connection should be closed by the server: %v", err)
+	}
+}